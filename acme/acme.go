@@ -0,0 +1,509 @@
+// Package acme obtains and renews certificates from an ACME CA such as
+// Let's Encrypt (RFC 8555), answering the http-01 or tls-alpn-01 challenges
+// itself. Certificates are obtained on the first handshake for a host, kept
+// in a cache directory across restarts and renewed in the background.
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/logging"
+)
+
+const (
+	LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	// ALPNProto is the protocol the CA negotiates to check a tls-alpn-01
+	// challenge. Listeners have to offer it.
+	ALPNProto = "acme-tls/1"
+
+	// HTTPChallengePath is where http-01 challenges are served.
+	HTTPChallengePath = "/.well-known/acme-challenge/"
+
+	accountKeyFile = "account.key"
+
+	obtainTimeout  = 5 * time.Minute
+	renewBefore    = 30 * 24 * time.Hour
+	renewInterval  = 12 * time.Hour
+	requestTimeout = 30 * time.Second
+)
+
+// pollInterval is how long to wait between checks of a pending order.
+var pollInterval = time.Second
+
+// idPeACMEIdentifier marks the certificate presented for a tls-alpn-01
+// challenge (RFC 8737).
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Config selects the CA and how it is talked to. AcceptTOS must be set to
+// agree to the CA's terms of service. DirectoryURL defaults to Let's
+// Encrypt and Challenge to tls-alpn-01, which is answered on the HTTPS
+// listeners themselves; http-01 needs a plain HTTP listener on port 80.
+type Config struct {
+	Email        string `json:"email,omitempty"`
+	CacheDir     string `json:"cache_dir"`
+	DirectoryURL string `json:"directory_url,omitempty"`
+	Challenge    string `json:"challenge,omitempty"`
+	AcceptTOS    bool   `json:"accept_tos"`
+}
+
+// Manager hands out certificates for a fixed set of hosts.
+type Manager struct {
+	email     string
+	cacheDir  string
+	challenge string
+	hosts     map[string]bool
+	client    *client
+
+	mutex          sync.Mutex
+	certificates   map[string]*tls.Certificate
+	pending        map[string]*pendingCertificate
+	tokens         map[string]string
+	challengeCerts map[string]*tls.Certificate
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type pendingCertificate struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// NewManager loads the account key and cached certificates from the cache
+// directory, creating it if needed, and starts renewing certificates.
+func NewManager(config Config, hosts []string) (*Manager, error) {
+	switch config.Challenge {
+	case "", ChallengeTLSALPN01, ChallengeHTTP01:
+	default:
+		return nil, fmt.Errorf("unknown challenge %q, expected %s or %s", config.Challenge, ChallengeTLSALPN01, ChallengeHTTP01)
+	}
+	if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadAccountKey(filepath.Join(config.CacheDir, accountKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		email:          config.Email,
+		cacheDir:       config.CacheDir,
+		challenge:      config.Challenge,
+		hosts:          make(map[string]bool),
+		client:         &client{directoryURL: config.DirectoryURL, http: &http.Client{Timeout: requestTimeout}, key: key},
+		certificates:   make(map[string]*tls.Certificate),
+		pending:        make(map[string]*pendingCertificate),
+		tokens:         make(map[string]string),
+		challengeCerts: make(map[string]*tls.Certificate),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if m.challenge == "" {
+		m.challenge = ChallengeTLSALPN01
+	}
+	if m.client.directoryURL == "" {
+		m.client.directoryURL = LetsEncryptURL
+	}
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		m.hosts[host] = true
+		if cert, err := m.loadCertificate(host); err == nil {
+			m.certificates[host] = cert
+		} else if !errors.Is(err, os.ErrNotExist) {
+			logging.Default().Warnf("Ignoring cached certificate for %s: %v", host, err)
+		}
+	}
+
+	go m.run()
+	return m, nil
+}
+
+// Close stops renewing certificates.
+func (m *Manager) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate. It answers
+// tls-alpn-01 challenges and otherwise returns the host's certificate,
+// obtaining it first if there is none yet.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := normalizeHost(hello.ServerName)
+	if host == "" {
+		return nil, errors.New("acme: client did not send a server name")
+	}
+
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ALPNProto {
+		m.mutex.Lock()
+		cert, ok := m.challengeCerts[host]
+		m.mutex.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("acme: no pending challenge for %s", host)
+		}
+		return cert, nil
+	}
+
+	if !m.hosts[host] {
+		return nil, fmt.Errorf("acme: %s is not a configured host", host)
+	}
+	m.mutex.Lock()
+	cert, ok := m.certificates[host]
+	m.mutex.Unlock()
+	if ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, obtainTimeout)
+	defer cancel()
+	return m.obtain(ctx, host)
+}
+
+// HTTPHandler answers http-01 challenges and passes every other request on
+// to next.
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, HTTPChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.mutex.Lock()
+		keyAuthorization, ok := m.tokens[strings.TrimPrefix(r.URL.Path, HTTPChallengePath)]
+		m.mutex.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuthorization))
+	})
+}
+
+// obtain orders a certificate for host. Concurrent calls for the same host
+// share one order.
+func (m *Manager) obtain(ctx context.Context, host string) (*tls.Certificate, error) {
+	m.mutex.Lock()
+	if p, ok := m.pending[host]; ok {
+		m.mutex.Unlock()
+		select {
+		case <-p.done:
+			return p.cert, p.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	p := &pendingCertificate{done: make(chan struct{})}
+	m.pending[host] = p
+	m.mutex.Unlock()
+
+	p.cert, p.err = m.order(ctx, host)
+
+	m.mutex.Lock()
+	delete(m.pending, host)
+	if p.err == nil {
+		m.certificates[host] = p.cert
+	}
+	m.mutex.Unlock()
+	close(p.done)
+
+	if p.err != nil {
+		logging.Default().Errorf("Error obtaining certificate for %s: %v", host, p.err)
+		return nil, p.err
+	}
+	logging.Default().Infof("Obtained certificate for %s, valid until %s", host, p.cert.Leaf.NotAfter.Format(time.RFC3339))
+	return p.cert, nil
+}
+
+func (m *Manager) order(ctx context.Context, host string) (*tls.Certificate, error) {
+	if err := m.client.register(ctx, m.email); err != nil {
+		return nil, err
+	}
+	dir, err := m.client.getDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var o order
+	header, err := m.client.post(ctx, dir.NewOrder, map[string]interface{}{
+		"identifiers": []identifier{{Type: "dns", Value: host}},
+	}, &o)
+	if err != nil {
+		return nil, fmt.Errorf("creating order: %w", err)
+	}
+	orderURL := header.Get("Location")
+	for _, authorizationURL := range o.Authorizations {
+		if err := m.authorize(ctx, host, authorizationURL); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.client.post(ctx, o.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &o); err != nil {
+		return nil, fmt.Errorf("finalizing order: %w", err)
+	}
+	for o.Status != "valid" {
+		if o.Status == "invalid" {
+			return nil, fmt.Errorf("order for %s is invalid: %v", host, o.Error)
+		}
+		if err := wait(ctx); err != nil {
+			return nil, err
+		}
+		if _, err := m.client.post(ctx, orderURL, nil, &o); err != nil {
+			return nil, fmt.Errorf("polling order: %w", err)
+		}
+	}
+
+	var chain []byte
+	if _, err := m.client.post(ctx, o.Certificate, nil, &chain); err != nil {
+		return nil, fmt.Errorf("downloading certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cached := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), chain...)
+	cert, err := parseCertificate(cached)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(m.certificatePath(host), cached, 0600); err != nil {
+		logging.Default().Warnf("Error caching certificate for %s: %v", host, err)
+	}
+	return cert, nil
+}
+
+// authorize proves control of host for one authorization of an order.
+func (m *Manager) authorize(ctx context.Context, host, authorizationURL string) error {
+	var authz authorization
+	if _, err := m.client.post(ctx, authorizationURL, nil, &authz); err != nil {
+		return fmt.Errorf("fetching authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chosen *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == m.challenge {
+			chosen = &authz.Challenges[i]
+		}
+	}
+	if chosen == nil {
+		return fmt.Errorf("the CA does not offer the %s challenge for %s", m.challenge, host)
+	}
+
+	keyAuthorization := m.client.keyAuthorization(chosen.Token)
+	if m.challenge == ChallengeHTTP01 {
+		m.mutex.Lock()
+		m.tokens[chosen.Token] = keyAuthorization
+		m.mutex.Unlock()
+		defer func() {
+			m.mutex.Lock()
+			delete(m.tokens, chosen.Token)
+			m.mutex.Unlock()
+		}()
+	} else {
+		cert, err := challengeCertificate(host, keyAuthorization)
+		if err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		m.challengeCerts[host] = cert
+		m.mutex.Unlock()
+		defer func() {
+			m.mutex.Lock()
+			delete(m.challengeCerts, host)
+			m.mutex.Unlock()
+		}()
+	}
+
+	if _, err := m.client.post(ctx, chosen.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("accepting %s challenge: %w", m.challenge, err)
+	}
+	for {
+		if _, err := m.client.post(ctx, authorizationURL, nil, &authz); err != nil {
+			return fmt.Errorf("polling authorization: %w", err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, c := range authz.Challenges {
+				if c.Type == m.challenge && c.Error != nil {
+					return fmt.Errorf("%s challenge for %s failed: %v", m.challenge, host, c.Error)
+				}
+			}
+			return fmt.Errorf("authorization for %s is %s", host, authz.Status)
+		}
+		if err := wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Manager) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		m.renew()
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// renew replaces the certificates that expire within renewBefore. Hosts
+// without a certificate yet are left to the first handshake.
+func (m *Manager) renew() {
+	m.mutex.Lock()
+	var expiring []string
+	for host, cert := range m.certificates {
+		if time.Until(cert.Leaf.NotAfter) < renewBefore {
+			expiring = append(expiring, host)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, host := range expiring {
+		ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+		m.obtain(ctx, host)
+		cancel()
+	}
+}
+
+func (m *Manager) certificatePath(host string) string {
+	return filepath.Join(m.cacheDir, host+".pem")
+}
+
+func (m *Manager) loadCertificate(host string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(m.certificatePath(host))
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificate(data)
+}
+
+// parseCertificate reads a private key followed by a certificate chain.
+func parseCertificate(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func loadAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key found in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// challengeCertificate builds the self-signed certificate presented to the
+// CA for a tls-alpn-01 challenge (RFC 8737).
+func challengeCertificate(host, keyAuthorization string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: host},
+		DNSNames:        []string{host},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func wait(ctx context.Context) error {
+	select {
+	case <-time.After(pollInterval):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,296 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is a minimal ACME server. It checks every request's signature,
+// validates challenges by asking the manager directly and signs whatever
+// CSR it is given.
+type fakeCA struct {
+	t       *testing.T
+	server  *httptest.Server
+	manager *Manager
+	caKey   *ecdsa.PrivateKey
+	caCert  *x509.Certificate
+
+	mutex      sync.Mutex
+	accountKey *ecdsa.PublicKey
+	orders     int
+	challenged bool
+	validated  bool
+	issued     []byte
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{t: t}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caKey = key
+	ca.caCert, _ = x509.ParseCertificate(der)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(directory{
+			NewNonce:   ca.server.URL + "/nonce",
+			NewAccount: ca.server.URL + "/account",
+			NewOrder:   ca.server.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		ca.verify(r, true)
+		w.Header().Set("Location", ca.server.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		ca.verify(r, false)
+		ca.mutex.Lock()
+		ca.orders++
+		ca.mutex.Unlock()
+		w.Header().Set("Location", ca.server.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order{Status: "pending", Authorizations: []string{ca.server.URL + "/authz/1"}, Finalize: ca.server.URL + "/finalize/1"})
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		ca.verify(r, false)
+		authz := authorization{
+			Status:     "pending",
+			Identifier: identifier{Type: "dns", Value: "example.com"},
+			Challenges: []challenge{
+				{Type: ChallengeHTTP01, URL: ca.server.URL + "/challenge/http", Token: "http-token"},
+				{Type: ChallengeTLSALPN01, URL: ca.server.URL + "/challenge/alpn", Token: "alpn-token"},
+			},
+		}
+		ca.mutex.Lock()
+		switch {
+		case ca.validated:
+			authz.Status = "valid"
+		case ca.challenged:
+			authz.Status = "invalid"
+			for i := range authz.Challenges {
+				authz.Challenges[i].Error = &problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "key authorization mismatch"}
+			}
+		}
+		ca.mutex.Unlock()
+		json.NewEncoder(w).Encode(authz)
+	})
+	mux.HandleFunc("/challenge/", func(w http.ResponseWriter, r *http.Request) {
+		ca.verify(r, false)
+		ca.mutex.Lock()
+		thumb := thumbprint(ca.accountKey)
+		ca.mutex.Unlock()
+
+		var valid bool
+		if strings.HasSuffix(r.URL.Path, "/http") {
+			recorder := httptest.NewRecorder()
+			ca.manager.HTTPHandler(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest("GET", HTTPChallengePath+"http-token", nil))
+			valid = recorder.Body.String() == "http-token."+thumb
+		} else {
+			cert, err := ca.manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com", SupportedProtos: []string{ALPNProto}})
+			if err == nil {
+				valid = hasKeyAuthorization(cert, "alpn-token."+thumb)
+			}
+		}
+		ca.mutex.Lock()
+		ca.challenged = true
+		ca.validated = valid
+		ca.mutex.Unlock()
+		json.NewEncoder(w).Encode(challenge{Status: "processing"})
+	})
+	mux.HandleFunc("/finalize/1", func(w http.ResponseWriter, r *http.Request) {
+		payload := ca.verify(r, false)
+		var request struct{ CSR string }
+		json.Unmarshal(payload, &request)
+		der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Errorf("Invalid CSR: %v", err)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		issued, _ := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+		ca.mutex.Lock()
+		ca.issued = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+		ca.mutex.Unlock()
+		json.NewEncoder(w).Encode(order{Status: "processing"})
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		ca.verify(r, false)
+		json.NewEncoder(w).Encode(order{Status: "valid", Certificate: ca.server.URL + "/certificate/1"})
+	})
+	mux.HandleFunc("/certificate/1", func(w http.ResponseWriter, r *http.Request) {
+		ca.verify(r, false)
+		ca.mutex.Lock()
+		defer ca.mutex.Unlock()
+		w.Write(ca.issued)
+	})
+
+	ca.server = httptest.NewServer(mux)
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+// verify checks the JWS signature of r and returns its payload. The
+// account key comes with the registration and is used from then on.
+func (ca *fakeCA) verify(r *http.Request, register bool) []byte {
+	var jws struct{ Protected, Payload, Signature string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	json.Unmarshal(protectedJSON, &protected)
+	if protected.URL != ca.server.URL+r.URL.Path {
+		ca.t.Errorf("Expected the signed url to be %s, got %s", ca.server.URL+r.URL.Path, protected.URL)
+	}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if register {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		ca.accountKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if protected.Kid != ca.server.URL+"/account/1" {
+		ca.t.Errorf("Expected requests to be signed with the account URL, got %q", protected.Kid)
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(ca.accountKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		ca.t.Errorf("Invalid signature on request to %s", r.URL.Path)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload
+}
+
+func hasKeyAuthorization(cert *tls.Certificate, keyAuthorization string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	for _, extension := range leaf.Extensions {
+		var value []byte
+		if extension.Id.Equal(idPeACMEIdentifier) && extension.Critical {
+			if _, err := asn1.Unmarshal(extension.Value, &value); err == nil && bytes.Equal(value, digest[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestManagerObtainsAndCachesCertificates(t *testing.T) {
+	previous := pollInterval
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = previous }()
+
+	for _, challengeType := range []string{ChallengeTLSALPN01, ChallengeHTTP01} {
+		t.Run(challengeType, func(t *testing.T) {
+			ca := newFakeCA(t)
+			config := Config{CacheDir: t.TempDir(), DirectoryURL: ca.server.URL + "/directory", Challenge: challengeType, AcceptTOS: true}
+			manager, err := NewManager(config, []string{"example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer manager.Close()
+			ca.manager = manager
+
+			cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "Example.com."})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cert.Certificate) != 2 || cert.Leaf.DNSNames[0] != "example.com" {
+				t.Errorf("Expected a certificate chain for example.com, got %d certificates for %v", len(cert.Certificate), cert.Leaf.DNSNames)
+			}
+			if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+				t.Error("Expected no certificate for a host that is not configured")
+			}
+
+			// A second manager finds the certificate in the cache.
+			cached, err := NewManager(config, []string{"example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cached.Close()
+			if _, err := cached.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			if ca.orders != 1 {
+				t.Errorf("Expected a single order, got %d", ca.orders)
+			}
+			info, err := os.Stat(filepath.Join(config.CacheDir, "example.com.pem"))
+			if err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("Expected the certificate to be cached readable by its owner only, got %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestManagerReportsFailedChallenges(t *testing.T) {
+	ca := newFakeCA(t)
+	manager, err := NewManager(Config{CacheDir: t.TempDir(), DirectoryURL: ca.server.URL + "/directory", AcceptTOS: true}, []string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	// The fake CA checks the challenge against a manager that knows nothing
+	// about it.
+	ca.manager, err = NewManager(Config{CacheDir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.manager.Close()
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err == nil || !strings.Contains(err.Error(), "key authorization mismatch") {
+		t.Errorf("Expected the CA's reason in the error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(manager.cacheDir, "example.com.pem")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be cached, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+)
+
+const (
+	problemBadNonce = "urn:ietf:params:acme:error:badNonce"
+
+	maxResponseSize = 1 << 20
+)
+
+// client speaks the subset of RFC 8555 needed to order certificates. Every
+// request is a JWS signed with the account key; the account is registered
+// on first use.
+type client struct {
+	directoryURL string
+	http         *http.Client
+	key          *ecdsa.PrivateKey
+
+	mutex     sync.Mutex
+	directory *directory
+	kid       string
+	nonces    []string
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// problem is an error document (RFC 7807) returned by the CA.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+func (c *client) getDirectory(ctx context.Context) (*directory, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.directory != nil {
+		return c.directory, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching directory %s: status %d", c.directoryURL, resp.StatusCode)
+	}
+	var dir directory
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("decoding directory %s: %w", c.directoryURL, err)
+	}
+	c.directory = &dir
+	return c.directory, nil
+}
+
+// register creates the account, or finds the existing one for the key.
+func (c *client) register(ctx context.Context, email string) error {
+	c.mutex.Lock()
+	registered := c.kid != ""
+	c.mutex.Unlock()
+	if registered {
+		return nil
+	}
+
+	dir, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	header, err := c.post(ctx, dir.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("registering account: %w", err)
+	}
+	kid := header.Get("Location")
+	if kid == "" {
+		return errors.New("registering account: no account URL in response")
+	}
+	c.mutex.Lock()
+	c.kid = kid
+	c.mutex.Unlock()
+	return nil
+}
+
+// post sends payload to url and decodes the response into out, which may
+// be a *[]byte for the raw body. A nil payload makes a POST-as-GET. A
+// rejected nonce is retried once with a fresh one, as RFC 8555 asks.
+func (c *client) post(ctx context.Context, url string, payload, out interface{}) (http.Header, error) {
+	header, err := c.postOnce(ctx, url, payload, out)
+	var p *problem
+	if errors.As(err, &p) && p.Type == problemBadNonce {
+		header, err = c.postOnce(ctx, url, payload, out)
+	}
+	return header, err
+}
+
+func (c *client) postOnce(ctx context.Context, url string, payload, out interface{}) (http.Header, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.saveNonce(resp.Header)
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		p := &problem{Status: resp.StatusCode}
+		if json.Unmarshal(data, p) != nil || p.Type == "" {
+			return nil, fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+		}
+		return nil, p
+	}
+	switch out := out.(type) {
+	case nil:
+	case *[]byte:
+		*out = data
+	default:
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("decoding response from %s: %w", url, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *client) nonce(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mutex.Unlock()
+		return nonce, nil
+	}
+	c.mutex.Unlock()
+
+	dir, err := c.getDirectory(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("%s returned no nonce", dir.NewNonce)
+	}
+	return nonce, nil
+}
+
+func (c *client) saveNonce(header http.Header) {
+	if nonce := header.Get("Replay-Nonce"); nonce != "" {
+		c.mutex.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mutex.Unlock()
+	}
+}
+
+// sign wraps payload in a flattened JWS signed with ES256. Until the
+// account is registered the public key itself identifies the signer.
+func (c *client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	c.mutex.Lock()
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = jwk(&c.key.PublicKey)
+	}
+	c.mutex.Unlock()
+
+	encodedProtected, err := encodeJSON(protected)
+	if err != nil {
+		return nil, err
+	}
+	encodedPayload := ""
+	if payload != nil {
+		if encodedPayload, err = encodeJSON(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	digest := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(padded(r, 32), padded(s, 32)...)
+
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// keyAuthorization is what a challenge has to present for token.
+func (c *client) keyAuthorization(token string) string {
+	return token + "." + thumbprint(&c.key.PublicKey)
+}
+
+func jwk(key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(padded(key.X, 32)),
+		"y":   base64.RawURLEncoding.EncodeToString(padded(key.Y, 32)),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of key. json.Marshal sorts the map
+// keys, which gives the required member order.
+func thumbprint(key *ecdsa.PublicKey) string {
+	data, _ := json.Marshal(jwk(key))
+	digest := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func encodeJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func padded(n *big.Int, size int) []byte {
+	data := n.Bytes()
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
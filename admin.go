@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"loadbalancer/loadbalancer"
+	"loadbalancer/logging"
+	"loadbalancer/metrics"
+)
+
+// newAdminHandler serves the endpoints that must never be reachable through
+// the public listeners. config is the config the process was started with;
+// per-listener settings are read from the running load balancers so that
+// reloads are reflected.
+func newAdminHandler(config loadbalancer.Config, listeners []*listener, registry *metrics.Registry) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", registry)
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		for _, l := range listeners {
+			if l.stopping.Load() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			if l.lb.AvailableBackends() == 0 {
+				http.Error(w, "no healthy backends", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, effectiveConfig(config, listeners).Redacted())
+	})
+
+	if config.DebugEndpoints {
+		registerDebugHandlers(mux)
+	}
+
+	if config.StatusPage != nil {
+		mux.Handle("/admin/status", basicAuth(*config.StatusPage, statusPage(listeners)))
+	}
+
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		window := defaultStatsWindow
+		if value := r.URL.Query().Get("window"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 || parsed > loadbalancer.MaxStatsWindow {
+				http.Error(w, fmt.Sprintf("window must be a duration up to %s", loadbalancer.MaxStatsWindow), http.StatusBadRequest)
+				return
+			}
+			window = parsed
+		}
+		writeJSON(w, stats(listeners, window))
+	})
+
+	// POST drains a backend, DELETE puts it back into rotation.
+	mux.HandleFunc("/admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		backend := r.URL.Query().Get("backend")
+		if backend == "" {
+			http.Error(w, "backend must be set", http.StatusBadRequest)
+			return
+		}
+		found := false
+		for _, l := range listeners {
+			if l.lb.SetDraining(backend, r.Method == http.MethodPost, "admin api") {
+				found = true
+			}
+		}
+		if !found {
+			http.Error(w, "no such backend", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// POST turns the configured fault injection on, DELETE turns it off.
+	mux.HandleFunc("/admin/faults", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, l := range listeners {
+			l.lb.SetFaultsEnabled(r.Method == http.MethodPost, "admin api")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// POST puts every listener, or the one on the given port or only one
+	// of its routes, in maintenance; DELETE takes it out again.
+	mux.HandleFunc("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		port, route := r.URL.Query().Get("listener"), r.URL.Query().Get("route")
+		if route != "" && port == "" {
+			http.Error(w, "route needs listener", http.StatusBadRequest)
+			return
+		}
+		found := false
+		for _, l := range listeners {
+			if port != "" && l.port != port {
+				continue
+			}
+			if l.lb.SetMaintenance(r.Method == http.MethodPost, route, "admin api") {
+				found = true
+			}
+		}
+		if !found {
+			http.Error(w, "no such listener or route", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// POST gives all requests of a listener, or of one of its routes, to
+	// one pool of its split.
+	mux.HandleFunc("/admin/switch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		port, route, pool := query.Get("listener"), query.Get("route"), query.Get("pool")
+		if port == "" || pool == "" {
+			http.Error(w, "listener and pool must be set", http.StatusBadRequest)
+			return
+		}
+		for _, l := range listeners {
+			if l.port != port {
+				continue
+			}
+			if err := l.lb.SwitchPool(route, pool, "admin api"); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "no such listener", http.StatusNotFound)
+	})
+
+	if config.AdminOIDC != nil {
+		return adminLogin(*config.AdminOIDC, mux)
+	}
+	return mux
+}
+
+// adminLogin sends everything but the probes and metrics through an OIDC
+// login, so orchestrators and scrapers keep working without a session.
+func adminLogin(config loadbalancer.OIDCConfig, mux http.Handler) http.Handler {
+	var protected http.Handler
+	if authenticator, err := config.NewAuthenticator(); err != nil {
+		logging.Default().Errorf("Error configuring admin OIDC, rejecting admin requests: %v", err)
+		protected = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	} else {
+		protected = authenticator.Handler(mux)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			mux.ServeHTTP(w, r)
+		default:
+			protected.ServeHTTP(w, r)
+		}
+	})
+}
+
+const defaultStatsWindow = 5 * time.Minute
+
+type statsResponse struct {
+	Window    loadbalancer.Duration `json:"window"`
+	Listeners []listenerStats       `json:"listeners"`
+}
+
+type listenerStats struct {
+	Port     string                      `json:"port"`
+	Backends []loadbalancer.BackendStats `json:"backends"`
+}
+
+func stats(listeners []*listener, window time.Duration) statsResponse {
+	response := statsResponse{Window: loadbalancer.Duration(window)}
+	for _, l := range listeners {
+		response.Listeners = append(response.Listeners, listenerStats{
+			Port:     l.port,
+			Backends: l.lb.Stats(window),
+		})
+	}
+	return response
+}
+
+// effectiveConfig describes what the process is running right now: the
+// process-wide settings plus every listener with defaults, environment
+// expansion and reloads applied.
+func effectiveConfig(config loadbalancer.Config, listeners []*listener) loadbalancer.Config {
+	effective := loadbalancer.Config{
+		AdminPort:       config.AdminPort,
+		FailFastOnStart: config.FailFastOnStart,
+		AccessLog:       config.AccessLog,
+		AuditLog:        config.AuditLog,
+		LogLevel:        config.LogLevel,
+		LogOutput:       config.LogOutput,
+		Tracing:         config.Tracing,
+		StatusPage:      config.StatusPage,
+		DebugEndpoints:  config.DebugEndpoints,
+		StatsD:          config.StatsD,
+		ACME:            config.ACME,
+		AdminOIDC:       config.AdminOIDC,
+		Shutdown:        config.Shutdown,
+	}
+	for _, l := range listeners {
+		effective.Listeners = append(effective.Listeners, l.lb.Config())
+	}
+	return effective
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		logging.Default().Errorf("Error writing admin response: %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"loadbalancer/loadbalancer"
+	"loadbalancer/metrics"
+)
+
+func TestAdminProbes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:     "8080",
+		Backends: []loadbalancer.BackendConfig{{URL: backend.URL}},
+	}
+	registry := metrics.NewRegistry()
+	listeners := newListeners(config, loadbalancer.WithMetrics(loadbalancer.NewMetrics(registry)))
+	defer listeners[0].lb.Close()
+	admin := newAdminHandler(config, listeners, registry)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected /healthz to return 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to return 503 without healthy backends, got %d", w.Code)
+	}
+}
+
+func TestAdminConfigIsResolvedAndRedacted(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:           "8080",
+		AdminPort:      "9090",
+		Backends:       []loadbalancer.BackendConfig{{URL: strings.Replace(backend.URL, "http://", "http://user:hunter2@", 1)}},
+		HealthWebhooks: []string{"https://hooks.slack.com/services/T000/B000/XXXX"},
+		JWT:            &loadbalancer.JWTConfig{Secret: "jwt-signing-secret"},
+		Auth:           &loadbalancer.AuthConfig{Users: map[string]string{"alice": "basic-password"}, APIKeys: []string{"api-key-1"}},
+		RateLimit:      &loadbalancer.RateLimitConfig{RateLimit: loadbalancer.RateLimit{Capacity: 10, Rate: 1}, Redis: &loadbalancer.RedisConfig{Address: "redis:6379", Password: "redis-password"}},
+		OIDC:           &loadbalancer.OIDCConfig{Issuer: "https://issuer", ClientID: "lb", ClientSecret: "oidc-client-secret", RedirectURL: "https://lb/callback", CookieSecret: "oidc-cookie-secret"},
+		Defaults: &loadbalancer.DefaultsConfig{
+			HealthCheck: loadbalancer.HealthCheckConfig{Headers: map[string]string{"Authorization": "Bearer secret"}},
+		},
+	}
+	registry := metrics.NewRegistry()
+	listeners := newListeners(config, loadbalancer.WithMetrics(loadbalancer.NewMetrics(registry)))
+	defer listeners[0].lb.Close()
+
+	w := httptest.NewRecorder()
+	newAdminHandler(config, listeners, registry).ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, secret := range []string{"hunter2", "Bearer secret", "XXXX", "jwt-signing-secret", "basic-password", "api-key-1", "oidc-client-secret", "oidc-cookie-secret", "redis-password"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Expected %q to be redacted from:\n%s", secret, body)
+		}
+	}
+
+	var effective loadbalancer.Config
+	if err := json.Unmarshal(w.Body.Bytes(), &effective); err != nil {
+		t.Fatal(err)
+	}
+	if len(effective.Listeners) != 1 || effective.Listeners[0].HealthCheck.Headers["Authorization"] != "REDACTED" {
+		t.Errorf("Expected defaults to be resolved into the listener, got %+v", effective.Listeners)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:     "8080",
+		Backends: []loadbalancer.BackendConfig{{URL: backend.URL}},
+	}
+	registry := metrics.NewRegistry()
+	listeners := newListeners(config, loadbalancer.WithMetrics(loadbalancer.NewMetrics(registry)))
+	defer listeners[0].lb.Close()
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		listeners[0].lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	newAdminHandler(config, listeners, registry).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, expected := range []string{
+		`httpbalance_requests_total{listener="8080",code="2xx"} 2`,
+		`httpbalance_backend_requests_total{listener="8080",backend="` + backend.URL + `",code="4xx"} 1`,
+		`httpbalance_request_duration_seconds_count{listener="8080",backend="` + backend.URL + `"} 3`,
+		`httpbalance_in_flight_requests{listener="8080"} 0`,
+		`httpbalance_backend_up{listener="8080",backend="` + backend.URL + `"} 1`,
+		`httpbalance_health_checks_total{listener="8080",backend="` + backend.URL + `",result="success"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:     "8080",
+		Backends: []loadbalancer.BackendConfig{{URL: backend.URL}},
+	}
+	listeners := newListeners(config)
+	defer listeners[0].lb.Close()
+	listeners[0].lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	admin := newAdminHandler(config, listeners, metrics.NewRegistry())
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/stats?window=1m", nil))
+	var stats statsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Expected JSON, got %q: %v", w.Body.String(), err)
+	}
+	if len(stats.Listeners) != 1 || stats.Listeners[0].Port != "8080" || len(stats.Listeners[0].Backends) != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if backendStats := stats.Listeners[0].Backends[0]; backendStats.Requests != 1 || backendStats.State != loadbalancer.BackendUp {
+		t.Errorf("Expected one request to a healthy backend, got %+v", backendStats)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/stats?window=1h", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a window beyond the kept history to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAdminStatusPage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:       "8080",
+		AdminPort:  "9090",
+		Backends:   []loadbalancer.BackendConfig{{URL: backend.URL}},
+		StatusPage: &loadbalancer.StatusPageConfig{Username: "ops", Password: "hunter2"},
+	}
+	listeners := newListeners(config)
+	defer listeners[0].lb.Close()
+	listeners[0].lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/broken", nil))
+	admin := newAdminHandler(config, listeners, metrics.NewRegistry())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/status", nil)
+	r.SetBasicAuth("ops", "wrong")
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a basic auth challenge, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.SetBasicAuth("ops", "hunter2")
+	admin.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, backend.URL) || !strings.Contains(body, "backend answered 502 Bad Gateway") {
+		t.Errorf("Expected the page to list the backend and its recent error, got %d:\n%s", w.Code, body)
+	}
+}
+
+func TestAdminDebugEndpoints(t *testing.T) {
+	config := loadbalancer.Config{Port: "8080", AdminPort: "9090"}
+	listeners := newListeners(config)
+	defer listeners[0].lb.Close()
+
+	w := httptest.NewRecorder()
+	newAdminHandler(config, listeners, metrics.NewRegistry()).ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected pprof to be off by default, got %d", w.Code)
+	}
+
+	config.DebugEndpoints = true
+	admin := newAdminHandler(config, listeners, metrics.NewRegistry())
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=2", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("Expected a goroutine dump, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/debug/runtime", nil))
+	var stats runtimeStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Goroutines == 0 {
+		t.Errorf("Expected runtime stats, got %q", w.Body.String())
+	}
+}
+
+func TestAdminOIDC(t *testing.T) {
+	var issuer string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/authorize",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+
+	config := loadbalancer.Config{
+		Port:      "8080",
+		AdminPort: "9090",
+		AdminOIDC: &loadbalancer.OIDCConfig{
+			Issuer:       issuer,
+			ClientID:     "admin",
+			RedirectURL:  "https://admin.example.com/oauth2/callback",
+			CookieSecret: "0123456789abcdef",
+		},
+	}
+	listeners := newListeners(config)
+	defer listeners[0].lb.Close()
+	admin := newAdminHandler(config, listeners, metrics.NewRegistry())
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.HasPrefix(location, issuer+"/authorize?") {
+		t.Errorf("Expected a redirect to the provider, got %d to %q", w.Code, location)
+	}
+
+	for _, path := range []string{"/healthz", "/metrics"} {
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %s to stay open, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:     "8080",
+		Backends: []loadbalancer.BackendConfig{{URL: backend.URL}},
+	}
+	registry := metrics.NewRegistry()
+	listeners := newListeners(config, loadbalancer.WithMetrics(loadbalancer.NewMetrics(registry)))
+	defer listeners[0].lb.Close()
+	admin := newAdminHandler(config, listeners, registry)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/admin/drain?backend=http://unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown backend, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/admin/drain?backend="+backend.URL, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", w.Code)
+	}
+	if state := listeners[0].lb.Stats(time.Minute)[0].State; state != loadbalancer.BackendDraining {
+		t.Errorf("Expected the backend to be draining, got %s", state)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/drain?backend="+backend.URL, nil))
+	if state := listeners[0].lb.Stats(time.Minute)[0].State; w.Code != http.StatusNoContent || state == loadbalancer.BackendDraining {
+		t.Errorf("Expected the backend to be back in rotation, got %d and %s", w.Code, state)
+	}
+}
+
+func TestReadinessFailsWhileStopping(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := loadbalancer.Config{
+		Port:     "8080",
+		Backends: []loadbalancer.BackendConfig{{URL: backend.URL}},
+	}
+	registry := metrics.NewRegistry()
+	listeners := newListeners(config)
+	defer listeners[0].lb.Close()
+	admin := newAdminHandler(config, listeners, registry)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected /readyz to return 200, got %d", w.Code)
+	}
+
+	listeners[0].stopping.Store(true)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to return 503 while shutting down, got %d", w.Code)
+	}
+}
+
+func TestAdminSwitch(t *testing.T) {
+	blue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "blue") }))
+	defer blue.Close()
+	green := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "green") }))
+	defer green.Close()
+
+	config := loadbalancer.Config{
+		Port: "8080",
+		Routes: []loadbalancer.RouteConfig{{
+			Name:       "app",
+			PathPrefix: "/",
+			Split: &loadbalancer.SplitConfig{Active: "blue", Pools: []loadbalancer.SplitPool{
+				{Name: "blue", Backends: []loadbalancer.BackendConfig{{URL: blue.URL}}},
+				{Name: "green", Backends: []loadbalancer.BackendConfig{{URL: green.URL}}},
+			}},
+		}},
+	}
+	registry := metrics.NewRegistry()
+	listeners := newListeners(config)
+	defer listeners[0].lb.Close()
+	admin := newAdminHandler(config, listeners, registry)
+	serves := func() string {
+		w := httptest.NewRecorder()
+		listeners[0].lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+
+	if pool := serves(); pool != "blue" {
+		t.Fatalf("Expected the active pool to serve, got %q", pool)
+	}
+	for _, target := range []string{"/admin/switch?listener=8080&route=app&pool=purple", "/admin/switch?listener=8080&route=web&pool=green", "/admin/switch?listener=9090&route=app&pool=green"} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", target, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", target, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/admin/switch?listener=8080&route=app&pool=green", nil))
+	if w.Code != http.StatusNoContent || serves() != "green" {
+		t.Fatalf("Expected the switch to green to take effect, got %d", w.Code)
+	}
+	listeners[0].lb.Reload(config)
+	if pool := serves(); pool != "green" {
+		t.Errorf("Expected the switch to outlast a reload, got %q", pool)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"loadbalancer/loadbalancer"
+)
+
+// configFormat picks the config format from the -config-format flag, falling
+// back to the file (or KV key) extension and finally to JSON.
+func configFormat(path, format string) (string, error) {
+	if format == "" {
+		if parsed, err := url.Parse(path); err == nil && parsed.Scheme != "" {
+			path = parsed.Path
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			format = "yaml"
+		default:
+			format = "json"
+		}
+	}
+	switch format {
+	case "json", "yaml":
+		return format, nil
+	case "yml":
+		return "yaml", nil
+	default:
+		return "", fmt.Errorf("unknown config format %q", format)
+	}
+}
+
+func loadConfig(path, format string) (loadbalancer.Config, error) {
+	var config loadbalancer.Config
+
+	format, err := configFormat(path, format)
+	if err != nil {
+		return config, err
+	}
+
+	var data []byte
+	if source := newRemoteSource(path); source != nil {
+		data, _, err = source.fetch(context.Background(), 0)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return config, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var document interface{}
+	if format == "yaml" {
+		err = yaml.Unmarshal(data, &document)
+	} else {
+		err = json.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return config, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	root, ok := expandEnv(document).(map[string]interface{})
+	if !ok {
+		if document != nil {
+			return config, fmt.Errorf("parsing config file: top level must be an object")
+		}
+		root = map[string]interface{}{}
+	}
+	applyEnvOverrides(root)
+
+	// YAML and JSON documents are both re-encoded as JSON so they go
+	// through exactly the same decoding (durations, backend shorthands).
+	data, err = json.Marshal(root)
+	if err != nil {
+		return config, fmt.Errorf("parsing config file: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("parsing config file: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return config, nil
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references in every string value of document
+// with the value of the environment variable.
+func expandEnv(document interface{}) interface{} {
+	switch value := document.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			return os.Getenv(envReference.FindStringSubmatch(reference)[1])
+		})
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = expandEnv(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = expandEnv(item)
+		}
+	}
+	return document
+}
+
+const envOverridePrefix = "HTTPBALANCE_"
+
+// applyEnvOverrides lets HTTPBALANCE_PORT, HTTPBALANCE_ADMIN_PORT and
+// HTTPBALANCE_BACKENDS (comma separated) replace the top-level fields of
+// the config file.
+func applyEnvOverrides(root map[string]interface{}) {
+	for _, key := range []string{"port", "admin_port"} {
+		if value, ok := os.LookupEnv(envOverridePrefix + strings.ToUpper(key)); ok {
+			root[key] = value
+		}
+	}
+
+	if value, ok := os.LookupEnv(envOverridePrefix + "BACKENDS"); ok {
+		var backends []interface{}
+		for _, backend := range strings.Split(value, ",") {
+			if backend = strings.TrimSpace(backend); backend != "" {
+				backends = append(backends, backend)
+			}
+		}
+		root["backends"] = backends
+	}
+}
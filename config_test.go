@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadYAMLConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `
+# comments are allowed in YAML configs
+port: "8080"
+health_check: &checks
+  type: http
+  timeout: 3s
+backends:
+  - http://backend1:80
+  - url: http://backend2:80
+    health_check: *checks
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	if config.Port != "8080" || len(config.Backends) != 2 {
+		t.Fatalf("Unexpected config: %+v", config)
+	}
+	if config.Backends[1].HealthCheck == nil || time.Duration(config.Backends[1].HealthCheck.Timeout) != 3*time.Second {
+		t.Errorf("Expected the anchored health check on the second backend, got %+v", config.Backends[1].HealthCheck)
+	}
+}
+
+func TestConfigFormatDetection(t *testing.T) {
+	cases := map[[2]string]string{
+		{"config.json", ""}:     "json",
+		{"config.yml", ""}:      "yaml",
+		{"config.conf", "yaml"}: "yaml",
+	}
+	for input, expected := range cases {
+		format, err := configFormat(input[0], input[1])
+		if err != nil || format != expected {
+			t.Errorf("configFormat(%q, %q) = %q, %v; expected %q", input[0], input[1], format, err, expected)
+		}
+	}
+	if _, err := configFormat("config.json", "toml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestConfigEnvExpansionAndOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"port": "8080", "admin_port": "${TEST_ADMIN_PORT}", "backends": ["http://ignored:80"]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_ADMIN_PORT", "9090")
+	t.Setenv("HTTPBALANCE_PORT", "8181")
+	t.Setenv("HTTPBALANCE_BACKENDS", "http://a:80, http://b:80")
+
+	config, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	if config.AdminPort != "9090" {
+		t.Errorf("Expected admin_port expanded from the environment, got %q", config.AdminPort)
+	}
+	if config.Port != "8181" {
+		t.Errorf("Expected HTTPBALANCE_PORT to override port, got %q", config.Port)
+	}
+	if len(config.Backends) != 2 || config.Backends[1].URL != "http://b:80" {
+		t.Errorf("Expected HTTPBALANCE_BACKENDS to replace backends, got %+v", config.Backends)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// registerDebugHandlers adds net/http/pprof and runtime statistics to the
+// admin mux. Goroutine dumps are served by /debug/pprof/goroutine?debug=2.
+func registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, readRuntimeStats())
+	})
+}
+
+type runtimeStats struct {
+	Goroutines     int       `json:"goroutines"`
+	HeapAllocBytes uint64    `json:"heap_alloc_bytes"`
+	HeapInuseBytes uint64    `json:"heap_inuse_bytes"`
+	HeapObjects    uint64    `json:"heap_objects"`
+	SysBytes       uint64    `json:"sys_bytes"`
+	NextGCBytes    uint64    `json:"next_gc_bytes"`
+	NumGC          int64     `json:"num_gc"`
+	LastGC         time.Time `json:"last_gc"`
+	PauseTotal     string    `json:"pause_total"`
+	RecentPauses   []string  `json:"recent_pauses"`
+	GOMAXPROCS     int       `json:"gomaxprocs"`
+	Uptime         string    `json:"uptime"`
+}
+
+var startedAt = time.Now()
+
+func readRuntimeStats() runtimeStats {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	stats := runtimeStats{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: memory.HeapAlloc,
+		HeapInuseBytes: memory.HeapInuse,
+		HeapObjects:    memory.HeapObjects,
+		SysBytes:       memory.Sys,
+		NextGCBytes:    memory.NextGC,
+		NumGC:          gc.NumGC,
+		LastGC:         gc.LastGC,
+		PauseTotal:     gc.PauseTotal.String(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		Uptime:         time.Since(startedAt).Round(time.Second).String(),
+	}
+	for i, pause := range gc.Pause {
+		if i == 10 {
+			break
+		}
+		stats.RecentPauses = append(stats.RecentPauses, pause.String())
+	}
+	return stats
+}
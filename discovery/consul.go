@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConsulConfig selects the instances of a service registered in the Consul
+// catalog whose health checks are all passing. Address and Token default to
+// $CONSUL_HTTP_ADDR (or 127.0.0.1:8500) and $CONSUL_HTTP_TOKEN.
+type ConsulConfig struct {
+	Address    string `json:"address,omitempty"`
+	Service    string `json:"service"`
+	Tag        string `json:"tag,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Scheme     string `json:"scheme,omitempty"`
+}
+
+const consulWaitTime = 5 * time.Minute
+
+type consulServiceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+		Weights struct {
+			Passing int `json:"Passing"`
+		} `json:"Weights"`
+	} `json:"Service"`
+}
+
+func init() {
+	Register("consul", newConsulProvider)
+}
+
+type consulProvider struct {
+	config ConsulConfig
+	client *http.Client
+}
+
+func newConsulProvider(raw json.RawMessage) (Provider, error) {
+	var config ConsulConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if config.Service == "" {
+		return nil, errors.New("service is required")
+	}
+	if config.Address == "" {
+		config.Address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if config.Address == "" {
+		config.Address = "127.0.0.1:8500"
+	}
+	if !strings.Contains(config.Address, "://") {
+		config.Address = "http://" + config.Address
+	}
+	if config.Token == "" {
+		config.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	return &consulProvider{config: config, client: &http.Client{}}, nil
+}
+
+func (p *consulProvider) List(ctx context.Context) ([]Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	instances, _, err := p.fetch(ctx, 0)
+	return instances, err
+}
+
+// Subscribe follows the service with blocking queries, so changes show up
+// as soon as Consul sees them.
+func (p *consulProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	var index uint64
+	for {
+		instances, changed, err := p.fetch(ctx, index)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// A blocking query that times out returns the same index; an index
+		// that goes backwards means Consul's state was reset and the next
+		// query has to start over.
+		if changed == index {
+			continue
+		}
+		if changed < index {
+			changed = 0
+		}
+		index = changed
+		update(instances)
+	}
+}
+
+func (p *consulProvider) fetch(ctx context.Context, index uint64) ([]Instance, uint64, error) {
+	query := url.Values{"passing": {"1"}}
+	if p.config.Tag != "" {
+		query.Set("tag", p.config.Tag)
+	}
+	if p.config.Datacenter != "" {
+		query.Set("dc", p.config.Datacenter)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWaitTime.String())
+	}
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s", p.config.Address, url.PathEscape(p.config.Service), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.config.Token != "" {
+		req.Header.Set("X-Consul-Token", p.config.Token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned status %d for service %s", resp.StatusCode, p.config.Service)
+	}
+
+	changed, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul response has no valid X-Consul-Index: %w", err)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	return p.instances(entries), changed, nil
+}
+
+func (p *consulProvider) instances(entries []consulServiceEntry) []Instance {
+	scheme := p.config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var instances []Instance
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		labels := map[string]string{"node": entry.Node.Node}
+		for name, value := range entry.Service.Meta {
+			labels[name] = value
+		}
+		instances = append(instances, Instance{
+			URL:    scheme + "://" + net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)),
+			Weight: entry.Service.Weights.Passing,
+			Labels: labels,
+		})
+	}
+	return sortInstances(instances)
+}
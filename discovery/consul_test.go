@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConsulDiscoveryUsesBlockingQueries(t *testing.T) {
+	changes := make(chan string)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/v1/health/service/web" || query.Get("passing") != "1" || query.Get("tag") != "v2" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if query.Get("index") == "" {
+			w.Header().Set("X-Consul-Index", "7")
+			fmt.Fprint(w, `[{"Node": {"Node": "n1", "Address": "10.0.0.1"}, "Service": {"Port": 8080, "Weights": {"Passing": 2}}}]`)
+			return
+		}
+		select {
+		case body := <-changes:
+			w.Header().Set("X-Consul-Index", "8")
+			fmt.Fprint(w, body)
+		case <-r.Context().Done():
+		}
+	}))
+	defer consul.Close()
+
+	provider, err := New("consul", json.RawMessage(`{"address": "`+consul.URL+`", "service": "web", "tag": "v2", "token": "secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, stop := subscribe(t, provider)
+	defer stop()
+
+	instances := nextUpdate(t, updates)
+	if len(instances) != 1 || instances[0].URL != "http://10.0.0.1:8080" || instances[0].Weight != 2 || instances[0].Labels["node"] != "n1" {
+		t.Fatalf("Unexpected instances after the first query: %+v", instances)
+	}
+
+	changes <- `[
+		{"Node": {"Node": "n1", "Address": "10.0.0.1"}, "Service": {"Port": 8080}},
+		{"Node": {"Node": "n2", "Address": "10.0.0.2"}, "Service": {"Address": "10.1.0.2", "Port": 9090}}
+	]`
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 2 || urls[1] != "http://10.1.0.2:9090" {
+		t.Errorf("Expected the service address of the new instance, got %v", urls)
+	}
+}
@@ -0,0 +1,109 @@
+// Package discovery finds backend instances in service registries. Each
+// registry is a Provider registered under the name that selects it in a
+// backend entry of the config, e.g. "kubernetes" or "consul".
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Instance is one backend reported by a registry. A zero Weight leaves the
+// weight to the config.
+type Instance struct {
+	URL    string
+	Weight int
+	Labels map[string]string
+}
+
+// Provider is a service registry query.
+type Provider interface {
+	// List returns the instances currently registered.
+	List(ctx context.Context) ([]Instance, error)
+	// Subscribe calls update with the full set of instances, first right
+	// away and then on every change, until ctx is cancelled. It returns an
+	// error when it loses track of the registry; the caller retries.
+	Subscribe(ctx context.Context, update func([]Instance)) error
+}
+
+// Factory builds a provider from its entry in the config.
+type Factory func(config json.RawMessage) (Provider, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Factory{}
+)
+
+// Register makes a provider available under name.
+func Register(name string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[name] = factory
+}
+
+// Registered reports whether a provider is registered under name.
+func Registered(name string) bool {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	_, ok := registry[name]
+	return ok
+}
+
+// Names returns the registered provider names, sorted.
+func Names() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds the provider registered under name.
+func New(name string, config json.RawMessage) (Provider, error) {
+	registryMutex.RLock()
+	factory, ok := registry[name]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown discovery provider %q", name)
+	}
+	return factory(config)
+}
+
+const requestTimeout = 5 * time.Second
+
+// sortInstances orders instances by URL so unchanged sets compare equal.
+func sortInstances(instances []Instance) []Instance {
+	sort.Slice(instances, func(i, j int) bool { return instances[i].URL < instances[j].URL })
+	return instances
+}
+
+// poll implements Subscribe for registries without a change feed by calling
+// List every interval and reporting the result when it differs.
+func poll(ctx context.Context, interval time.Duration, list func(context.Context) ([]Instance, error), update func([]Instance)) error {
+	var last string
+	for {
+		instances, err := list(ctx)
+		if err != nil {
+			return err
+		}
+		if encoded, _ := json.Marshal(instances); string(encoded) != last {
+			last = string(encoded)
+			update(instances)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// subscribe runs provider.Subscribe in the background and returns the
+// updates it reports and a function that stops it.
+func subscribe(t *testing.T, provider Provider) (<-chan []Instance, func()) {
+	updates := make(chan []Instance, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := provider.Subscribe(ctx, func(instances []Instance) { updates <- instances }); err != nil {
+			t.Errorf("Subscribe failed: %v", err)
+		}
+	}()
+	return updates, func() {
+		cancel()
+		<-done
+	}
+}
+
+func nextUpdate(t *testing.T, updates <-chan []Instance) []Instance {
+	t.Helper()
+	select {
+	case instances := <-updates:
+		return instances
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an update")
+		return nil
+	}
+}
+
+func instanceURLs(instances []Instance) []string {
+	var urls []string
+	for _, instance := range instances {
+		urls = append(urls, instance.URL)
+	}
+	return urls
+}
+
+type fixedProvider []Instance
+
+func (p fixedProvider) List(ctx context.Context) ([]Instance, error) { return p, nil }
+
+func (p fixedProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	return poll(ctx, time.Hour, p.List, update)
+}
+
+func TestRegistry(t *testing.T) {
+	Register("fixed", func(config json.RawMessage) (Provider, error) {
+		var urls []string
+		if err := json.Unmarshal(config, &urls); err != nil {
+			return nil, err
+		}
+		var provider fixedProvider
+		for _, url := range urls {
+			provider = append(provider, Instance{URL: url})
+		}
+		return provider, nil
+	})
+
+	if !Registered("fixed") || !Registered("kubernetes") || Registered("carrier-pigeon") {
+		t.Errorf("Unexpected registry contents: %v", Names())
+	}
+	if _, err := New("carrier-pigeon", nil); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+
+	provider, err := New("fixed", json.RawMessage(`["http://a:80"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, stop := subscribe(t, provider)
+	defer stop()
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 1 || urls[0] != "http://a:80" {
+		t.Errorf("Unexpected instances: %v", urls)
+	}
+}
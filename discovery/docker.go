@@ -0,0 +1,245 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"loadbalancer/logging"
+)
+
+// DockerConfig registers the running containers of the local Docker daemon
+// that carry Label (httpbalance.enable=true by default). Containers set
+// their port, weight and scheme with the httpbalance.port,
+// httpbalance.weight and httpbalance.scheme labels; Network picks which of
+// the container's networks to reach it on.
+type DockerConfig struct {
+	Host    string `json:"host,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Network string `json:"network,omitempty"`
+}
+
+const (
+	dockerLabelPrefix = "httpbalance."
+	defaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func init() {
+	Register("docker", newDockerProvider)
+}
+
+type dockerProvider struct {
+	config  DockerConfig
+	client  *http.Client
+	baseURL string
+}
+
+func newDockerProvider(raw json.RawMessage) (Provider, error) {
+	var config DockerConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if config.Host == "" {
+		config.Host = os.Getenv("DOCKER_HOST")
+	}
+	if config.Host == "" {
+		config.Host = defaultDockerHost
+	}
+	if config.Label == "" {
+		config.Label = dockerLabelPrefix + "enable=true"
+	}
+
+	p := &dockerProvider{config: config}
+	parsed, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "unix":
+		socket := parsed.Path
+		p.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}}
+		p.baseURL = "http://docker"
+	case "tcp", "http":
+		p.client = &http.Client{}
+		p.baseURL = "http://" + parsed.Host
+	default:
+		return nil, fmt.Errorf("unsupported Docker host %q", config.Host)
+	}
+	return p, nil
+}
+
+func (p *dockerProvider) get(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	encoded, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := p.baseURL + path + "?" + url.Values{"filters": {string(encoded)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker returned status %d for %s", resp.StatusCode, path)
+	}
+	return resp, nil
+}
+
+// Subscribe lists the matching containers and lists them again for every
+// start, stop or pause of one, until the daemon's event stream ends.
+func (p *dockerProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	resp, err := p.get(ctx, "/events", map[string][]string{
+		"type":  {"container"},
+		"label": {p.config.Label},
+		"event": {"start", "stop", "die", "pause", "unpause", "destroy"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	instances, err := p.List(ctx)
+	if err != nil {
+		return err
+	}
+	update(instances)
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event json.RawMessage
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("docker event stream ended: %w", err)
+		}
+		instances, err := p.List(ctx)
+		if err != nil {
+			return err
+		}
+		update(instances)
+	}
+}
+
+func (p *dockerProvider) List(ctx context.Context) ([]Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := p.get(ctx, "/containers/json", map[string][]string{
+		"label":  {p.config.Label},
+		"status": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, container := range containers {
+		instance, err := p.instance(container)
+		if err != nil {
+			logging.Default().Warnf("Skipping container %s: %v", containerName(container), err)
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return sortInstances(instances), nil
+}
+
+func (p *dockerProvider) instance(container dockerContainer) (Instance, error) {
+	var instance Instance
+
+	var address string
+	if p.config.Network != "" {
+		address = container.NetworkSettings.Networks[p.config.Network].IPAddress
+	} else {
+		var networks []string
+		for name := range container.NetworkSettings.Networks {
+			networks = append(networks, name)
+		}
+		sort.Strings(networks)
+		for _, name := range networks {
+			if address = container.NetworkSettings.Networks[name].IPAddress; address != "" {
+				break
+			}
+		}
+	}
+	if address == "" {
+		return instance, fmt.Errorf("no IP address on network %q", p.config.Network)
+	}
+
+	port := container.Labels[dockerLabelPrefix+"port"]
+	if port == "" {
+		var exposed []int
+		for _, p := range container.Ports {
+			if p.Type == "tcp" {
+				exposed = append(exposed, p.PrivatePort)
+			}
+		}
+		if len(exposed) != 1 {
+			return instance, fmt.Errorf("set the %sport label to pick one of %d exposed ports", dockerLabelPrefix, len(exposed))
+		}
+		port = strconv.Itoa(exposed[0])
+	}
+
+	scheme := container.Labels[dockerLabelPrefix+"scheme"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	if weight := container.Labels[dockerLabelPrefix+"weight"]; weight != "" {
+		parsed, err := strconv.Atoi(weight)
+		if err != nil {
+			return instance, fmt.Errorf("invalid %sweight label: %v", dockerLabelPrefix, err)
+		}
+		instance.Weight = parsed
+	}
+
+	instance.URL = scheme + "://" + net.JoinHostPort(address, port)
+	instance.Labels = map[string]string{"container": containerName(container)}
+	return instance, nil
+}
+
+func containerName(container dockerContainer) string {
+	if len(container.Names) > 0 {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+	if len(container.ID) > 12 {
+		return container.ID[:12]
+	}
+	return container.ID
+}
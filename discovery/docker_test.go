@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDockerDiscoveryRegistersLabelledContainers(t *testing.T) {
+	var running atomic.Int32
+	running.Store(1)
+	events := make(chan string)
+
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil || filters["label"][0] != "httpbalance.enable=true" {
+			http.Error(w, "bad filters", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/containers/json":
+			containers := `{"Id": "aaa", "Names": ["/web-1"], "Labels": {"httpbalance.port": "8080", "httpbalance.weight": "2"},
+				"NetworkSettings": {"Networks": {"app": {"IPAddress": "172.18.0.2"}}}}`
+			if running.Load() == 2 {
+				containers += `, {"Id": "bbb", "Names": ["/web-2"], "Ports": [{"PrivatePort": 3000, "Type": "tcp"}],
+					"NetworkSettings": {"Networks": {"app": {"IPAddress": "172.18.0.3"}}}}`
+			}
+			fmt.Fprintf(w, "[%s]", containers)
+		case "/events":
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case event := <-events:
+					fmt.Fprintln(w, event)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daemon.Close()
+
+	provider, err := New("docker", json.RawMessage(`{"host": "tcp://`+daemon.Listener.Addr().String()+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, stop := subscribe(t, provider)
+	defer stop()
+
+	instances := nextUpdate(t, updates)
+	if len(instances) != 1 || instances[0].URL != "http://172.18.0.2:8080" || instances[0].Weight != 2 || instances[0].Labels["container"] != "web-1" {
+		t.Fatalf("Unexpected instances: %+v", instances)
+	}
+
+	running.Store(2)
+	events <- `{"Type": "container", "Action": "start", "id": "bbb"}`
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 2 || urls[1] != "http://172.18.0.3:3000" {
+		t.Errorf("Expected the started container on its only exposed port, got %v", urls)
+	}
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EurekaConfig selects the instances of App that are UP in a Eureka
+// registry. Server is the base of the Eureka REST API, usually ending in
+// /eureka. With Secure the instances' secure port is used over https.
+// Eureka has no change feed, so the registry is polled every
+// RefreshInterval (30s by default, like Eureka's own clients).
+type EurekaConfig struct {
+	Server          string `json:"server"`
+	App             string `json:"app"`
+	Secure          bool   `json:"secure,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+}
+
+const defaultEurekaRefresh = 30 * time.Second
+
+func init() {
+	Register("eureka", newEurekaProvider)
+}
+
+type eurekaProvider struct {
+	config  EurekaConfig
+	refresh time.Duration
+	client  *http.Client
+}
+
+func newEurekaProvider(raw json.RawMessage) (Provider, error) {
+	var config EurekaConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if parsed, err := url.Parse(config.Server); err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("server %q is not a URL", config.Server)
+	}
+	if config.App == "" {
+		return nil, errors.New("app is required")
+	}
+
+	refresh := defaultEurekaRefresh
+	if config.RefreshInterval != "" {
+		var err error
+		if refresh, err = time.ParseDuration(config.RefreshInterval); err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("refresh_interval %q is not a positive duration", config.RefreshInterval)
+		}
+	}
+	return &eurekaProvider{config: config, refresh: refresh, client: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+type eurekaPort struct {
+	Port    json.Number `json:"$"`
+	Enabled string      `json:"@enabled"`
+}
+
+type eurekaInstance struct {
+	InstanceID string            `json:"instanceId"`
+	HostName   string            `json:"hostName"`
+	IPAddr     string            `json:"ipAddr"`
+	Status     string            `json:"status"`
+	Port       eurekaPort        `json:"port"`
+	SecurePort eurekaPort        `json:"securePort"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+func (p *eurekaProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	return poll(ctx, p.refresh, p.List, update)
+}
+
+func (p *eurekaProvider) List(ctx context.Context) ([]Instance, error) {
+	endpoint := strings.TrimSuffix(p.config.Server, "/") + "/apps/" + url.PathEscape(strings.ToUpper(p.config.App))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Eureka forgets applications whose last instance went away.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("eureka returned status %d for app %s", resp.StatusCode, p.config.App)
+	}
+
+	var body struct {
+		Application struct {
+			Instance json.RawMessage `json:"instance"`
+		} `json:"application"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	// Eureka encodes a single instance as an object instead of a list.
+	raw := bytes.TrimSpace(body.Application.Instance)
+	if len(raw) > 0 && raw[0] == '{' {
+		raw = append(append([]byte{'['}, raw...), ']')
+	}
+	var registered []eurekaInstance
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &registered); err != nil {
+			return nil, err
+		}
+	}
+
+	scheme, portOf := "http", func(i eurekaInstance) eurekaPort { return i.Port }
+	if p.config.Secure {
+		scheme, portOf = "https", func(i eurekaInstance) eurekaPort { return i.SecurePort }
+	}
+
+	var instances []Instance
+	for _, instance := range registered {
+		port := portOf(instance)
+		if instance.Status != "UP" || port.Enabled == "false" || port.Port == "" {
+			continue
+		}
+		address := instance.IPAddr
+		if address == "" {
+			address = instance.HostName
+		}
+		labels := map[string]string{"instance": instance.InstanceID}
+		for name, value := range instance.Metadata {
+			labels[name] = value
+		}
+		instances = append(instances, Instance{
+			URL:    scheme + "://" + net.JoinHostPort(address, port.Port.String()),
+			Labels: labels,
+		})
+	}
+	return sortInstances(instances), nil
+}
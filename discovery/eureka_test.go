@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEurekaListsInstancesThatAreUp(t *testing.T) {
+	instances := `{"instanceId": "web-1", "ipAddr": "10.0.0.1", "status": "UP", "port": {"$": 8080, "@enabled": "true"}, "metadata": {"zone": "a"}}`
+	eureka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eureka/apps/WEB" || r.Header.Get("Accept") != "application/json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"application": {"name": "WEB", "instance": %s}}`, instances)
+	}))
+	defer eureka.Close()
+
+	provider, err := New("eureka", json.RawMessage(`{"server": "`+eureka.URL+`/eureka", "app": "web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single instance is encoded as an object rather than a list.
+	listed, err := provider.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].URL != "http://10.0.0.1:8080" || listed[0].Labels["zone"] != "a" {
+		t.Fatalf("Unexpected instances: %+v", listed)
+	}
+
+	instances = `[` + instances + `,
+		{"instanceId": "web-2", "hostName": "web-2.local", "status": "UP", "port": {"$": "9090", "@enabled": "true"}},
+		{"instanceId": "web-3", "ipAddr": "10.0.0.3", "status": "OUT_OF_SERVICE", "port": {"$": 8080}}]`
+	listed, err = provider.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := instanceURLs(listed); len(urls) != 2 || urls[1] != "http://web-2.local:9090" {
+		t.Errorf("Expected the two instances that are up, got %v", urls)
+	}
+}
@@ -0,0 +1,461 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KubernetesConfig selects the ready endpoints of a Service. Port is the
+// name or number of the Service port to use and may be left out when the
+// Service has a single port. Without Kubeconfig the in-cluster service
+// account is used, falling back to $KUBECONFIG and ~/.kube/config.
+type KubernetesConfig struct {
+	Namespace  string `json:"namespace,omitempty"`
+	Service    string `json:"service"`
+	Port       string `json:"port,omitempty"`
+	Scheme     string `json:"scheme,omitempty"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+}
+
+const (
+	serviceAccountDir     = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesWatchWindow = 5 * time.Minute
+)
+
+func init() {
+	Register("kubernetes", newKubernetesProvider)
+}
+
+type kubernetesProvider struct {
+	config KubernetesConfig
+
+	mutex  sync.Mutex
+	client *kubernetesClient
+}
+
+func newKubernetesProvider(raw json.RawMessage) (Provider, error) {
+	var config KubernetesConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if config.Service == "" {
+		return nil, errors.New("service is required")
+	}
+	return &kubernetesProvider{config: config}, nil
+}
+
+// connect builds the API client on first use, so that validating a config
+// does not need cluster credentials.
+func (p *kubernetesProvider) connect() (*kubernetesClient, string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.client == nil {
+		client, err := newKubernetesClient(p.config.Kubeconfig)
+		if err != nil {
+			return nil, "", err
+		}
+		p.client = client
+	}
+
+	namespace := p.config.Namespace
+	if namespace == "" {
+		namespace = p.client.namespace
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return p.client, namespace, nil
+}
+
+type kubernetesClient struct {
+	server    string
+	token     string
+	tokenFile string
+	namespace string
+	http      *http.Client
+}
+
+func newKubernetesClient(kubeconfig string) (*kubernetesClient, error) {
+	if kubeconfig == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host != "" && port != "" {
+			return inClusterClient(host, port)
+		}
+		kubeconfig = os.Getenv("KUBECONFIG")
+		if kubeconfig == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			kubeconfig = filepath.Join(home, ".kube", "config")
+		}
+	}
+	return kubeconfigClient(kubeconfig)
+}
+
+func inClusterClient(host, port string) (*kubernetesClient, error) {
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	namespace, _ := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	return &kubernetesClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		// The projected token is rotated by the kubelet, so it is read
+		// again for every request.
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		namespace: strings.TrimSpace(string(namespace)),
+		http:      &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+type kubeconfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+func kubeconfigClient(path string) (*kubernetesClient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubeconfig: %w", err)
+	}
+	var file kubeconfigFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig: %w", err)
+	}
+
+	client := &kubernetesClient{}
+	tlsConfig := &tls.Config{}
+	// Relative paths in a kubeconfig are relative to the file itself.
+	readFile := func(name, inline string) ([]byte, error) {
+		if inline != "" {
+			return base64.StdEncoding.DecodeString(inline)
+		}
+		if name == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		return os.ReadFile(name)
+	}
+
+	for _, context := range file.Contexts {
+		if context.Name != file.CurrentContext {
+			continue
+		}
+		client.namespace = context.Context.Namespace
+
+		for _, cluster := range file.Clusters {
+			if cluster.Name != context.Context.Cluster {
+				continue
+			}
+			client.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+			tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+			ca, err := readFile(cluster.Cluster.CertificateAuthority, cluster.Cluster.CertificateAuthorityData)
+			if err != nil {
+				return nil, fmt.Errorf("reading cluster CA: %w", err)
+			}
+			if ca != nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+				tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+			}
+		}
+
+		for _, user := range file.Users {
+			if user.Name != context.Context.User {
+				continue
+			}
+			client.token = user.User.Token
+			cert, err := readFile(user.User.ClientCertificate, user.User.ClientCertificateData)
+			if err != nil {
+				return nil, fmt.Errorf("reading client certificate: %w", err)
+			}
+			key, err := readFile(user.User.ClientKey, user.User.ClientKeyData)
+			if err != nil {
+				return nil, fmt.Errorf("reading client key: %w", err)
+			}
+			if cert != nil {
+				pair, err := tls.X509KeyPair(cert, key)
+				if err != nil {
+					return nil, fmt.Errorf("loading client certificate: %w", err)
+				}
+				tlsConfig.Certificates = []tls.Certificate{pair}
+			}
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("kubeconfig %s has no server for context %q", path, file.CurrentContext)
+	}
+
+	client.http = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return client, nil
+}
+
+func (c *kubernetesClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading service account token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+// endpointSlices lists and watches the EndpointSlices of one Service.
+type endpointSlices struct {
+	provider  *kubernetesProvider
+	client    *kubernetesClient
+	namespace string
+	slices    map[string]endpointSlice
+}
+
+func (p *kubernetesProvider) open() (*endpointSlices, error) {
+	client, namespace, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &endpointSlices{provider: p, client: client, namespace: namespace}, nil
+}
+
+func (p *kubernetesProvider) List(ctx context.Context) ([]Instance, error) {
+	e, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.list(ctx); err != nil {
+		return nil, err
+	}
+	return e.instances(), nil
+}
+
+// Subscribe lists the slices and then follows the watch stream, listing
+// again whenever the API server ends the watch window.
+func (p *kubernetesProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	e, err := p.open()
+	if err != nil {
+		return err
+	}
+	for {
+		resourceVersion, err := e.list(ctx)
+		if err != nil {
+			return err
+		}
+		update(e.instances())
+
+		err = e.follow(ctx, resourceVersion, update)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *endpointSlices) path() string {
+	return "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(e.namespace) + "/endpointslices"
+}
+
+func (e *endpointSlices) selector() url.Values {
+	return url.Values{"labelSelector": {"kubernetes.io/service-name=" + e.provider.config.Service}}
+}
+
+func (e *endpointSlices) list(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := e.client.get(ctx, e.path(), e.selector())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	e.slices = make(map[string]endpointSlice)
+	for _, slice := range list.Items {
+		e.slices[slice.Metadata.Name] = slice
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// follow applies watch events until the stream ends. A nil error means the
+// watch window closed normally.
+func (e *endpointSlices) follow(ctx context.Context, resourceVersion string, update func([]Instance)) error {
+	query := e.selector()
+	query.Set("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(int(kubernetesWatchWindow/time.Second)))
+	resp, err := e.client.get(ctx, e.path(), query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			e.slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(e.slices, slice.Metadata.Name)
+		case "ERROR":
+			// Usually 410 Gone: the resource version is too old and the
+			// caller has to list again.
+			return fmt.Errorf("watch error: %s", event.Object)
+		default:
+			continue
+		}
+		update(e.instances())
+	}
+}
+
+// instances returns the ready endpoints of every slice.
+func (e *endpointSlices) instances() []Instance {
+	config := e.provider.config
+	scheme := config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var instances []Instance
+	for _, slice := range e.slices {
+		port := 0
+		for _, slicePort := range slice.Ports {
+			if config.Port == "" && len(slice.Ports) == 1 ||
+				slicePort.Name == config.Port || strconv.Itoa(slicePort.Port) == config.Port {
+				port = slicePort.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A missing ready condition means ready.
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			labels := map[string]string{}
+			if endpoint.Zone != "" {
+				labels["zone"] = endpoint.Zone
+			}
+			if endpoint.NodeName != "" {
+				labels["node"] = endpoint.NodeName
+			}
+			for _, address := range endpoint.Addresses {
+				instances = append(instances, Instance{
+					URL:    scheme + "://" + net.JoinHostPort(address, strconv.Itoa(port)),
+					Labels: labels,
+				})
+			}
+		}
+	}
+	return sortInstances(instances)
+}
@@ -0,0 +1,97 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testEndpointSlice = `{
+	"metadata": {"name": "web-abc"},
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "zone": "a"},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+		{"addresses": ["10.0.0.3"]}%s
+	],
+	"ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}]
+}`
+
+func TestKubernetesDiscoveryFollowsEndpointSlices(t *testing.T) {
+	events := make(chan string)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/shop/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "1"}, "items": [`+testEndpointSlice+`]}`, "")
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer apiServer.Close()
+
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(kubeconfig, []byte(`
+current-context: test
+contexts:
+- name: test
+  context: {cluster: test, user: test, namespace: shop}
+clusters:
+- name: test
+  cluster: {server: `+apiServer.URL+`}
+users:
+- name: test
+  user: {token: test-token}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := New("kubernetes", json.RawMessage(`{"service": "web", "port": "http", "kubeconfig": "`+kubeconfig+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := provider.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := instanceURLs(instances); len(urls) != 2 || urls[0] != "http://10.0.0.1:8080" || urls[1] != "http://10.0.0.3:8080" {
+		t.Fatalf("Expected the two ready endpoints, got %v", urls)
+	}
+	if zone := instances[0].Labels["zone"]; zone != "a" {
+		t.Errorf("Expected the endpoint zone as a label, got %q", zone)
+	}
+
+	updates, stop := subscribe(t, provider)
+	defer stop()
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 2 {
+		t.Fatalf("Expected the listed endpoints first, got %v", urls)
+	}
+
+	modified := fmt.Sprintf(testEndpointSlice, `, {"addresses": ["10.0.0.4"]}`)
+	events <- `{"type": "MODIFIED", "object": ` + modified + `}`
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 3 || urls[2] != "http://10.0.0.4:8080" {
+		t.Errorf("Expected the new endpoint after the watch event, got %v", urls)
+	}
+}
@@ -0,0 +1,231 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XDSConfig subscribes to the ClusterLoadAssignment of Cluster on an xDS
+// control plane (Envoy EDS). It uses the REST-JSON variant of the protocol,
+// which control planes such as go-control-plane serve next to gRPC, and
+// asks again every RefreshInterval (a duration such as "5s", the default)
+// unless the server holds the request open until something changes.
+type XDSConfig struct {
+	Server          string `json:"server"`
+	Cluster         string `json:"cluster"`
+	NodeID          string `json:"node_id,omitempty"`
+	NodeCluster     string `json:"node_cluster,omitempty"`
+	Scheme          string `json:"scheme,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+}
+
+const (
+	edsTypeURL            = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+	defaultXDSRefresh     = 5 * time.Second
+	xdsRequestTimeout     = 5 * time.Minute
+	defaultXDSNodeID      = "httpbalance"
+	defaultXDSNodeCluster = "httpbalance"
+	xdsDiscoveryEndpoint  = "/v3/discovery:endpoints"
+)
+
+type xdsDiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info,omitempty"`
+	Node          xdsNode  `json:"node"`
+	ResourceNames []string `json:"resource_names"`
+	TypeURL       string   `json:"type_url"`
+	ResponseNonce string   `json:"response_nonce,omitempty"`
+}
+
+type xdsNode struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster"`
+}
+
+type xdsDiscoveryResponse struct {
+	VersionInfo string                     `json:"version_info"`
+	Resources   []xdsClusterLoadAssignment `json:"resources"`
+	Nonce       string                     `json:"nonce"`
+}
+
+type xdsClusterLoadAssignment struct {
+	ClusterName string `json:"cluster_name"`
+	Endpoints   []struct {
+		Locality struct {
+			Region string `json:"region"`
+			Zone   string `json:"zone"`
+		} `json:"locality"`
+		LBEndpoints []struct {
+			Endpoint struct {
+				Address struct {
+					SocketAddress struct {
+						Address   string `json:"address"`
+						PortValue int    `json:"port_value"`
+					} `json:"socket_address"`
+				} `json:"address"`
+			} `json:"endpoint"`
+			HealthStatus        string `json:"health_status"`
+			LoadBalancingWeight int    `json:"load_balancing_weight"`
+		} `json:"lb_endpoints"`
+	} `json:"endpoints"`
+}
+
+func init() {
+	Register("xds", newXDSProvider)
+}
+
+type xdsProvider struct {
+	config  XDSConfig
+	refresh time.Duration
+	client  *http.Client
+}
+
+func newXDSProvider(raw json.RawMessage) (Provider, error) {
+	var config XDSConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if parsed, err := url.Parse(config.Server); err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("server %q is not a URL", config.Server)
+	}
+	if config.Cluster == "" {
+		return nil, errors.New("cluster is required")
+	}
+	if config.NodeID == "" {
+		config.NodeID = defaultXDSNodeID
+	}
+	if config.NodeCluster == "" {
+		config.NodeCluster = defaultXDSNodeCluster
+	}
+
+	refresh := defaultXDSRefresh
+	if config.RefreshInterval != "" {
+		var err error
+		if refresh, err = time.ParseDuration(config.RefreshInterval); err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("refresh_interval %q is not a positive duration", config.RefreshInterval)
+		}
+	}
+	return &xdsProvider{config: config, refresh: refresh, client: &http.Client{Timeout: xdsRequestTimeout}}, nil
+}
+
+func (p *xdsProvider) List(ctx context.Context) ([]Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	response, err := p.fetch(ctx, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return p.instances(response), nil
+}
+
+// Subscribe sends a DiscoveryRequest carrying the last accepted version and
+// nonce, which is the protocol's ACK, every refresh interval and reports
+// the endpoints whenever the version changes.
+func (p *xdsProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	var version, nonce string
+	for {
+		response, err := p.fetch(ctx, version, nonce)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if response != nil && (response.VersionInfo != version || version == "") {
+			version, nonce = response.VersionInfo, response.Nonce
+			update(p.instances(response))
+		}
+
+		timer := time.NewTimer(p.refresh)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// fetch returns nil without an error when the control plane answers that
+// nothing changed since version.
+func (p *xdsProvider) fetch(ctx context.Context, version, nonce string) (*xdsDiscoveryResponse, error) {
+	body, err := json.Marshal(xdsDiscoveryRequest{
+		VersionInfo:   version,
+		Node:          xdsNode{ID: p.config.NodeID, Cluster: p.config.NodeCluster},
+		ResourceNames: []string{p.config.Cluster},
+		TypeURL:       edsTypeURL,
+		ResponseNonce: nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(p.config.Server, "/") + xdsDiscoveryEndpoint
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control plane returned status %d", resp.StatusCode)
+	}
+
+	var response xdsDiscoveryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (p *xdsProvider) instances(response *xdsDiscoveryResponse) []Instance {
+	scheme := p.config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var instances []Instance
+	for _, assignment := range response.Resources {
+		if assignment.ClusterName != p.config.Cluster {
+			continue
+		}
+		for _, locality := range assignment.Endpoints {
+			labels := map[string]string{}
+			if locality.Locality.Region != "" {
+				labels["region"] = locality.Locality.Region
+			}
+			if locality.Locality.Zone != "" {
+				labels["zone"] = locality.Locality.Zone
+			}
+			for _, lbEndpoint := range locality.LBEndpoints {
+				switch lbEndpoint.HealthStatus {
+				case "UNHEALTHY", "DRAINING", "TIMEOUT":
+					continue
+				}
+				address := lbEndpoint.Endpoint.Address.SocketAddress
+				instances = append(instances, Instance{
+					URL:    scheme + "://" + net.JoinHostPort(address.Address, strconv.Itoa(address.PortValue)),
+					Weight: lbEndpoint.LoadBalancingWeight,
+					Labels: labels,
+				})
+			}
+		}
+	}
+	return sortInstances(instances)
+}
@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestXDSDiscoveryFollowsClusterLoadAssignment(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	var acked atomic.Value
+	acked.Store("")
+
+	controlPlane := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request xdsDiscoveryRequest
+		if r.URL.Path != "/v3/discovery:endpoints" || json.NewDecoder(r.Body).Decode(&request) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if request.TypeURL != edsTypeURL || len(request.ResourceNames) != 1 || request.ResourceNames[0] != "web" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		acked.Store(request.VersionInfo)
+
+		current := fmt.Sprint(version.Load())
+		if request.VersionInfo == current {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		endpoints := `{"endpoint": {"address": {"socket_address": {"address": "10.0.0.1", "port_value": 8080}}}, "load_balancing_weight": 3},
+			{"endpoint": {"address": {"socket_address": {"address": "10.0.0.2", "port_value": 8080}}}, "health_status": "UNHEALTHY"}`
+		if current == "2" {
+			endpoints += `, {"endpoint": {"address": {"socket_address": {"address": "10.0.0.3", "port_value": 8080}}}, "health_status": "HEALTHY"}`
+		}
+		fmt.Fprintf(w, `{"version_info": %q, "nonce": "n%s", "resources": [{
+			"@type": %q, "cluster_name": "web",
+			"endpoints": [{"locality": {"zone": "us-east-1a"}, "lb_endpoints": [%s]}]
+		}]}`, current, current, edsTypeURL, endpoints)
+	}))
+	defer controlPlane.Close()
+
+	provider, err := New("xds", json.RawMessage(`{"server": "`+controlPlane.URL+`", "cluster": "web", "refresh_interval": "20ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, stop := subscribe(t, provider)
+	defer stop()
+
+	instances := nextUpdate(t, updates)
+	if len(instances) != 1 || instances[0].URL != "http://10.0.0.1:8080" || instances[0].Weight != 3 || instances[0].Labels["zone"] != "us-east-1a" {
+		t.Fatalf("Expected only the healthy endpoint with its weight and zone, got %+v", instances)
+	}
+
+	version.Store(2)
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 2 || urls[1] != "http://10.0.0.3:8080" {
+		t.Errorf("Expected the new endpoint, got %v", urls)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for acked.Load() != "2" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if acked.Load() != "2" {
+		t.Errorf("Expected the client to acknowledge version 2, got %q", acked.Load())
+	}
+}
@@ -0,0 +1,422 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZooKeeperConfig selects the instances registered as children of Path.
+// Each child's data is either a Curator service instance (JSON with address
+// and port) or a plain host:port. Servers are tried in order.
+type ZooKeeperConfig struct {
+	Servers        []string `json:"servers"`
+	Path           string   `json:"path"`
+	Scheme         string   `json:"scheme,omitempty"`
+	SessionTimeout string   `json:"session_timeout,omitempty"`
+}
+
+const defaultZooKeeperSession = 10 * time.Second
+
+func init() {
+	Register("zookeeper", newZooKeeperProvider)
+}
+
+type zooKeeperProvider struct {
+	config  ZooKeeperConfig
+	timeout time.Duration
+}
+
+func newZooKeeperProvider(raw json.RawMessage) (Provider, error) {
+	var config ZooKeeperConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("servers is required")
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		return nil, fmt.Errorf("path %q must be absolute", config.Path)
+	}
+
+	timeout := defaultZooKeeperSession
+	if config.SessionTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.SessionTimeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("session_timeout %q is not a positive duration", config.SessionTimeout)
+		}
+	}
+	return &zooKeeperProvider{config: config, timeout: timeout}, nil
+}
+
+func (p *zooKeeperProvider) List(ctx context.Context) ([]Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	return p.instances(conn, false)
+}
+
+// Subscribe reads the children with a watch set and reads them again every
+// time ZooKeeper reports that they changed.
+func (p *zooKeeperProvider) Subscribe(ctx context.Context, update func([]Instance)) error {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	for {
+		instances, err := p.instances(conn, true)
+		if err != nil {
+			return err
+		}
+		update(instances)
+		if err := conn.waitForEvent(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (p *zooKeeperProvider) instances(conn *zooKeeperConn, watch bool) ([]Instance, error) {
+	children, err := conn.getChildren(p.config.Path, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := p.config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	var instances []Instance
+	for _, child := range children {
+		data, err := conn.getData(path.Join(p.config.Path, child))
+		if errors.Is(err, errNoNode) {
+			// Removed between listing and reading; the watch fires again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hostPort, ok := parseZooKeeperInstance(data)
+		if !ok {
+			continue
+		}
+		instances = append(instances, Instance{
+			URL:    scheme + "://" + hostPort,
+			Labels: map[string]string{"znode": child},
+		})
+	}
+	return sortInstances(instances), nil
+}
+
+// parseZooKeeperInstance understands Curator's ServiceInstance JSON and
+// plain host:port data.
+func parseZooKeeperInstance(data []byte) (string, bool) {
+	var curator struct {
+		Address string `json:"address"`
+		Port    *int   `json:"port"`
+	}
+	if json.Unmarshal(data, &curator) == nil && curator.Address != "" && curator.Port != nil {
+		return net.JoinHostPort(curator.Address, strconv.Itoa(*curator.Port)), true
+	}
+	text := strings.TrimSpace(string(data))
+	if _, _, err := net.SplitHostPort(text); err == nil {
+		return text, true
+	}
+	return "", false
+}
+
+// ZooKeeper wire protocol: every packet is a big-endian length followed by
+// jute-encoded records.
+const (
+	zkOpGetData     = 4
+	zkOpGetChildren = 8
+	zkOpPing        = 11
+	zkOpClose       = -11
+
+	zkXidWatchEvent = -1
+	zkXidPing       = -2
+
+	zkErrNoNode = -101
+)
+
+var errNoNode = errors.New("znode does not exist")
+
+type zooKeeperConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	xid          int32
+	pingInterval time.Duration
+	pendingEvent bool
+	stopWatching func() bool
+}
+
+func (p *zooKeeperProvider) connect(ctx context.Context) (*zooKeeperConn, error) {
+	var errs []error
+	for _, server := range p.config.Servers {
+		var dialer net.Dialer
+		dialCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		conn, err := dialer.DialContext(dialCtx, "tcp", server)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		zk := &zooKeeperConn{conn: conn, reader: bufio.NewReader(conn), pingInterval: p.timeout / 3}
+		zk.stopWatching = context.AfterFunc(ctx, func() { conn.Close() })
+		if err := zk.handshake(p.timeout); err != nil {
+			zk.close()
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		return zk, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c *zooKeeperConn) handshake(timeout time.Duration) error {
+	var request zkWriter
+	request.int32(0) // protocol version
+	request.int64(0) // last zxid seen
+	request.int32(int32(timeout / time.Millisecond))
+	request.int64(0)                 // session id
+	request.buffer(make([]byte, 16)) // password
+	if err := c.send(request); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	response, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	reader := zkReader{data: response}
+	reader.int32() // protocol version
+	negotiated := reader.int32()
+	if reader.err != nil {
+		return reader.err
+	}
+	if negotiated <= 0 {
+		return errors.New("session expired")
+	}
+	c.pingInterval = time.Duration(negotiated) * time.Millisecond / 3
+	return nil
+}
+
+func (c *zooKeeperConn) close() {
+	var request zkWriter
+	request.int32(c.nextXid())
+	request.int32(zkOpClose)
+	c.send(request)
+	c.stopWatching()
+	c.conn.Close()
+}
+
+func (c *zooKeeperConn) nextXid() int32 {
+	c.xid++
+	return c.xid
+}
+
+func (c *zooKeeperConn) send(w zkWriter) error {
+	packet := make([]byte, 4, 4+len(w.data))
+	binary.BigEndian.PutUint32(packet, uint32(len(w.data)))
+	c.conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	_, err := c.conn.Write(append(packet, w.data...))
+	return err
+}
+
+func (c *zooKeeperConn) readPacket() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err := io.ReadFull(c.reader, packet)
+	return packet, err
+}
+
+// call sends a request and returns the body of its reply. Watch events that
+// arrive in between are remembered for waitForEvent.
+func (c *zooKeeperConn) call(op int32, body func(*zkWriter)) (*zkReader, error) {
+	xid := c.nextXid()
+	var request zkWriter
+	request.int32(xid)
+	request.int32(op)
+	body(&request)
+	if err := c.send(request); err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if reply.xid != xid {
+			continue
+		}
+		if reply.code == zkErrNoNode {
+			return nil, errNoNode
+		}
+		if reply.code != 0 {
+			return nil, fmt.Errorf("zookeeper error %d", reply.code)
+		}
+		return reply.body, nil
+	}
+}
+
+type zkReply struct {
+	xid  int32
+	code int32
+	body *zkReader
+}
+
+func (c *zooKeeperConn) readReply() (zkReply, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return zkReply{}, err
+	}
+	reader := &zkReader{data: packet}
+	reply := zkReply{xid: reader.int32()}
+	reader.int64() // zxid
+	reply.code = reader.int32()
+	reply.body = reader
+	if reply.xid == zkXidWatchEvent {
+		c.pendingEvent = true
+	}
+	return reply, reader.err
+}
+
+// waitForEvent blocks until a watch fires, pinging to keep the session
+// alive meanwhile.
+func (c *zooKeeperConn) waitForEvent() error {
+	for !c.pendingEvent {
+		c.conn.SetReadDeadline(time.Now().Add(c.pingInterval))
+		_, err := c.readReply()
+		var timeout net.Error
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			var ping zkWriter
+			ping.int32(zkXidPing)
+			ping.int32(zkOpPing)
+			if err := c.send(ping); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.pendingEvent = false
+	return nil
+}
+
+func (c *zooKeeperConn) getChildren(path string, watch bool) ([]string, error) {
+	reply, err := c.call(zkOpGetChildren, func(w *zkWriter) {
+		w.string(path)
+		w.bool(watch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	count := reply.int32()
+	children := make([]string, 0, max(count, 0))
+	for i := int32(0); i < count && reply.err == nil; i++ {
+		children = append(children, reply.string())
+	}
+	return children, reply.err
+}
+
+func (c *zooKeeperConn) getData(path string) ([]byte, error) {
+	reply, err := c.call(zkOpGetData, func(w *zkWriter) {
+		w.string(path)
+		w.bool(false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := reply.buffer()
+	return data, reply.err
+}
+
+type zkWriter struct {
+	data []byte
+}
+
+func (w *zkWriter) int32(v int32) { w.data = binary.BigEndian.AppendUint32(w.data, uint32(v)) }
+func (w *zkWriter) int64(v int64) { w.data = binary.BigEndian.AppendUint64(w.data, uint64(v)) }
+
+func (w *zkWriter) bool(v bool) {
+	if v {
+		w.data = append(w.data, 1)
+	} else {
+		w.data = append(w.data, 0)
+	}
+}
+
+func (w *zkWriter) buffer(v []byte) {
+	w.int32(int32(len(v)))
+	w.data = append(w.data, v...)
+}
+
+func (w *zkWriter) string(v string) { w.buffer([]byte(v)) }
+
+type zkReader struct {
+	data []byte
+	err  error
+}
+
+func (r *zkReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	taken := r.data[:n]
+	r.data = r.data[n:]
+	return taken
+}
+
+func (r *zkReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *zkReader) int64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// buffer reads a length-prefixed byte string; a length of -1 is null.
+func (r *zkReader) buffer() []byte {
+	size := r.int32()
+	if size == -1 {
+		return nil
+	}
+	return r.take(int(size))
+}
+
+func (r *zkReader) string() string { return string(r.buffer()) }
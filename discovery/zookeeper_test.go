@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeZooKeeper serves the handful of requests the provider sends from an
+// in-memory tree of children.
+type fakeZooKeeper struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	children map[string]string
+	watchers []*zooKeeperConn
+}
+
+func newFakeZooKeeper(t *testing.T, children map[string]string) *fakeZooKeeper {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zk := &fakeZooKeeper{listener: listener, children: children}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go zk.serve(&zooKeeperConn{conn: conn, reader: bufio.NewReader(conn)})
+		}
+	}()
+	return zk
+}
+
+func (zk *fakeZooKeeper) serve(conn *zooKeeperConn) {
+	defer conn.conn.Close()
+	if _, err := conn.readPacket(); err != nil {
+		return
+	}
+	var handshake zkWriter
+	handshake.int32(0)
+	handshake.int32(3000)
+	handshake.int64(1)
+	handshake.buffer(make([]byte, 16))
+	conn.send(handshake)
+
+	for {
+		packet, err := conn.readPacket()
+		if err != nil {
+			return
+		}
+		request := &zkReader{data: packet}
+		xid, op := request.int32(), request.int32()
+
+		var reply zkWriter
+		reply.int32(xid)
+		reply.int64(1)
+		reply.int32(0)
+
+		zk.mutex.Lock()
+		switch op {
+		case zkOpGetChildren:
+			request.string()
+			if request.take(1)[0] == 1 {
+				zk.watchers = append(zk.watchers, conn)
+			}
+			reply.int32(int32(len(zk.children)))
+			for name := range zk.children {
+				reply.string(name)
+			}
+		case zkOpGetData:
+			path := request.string()
+			reply.buffer([]byte(zk.children[path[len("/services/web/"):]]))
+		case zkOpClose:
+			zk.mutex.Unlock()
+			return
+		}
+		zk.mutex.Unlock()
+		conn.send(reply)
+	}
+}
+
+// setChildren replaces the children and fires the pending watches.
+func (zk *fakeZooKeeper) setChildren(children map[string]string) {
+	zk.mutex.Lock()
+	defer zk.mutex.Unlock()
+	zk.children = children
+	for _, conn := range zk.watchers {
+		var event zkWriter
+		event.int32(zkXidWatchEvent)
+		event.int64(-1)
+		event.int32(0)
+		event.int32(4) // NodeChildrenChanged
+		event.int32(3) // SyncConnected
+		event.string("/services/web")
+		conn.send(event)
+	}
+	zk.watchers = nil
+}
+
+func TestZooKeeperFollowsChildren(t *testing.T) {
+	zk := newFakeZooKeeper(t, map[string]string{
+		"instance-1": `{"name": "web", "id": "1", "address": "10.0.0.1", "port": 8080}`,
+	})
+	defer zk.listener.Close()
+
+	provider, err := New("zookeeper", json.RawMessage(`{"servers": ["`+zk.listener.Addr().String()+`"], "path": "/services/web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, stop := subscribe(t, provider)
+	defer stop()
+
+	instances := nextUpdate(t, updates)
+	if len(instances) != 1 || instances[0].URL != "http://10.0.0.1:8080" || instances[0].Labels["znode"] != "instance-1" {
+		t.Fatalf("Unexpected instances: %+v", instances)
+	}
+
+	zk.setChildren(map[string]string{
+		"instance-1": `{"name": "web", "id": "1", "address": "10.0.0.1", "port": 8080}`,
+		"instance-2": "10.0.0.2:9090",
+		"garbage":    "not an address",
+	})
+	if urls := instanceURLs(nextUpdate(t, updates)); len(urls) != 2 || urls[1] != "http://10.0.0.2:9090" {
+		t.Errorf("Expected the plain host:port child to be added, got %v", urls)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"loadbalancer/loadbalancer"
 )
 
 func TestLoadBalancerIntegration(t *testing.T) {
@@ -16,12 +18,12 @@ func TestLoadBalancerIntegration(t *testing.T) {
 		w.Write([]byte("backend2"))
 	}))
 	defer backend2.Close()
-	config := Config{
+	config := loadbalancer.Config{
 		Port:     "8080",
-		Backends: []string{backend1.URL, backend2.URL},
+		Backends: []loadbalancer.BackendConfig{{URL: backend1.URL}, {URL: backend2.URL}},
 	}
 
-	lb := NewLoadBalancer(config)
+	lb := loadbalancer.NewLoadBalancer(config)
 	server := httptest.NewServer(lb)
 	defer server.Close()
 
@@ -34,4 +36,4 @@ func TestLoadBalancerIntegration(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", resp.StatusCode)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,267 @@
+// Package jwt verifies JSON Web Tokens (RFC 7519) signed with keys from a
+// JWKS endpoint, a PEM file or a shared secret.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Config selects the keys tokens must be signed with and the claims they
+// must carry. Keys come from exactly one of JWKSURL, KeyFile (a PEM public
+// key or certificate) and Secret (for HMAC). Issuer and Audience are only
+// checked when set; Leeway allows for clock skew in exp and nbf.
+type Config struct {
+	JWKSURL  string
+	KeyFile  string
+	Secret   string
+	Issuer   string
+	Audience []string
+	Leeway   time.Duration
+}
+
+// Claims are the decoded claims of a verified token. Numbers are kept as
+// json.Number.
+type Claims map[string]interface{}
+
+// Verifier checks tokens against a Config.
+type Verifier struct {
+	keys     keySource
+	issuer   string
+	audience []string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func NewVerifier(config Config) (*Verifier, error) {
+	v := &Verifier{
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		leeway:   config.Leeway,
+		now:      time.Now,
+	}
+	switch {
+	case config.JWKSURL != "":
+		v.keys = newJWKS(config.JWKSURL)
+	case config.KeyFile != "":
+		key, err := loadKeyFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = staticKey{key}
+	case config.Secret != "":
+		v.keys = staticKey{[]byte(config.Secret)}
+	default:
+		return nil, errors.New("one of jwks_url, key_file and secret is required")
+	}
+	return v, nil
+}
+
+// Verify checks the signature and the registered claims of token and
+// returns its claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	key, err := v.keys.key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(h.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) checkClaims(claims Claims) error {
+	now := v.now()
+	if exp, ok := claims.time("exp"); ok && !now.Before(exp.Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if len(v.audience) > 0 && !claims.hasAudience(v.audience) {
+		return fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	number, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them,
+// names one of audience.
+func (c Claims) hasAudience(audience []string) bool {
+	var names []string
+	switch aud := c["aud"].(type) {
+	case string:
+		names = []string{aud}
+	case []interface{}:
+		for _, name := range aud {
+			if name, ok := name.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		for _, expected := range audience {
+			if name == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// algorithms are the JWS algorithms (RFC 7518) tokens may be signed with,
+// by key type and hash. "none" is deliberately missing.
+var algorithms = map[string]struct {
+	family string
+	hash   crypto.Hash
+}{
+	"HS256": {"HS", crypto.SHA256},
+	"HS384": {"HS", crypto.SHA384},
+	"HS512": {"HS", crypto.SHA512},
+	"RS256": {"RS", crypto.SHA256},
+	"RS384": {"RS", crypto.SHA384},
+	"RS512": {"RS", crypto.SHA512},
+	"PS256": {"PS", crypto.SHA256},
+	"PS384": {"PS", crypto.SHA384},
+	"PS512": {"PS", crypto.SHA512},
+	"ES256": {"ES", crypto.SHA256},
+	"ES384": {"ES", crypto.SHA384},
+	"ES512": {"ES", crypto.SHA512},
+	"EdDSA": {"EdDSA", 0},
+}
+
+// verifySignature checks signature over signed with key for alg. The key
+// type has to fit the algorithm, so a public key can never be mistaken for
+// an HMAC secret.
+func verifySignature(alg string, key interface{}, signed, signature []byte) error {
+	algorithm, ok := algorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	family, hash := algorithm.family, algorithm.hash
+
+	invalid := errors.New("invalid signature")
+	switch family {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("algorithm %s does not fit the key", alg)
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return invalid
+		}
+		return nil
+	case "RS", "PS":
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s does not fit the key", alg)
+		}
+		digest := hashed(hash, signed)
+		var err error
+		if family == "RS" {
+			err = rsa.VerifyPKCS1v15(public, hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(public, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return invalid
+		}
+		return nil
+	case "ES":
+		public, ok := key.(*ecdsa.PublicKey)
+		size := map[crypto.Hash]int{crypto.SHA256: 32, crypto.SHA384: 48, crypto.SHA512: 66}[hash]
+		if !ok || (public.Curve.Params().BitSize+7)/8 != size {
+			return fmt.Errorf("algorithm %s does not fit the key", alg)
+		}
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(public, hashed(hash, signed), r, s) {
+			return invalid
+		}
+		return nil
+	case "EdDSA":
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s does not fit the key", alg)
+		}
+		if !ed25519.Verify(public, signed, signature) {
+			return invalid
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+func hashed(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
@@ -0,0 +1,192 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encode(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sign builds a token for claims signed by sign.
+func sign(t *testing.T, alg, kid string, claims map[string]interface{}, signer func([]byte) []byte) string {
+	t.Helper()
+	h := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		h["kid"] = kid
+	}
+	signed := encode(h) + "." + encode(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signer([]byte(signed)))
+}
+
+func signRS256(key *rsa.PrivateKey) func([]byte) []byte {
+	return func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return signature
+	}
+}
+
+func signES256(key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+func signHS256(secret []byte) func([]byte) []byte {
+	return func(data []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	verifier, err := NewVerifier(Config{Secret: "secret", Issuer: "https://issuer", Audience: []string{"api"}, Leeway: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for _, test := range []struct {
+		name   string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"valid", map[string]interface{}{"iss": "https://issuer", "aud": "api", "exp": now + 60, "sub": "alice"}, true},
+		{"audience list", map[string]interface{}{"iss": "https://issuer", "aud": []string{"web", "api"}, "exp": now + 60}, true},
+		{"within leeway", map[string]interface{}{"iss": "https://issuer", "aud": "api", "exp": now - 30}, true},
+		{"expired", map[string]interface{}{"iss": "https://issuer", "aud": "api", "exp": now - 120}, false},
+		{"not yet valid", map[string]interface{}{"iss": "https://issuer", "aud": "api", "nbf": now + 120}, false},
+		{"wrong issuer", map[string]interface{}{"iss": "https://other", "aud": "api"}, false},
+		{"wrong audience", map[string]interface{}{"iss": "https://issuer", "aud": "web"}, false},
+	} {
+		token := sign(t, "HS256", "", test.claims, signHS256([]byte("secret")))
+		claims, err := verifier.Verify(token)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected the token to be accepted, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected the token to be rejected", test.name)
+		}
+		if test.name == "valid" && claims["sub"] != "alice" {
+			t.Errorf("Expected the claims of the token, got %v", claims)
+		}
+	}
+
+	forged := sign(t, "HS256", "", map[string]interface{}{"iss": "https://issuer", "aud": "api"}, signHS256([]byte("guess")))
+	if _, err := verifier.Verify(forged); err == nil {
+		t.Error("Expected a token signed with another secret to be rejected")
+	}
+	unsigned := encode(map[string]string{"alg": "none"}) + "." + encode(map[string]string{"iss": "https://issuer", "aud": "api"}) + "."
+	if _, err := verifier.Verify(unsigned); err == nil {
+		t.Error("Expected an unsigned token to be rejected")
+	}
+}
+
+func TestVerifyWithKeyFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pemData, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewVerifier(Config{KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(sign(t, "RS256", "", map[string]interface{}{"sub": "alice"}, signRS256(key))); err != nil {
+		t.Errorf("Expected a token signed with the key to be accepted, got %v", err)
+	}
+	// The public key is no secret; it must not verify HMAC signatures.
+	if _, err := verifier.Verify(sign(t, "HS256", "", map[string]interface{}{"sub": "mallory"}, signHS256(pemData))); err == nil {
+		t.Error("Expected an HMAC token to be rejected for an RSA key")
+	}
+}
+
+func TestVerifyWithJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var fetches atomic.Int32
+	var includeRotated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []map[string]string{
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encodeInt(ecKey.X.Bytes()), "y": encodeInt(ecKey.Y.Bytes())},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(edPublic)},
+			{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+		}
+		if includeRotated.Load() {
+			keys = append(keys, map[string]string{"kty": "EC", "kid": "rotated", "crv": "P-256", "x": encodeInt(rotated.X.Bytes()), "y": encodeInt(rotated.Y.Bytes())})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	verifier, err := NewVerifier(Config{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"sub": "alice"}
+	if _, err := verifier.Verify(sign(t, "ES256", "ec", claims, signES256(ecKey))); err != nil {
+		t.Errorf("Expected an ES256 token to be accepted, got %v", err)
+	}
+	if _, err := verifier.Verify(sign(t, "EdDSA", "ed", claims, func(data []byte) []byte { return ed25519.Sign(edKey, data) })); err != nil {
+		t.Errorf("Expected an EdDSA token to be accepted, got %v", err)
+	}
+	if _, err := verifier.Verify(sign(t, "HS256", "secret", claims, signHS256([]byte("secret")))); err == nil {
+		t.Error("Expected symmetric keys from the JWKS to be ignored")
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("Expected the keys to be fetched once, got %d fetches", fetches.Load())
+	}
+
+	// A key published after the last fetch is picked up once the minimum
+	// interval has passed.
+	includeRotated.Store(true)
+	token := sign(t, "ES256", "rotated", claims, signES256(rotated))
+	if _, err := verifier.Verify(token); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("Expected the new key to be unknown right after a fetch, got %v", err)
+	}
+	verifier.keys.(*jwks).attempted = time.Now().Add(-time.Hour)
+	if _, err := verifier.Verify(token); err != nil {
+		t.Errorf("Expected the new key to be fetched, got %v", err)
+	}
+}
+
+func encodeInt(data []byte) string {
+	padded := make([]byte, 32)
+	copy(padded[32-len(data):], data)
+	return base64.RawURLEncoding.EncodeToString(padded)
+}
@@ -0,0 +1,249 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge is how long fetched keys are used before they are
+	// fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinInterval limits how often a token with an unknown key ID can
+	// make the keys be fetched again.
+	jwksMinInterval = 30 * time.Second
+
+	maxJWKSSize = 1 << 20
+)
+
+type keySource interface {
+	key(kid string) (interface{}, error)
+}
+
+// staticKey is a single key, used whatever key ID a token names.
+type staticKey struct {
+	value interface{}
+}
+
+func (k staticKey) key(string) (interface{}, error) {
+	return k.value, nil
+}
+
+func loadKeyFile(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return key, nil
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return key, nil
+	}
+}
+
+// jwks fetches the keys published at a JWKS URL, again once they are
+// jwksMaxAge old or when a token names a key ID it hasn't seen.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	// fetching serializes fetches, so concurrent requests wait for the one
+	// in progress instead of starting their own.
+	fetching sync.Mutex
+
+	mutex     sync.Mutex
+	keys      map[string]interface{}
+	err       error
+	fetched   time.Time
+	attempted time.Time
+}
+
+func newJWKS(url string) *jwks {
+	return &jwks{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (j *jwks) key(kid string) (interface{}, error) {
+	j.mutex.Lock()
+	_, ok := j.lookup(kid)
+	stale := time.Since(j.fetched) > jwksMaxAge
+	mayFetch := time.Since(j.attempted) > jwksMinInterval
+	j.mutex.Unlock()
+
+	if mayFetch && (!ok || stale) {
+		j.refresh()
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	// Stale keys keep being used while the endpoint fails.
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	if j.err != nil {
+		return nil, fmt.Errorf("fetching keys from %s: %w", j.url, j.err)
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// lookup finds the key with ID kid. Tokens without a key ID match a set
+// with a single key.
+func (j *jwks) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *jwks) refresh() {
+	j.fetching.Lock()
+	defer j.fetching.Unlock()
+	j.mutex.Lock()
+	if time.Since(j.attempted) <= jwksMinInterval {
+		// Fetched by someone else while we were waiting.
+		j.mutex.Unlock()
+		return
+	}
+	j.attempted = time.Now()
+	j.mutex.Unlock()
+
+	keys, err := j.fetch()
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.err = err
+	if err == nil {
+		j.keys = keys
+		j.fetched = time.Now()
+	}
+}
+
+func (j *jwks) fetch() (map[string]interface{}, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unknown types are skipped rather than failing the set.
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
+
+// jsonWebKey is a public key in JWK form (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer/acme"
+	"loadbalancer/loadbalancer"
+	"loadbalancer/logging"
+)
+
+// listener is one public port together with the load balancer serving it.
+type listener struct {
+	port         string
+	mode         string
+	tls          *loadbalancer.ServerTLSConfig
+	http2        *loadbalancer.HTTP2Config
+	http3        *loadbalancer.HTTP3Config
+	certificates *loadbalancer.CertificateStore
+	lb           *loadbalancer.LoadBalancer
+	server       *http.Server
+	// redirect is the plain HTTP server sending clients to the HTTPS one,
+	// if the listener has a redirect_http_port.
+	redirect *http.Server
+	// quic serves HTTP/3 next to an HTTPS listener with http3.
+	quic *loadbalancer.HTTP3Server
+	// tcp accepts the connections of a listener in tcp mode, which has no
+	// server.
+	tcp net.Listener
+	// stopping fails readiness once the process is shutting down.
+	stopping atomic.Bool
+}
+
+// newListeners creates a load balancer for every listener in config. They
+// share a single prober so backends used by several listeners are only
+// probed once per interval; options carry the other process-wide pieces
+// such as metrics and the access log.
+func newListeners(config loadbalancer.Config, options ...loadbalancer.Option) []*listener {
+	options = append([]loadbalancer.Option{loadbalancer.WithProber(loadbalancer.NewProber())}, options...)
+
+	var listeners []*listener
+	for _, listenerConfig := range config.ListenerConfigs() {
+		lb := loadbalancer.NewLoadBalancer(listenerConfig, options...)
+		listeners = append(listeners, &listener{
+			port:  listenerConfig.Port,
+			mode:  listenerConfig.Mode,
+			tls:   listenerConfig.TLS,
+			http2: listenerConfig.HTTP2,
+			http3: listenerConfig.HTTP3,
+			lb:    lb,
+			server: &http.Server{
+				Addr:    ":" + listenerConfig.Port,
+				Handler: lb.Handler(),
+			},
+		})
+	}
+	return listeners
+}
+
+// start serves the listener. certificates, when not nil, provides the ACME
+// certificates of HTTPS listeners and answers http-01 challenges on plain
+// ones.
+func (l *listener) start(certificates *acme.Manager) {
+	if l.mode == loadbalancer.ModeTCP {
+		tcp, err := net.Listen("tcp", ":"+l.port)
+		if err != nil {
+			log.Fatalf("Error starting TCP listener: %v", err)
+		}
+		l.tcp = l.lb.WrapListener(tcp)
+		go func() {
+			logging.Default().Infof("TCP proxy started on port %s", l.port)
+			if err := l.lb.ServeTCP(l.tcp); err != nil {
+				log.Fatalf("Error serving TCP listener: %v", err)
+			}
+		}()
+		return
+	}
+	if l.tls != nil {
+		store, err := loadbalancer.NewCertificateStore(*l.tls)
+		if err != nil {
+			log.Fatalf("Error loading TLS config for port %s: %v", l.port, err)
+		}
+		l.certificates = store
+		tlsConfig := store.TLSConfig()
+		if len(l.tls.ACMEHosts) > 0 {
+			tlsConfig.GetCertificate = acmeCertificates(certificates, l.tls.ACMEHosts, store)
+			tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		}
+		l.server.TLSConfig = tlsConfig
+		if err := l.http2.ConfigureServer(l.server); err != nil {
+			log.Fatalf("Error configuring HTTP/2 for port %s: %v", l.port, err)
+		}
+		if l.http3 != nil {
+			l.quic = l.http3.Server(l.port, l.server.Handler, tlsConfig)
+			l.server.Handler = l.http3.Advertise(l.port, l.server.Handler)
+			go func() {
+				logging.Default().Infof("HTTP/3 started on UDP %s for port %s", l.quic.Addr, l.port)
+				if err := l.quic.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("Error starting HTTP/3 server: %v", err)
+				}
+			}()
+		}
+
+		if l.tls.RedirectHTTPPort != "" {
+			var handler http.Handler = loadbalancer.HTTPSRedirect(l.port)
+			if certificates != nil {
+				handler = certificates.HTTPHandler(handler)
+			}
+			l.redirect = &http.Server{Addr: ":" + l.tls.RedirectHTTPPort, Handler: handler}
+			go func() {
+				logging.Default().Infof("Redirecting port %s to HTTPS on port %s", l.tls.RedirectHTTPPort, l.port)
+				if err := l.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("Error starting redirect server: %v", err)
+				}
+			}()
+		}
+	} else if certificates != nil {
+		l.server.Handler = certificates.HTTPHandler(l.server.Handler)
+	}
+
+	// The listener is wrapped to read PROXY headers when the listener's
+	// proxy_protocol accepts them.
+	inner, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	listener := l.lb.WrapListener(inner)
+	go func() {
+		var err error
+		if l.server.TLSConfig != nil {
+			logging.Default().Infof("Load balancer started on port %s with TLS", l.port)
+			err = l.server.ServeTLS(listener, "", "")
+		} else {
+			logging.Default().Infof("Load balancer started on port %s", l.port)
+			err = l.server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+}
+
+// drain refuses new requests and waits for those in flight to finish
+// until ctx is done.
+func (l *listener) drain(ctx context.Context) {
+	if left, err := l.lb.Shutdown(ctx); err != nil {
+		logging.Default().Warnf("%d requests still in flight on port %s after the shutdown grace period", left, l.port)
+	}
+}
+
+// shutdown stops the listener's servers, waiting for open requests to
+// finish until ctx is done.
+func (l *listener) shutdown(ctx context.Context) error {
+	if l.tcp != nil {
+		return l.tcp.Close()
+	}
+	if l.redirect != nil {
+		if err := l.redirect.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if err := l.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if l.quic != nil {
+		return l.quic.Shutdown(ctx)
+	}
+	return nil
+}
+
+// maxConcurrentStreams returns the HTTP/2 stream limit of config, 0 for
+// the default.
+func maxConcurrentStreams(config *loadbalancer.HTTP2Config) uint32 {
+	if config == nil {
+		return 0
+	}
+	return config.MaxConcurrentStreams
+}
+
+// acmeCertificates asks certificates for the ACME hosts. Other names get
+// the certificates from disk in static, if there are any.
+func acmeCertificates(certificates *acme.Manager, hosts []string, static *loadbalancer.CertificateStore) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.TrimSuffix(hello.ServerName, ".")
+		if !slices.ContainsFunc(hosts, func(host string) bool { return strings.EqualFold(host, name) }) {
+			if cert, err := static.GetCertificate(hello); cert != nil || err != nil {
+				return cert, err
+			}
+		}
+		return certificates.GetCertificate(hello)
+	}
+}
+
+// reloadCertificates reads the certificates of every HTTPS listener from
+// disk again. New handshakes use them right away.
+func reloadCertificates(listeners []*listener) {
+	for _, l := range listeners {
+		if l.certificates == nil {
+			continue
+		}
+		if err := l.certificates.Reload(); err != nil {
+			logging.Default().Errorf("Error reloading TLS certificates for port %s, keeping the current ones: %v", l.port, err)
+			continue
+		}
+		logging.Default().Infof("Reloaded TLS certificates for port %s", l.port)
+	}
+}
+
+// certificateFiles returns the files the certificates of listeners are
+// read from.
+func certificateFiles(listeners []*listener) []string {
+	var files []string
+	for _, l := range listeners {
+		if l.certificates != nil {
+			files = append(files, l.certificates.Files()...)
+		}
+	}
+	return files
+}
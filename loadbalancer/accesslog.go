@@ -0,0 +1,175 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/logging"
+)
+
+// AccessLogConfig enables the JSON access log. Path is the file lines are
+// appended to; empty or "-" means standard output. Disabled turns the log
+// off without removing the section. With Sample set to N only one in N
+// successful requests is logged, while failed ones (4xx and 5xx) and those
+// slower than SlowRequestThreshold always are. Rotate applies to Path.
+type AccessLogConfig struct {
+	Path                 string          `json:"path,omitempty"`
+	Disabled             bool            `json:"disabled,omitempty"`
+	Sample               int             `json:"sample,omitempty"`
+	SlowRequestThreshold Duration        `json:"slow_request_threshold,omitempty"`
+	Rotate               *RotationConfig `json:"rotate,omitempty"`
+}
+
+// RotationConfig rotates a log file once it grows past MaxSizeMB or has
+// been written to for Every, keeping MaxBackups rotated files (0 keeps all).
+type RotationConfig struct {
+	MaxSizeMB  int      `json:"max_size_mb,omitempty"`
+	Every      Duration `json:"every,omitempty"`
+	MaxBackups int      `json:"max_backups,omitempty"`
+}
+
+func (c *RotationConfig) Rotation() logging.Rotation {
+	if c == nil {
+		return logging.Rotation{}
+	}
+	return logging.Rotation{
+		MaxSize:    int64(c.MaxSizeMB) << 20,
+		Every:      time.Duration(c.Every),
+		MaxBackups: c.MaxBackups,
+	}
+}
+
+// AccessLog writes one JSON line per request. It is safe to share between
+// listeners.
+type AccessLog struct {
+	jsonLog
+
+	sample        uint64
+	slowThreshold time.Duration
+	successes     atomic.Uint64
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Listener  string    `json:"listener"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Backend   string    `json:"backend,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	Bytes     int64     `json:"bytes"`
+	Slow      bool      `json:"slow,omitempty"`
+}
+
+// OpenAccessLog opens the destination described by config. It returns nil
+// when the access log is disabled.
+func OpenAccessLog(config *AccessLogConfig) (*AccessLog, error) {
+	if config == nil || config.Disabled {
+		return nil, nil
+	}
+	accessLog := NewAccessLog(os.Stdout)
+	if config.Path != "" && config.Path != "-" {
+		file, err := logging.OpenFile(config.Path, 0644, config.Rotate.Rotation())
+		if err != nil {
+			return nil, err
+		}
+		accessLog = &AccessLog{jsonLog: jsonLog{out: file, closer: file}}
+	}
+	if config.Sample > 1 {
+		accessLog.sample = uint64(config.Sample)
+	}
+	accessLog.slowThreshold = time.Duration(config.SlowRequestThreshold)
+	return accessLog, nil
+}
+
+func NewAccessLog(out io.Writer) *AccessLog {
+	return &AccessLog{jsonLog: jsonLog{out: out}}
+}
+
+// Close closes the log file, if the access log opened one.
+func (a *AccessLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.jsonLog.close()
+}
+
+// WithAccessLog makes the load balancer write every request to accessLog.
+func WithAccessLog(accessLog *AccessLog) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessLog = accessLog
+	}
+}
+
+func (a *AccessLog) record(listener string, r *http.Request, backend *Backend, recorder *responseRecorder, start time.Time) {
+	if a == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	slow := a.slowThreshold > 0 && elapsed >= a.slowThreshold
+	if !slow && !a.sampled(recorder.status) {
+		return
+	}
+
+	entry := accessLogEntry{
+		Time:      start.UTC(),
+		Listener:  listener,
+		RequestID: r.Header.Get(RequestIDHeader),
+		ClientIP:  clientIP(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    recorder.status,
+		LatencyMs: float64(elapsed.Microseconds()) / 1000,
+		Bytes:     recorder.written,
+		Slow:      slow,
+	}
+	if backend != nil {
+		entry.Backend = backend.URL.String()
+	}
+
+	if err := a.write(entry); err != nil {
+		logging.Default().Errorf("Error writing access log: %v", err)
+	}
+}
+
+// jsonLog appends JSON values to a writer, one per line.
+type jsonLog struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+func (l *jsonLog) write(value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.out.Write(line)
+	return err
+}
+
+func (l *jsonLog) close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// sampled reports whether a request that was not slow gets logged.
+func (a *AccessLog) sampled(status int) bool {
+	if a.sample == 0 || status >= http.StatusBadRequest {
+		return true
+	}
+	return (a.successes.Add(1)-1)%a.sample == 0
+}
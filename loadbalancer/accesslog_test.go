@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/items" {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	var out bytes.Buffer
+	lb := NewLoadBalancer(Config{
+		Port:     "8080",
+		Backends: []BackendConfig{{URL: backend.URL}},
+	}, WithAccessLog(NewAccessLog(&out)))
+	defer lb.Close()
+
+	r := httptest.NewRequest("POST", "/items?id=1", nil)
+	r.RemoteAddr = "192.0.2.10:51234"
+	r.Header.Set(RequestIDHeader, "abc-123")
+	lb.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected one JSON line, got %q: %v", out.String(), err)
+	}
+	if entry.Listener != "8080" || entry.RequestID != "abc-123" || entry.ClientIP != "192.0.2.10" || entry.Method != "POST" || entry.Path != "/items" {
+		t.Errorf("Unexpected request fields in %+v", entry)
+	}
+	if entry.Status != http.StatusCreated || entry.Backend != backend.URL || entry.Bytes != 5 {
+		t.Errorf("Unexpected response fields in %+v", entry)
+	}
+	if entry.Time.IsZero() || entry.LatencyMs <= 0 {
+		t.Errorf("Expected time and latency to be set, got %+v", entry)
+	}
+}
+
+func TestOpenAccessLog(t *testing.T) {
+	if accessLog, err := OpenAccessLog(&AccessLogConfig{Disabled: true}); accessLog != nil || err != nil {
+		t.Errorf("Expected a disabled access log to be nil, got %v, %v", accessLog, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := OpenAccessLog(&AccessLogConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(Config{}, WithAccessLog(accessLog))
+	defer lb.Close()
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	accessLog.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry accessLogEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Status != http.StatusServiceUnavailable || entry.Backend != "" {
+		t.Errorf("Expected a 503 without backend in the file, got %q", data)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var out bytes.Buffer
+	accessLog := NewAccessLog(&out)
+	accessLog.sample = 3
+	accessLog.slowThreshold = 50 * time.Millisecond
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 6; i++ {
+		accessLog.record("8080", r, nil, &responseRecorder{status: http.StatusOK}, time.Now())
+	}
+	accessLog.record("8080", r, nil, &responseRecorder{status: http.StatusNotFound}, time.Now())
+	accessLog.record("8080", r, nil, &responseRecorder{status: http.StatusOK}, time.Now().Add(-time.Second))
+
+	var statuses []int
+	var slow []bool
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, entry.Status)
+		slow = append(slow, entry.Slow)
+	}
+	if fmt.Sprint(statuses) != "[200 200 404 200]" || fmt.Sprint(slow) != "[false false false true]" {
+		t.Errorf("Expected two sampled successes, the 404 and the slow request, got %v %v", statuses, slow)
+	}
+}
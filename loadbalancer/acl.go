@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// AccessControlConfig limits which clients may use a listener or route.
+// Entries are CIDR ranges or single addresses. Clients matching Deny are
+// refused, and when Allow is set so is every client it doesn't match.
+type AccessControlConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+type accessList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// denyAll refuses every client; it stands in for an access list that
+// failed to parse.
+var denyAll = &accessList{allow: []netip.Prefix{}}
+
+func (c *AccessControlConfig) compile() (*accessList, error) {
+	if c == nil {
+		return nil, nil
+	}
+	allow, err := parsePrefixes(c.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := parsePrefixes(c.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	if len(allow) == 0 {
+		allow = nil
+	}
+	return &accessList{allow: allow, deny: deny}, nil
+}
+
+// allows reports whether ip may pass. A nil list allows everyone; an
+// address that could not be determined only passes a nil list.
+func (a *accessList) allows(ip netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	if !ip.IsValid() || containsAddr(a.deny, ip) {
+		return false
+	}
+	return a.allow == nil || containsAddr(a.allow, ip)
+}
+
+// parsePrefixes parses CIDR ranges, taking a plain address as a range of
+// just that address.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or CIDR range %q", entry)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR range %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessControl(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:       []BackendConfig{{URL: backend.URL}},
+		AccessControl:  &AccessControlConfig{Allow: []string{"10.0.0.0/8", "192.0.2.1"}, Deny: []string{"10.1.0.0/16"}},
+		TrustedProxies: []string{"192.0.2.0/24"},
+		Routes: []RouteConfig{{
+			ServerNames:   []string{"admin.example.com"},
+			Backends:      []BackendConfig{{URL: backend.URL}},
+			AccessControl: &AccessControlConfig{Allow: []string{"10.1.0.0/16", "10.2.0.0/16"}},
+		}},
+	})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		name, target, remoteAddr, forwardedFor string
+		expected                               int
+	}{
+		{"allowed", "http://example.com/", "10.0.0.1:1234", "", http.StatusOK},
+		{"not allowed", "http://example.com/", "172.16.0.1:1234", "", http.StatusForbidden},
+		{"denied", "http://example.com/", "10.1.2.3:1234", "", http.StatusForbidden},
+		{"single address", "http://example.com/", "192.0.2.1:1234", "", http.StatusOK},
+		{"behind trusted proxy", "http://example.com/", "192.0.2.10:1234", "10.1.2.3, 10.0.0.1, 192.0.2.11", http.StatusOK},
+		{"denied behind trusted proxy", "http://example.com/", "192.0.2.10:1234", "10.0.0.1, 10.1.2.3", http.StatusForbidden},
+		{"untrusted proxy", "http://example.com/", "172.16.0.1:1234", "10.0.0.1", http.StatusForbidden},
+		{"route allowed", "https://admin.example.com/", "10.2.0.1:1234", "", http.StatusOK},
+		{"route not allowed", "https://admin.example.com/", "10.3.0.1:1234", "", http.StatusForbidden},
+		{"route behind listener", "https://admin.example.com/", "10.1.0.1:1234", "", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		recorder := httptest.NewRecorder()
+		lb.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expected, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package loadbalancer
+
+import (
+	"io"
+	"time"
+
+	"loadbalancer/logging"
+)
+
+// Audit actions recorded by the balancer.
+const (
+	AuditConfigReloaded      = "config_reloaded"
+	AuditListenerReloaded    = "listener_reloaded"
+	AuditBackendAdded        = "backend_added"
+	AuditBackendRemoved      = "backend_removed"
+	AuditWeightChanged       = "weight_changed"
+	AuditBackendDrained      = "backend_drained"
+	AuditBackendResumed      = "backend_resumed"
+	AuditFaultsEnabled       = "faults_enabled"
+	AuditFaultsDisabled      = "faults_disabled"
+	AuditMaintenanceEnabled  = "maintenance_enabled"
+	AuditMaintenanceDisabled = "maintenance_disabled"
+	AuditCanaryRamped        = "canary_ramped"
+	AuditCanaryPromoted      = "canary_promoted"
+	AuditCanaryRolledBack    = "canary_rolled_back"
+	AuditPoolSwitched        = "pool_switched"
+)
+
+// AuditLogConfig sets the file administrative actions are appended to and
+// how it is rotated.
+type AuditLogConfig struct {
+	Path   string          `json:"path"`
+	Rotate *RotationConfig `json:"rotate,omitempty"`
+}
+
+// AuditEvent is one administrative action. Actor says what triggered it,
+// e.g. a signal, the config watcher or a DNS refresh; Before and After hold
+// the values it changed.
+type AuditEvent struct {
+	Time     time.Time   `json:"time"`
+	Actor    string      `json:"actor"`
+	Action   string      `json:"action"`
+	Listener string      `json:"listener,omitempty"`
+	Target   string      `json:"target,omitempty"`
+	Before   interface{} `json:"before,omitempty"`
+	After    interface{} `json:"after,omitempty"`
+}
+
+// AuditLog is an append-only JSON lines record of control-plane actions.
+// A nil *AuditLog discards events.
+type AuditLog struct {
+	jsonLog
+}
+
+// OpenAuditLog opens the audit file for appending, creating it readable by
+// its owner only. It returns nil when config is nil.
+func OpenAuditLog(config *AuditLogConfig) (*AuditLog, error) {
+	if config == nil {
+		return nil, nil
+	}
+	file, err := logging.OpenFile(config.Path, 0600, config.Rotate.Rotation())
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{jsonLog{out: file, closer: file}}, nil
+}
+
+func NewAuditLog(out io.Writer) *AuditLog {
+	return &AuditLog{jsonLog{out: out}}
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.jsonLog.close()
+}
+
+// Record appends event, stamping it with the current time when it has none.
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if err := a.write(event); err != nil {
+		logging.Default().Errorf("Error writing audit log: %v", err)
+	}
+}
+
+// WithAuditLog records changes to the pool, such as backends joining or
+// leaving and weight changes, in auditLog.
+func WithAuditLog(auditLog *AuditLog) Option {
+	return func(lb *LoadBalancer) {
+		lb.auditLog = auditLog
+	}
+}
+
+// auditedBackend is how a backend appears in before and after values.
+type auditedBackend struct {
+	URL    string            `json:"url"`
+	Weight int               `json:"weight"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
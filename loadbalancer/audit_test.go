@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditPoolChanges(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	var out bytes.Buffer
+	lb := NewLoadBalancer(Config{
+		Port:     "8080",
+		Backends: []BackendConfig{{URL: first.URL}},
+	}, WithAuditLog(NewAuditLog(&out)))
+	defer lb.Close()
+	if out.Len() != 0 {
+		t.Fatalf("Expected the initial pool not to be audited, got %q", out.String())
+	}
+
+	lb.Reload(Config{Port: "8080", Backends: []BackendConfig{{URL: first.URL, Weight: 3}, {URL: second.URL}}})
+	lb.Reload(Config{Port: "8080", Backends: []BackendConfig{{URL: second.URL}}})
+
+	var events []AuditEvent
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Actor != "config reload" || event.Listener != "8080" || event.Time.IsZero() {
+			t.Errorf("Expected actor, listener and time to be set, got %+v", event)
+		}
+		events = append(events, event)
+	}
+
+	expected := []struct {
+		action, target string
+	}{
+		{AuditWeightChanged, first.URL},
+		{AuditBackendAdded, second.URL},
+		{AuditBackendRemoved, first.URL},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), events)
+	}
+	for i, want := range expected {
+		if events[i].Action != want.action || events[i].Target != want.target {
+			t.Errorf("Expected event %d to be %s of %s, got %+v", i, want.action, want.target, events[i])
+		}
+	}
+	if events[0].Before != float64(1) || events[0].After != float64(3) {
+		t.Errorf("Expected the weight to change from 1 to 3, got %v to %v", events[0].Before, events[0].After)
+	}
+	if before, _ := events[2].Before.(map[string]interface{}); before["weight"] != float64(3) {
+		t.Errorf("Expected the removed backend's last weight, got %v", events[2].Before)
+	}
+}
@@ -0,0 +1,196 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultAuthRealm    = "httpbalance"
+
+	// AuthenticatedUserHeader tells backends which basic auth user a
+	// request was let in as.
+	AuthenticatedUserHeader = "X-Authenticated-User"
+
+	passwordHashPrefix = "sha256:"
+)
+
+// AuthConfig puts basic auth or API keys in front of a listener or route.
+// Users maps user names to passwords, given as is or as "sha256:" and the
+// hex digest; UsersFile holds more of them as "user:password" lines.
+// APIKeys and the lines of APIKeysFile are accepted in APIKeyHeader
+// (X-API-Key by default). A request needs any one valid credential.
+type AuthConfig struct {
+	Realm        string            `json:"realm,omitempty"`
+	Users        map[string]string `json:"users,omitempty"`
+	UsersFile    string            `json:"users_file,omitempty"`
+	APIKeys      []string          `json:"api_keys,omitempty"`
+	APIKeysFile  string            `json:"api_keys_file,omitempty"`
+	APIKeyHeader string            `json:"api_key_header,omitempty"`
+}
+
+func (c *AuthConfig) validate() error {
+	if len(c.Users) == 0 && c.UsersFile == "" && len(c.APIKeys) == 0 && c.APIKeysFile == "" {
+		return fmt.Errorf("one of users, users_file, api_keys and api_keys_file is required")
+	}
+	for user, password := range c.Users {
+		if _, err := passwordDigest(password); err != nil {
+			return fmt.Errorf("users.%s: %v", user, err)
+		}
+	}
+	return nil
+}
+
+// credentials holds the digests of what an AuthConfig accepts, so that
+// comparisons take the same time whatever the client sent.
+type credentials struct {
+	realm     string
+	users     map[string][]byte
+	keys      [][]byte
+	keyHeader string
+}
+
+func newCredentials(config *AuthConfig) (*credentials, error) {
+	if config == nil {
+		return nil, nil
+	}
+	c := &credentials{realm: config.Realm, users: map[string][]byte{}, keyHeader: config.APIKeyHeader}
+	if c.realm == "" {
+		c.realm = defaultAuthRealm
+	}
+	if c.keyHeader == "" {
+		c.keyHeader = defaultAPIKeyHeader
+	}
+	// Credentials that failed to load accept nobody.
+	fail := func(err error) (*credentials, error) {
+		return &credentials{realm: c.realm, keyHeader: c.keyHeader}, err
+	}
+
+	users := config.Users
+	if config.UsersFile != "" {
+		lines, err := readLines(config.UsersFile)
+		if err != nil {
+			return fail(err)
+		}
+		users = make(map[string]string, len(config.Users)+len(lines))
+		for user, password := range config.Users {
+			users[user] = password
+		}
+		for i, line := range lines {
+			user, password, ok := strings.Cut(line, ":")
+			if !ok {
+				return fail(fmt.Errorf("%s:%d: expected user:password", config.UsersFile, i+1))
+			}
+			users[user] = password
+		}
+	}
+	for user, password := range users {
+		digest, err := passwordDigest(password)
+		if err != nil {
+			return fail(fmt.Errorf("password of %s: %w", user, err))
+		}
+		c.users[user] = digest
+	}
+
+	keys := config.APIKeys
+	if config.APIKeysFile != "" {
+		lines, err := readLines(config.APIKeysFile)
+		if err != nil {
+			return fail(err)
+		}
+		keys = append(append([]string(nil), keys...), lines...)
+	}
+	for _, key := range keys {
+		digest := sha256.Sum256([]byte(key))
+		c.keys = append(c.keys, digest[:])
+	}
+	return c, nil
+}
+
+// passwordDigest returns the SHA-256 digest of a configured password.
+func passwordDigest(password string) ([]byte, error) {
+	if encoded, ok := strings.CutPrefix(password, passwordHashPrefix); ok {
+		digest, err := hex.DecodeString(encoded)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s hash", strings.TrimSuffix(passwordHashPrefix, ":"))
+		}
+		return digest, nil
+	}
+	digest := sha256.Sum256([]byte(password))
+	return digest[:], nil
+}
+
+// readLines returns the non-empty lines of path that aren't comments.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// authenticate returns the user r authenticated as, which is empty for an
+// API key, and whether its credentials are valid.
+func (c *credentials) authenticate(r *http.Request) (string, bool) {
+	if key := r.Header.Get(c.keyHeader); key != "" {
+		digest := sha256.Sum256([]byte(key))
+		valid := 0
+		for _, expected := range c.keys {
+			valid |= subtle.ConstantTimeCompare(digest[:], expected)
+		}
+		return "", valid == 1
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, known := c.users[user]
+	digest := sha256.Sum256([]byte(password))
+	if !known {
+		// Compare anyway, so unknown users take as long as wrong passwords.
+		expected = make([]byte, sha256.Size)
+	}
+	return user, subtle.ConstantTimeCompare(digest[:], expected) == 1 && known
+}
+
+// admitAuth answers 401 to requests without valid credentials. The
+// credentials are removed before the request is proxied, and backends learn
+// the basic auth user from AuthenticatedUserHeader.
+func (lb *LoadBalancer) admitAuth(c *credentials, w http.ResponseWriter, r *http.Request) bool {
+	if c == nil {
+		return true
+	}
+	r.Header.Del(AuthenticatedUserHeader)
+	user, ok := c.authenticate(r)
+	if !ok {
+		lb.logger.Debugf("Rejecting request %s: missing or invalid credentials", r.Header.Get(RequestIDHeader))
+		if len(c.users) > 0 {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", c.realm))
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	r.Header.Del(c.keyHeader)
+	if user != "" {
+		r.Header.Del("Authorization")
+		r.Header.Set(AuthenticatedUserHeader, user)
+	}
+	return true
+}
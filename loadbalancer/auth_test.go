@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	usersFile := filepath.Join(dir, "users")
+	keysFile := filepath.Join(dir, "keys")
+	if err := os.WriteFile(usersFile, []byte("# tools team\ncarol:from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keysFile, []byte("key-from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("hashed"))
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Auth: &AuthConfig{
+			Realm:       "tools",
+			Users:       map[string]string{"alice": "plain", "bob": passwordHashPrefix + hex.EncodeToString(digest[:])},
+			UsersFile:   usersFile,
+			APIKeys:     []string{"key-from-config"},
+			APIKeysFile: keysFile,
+		},
+		Routes: []RouteConfig{{
+			ServerNames: []string{"ci.example.com"},
+			Backends:    []BackendConfig{{URL: backend.URL}},
+			Auth:        &AuthConfig{APIKeys: []string{"ci-key"}, APIKeyHeader: "X-CI-Token"},
+		}},
+	})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		name, target, user, password, header, key string
+		expected                                  int
+	}{
+		{"plain password", "http://example.com/", "alice", "plain", "", "", http.StatusOK},
+		{"hashed password", "http://example.com/", "bob", "hashed", "", "", http.StatusOK},
+		{"user from file", "http://example.com/", "carol", "from-file", "", "", http.StatusOK},
+		{"wrong password", "http://example.com/", "alice", "hashed", "", "", http.StatusUnauthorized},
+		{"unknown user", "http://example.com/", "mallory", "plain", "", "", http.StatusUnauthorized},
+		{"api key", "http://example.com/", "", "", "X-API-Key", "key-from-config", http.StatusOK},
+		{"api key from file", "http://example.com/", "", "", "X-API-Key", "key-from-file", http.StatusOK},
+		{"wrong api key", "http://example.com/", "", "", "X-API-Key", "guess", http.StatusUnauthorized},
+		{"nothing", "http://example.com/", "", "", "", "", http.StatusUnauthorized},
+		{"route key", "https://ci.example.com/", "", "", "X-CI-Token", "ci-key", http.StatusOK},
+		{"listener user on route", "https://ci.example.com/", "alice", "plain", "", "", http.StatusUnauthorized},
+	} {
+		received = nil
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Header.Set(AuthenticatedUserHeader, "admin")
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		if test.header != "" {
+			req.Header.Set(test.header, test.key)
+		}
+		recorder := httptest.NewRecorder()
+		lb.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expected, recorder.Code)
+			continue
+		}
+		if test.expected != http.StatusOK {
+			continue
+		}
+		if received.Get("Authorization") != "" || (test.header != "" && received.Get(test.header) != "") {
+			t.Errorf("%s: expected the credentials to be removed before proxying", test.name)
+		}
+		if received.Get(AuthenticatedUserHeader) != test.user {
+			t.Errorf("%s: expected %s to be %q, got %q", test.name, AuthenticatedUserHeader, test.user, received.Get(AuthenticatedUserHeader))
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	lb.ServeHTTP(recorder, httptest.NewRequest("GET", "http://example.com/", nil))
+	if recorder.Header().Get("WWW-Authenticate") != `Basic realm="tools"` {
+		t.Errorf("Expected a basic auth challenge, got %q", recorder.Header().Get("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,150 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Backend struct {
+	URL    *url.URL
+	Labels map[string]string
+
+	proxy    *httputil.ReverseProxy
+	checker  healthChecker
+	probeKey string
+	identity string
+
+	// weight and currentWeight drive smooth weighted round-robin and are
+	// guarded by the load balancer's mutex.
+	weight        int
+	currentWeight int
+	// maxActive caps active (0 means no limit); guarded by the load
+	// balancer's mutex like weight.
+	maxActive int
+
+	// active counts in-flight requests; accessed atomically.
+	active int64
+	stats  requestStats
+
+	mutex   sync.Mutex
+	healthy bool
+	passed  bool
+	ejected bool
+	removed bool
+	window  *outcomeWindow
+	breaker *circuitBreaker
+
+	// drainConfig and drainAdmin say whether the config or the admin API
+	// drain the backend. drained is cancelled once the requests in flight
+	// ran out of time to finish, by drainTimer.
+	drainConfig bool
+	drainAdmin  bool
+	drainTimer  *time.Timer
+	drained     context.Context
+	abort       context.CancelFunc
+}
+
+func newBackend(backendURL *url.URL, maxConnections int, tlsConfig *tls.Config, timeouts *TimeoutsConfig, http2 *BackendHTTP2Config, streaming *StreamingConfig) *Backend {
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	proxy.FlushInterval = streaming.flushInterval()
+	if http2 != nil {
+		proxy.Transport = newHTTP2Transport(tlsConfig, timeouts, http2)
+	} else if maxConnections > 0 || tlsConfig != nil || timeouts != nil || streaming != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxConnsPerHost = maxConnections
+		// Decompressing would hold back what the backend streams.
+		transport.DisableCompression = streaming != nil
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig.Clone()
+		}
+		if timeouts != nil {
+			timeouts.apply(transport)
+		}
+		proxy.Transport = transport
+	}
+	drained, abort := context.WithCancel(context.Background())
+	return &Backend{
+		URL:     backendURL,
+		proxy:   proxy,
+		healthy: true,
+		drained: drained,
+		abort:   abort,
+	}
+}
+
+// hasCapacity reports whether the backend may take another request under
+// its max_concurrent_requests. The caller holds the load balancer's mutex.
+func (b *Backend) hasCapacity() bool {
+	return b.maxActive <= 0 || atomic.LoadInt64(&b.active) < int64(b.maxActive)
+}
+
+// available reports whether the backend may receive traffic. During the
+// startup grace period a backend that has never passed a probe is still
+// eligible, so the balancer can come up before its backends.
+func (b *Backend) available(inGrace bool) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.ejected || b.removed || b.drainConfig || b.drainAdmin {
+		return false
+	}
+	return b.healthy || (inGrace && !b.passed)
+}
+
+// allowedByCircuit reports whether the backend's circuit lets a request
+// through.
+func (b *Backend) allowedByCircuit(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.breaker == nil || b.breaker.allows(now)
+}
+
+func (b *Backend) admitByCircuit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.breaker != nil {
+		b.breaker.admit()
+	}
+}
+
+// circuit returns the state of the backend's circuit, "" without a
+// circuit breaker.
+func (b *Backend) circuit() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.breaker == nil {
+		return ""
+	}
+	return b.breaker.state
+}
+
+// setCircuitBreaker keeps the backend's circuit across reloads that leave
+// the config alone.
+func (b *Backend) setCircuitBreaker(config *CircuitBreakerConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if config == nil {
+		b.breaker = nil
+		return
+	}
+	if b.breaker == nil || b.breaker.config != config.withDefaults() {
+		b.breaker = newCircuitBreaker(*config)
+	}
+}
+
+func (b *Backend) setOutlierWindow(outlier *OutlierDetectionConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if outlier == nil {
+		b.window = nil
+		return
+	}
+	if b.window == nil || b.window.width != time.Duration(outlier.Window)/outlierWindowBuckets {
+		b.window = newOutcomeWindow(time.Duration(outlier.Window))
+	}
+}
@@ -0,0 +1,183 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+
+	defaultBreakerConsecutiveFailures = 5
+	defaultBreakerErrorThreshold      = 0.5
+	defaultBreakerMinRequests         = 20
+	defaultBreakerWindow              = 10 * time.Second
+	defaultBreakerCoolDown            = 30 * time.Second
+	defaultBreakerHalfOpenRequests    = 1
+)
+
+// CircuitBreakerConfig opens a backend's circuit after ConsecutiveFailures
+// failed requests in a row (default 5), or once ErrorThreshold of its
+// requests in Window failed (default half of 10s, after at least
+// MinRequests, default 20). An open circuit gets no requests for CoolDown
+// (default 30s); then HalfOpenRequests trial requests (default 1) are let
+// through, which close it again if they all succeed and reopen it if one
+// fails.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures,omitempty"`
+	ErrorThreshold      float64  `json:"error_threshold,omitempty"`
+	MinRequests         int      `json:"min_requests,omitempty"`
+	Window              Duration `json:"window,omitempty"`
+	CoolDown            Duration `json:"cool_down,omitempty"`
+	HalfOpenRequests    int      `json:"half_open_requests,omitempty"`
+}
+
+func (c *CircuitBreakerConfig) validate() error {
+	if c.ConsecutiveFailures < 0 {
+		return errors.New("consecutive_failures: must not be negative")
+	}
+	if c.ErrorThreshold < 0 || c.ErrorThreshold > 1 {
+		return errors.New("error_threshold: must be between 0 and 1")
+	}
+	if c.MinRequests < 0 {
+		return errors.New("min_requests: must not be negative")
+	}
+	if c.Window < 0 {
+		return errors.New("window: must not be negative")
+	}
+	if c.CoolDown < 0 {
+		return errors.New("cool_down: must not be negative")
+	}
+	if c.HalfOpenRequests < 0 {
+		return errors.New("half_open_requests: must not be negative")
+	}
+	return nil
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = defaultBreakerConsecutiveFailures
+	}
+	if c.ErrorThreshold == 0 {
+		c.ErrorThreshold = defaultBreakerErrorThreshold
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = defaultBreakerMinRequests
+	}
+	if c.Window == 0 {
+		c.Window = Duration(defaultBreakerWindow)
+	}
+	if c.CoolDown == 0 {
+		c.CoolDown = Duration(defaultBreakerCoolDown)
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return c
+}
+
+// circuitBreaker is a backend's circuit. It is guarded by the backend's
+// mutex.
+type circuitBreaker struct {
+	config      CircuitBreakerConfig
+	state       string
+	consecutive int
+	window      *outcomeWindow
+	// changed is when the circuit last opened or went half-open.
+	changed time.Time
+	// trials and passed count the requests let through while half-open
+	// and those of them that succeeded.
+	trials int
+	passed int
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	config = config.withDefaults()
+	return &circuitBreaker{config: config, state: CircuitClosed, window: newOutcomeWindow(time.Duration(config.Window))}
+}
+
+// allows reports whether the circuit lets a request through at now, going
+// half-open once an open circuit has cooled down. A half-open circuit
+// whose trial requests never finished allows new ones after another
+// cool-down.
+func (cb *circuitBreaker) allows(now time.Time) bool {
+	coolDown := time.Duration(cb.config.CoolDown)
+	switch cb.state {
+	case CircuitOpen:
+		if now.Sub(cb.changed) < coolDown {
+			return false
+		}
+		cb.state, cb.changed, cb.trials, cb.passed = CircuitHalfOpen, now, 0, 0
+	case CircuitHalfOpen:
+		if cb.trials >= cb.config.HalfOpenRequests && now.Sub(cb.changed) >= coolDown {
+			cb.changed, cb.trials, cb.passed = now, 0, 0
+		}
+	}
+	return cb.state == CircuitClosed || cb.trials < cb.config.HalfOpenRequests
+}
+
+// admit counts a request sent through a half-open circuit.
+func (cb *circuitBreaker) admit() {
+	if cb.state == CircuitHalfOpen {
+		cb.trials++
+	}
+}
+
+// record feeds in the outcome of a request and returns the state the
+// circuit moved to, or "" if it stayed as it was, with the reason.
+func (cb *circuitBreaker) record(now time.Time, failed bool) (string, string) {
+	switch cb.state {
+	case CircuitClosed:
+		cb.window.record(now, failed)
+		if !failed {
+			cb.consecutive = 0
+			return "", ""
+		}
+		cb.consecutive++
+		total, failures := cb.window.counts(now)
+		if cb.consecutive >= cb.config.ConsecutiveFailures {
+			return cb.open(now), fmt.Sprintf("%d requests in a row failed", cb.consecutive)
+		}
+		if total >= cb.config.MinRequests && float64(failures)/float64(total) >= cb.config.ErrorThreshold {
+			return cb.open(now), fmt.Sprintf("%d of %d requests failed", failures, total)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			return cb.open(now), "a trial request failed"
+		}
+		cb.passed++
+		if cb.passed >= cb.config.HalfOpenRequests {
+			cb.state, cb.consecutive = CircuitClosed, 0
+			cb.window.reset()
+			return CircuitClosed, "trial requests succeeded"
+		}
+	}
+	return "", ""
+}
+
+func (cb *circuitBreaker) open(now time.Time) string {
+	cb.state, cb.changed = CircuitOpen, now
+	return CircuitOpen
+}
+
+// recordCircuit feeds the result of a proxied request into the backend's
+// circuit breaker, if it has one, and logs when the circuit changes.
+func (lb *LoadBalancer) recordCircuit(backend *Backend, failed bool) {
+	backend.mutex.Lock()
+	if backend.breaker == nil {
+		backend.mutex.Unlock()
+		return
+	}
+	state, reason := backend.breaker.record(time.Now(), failed)
+	backend.mutex.Unlock()
+
+	switch state {
+	case CircuitOpen:
+		lb.logger.Warnf("Circuit of backend %s opened, %s", backend.URL.String(), reason)
+	case CircuitClosed:
+		lb.logger.Infof("Circuit of backend %s closed, %s", backend.URL.String(), reason)
+	}
+}
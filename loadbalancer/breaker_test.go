@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerConfig{ConsecutiveFailures: 3, CoolDown: Duration(time.Minute), HalfOpenRequests: 2})
+	now := time.Now()
+
+	cb.record(now, true)
+	cb.record(now, true)
+	cb.record(now, false)
+	cb.record(now, true)
+	if state, _ := cb.record(now, true); state != "" {
+		t.Fatalf("Expected a success to reset the count of failures in a row, circuit went %s", state)
+	}
+	if state, _ := cb.record(now, true); state != CircuitOpen {
+		t.Fatalf("Expected the circuit to open after 3 failures in a row, got %q", state)
+	}
+	if cb.allows(now.Add(59 * time.Second)) {
+		t.Error("Expected an open circuit to let no requests through while cooling down")
+	}
+
+	later := now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if !cb.allows(later) {
+			t.Fatalf("Expected trial request %d through the half-open circuit", i+1)
+		}
+		cb.admit()
+	}
+	if cb.allows(later) {
+		t.Error("Expected no more than 2 trial requests")
+	}
+	if state, _ := cb.record(later, true); state != CircuitOpen {
+		t.Errorf("Expected a failed trial to reopen the circuit, got %q", state)
+	}
+
+	later = later.Add(time.Minute)
+	cb.allows(later)
+	cb.admit()
+	cb.record(later, false)
+	if state, _ := cb.record(later, false); state != CircuitClosed {
+		t.Errorf("Expected the circuit to close after its trials succeeded, got %q", state)
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerConfig{ConsecutiveFailures: 100, ErrorThreshold: 0.5, MinRequests: 4})
+	now := time.Now()
+	cb.record(now, true)
+	cb.record(now, false)
+	cb.record(now, true)
+	if state, _ := cb.record(now, false); state != "" {
+		t.Fatalf("Expected the circuit to stay closed on a success, got %q", state)
+	}
+	if state, _ := cb.record(now, true); state != CircuitOpen {
+		t.Errorf("Expected the circuit to open with 3 of 5 requests failed, got %q", state)
+	}
+}
+
+func TestCircuitBreakerSkipsFailingBackend(t *testing.T) {
+	var failures atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		failures.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer working.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:       []BackendConfig{{URL: failing.URL}, {URL: working.URL}},
+		CircuitBreaker: &CircuitBreakerConfig{ConsecutiveFailures: 2},
+	})
+	defer lb.Close()
+
+	for i := 0; i < 20; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if failures.Load() != 2 {
+		t.Errorf("Expected the failing backend to be skipped once its circuit opened, it got %d requests", failures.Load())
+	}
+	for _, stats := range lb.Stats(time.Minute) {
+		if stats.URL == failing.URL && stats.Circuit != CircuitOpen {
+			t.Errorf("Expected stats to show the open circuit, got %q", stats.Circuit)
+		}
+	}
+}
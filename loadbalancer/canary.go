@@ -0,0 +1,267 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	defaultCanaryInterval             = 5 * time.Minute
+	defaultCanaryMinRequests          = 100
+	defaultCanaryMaxErrorRateIncrease = 0.01
+	defaultCanaryMaxLatencyRatio      = 1.5
+
+	CanaryRamping    = "ramping"
+	CanaryPromoted   = "promoted"
+	CanaryRolledBack = "rolled_back"
+)
+
+var defaultCanarySteps = []int{10, 25, 50, 100}
+
+// CanaryConfig rolls a split's canary pool out step by step, comparing it
+// with the baseline pool. The canary gets each of Steps percent of the
+// traffic in turn (default 10, 25, 50 and 100) and the baseline the rest,
+// whatever weights the two pools are given. Every Interval (default 5m),
+// once the canary served MinRequests (default 100) in it, the canary moves
+// to the next step, unless its error rate exceeds the baseline's by more
+// than MaxErrorRateIncrease (default 0.01) or its p95 latency is over
+// MaxLatencyRatio (default 1.5) times the baseline's: then it is rolled
+// back to no traffic. Canary defaults to the last pool and Baseline to the
+// first. A rollout starts over when the split changes and at startup.
+type CanaryConfig struct {
+	Canary               string   `json:"canary,omitempty"`
+	Baseline             string   `json:"baseline,omitempty"`
+	Steps                []int    `json:"steps,omitempty"`
+	Interval             Duration `json:"interval,omitempty"`
+	MinRequests          int      `json:"min_requests,omitempty"`
+	MaxErrorRateIncrease float64  `json:"max_error_rate_increase,omitempty"`
+	MaxLatencyRatio      float64  `json:"max_latency_ratio,omitempty"`
+}
+
+func (c *CanaryConfig) validate(pools []SplitPool) error {
+	names := make(map[string]bool)
+	for _, pool := range pools {
+		names[pool.Name] = true
+	}
+	if c.Canary != "" && !names[c.Canary] {
+		return fmt.Errorf("canary: no pool is named %q", c.Canary)
+	}
+	if c.Baseline != "" && !names[c.Baseline] {
+		return fmt.Errorf("baseline: no pool is named %q", c.Baseline)
+	}
+	if len(pools) > 0 {
+		defaults := c.withDefaults(pools)
+		if defaults.Canary == defaults.Baseline {
+			return errors.New("canary: must differ from the baseline pool")
+		}
+	}
+	for i, step := range c.Steps {
+		if step < 1 || step > 100 || i > 0 && step <= c.Steps[i-1] {
+			return errors.New("steps: must rise from 1 to at most 100")
+		}
+	}
+	if c.Interval < 0 {
+		return errors.New("interval: must not be negative")
+	}
+	if c.MinRequests < 0 {
+		return errors.New("min_requests: must not be negative")
+	}
+	if c.MaxErrorRateIncrease < 0 || c.MaxErrorRateIncrease > 1 {
+		return errors.New("max_error_rate_increase: must be between 0 and 1")
+	}
+	if c.MaxLatencyRatio != 0 && c.MaxLatencyRatio < 1 {
+		return errors.New("max_latency_ratio: must be at least 1")
+	}
+	return nil
+}
+
+func (c CanaryConfig) withDefaults(pools []SplitPool) CanaryConfig {
+	if c.Canary == "" {
+		c.Canary = pools[len(pools)-1].Name
+	}
+	if c.Baseline == "" {
+		c.Baseline = pools[0].Name
+	}
+	if len(c.Steps) == 0 {
+		c.Steps = defaultCanarySteps
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(defaultCanaryInterval)
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = defaultCanaryMinRequests
+	}
+	if c.MaxErrorRateIncrease == 0 {
+		c.MaxErrorRateIncrease = defaultCanaryMaxErrorRateIncrease
+	}
+	if c.MaxLatencyRatio == 0 {
+		c.MaxLatencyRatio = defaultCanaryMaxLatencyRatio
+	}
+	return c
+}
+
+// canaryRollout is the progress of a split's canary. Its step and state
+// are guarded by the load balancer's mutex.
+type canaryRollout struct {
+	split  SplitConfig
+	config CanaryConfig
+	step   int
+	state  string
+	stop   chan struct{}
+}
+
+// canaryWeight returns the percentage of traffic the canary gets.
+func (rollout *canaryRollout) canaryWeight() int {
+	if rollout.state == CanaryRolledBack {
+		return 0
+	}
+	return rollout.config.Steps[rollout.step]
+}
+
+// syncCanary starts the rollout of config's canary, keeping the one in
+// progress if the split is unchanged, and gives the pools their weights.
+func (lb *LoadBalancer) syncCanary(config Config) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	previous := lb.canary
+	if previous != nil && config.Split != nil && reflect.DeepEqual(previous.split, *config.Split) {
+		lb.setCanaryWeights(previous)
+		return
+	}
+	if previous != nil {
+		close(previous.stop)
+		lb.canary = nil
+	}
+	if config.Split == nil || config.Split.Canary == nil {
+		return
+	}
+	rollout := &canaryRollout{
+		split:  *config.Split,
+		config: config.Split.Canary.withDefaults(config.Split.Pools),
+		state:  CanaryRamping,
+		stop:   make(chan struct{}),
+	}
+	lb.canary = rollout
+	lb.setCanaryWeights(rollout)
+	lb.logger.Infof("Starting the rollout of canary pool %s with %d%% of traffic", rollout.config.Canary, rollout.canaryWeight())
+	go lb.runCanary(rollout)
+}
+
+// setCanaryWeights gives the canary and baseline pools their share of the
+// traffic. lb.mutex must be held.
+func (lb *LoadBalancer) setCanaryWeights(rollout *canaryRollout) {
+	canary, baseline := lb.canaryPools(rollout)
+	if canary == nil || baseline == nil {
+		return
+	}
+	canary.weight.Store(int64(rollout.canaryWeight()))
+	baseline.weight.Store(int64(100 - rollout.canaryWeight()))
+}
+
+// canaryPools returns the canary and baseline pools of the rollout.
+// lb.mutex must be held.
+func (lb *LoadBalancer) canaryPools(rollout *canaryRollout) (canary, baseline *route) {
+	for _, route := range lb.routes {
+		if !route.split {
+			continue
+		}
+		switch route.name {
+		case rollout.config.Canary:
+			canary = route
+		case rollout.config.Baseline:
+			baseline = route
+		}
+	}
+	return canary, baseline
+}
+
+func (lb *LoadBalancer) runCanary(rollout *canaryRollout) {
+	ticker := time.NewTicker(time.Duration(rollout.config.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.done:
+			return
+		case <-rollout.stop:
+			return
+		case <-ticker.C:
+			if !lb.evaluateCanary(rollout) {
+				return
+			}
+		}
+	}
+}
+
+// evaluateCanary compares the canary with the baseline over the last
+// interval and ramps it up or rolls it back. It reports whether the
+// rollout goes on.
+func (lb *LoadBalancer) evaluateCanary(rollout *canaryRollout) bool {
+	lb.mutex.Lock()
+	if lb.canary != rollout || rollout.state != CanaryRamping {
+		lb.mutex.Unlock()
+		return false
+	}
+	canaryPool, baselinePool := lb.canaryPools(rollout)
+	lb.mutex.Unlock()
+	if canaryPool == nil || baselinePool == nil {
+		return false
+	}
+
+	now, window := time.Now(), time.Duration(rollout.config.Interval)
+	canary, baseline := canaryPool.lb.poolSummary(now, window), baselinePool.lb.poolSummary(now, window)
+	if canary.Requests < rollout.config.MinRequests {
+		lb.logger.Debugf("Canary pool %s served %d requests, waiting for %d", rollout.config.Canary, canary.Requests, rollout.config.MinRequests)
+		return true
+	}
+	regression := ""
+	if canary.ErrorRate-baseline.ErrorRate > rollout.config.MaxErrorRateIncrease {
+		regression = fmt.Sprintf("error rate %.2f%% against %.2f%%", canary.ErrorRate*100, baseline.ErrorRate*100)
+	} else if baseline.Requests > 0 && canary.LatencyMs.P95 > baseline.LatencyMs.P95*rollout.config.MaxLatencyRatio {
+		regression = fmt.Sprintf("p95 latency %.1fms against %.1fms", canary.LatencyMs.P95, baseline.LatencyMs.P95)
+	}
+
+	lb.mutex.Lock()
+	if lb.canary != rollout {
+		lb.mutex.Unlock()
+		return false
+	}
+	action := AuditCanaryRamped
+	if regression != "" {
+		rollout.state, action = CanaryRolledBack, AuditCanaryRolledBack
+	} else {
+		if rollout.step+1 < len(rollout.config.Steps) {
+			rollout.step++
+		}
+		if rollout.step == len(rollout.config.Steps)-1 {
+			rollout.state, action = CanaryPromoted, AuditCanaryPromoted
+		}
+	}
+	lb.setCanaryWeights(rollout)
+	weight, state := rollout.canaryWeight(), rollout.state
+	lb.mutex.Unlock()
+
+	switch state {
+	case CanaryRolledBack:
+		lb.logger.Warnf("Rolling back canary pool %s: %s", rollout.config.Canary, regression)
+	case CanaryPromoted:
+		lb.logger.Infof("Promoted canary pool %s to %d%% of traffic", rollout.config.Canary, weight)
+	default:
+		lb.logger.Infof("Ramping canary pool %s up to %d%% of traffic", rollout.config.Canary, weight)
+	}
+	lb.auditLog.Record(AuditEvent{Actor: "canary rollout", Action: action, Listener: lb.listener, Target: rollout.config.Canary})
+	return state == CanaryRamping
+}
+
+// poolSummary adds up the traffic of the pool's backends over window.
+func (lb *LoadBalancer) poolSummary(now time.Time, window time.Duration) BackendStats {
+	lb.mutex.Lock()
+	stats := make([]*requestStats, len(lb.pool))
+	for i, backend := range lb.pool {
+		stats[i] = &backend.stats
+	}
+	lb.mutex.Unlock()
+	return summarize(now, window, stats...)
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func canaryTestConfig() Config {
+	return Config{Split: &SplitConfig{
+		Pools: []SplitPool{
+			{Name: "stable", Backends: []BackendConfig{{URL: "http://stable:80"}}},
+			{Name: "canary", Backends: []BackendConfig{{URL: "http://canary:80"}}},
+		},
+		Canary: &CanaryConfig{Steps: []int{10, 50, 100}, Interval: Duration(time.Hour), MinRequests: 10},
+	}}
+}
+
+// recordTraffic records requests on every backend of the split pool with
+// the given name.
+func recordTraffic(t *testing.T, lb *LoadBalancer, pool string, requests, errors int, latency time.Duration) {
+	t.Helper()
+	for _, route := range lb.routeSnapshot() {
+		if route.name != pool {
+			continue
+		}
+		for _, backend := range route.lb.pool {
+			for i := 0; i < requests; i++ {
+				backend.stats.record(time.Now(), latency, i < errors)
+			}
+		}
+		return
+	}
+	t.Fatalf("No pool named %s", pool)
+}
+
+func canaryWeights(lb *LoadBalancer) map[string]int64 {
+	weights := map[string]int64{}
+	for _, route := range lb.routeSnapshot() {
+		weights[route.name] = route.weight.Load()
+	}
+	return weights
+}
+
+func TestCanaryPromotion(t *testing.T) {
+	lb := NewLoadBalancer(canaryTestConfig())
+	defer lb.Close()
+	rollout := lb.canary
+
+	if weights := canaryWeights(lb); weights["canary"] != 10 || weights["stable"] != 90 {
+		t.Fatalf("Expected the canary to start at 10%%, got %v", weights)
+	}
+	if !lb.evaluateCanary(rollout) || canaryWeights(lb)["canary"] != 10 {
+		t.Errorf("Expected the canary to wait for enough requests, got %v", canaryWeights(lb))
+	}
+
+	recordTraffic(t, lb, "stable", 100, 1, 10*time.Millisecond)
+	recordTraffic(t, lb, "canary", 20, 0, 11*time.Millisecond)
+	if !lb.evaluateCanary(rollout) || canaryWeights(lb)["canary"] != 50 {
+		t.Errorf("Expected the canary to ramp up to 50%%, got %v", canaryWeights(lb))
+	}
+
+	// A reload leaving the split alone keeps the rollout going.
+	lb.Reload(canaryTestConfig())
+	if lb.canary != rollout || canaryWeights(lb)["canary"] != 50 {
+		t.Errorf("Expected the reload to keep the canary at 50%%, got %v", canaryWeights(lb))
+	}
+
+	if lb.evaluateCanary(rollout) || rollout.state != CanaryPromoted {
+		t.Errorf("Expected the canary to be promoted, got %s", rollout.state)
+	}
+	if weights := canaryWeights(lb); weights["canary"] != 100 || weights["stable"] != 0 {
+		t.Errorf("Expected the canary to get all traffic, got %v", weights)
+	}
+}
+
+func TestCanaryRollback(t *testing.T) {
+	for name, canary := range map[string]struct {
+		errors  int
+		latency time.Duration
+	}{
+		"errors":  {5, 10 * time.Millisecond},
+		"latency": {0, 100 * time.Millisecond},
+	} {
+		lb := NewLoadBalancer(canaryTestConfig())
+		rollout := lb.canary
+		recordTraffic(t, lb, "stable", 100, 0, 10*time.Millisecond)
+		recordTraffic(t, lb, "canary", 20, canary.errors, canary.latency)
+
+		if lb.evaluateCanary(rollout) || rollout.state != CanaryRolledBack {
+			t.Errorf("Expected a regression in %s to roll the canary back, got %s", name, rollout.state)
+		}
+		if weights := canaryWeights(lb); weights["canary"] != 0 || weights["stable"] != 100 {
+			t.Errorf("Expected the baseline to get all traffic back, got %v", weights)
+		}
+
+		config := canaryTestConfig()
+		config.Split.Canary.Steps = []int{5, 100}
+		lb.Reload(config)
+		if lb.canary == rollout || canaryWeights(lb)["canary"] != 5 {
+			t.Errorf("Expected a changed split to start a new rollout, got %v", canaryWeights(lb))
+		}
+		lb.Close()
+	}
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	ClientCertSubjectHeader = "X-Client-Cert-Subject"
+	ClientCertSANHeader     = "X-Client-Cert-SAN"
+)
+
+// setClientCertHeaders replaces whatever the client sent in the client
+// certificate headers with the subject and subject alternative names of
+// the certificate it authenticated with, if it was verified. It is only
+// called for TLS connections, which nothing in front of us can have
+// added the headers to.
+func setClientCertHeaders(r *http.Request) {
+	r.Header.Del(ClientCertSubjectHeader)
+	r.Header.Del(ClientCertSANHeader)
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	r.Header.Set(ClientCertSubjectHeader, cert.Subject.String())
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, address := range cert.EmailAddresses {
+		names = append(names, "email:"+address)
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	if len(names) > 0 {
+		r.Header.Set(ClientCertSANHeader, strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// clientIP returns the address of the client that sent r: the one resolved
+// through trusted proxies when the load balancer has done so, otherwise the
+// peer's.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok && ip.IsValid() {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withClientIP resolves the client address of r once and keeps it with the
+// request for access control and logging.
+func withClientIP(r *http.Request, trusted []netip.Prefix) (*http.Request, netip.Addr) {
+	if ip, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return r, ip
+	}
+	ip := resolveClientIP(r, trusted)
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)), ip
+}
+
+// resolveClientIP returns the peer address, unless the peer is a trusted
+// proxy. Then X-Forwarded-For is followed from the right, past the hops
+// that are trusted as well, to the first one that isn't; X-Real-IP is used
+// when there is no X-Forwarded-For.
+func resolveClientIP(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	ip := peer.Addr().Unmap()
+	if !containsAddr(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = r.Header.Values("X-Real-IP")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Anything left of a malformed entry can't be trusted.
+			break
+		}
+		ip = hop.Unmap()
+		if !containsAddr(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// setForwardedHeaders prepares the X-Forwarded-* headers of r for the
+// backend. Values from a trusted proxy are passed on; anyone else's are
+// replaced. The proxy appends the peer to X-Forwarded-For afterwards.
+func setForwardedHeaders(r *http.Request, trusted []netip.Prefix) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !containsAddr(trusted, peer.Addr()) {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+	}
+	r.Header.Set("X-Real-IP", clientIP(r))
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+}
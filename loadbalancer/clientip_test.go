@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL}}, TrustedProxies: []string{"192.0.2.0/24"}})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		name, target, remoteAddr string
+		expected                 map[string]string
+	}{
+		{"untrusted peer", "http://example.com/", "198.51.100.7:1234", map[string]string{
+			"X-Forwarded-For":   "198.51.100.7",
+			"X-Real-Ip":         "198.51.100.7",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "example.com",
+		}},
+		{"trusted proxy", "http://internal:8080/", "192.0.2.10:1234", map[string]string{
+			"X-Forwarded-For":   "203.0.113.5, 192.0.2.10",
+			"X-Real-Ip":         "203.0.113.5",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "www.example.com",
+		}},
+	} {
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+		req.Header.Set("X-Real-IP", "203.0.113.5")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "www.example.com")
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+		for name, expected := range test.expected {
+			if got := received.Get(name); got != expected {
+				t.Errorf("%s: expected %s to be %q, got %q", test.name, name, expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig gzips responses for clients that accept it. Only
+// responses whose Content-Type is in ContentTypes ("text/*" matches a whole
+// type) and, when their length is known, of at least MinSize bytes are
+// compressed, at Level (1 to 9). Responses the backend already encoded are
+// passed on as they are, and so are event streams.
+type CompressionConfig struct {
+	ContentTypes []string `json:"content_types,omitempty"`
+	MinSize      int64    `json:"min_size,omitempty"`
+	Level        int      `json:"level,omitempty"`
+}
+
+const defaultCompressionMinSize = 1024
+
+var defaultCompressedTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+func (c *CompressionConfig) validate() error {
+	for i, contentType := range c.ContentTypes {
+		mediaType, subtype, ok := strings.Cut(contentType, "/")
+		if !ok || mediaType == "" || mediaType == "*" || subtype == "" {
+			return fmt.Errorf("content_types[%d]: %q must be a type/subtype or type/*", i, contentType)
+		}
+	}
+	if c.MinSize < 0 {
+		return errors.New("min_size: must not be negative")
+	}
+	if c.Level < 0 || c.Level > gzip.BestCompression {
+		return errors.New("level: must be between 1 and 9")
+	}
+	return nil
+}
+
+// compresses reports whether responses of contentType are compressed.
+func (c *CompressionConfig) compresses(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressedTypes
+	}
+	for _, allowed := range types {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CompressionConfig) minSize() int64 {
+	if c.MinSize == 0 {
+		return defaultCompressionMinSize
+	}
+	return c.MinSize
+}
+
+// acceptsGzip reports whether an Accept-Encoding header lets the response
+// be gzipped.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil || q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressWriter gzips the response on its way to the client once it is
+// known to qualify. Responses of unknown length are held back until they
+// reach the minimum size, are flushed or end.
+type compressWriter struct {
+	http.ResponseWriter
+	config *CompressionConfig
+
+	status  int
+	decided bool
+	buffer  []byte
+	gzip    *gzip.Writer
+}
+
+func newCompressWriter(w http.ResponseWriter, config *CompressionConfig) *compressWriter {
+	return &compressWriter{ResponseWriter: w, config: config}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 || status < http.StatusOK {
+		if w.status == 0 {
+			w.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+	w.status = status
+	header := w.Header()
+	switch {
+	case status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent,
+		header.Get("Content-Encoding") != "",
+		!w.config.compresses(header.Get("Content-Type")):
+		w.passThrough()
+	case header.Get("Content-Length") != "":
+		if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length >= w.config.minSize() {
+			w.compress()
+		} else {
+			w.passThrough()
+		}
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gzip != nil {
+		return w.gzip.Write(data)
+	}
+	if w.decided {
+		return w.ResponseWriter.Write(data)
+	}
+	w.buffer = append(w.buffer, data...)
+	if int64(len(w.buffer)) >= w.config.minSize() {
+		w.compress()
+	}
+	return len(data), nil
+}
+
+// Flush starts compressing a response still held back, since the writer
+// wants it on its way.
+func (w *compressWriter) Flush() {
+	if w.status != 0 && !w.decided {
+		w.compress()
+	}
+	if w.gzip != nil {
+		w.gzip.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) passThrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buffer) > 0 {
+		w.ResponseWriter.Write(w.buffer)
+		w.buffer = nil
+	}
+}
+
+func (w *compressWriter) compress() {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	// The compressed body is no longer byte for byte what a strong
+	// validator promises.
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	level := w.config.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gzip, _ = gzip.NewWriterLevel(w.ResponseWriter, level)
+	if len(w.buffer) > 0 {
+		w.gzip.Write(w.buffer)
+		w.buffer = nil
+	}
+}
+
+// Close finishes the response: it completes the gzip stream, or sends a
+// response held back that stayed too small to compress.
+func (w *compressWriter) Close() {
+	switch {
+	case w.gzip != nil:
+		w.gzip.Close()
+	case w.status != 0 && !w.decided:
+		w.passThrough()
+	}
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	text := strings.Repeat("compress me ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "tiny")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, text)
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, text)
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: "+text+"\n\n")
+		case "/chunked":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"a":1}`)
+			w.(http.Flusher).Flush()
+			io.WriteString(w, `{"b":2}`)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, text)
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:    []BackendConfig{{URL: backend.URL}},
+		Compression: &CompressionConfig{},
+	})
+	defer lb.Close()
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path, acceptEncoding string) (*http.Response, string) {
+		t.Helper()
+		request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		var body io.Reader = response.Body
+		if response.Header.Get("Content-Encoding") == "gzip" {
+			if body, err = gzip.NewReader(response.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, string(data)
+	}
+
+	response, body := get("/", "br, gzip;q=0.8")
+	if response.Header.Get("Content-Encoding") != "gzip" || body != text {
+		t.Errorf("Expected a gzipped page, got %q with %d bytes", response.Header.Get("Content-Encoding"), len(body))
+	}
+	if response.Header.Get("Vary") != "Accept-Encoding" || response.Header.Get("ETag") != `W/"v1"` {
+		t.Errorf("Expected Vary and a weak ETag, got %v", response.Header)
+	}
+	if response, body := get("/chunked", "gzip"); response.Header.Get("Content-Encoding") != "gzip" || body != `{"a":1}{"b":2}` {
+		t.Errorf("Expected a flushed response of unknown length to be gzipped, got %q %q", response.Header.Get("Content-Encoding"), body)
+	}
+
+	for path, acceptEncoding := range map[string]string{
+		"/":        "gzip;q=0, identity",
+		"/small":   "gzip",
+		"/image":   "gzip",
+		"/events":  "gzip",
+		"/encoded": "gzip, br",
+	} {
+		response, body := get(path, acceptEncoding)
+		encoding := response.Header.Get("Content-Encoding")
+		if path == "/encoded" {
+			if encoding != "br" || body != text {
+				t.Errorf("Expected the backend's own encoding to be passed on, got %q", encoding)
+			}
+		} else if encoding != "" {
+			t.Errorf("Expected %s with Accept-Encoding %q not to be compressed, got %q", path, acceptEncoding, encoding)
+		}
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for _, config := range []CompressionConfig{
+		{ContentTypes: []string{"json"}},
+		{ContentTypes: []string{"*/*"}},
+		{MinSize: -1},
+		{Level: 10},
+	} {
+		if err := config.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", config)
+		}
+	}
+	config := CompressionConfig{ContentTypes: []string{"application/*"}}
+	if err := config.validate(); err != nil || !config.compresses("application/x-ndjson") || config.compresses("text/plain") {
+		t.Errorf("Expected application/* to match only application types, got %v", err)
+	}
+}
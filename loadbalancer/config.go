@@ -0,0 +1,432 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"loadbalancer/acme"
+	"loadbalancer/discovery"
+	"loadbalancer/statsd"
+	"loadbalancer/tracing"
+)
+
+// Config describes a listener and its backend pool. The top-level config
+// may additionally define more Listeners, each with its own port, pool and
+// strategy; AdminPort, FailFastOnStart, AccessLog, AuditLog, LogLevel,
+// LogOutput, Tracing, StatusPage, DebugEndpoints, StatsD, ACME, AdminOIDC
+// and Shutdown are only read from the top level. When every backend is at its
+// max_concurrent_requests, a request waits up to BackendQueueTimeout for
+// one to free up before it is answered with 503.
+type Config struct {
+	Port                string                  `json:"port"`
+	Mode                string                  `json:"mode,omitempty"`
+	TLS                 *ServerTLSConfig        `json:"tls,omitempty"`
+	ProxyProtocol       *ProxyProtocolConfig    `json:"proxy_protocol,omitempty"`
+	AdminPort           string                  `json:"admin_port,omitempty"`
+	Backends            []BackendConfig         `json:"backends"`
+	BackendTLS          *ClientTLSConfig        `json:"backend_tls,omitempty"`
+	Strategy            string                  `json:"strategy,omitempty"`
+	HealthCheck         HealthCheckConfig       `json:"health_check"`
+	OutlierDetection    *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+	BackendQueueTimeout Duration                `json:"backend_queue_timeout,omitempty"`
+	DrainTimeout        Duration                `json:"drain_timeout,omitempty"`
+	Retry               *RetryConfig            `json:"retry,omitempty"`
+	CircuitBreaker      *CircuitBreakerConfig   `json:"circuit_breaker,omitempty"`
+	Timeouts            *TimeoutsConfig         `json:"timeouts,omitempty"`
+	Hedge               *HedgeConfig            `json:"hedge,omitempty"`
+	GRPC                *GRPCConfig             `json:"grpc,omitempty"`
+	HTTP2               *HTTP2Config            `json:"http2,omitempty"`
+	HTTP3               *HTTP3Config            `json:"http3,omitempty"`
+	BackendHTTP2        *BackendHTTP2Config     `json:"backend_http2,omitempty"`
+	WebSocket           *WebSocketConfig        `json:"websocket,omitempty"`
+	Streaming           *StreamingConfig        `json:"streaming,omitempty"`
+	Compression         *CompressionConfig      `json:"compression,omitempty"`
+	Fault               *FaultConfig            `json:"fault,omitempty"`
+	Mirror              *MirrorConfig           `json:"mirror,omitempty"`
+	Maintenance         *MaintenanceConfig      `json:"maintenance,omitempty"`
+	Fallback            *FallbackConfig         `json:"fallback,omitempty"`
+	Redirect            *RedirectConfig         `json:"redirect,omitempty"`
+	Static              *StaticConfig           `json:"static,omitempty"`
+	Split               *SplitConfig            `json:"split,omitempty"`
+	Experiment          *ExperimentConfig       `json:"experiment,omitempty"`
+	ErrorPages          *ErrorPagesConfig       `json:"error_pages,omitempty"`
+	Rewrite             *RewriteConfig          `json:"rewrite,omitempty"`
+	RequestHeaders      *HeaderRules            `json:"request_headers,omitempty"`
+	ResponseHeaders     *HeaderRules            `json:"response_headers,omitempty"`
+	SecurityHeaders     *SecurityHeadersConfig  `json:"security_headers,omitempty"`
+	AccessControl       *AccessControlConfig    `json:"access_control,omitempty"`
+	TrustedProxies      []string                `json:"trusted_proxies,omitempty"`
+	RequestLimits       *RequestLimitsConfig    `json:"request_limits,omitempty"`
+	Decompression       *DecompressionConfig    `json:"decompression,omitempty"`
+	ConcurrencyLimit    *ConcurrencyLimitConfig `json:"concurrency_limit,omitempty"`
+	RateLimit           *RateLimitConfig        `json:"rate_limit,omitempty"`
+	CORS                *CORSConfig             `json:"cors,omitempty"`
+	WAF                 *WAFConfig              `json:"waf,omitempty"`
+	JWT                 *JWTConfig              `json:"jwt,omitempty"`
+	Auth                *AuthConfig             `json:"auth,omitempty"`
+	OIDC                *OIDCConfig             `json:"oidc,omitempty"`
+	FailFastOnStart     bool                    `json:"fail_fast_on_start,omitempty"`
+	AccessLog           *AccessLogConfig        `json:"access_log,omitempty"`
+	AuditLog            *AuditLogConfig         `json:"audit_log,omitempty"`
+	LogLevel            string                  `json:"log_level,omitempty"`
+	LogOutput           *LogOutputConfig        `json:"log_output,omitempty"`
+	Tracing             *tracing.Config         `json:"tracing,omitempty"`
+	StatusPage          *StatusPageConfig       `json:"status_page,omitempty"`
+	DebugEndpoints      bool                    `json:"debug_endpoints,omitempty"`
+	StatsD              *statsd.Config          `json:"statsd,omitempty"`
+	ACME                *acme.Config            `json:"acme,omitempty"`
+	AdminOIDC           *OIDCConfig             `json:"admin_oidc,omitempty"`
+	Shutdown            *ShutdownConfig         `json:"shutdown,omitempty"`
+	HealthWebhooks      []string                `json:"health_webhooks,omitempty"`
+	Defaults            *DefaultsConfig         `json:"defaults,omitempty"`
+	Routes              []RouteConfig           `json:"routes,omitempty"`
+	Listeners           []Config                `json:"listeners,omitempty"`
+}
+
+// DefaultsConfig holds settings shared by every listener. A listener's own
+// settings override the defaults field by field, and a backend's
+// health_check overrides the listener's in turn.
+type DefaultsConfig struct {
+	BackendTLS       *ClientTLSConfig        `json:"backend_tls,omitempty"`
+	Strategy         string                  `json:"strategy,omitempty"`
+	HealthCheck      HealthCheckConfig       `json:"health_check"`
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+	Retry            *RetryConfig            `json:"retry,omitempty"`
+	CircuitBreaker   *CircuitBreakerConfig   `json:"circuit_breaker,omitempty"`
+	Timeouts         *TimeoutsConfig         `json:"timeouts,omitempty"`
+	ErrorPages       *ErrorPagesConfig       `json:"error_pages,omitempty"`
+	SecurityHeaders  *SecurityHeadersConfig  `json:"security_headers,omitempty"`
+	TrustedProxies   []string                `json:"trusted_proxies,omitempty"`
+	RequestLimits    *RequestLimitsConfig    `json:"request_limits,omitempty"`
+	ConcurrencyLimit *ConcurrencyLimitConfig `json:"concurrency_limit,omitempty"`
+	RateLimit        *RateLimitConfig        `json:"rate_limit,omitempty"`
+}
+
+// resolve returns the config with its defaults applied.
+func (c Config) resolve() Config {
+	defaults := c.Defaults
+	if defaults == nil {
+		return c
+	}
+	c.Defaults = nil
+
+	if c.BackendTLS == nil {
+		c.BackendTLS = defaults.BackendTLS
+	}
+	if c.Strategy == "" {
+		c.Strategy = defaults.Strategy
+	}
+	c.HealthCheck = defaults.HealthCheck.merge(&c.HealthCheck)
+	if c.OutlierDetection == nil {
+		c.OutlierDetection = defaults.OutlierDetection
+	}
+	if c.Retry == nil {
+		c.Retry = defaults.Retry
+	}
+	if c.CircuitBreaker == nil {
+		c.CircuitBreaker = defaults.CircuitBreaker
+	}
+	if c.Timeouts == nil {
+		c.Timeouts = defaults.Timeouts
+	}
+	if c.ErrorPages == nil {
+		c.ErrorPages = defaults.ErrorPages
+	}
+	if c.SecurityHeaders == nil {
+		c.SecurityHeaders = defaults.SecurityHeaders
+	}
+	if c.TrustedProxies == nil {
+		c.TrustedProxies = defaults.TrustedProxies
+	}
+	if c.RequestLimits == nil {
+		c.RequestLimits = defaults.RequestLimits
+	}
+	if c.ConcurrencyLimit == nil {
+		c.ConcurrencyLimit = defaults.ConcurrencyLimit
+	}
+	if c.RateLimit == nil {
+		c.RateLimit = defaults.RateLimit
+	}
+	return c
+}
+
+// ListenerConfigs returns one config per listener, with the top-level
+// defaults applied: the top-level one when it sets a port, followed by the
+// entries of Listeners.
+func (c Config) ListenerConfigs() []Config {
+	var listeners []Config
+	if c.Port != "" {
+		top := c
+		top.Listeners = nil
+		listeners = append(listeners, top.resolve())
+	}
+	for _, listener := range c.Listeners {
+		if listener.Defaults == nil {
+			listener.Defaults = c.Defaults
+		}
+		listeners = append(listeners, listener.resolve())
+	}
+	return listeners
+}
+
+// ACMEHosts returns the hostnames every listener wants certificates for
+// from the ACME CA.
+func (c Config) ACMEHosts() []string {
+	var hosts []string
+	for _, listener := range c.ListenerConfigs() {
+		if listener.TLS != nil {
+			hosts = append(hosts, listener.TLS.ACMEHosts...)
+		}
+	}
+	return hosts
+}
+
+// LogOutputConfig sends the balancer's own logs to a rotated File or to
+// Syslog instead of standard error.
+type LogOutputConfig struct {
+	File   string          `json:"file,omitempty"`
+	Rotate *RotationConfig `json:"rotate,omitempty"`
+	Syslog *SyslogConfig   `json:"syslog,omitempty"`
+}
+
+// SyslogConfig selects a syslog daemon: the local one when Network and
+// Address are empty, otherwise a remote one over "udp" or "tcp". Facility
+// defaults to "daemon".
+type SyslogConfig struct {
+	Network  string `json:"network,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Facility string `json:"facility,omitempty"`
+}
+
+// StatusPageConfig enables the HTML status page on the admin listener,
+// behind basic auth with the given credentials.
+type StatusPageConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// BackendConfig describes one backend. In config files it can be written
+// either as a plain URL string or as an object. Weight defaults to 1,
+// MaxConnections caps the connections opened to the backend and
+// MaxConcurrentRequests the requests in flight to it (0 means no limit for
+// either), HealthPath is a shorthand for health_check.path and Labels are
+// free-form metadata. With Resolve set, the URL's hostname is looked up in
+// DNS every ResolveInterval (30s by default) and each address becomes a
+// backend of its own. Discovery replaces URL with the instances a service
+// registry reports; in config files it is written as a key named after the
+// provider, e.g. "kubernetes": {...}.
+type BackendConfig struct {
+	URL                   string                     `json:"url"`
+	Weight                int                        `json:"weight,omitempty"`
+	MaxConnections        int                        `json:"max_connections,omitempty"`
+	MaxConcurrentRequests int                        `json:"max_concurrent_requests,omitempty"`
+	Drain                 bool                       `json:"drain,omitempty"`
+	HealthPath            string                     `json:"health_path,omitempty"`
+	Labels                map[string]string          `json:"labels,omitempty"`
+	HealthCheck           *HealthCheckConfig         `json:"health_check,omitempty"`
+	Resolve               bool                       `json:"resolve,omitempty"`
+	ResolveInterval       Duration                   `json:"resolve_interval,omitempty"`
+	Discovery             map[string]json.RawMessage `json:"-"`
+	// serverName is the hostname a resolved https backend's certificate
+	// is checked against, as its URL only has the address.
+	serverName string
+}
+
+func (b BackendConfig) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+func (b BackendConfig) healthCheck(defaults HealthCheckConfig) HealthCheckConfig {
+	config := defaults.merge(b.HealthCheck)
+	if b.HealthPath != "" {
+		config.Path = b.HealthPath
+	}
+	return config.withDefaults()
+}
+
+func (b *BackendConfig) UnmarshalJSON(data []byte) error {
+	var rawURL string
+	if err := json.Unmarshal(data, &rawURL); err == nil {
+		*b = BackendConfig{URL: rawURL}
+		return nil
+	}
+	type plain BackendConfig
+	if err := json.Unmarshal(data, (*plain)(b)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, config := range fields {
+		if discovery.Registered(name) {
+			if b.Discovery == nil {
+				b.Discovery = make(map[string]json.RawMessage)
+			}
+			b.Discovery[name] = config
+		}
+	}
+	return nil
+}
+
+func (b BackendConfig) MarshalJSON() ([]byte, error) {
+	type plain BackendConfig
+	data, err := json.Marshal(plain(b))
+	if err != nil || len(b.Discovery) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, config := range b.Discovery {
+		fields[name] = config
+	}
+	return json.Marshal(fields)
+}
+
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckGRPC = "grpc"
+)
+
+// HealthCheckConfig selects how backends are probed. The "http" type expects
+// a 200 from Path, the "tcp" type only requires the backend port to accept
+// a connection and the "grpc" type calls grpc.health.v1.Health/Check for
+// Service (empty means the whole server). Headers are sent with every HTTP
+// and gRPC probe and TLS sets the client certificate and CA used for https
+// backends. GracePeriod keeps backends that have not passed a probe yet in
+// rotation for that long after startup. Concurrency, Interval, Jitter and
+// GracePeriod are only read from the top-level health_check.
+type HealthCheckConfig struct {
+	Type        string   `json:"type,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	Service     string   `json:"service,omitempty"`
+	Timeout     Duration `json:"timeout,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+	Interval    Duration `json:"interval,omitempty"`
+	Jitter      Duration `json:"jitter,omitempty"`
+	GracePeriod Duration `json:"grace_period,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+	TLS     *ClientTLSConfig  `json:"tls,omitempty"`
+}
+
+// merge returns c with the fields set in override replacing its own.
+func (c HealthCheckConfig) merge(override *HealthCheckConfig) HealthCheckConfig {
+	if override == nil {
+		return c
+	}
+	if override.Type != "" {
+		c.Type = override.Type
+	}
+	if override.Path != "" {
+		c.Path = override.Path
+	}
+	if override.Service != "" {
+		c.Service = override.Service
+	}
+	if override.Timeout > 0 {
+		c.Timeout = override.Timeout
+	}
+	if override.Headers != nil {
+		c.Headers = override.Headers
+	}
+	if override.TLS != nil {
+		c.TLS = override.TLS
+	}
+	if override.Concurrency != 0 {
+		c.Concurrency = override.Concurrency
+	}
+	if override.Interval != 0 {
+		c.Interval = override.Interval
+	}
+	if override.Jitter != 0 {
+		c.Jitter = override.Jitter
+	}
+	if override.GracePeriod != 0 {
+		c.GracePeriod = override.GracePeriod
+	}
+	return c
+}
+
+func (c HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if c.Type == "" {
+		c.Type = HealthCheckHTTP
+	}
+	if c.Path == "" {
+		c.Path = "/health"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(2 * time.Second)
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 10
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(10 * time.Second)
+	}
+	return c
+}
+
+// OutlierDetectionConfig controls passive health checking: backends whose
+// error rate over Window reaches ErrorThreshold are ejected for EjectionTime
+// and must pass an active probe before they receive traffic again.
+type OutlierDetectionConfig struct {
+	Window         Duration `json:"window"`
+	ErrorThreshold float64  `json:"error_threshold"`
+	MinRequests    int      `json:"min_requests"`
+	EjectionTime   Duration `json:"ejection_time"`
+}
+
+func (c *OutlierDetectionConfig) withDefaults() OutlierDetectionConfig {
+	out := *c
+	if out.Window <= 0 {
+		out.Window = Duration(30 * time.Second)
+	}
+	if out.ErrorThreshold <= 0 {
+		out.ErrorThreshold = 0.5
+	}
+	if out.MinRequests <= 0 {
+		out.MinRequests = 10
+	}
+	if out.EjectionTime <= 0 {
+		out.EjectionTime = Duration(30 * time.Second)
+	}
+	return out
+}
+
+// Duration is a time.Duration that is written as "10s" or "1m30s" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value) * time.Second)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORSConfig is the cross-origin policy answered at the balancer. Origins
+// are matched exactly, "*" allows any and "https://*.example.com" any
+// subdomain. Methods default to GET, HEAD and POST. MaxAge lets browsers
+// cache preflight answers.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty"`
+}
+
+func (c *CORSConfig) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("allowed_origins: is required")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("allowed_origins: \"*\" cannot be combined with allow_credentials")
+			}
+			continue
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("allowed_origins: %q must be \"*\" or start with http:// or https://", origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max_age: must not be negative")
+	}
+	return nil
+}
+
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if scheme, host, ok := strings.Cut(allowed, "://*."); ok {
+			prefix := scheme + "://"
+			if rest, ok := strings.CutPrefix(origin, prefix); ok && strings.HasSuffix(rest, "."+host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *CORSConfig) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return c.AllowedMethods
+}
+
+func (c *CORSConfig) allowsMethod(method string) bool {
+	for _, allowed := range c.methods() {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether every header in requested, a comma
+// separated Access-Control-Request-Headers value, is allowed.
+func (c *CORSConfig) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, candidate := range c.AllowedHeaders {
+			if candidate == "*" || strings.EqualFold(candidate, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CORSConfig) setOrigin(header http.Header, origin string) {
+	header.Add("Vary", "Origin")
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+}
+
+// admitCORS answers preflight requests itself and adds the CORS headers
+// for the other requests from an allowed origin, so that they are on
+// responses the balancer writes itself as well as on proxied ones.
+func (lb *LoadBalancer) admitCORS(cors *CORSConfig, w http.ResponseWriter, r *http.Request) bool {
+	if cors == nil {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	requestedMethod := r.Header.Get("Access-Control-Request-Method")
+	if r.Method == http.MethodOptions && origin != "" && requestedMethod != "" {
+		requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+		header := w.Header()
+		header.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		if !cors.allowsOrigin(origin) || !cors.allowsMethod(requestedMethod) || !cors.allowsHeaders(requestedHeaders) {
+			lb.logger.Debugf("Refusing CORS preflight %s from %s for %s %s", r.Header.Get(RequestIDHeader), origin, requestedMethod, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		cors.setOrigin(header, origin)
+		header.Set("Access-Control-Allow-Methods", strings.Join(cors.methods(), ", "))
+		if requestedHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+		if cors.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.FormatInt(int64(time.Duration(cors.MaxAge)/time.Second), 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	if origin != "" && cors.allowsOrigin(origin) {
+		cors.setOrigin(w.Header(), origin)
+		if len(cors.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+		}
+	}
+	return true
+}
+
+// stripCORSHeaders removes the backend's own CORS headers from resp when
+// the balancer sets them, so responses never carry two policies.
+func (lb *LoadBalancer) stripCORSHeaders(resp *http.Response) {
+	lb.mutex.Lock()
+	cors := lb.config.CORS
+	lb.mutex.Unlock()
+
+	if cors == nil {
+		return
+	}
+	for _, name := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers"} {
+		resp.Header.Del(name)
+	}
+}
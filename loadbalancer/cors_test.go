@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		CORS: &CORSConfig{
+			AllowedOrigins:   []string{"https://app.example.com", "https://*.tools.example.com"},
+			AllowedMethods:   []string{"GET", "PUT"},
+			AllowedHeaders:   []string{"Content-Type", "X-Request-ID"},
+			ExposedHeaders:   []string{"X-Request-ID"},
+			AllowCredentials: true,
+			MaxAge:           Duration(10 * time.Minute),
+		},
+		Auth: &AuthConfig{APIKeys: []string{"key"}},
+	})
+	defer lb.Close()
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/items/1", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://app.example.com", "PUT", "content-type")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the preflight to be answered without credentials, got %d", w.Code)
+	}
+	for name, expected := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "content-type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if got := w.Header().Get(name); got != expected {
+			t.Errorf("Expected %s %q, got %q", name, expected, got)
+		}
+	}
+
+	if w := preflight("https://a.tools.example.com", "GET", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected a wildcard subdomain to be allowed, got %d", w.Code)
+	}
+	for _, test := range []struct{ origin, method, headers string }{
+		{"https://evil.example.com", "GET", ""},
+		{"https://tools.example.com", "GET", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "GET", "Authorization"},
+	} {
+		if w := preflight(test.origin, test.method, test.headers); w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected a preflight from %s for %s with %q to be refused, got %d", test.origin, test.method, test.headers, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("X-API-Key", "key")
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, req)
+	if origins := w.Header().Values("Access-Control-Allow-Origin"); w.Code != http.StatusOK || len(origins) != 1 || origins[0] != "https://app.example.com" {
+		t.Errorf("Expected the balancer's CORS headers to replace the backend's, got %d %q", w.Code, origins)
+	}
+	if w.Header().Get("Access-Control-Expose-Headers") != "X-Request-ID" {
+		t.Errorf("Expected exposed headers, got %q", w.Header().Get("Access-Control-Expose-Headers"))
+	}
+
+	req.Header.Del("X-API-Key")
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("Expected a 401 the browser can read, got %d", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DecompressionConfig decompresses gzip request bodies for backends
+// that don't support Content-Encoding. MaxBodyBytes caps the size of the
+// decompressed body (default 10 MB), so that a small compressed body
+// cannot blow up on the way to the backend.
+type DecompressionConfig struct {
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+}
+
+const defaultDecompressedBodyBytes = 10 << 20
+
+// errCorruptBody marks a request body that claimed to be gzip but isn't,
+// which is the client's fault rather than the backend's.
+var errCorruptBody = errors.New("invalid gzip request body")
+
+func (c *DecompressionConfig) validate() error {
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes: must not be negative")
+	}
+	return nil
+}
+
+func (c *DecompressionConfig) maxBodyBytes() int64 {
+	if c.MaxBodyBytes == 0 {
+		return defaultDecompressedBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+// admitDecompression swaps a gzip request body for its decompressed
+// content. Bodies in other encodings are passed on as they are.
+func (lb *LoadBalancer) admitDecompression(config *DecompressionConfig, w http.ResponseWriter, r *http.Request) bool {
+	if config == nil || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "x-gzip" {
+		return true
+	}
+	reader, err := gzip.NewReader(r.Body)
+	if isBodyTooLarge(err) {
+		http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		lb.logger.Debugf("Rejecting request %s: %v: %v", r.Header.Get(RequestIDHeader), errCorruptBody, err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return false
+	}
+	r.Body = &decompressedBody{reader: http.MaxBytesReader(w, reader, config.maxBodyBytes()), compressed: r.Body}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return true
+}
+
+type decompressedBody struct {
+	reader     io.ReadCloser
+	compressed io.Closer
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && err != io.EOF && !isBodyTooLarge(err) {
+		err = fmt.Errorf("%w: %v", errCorruptBody, err)
+	}
+	return n, err
+}
+
+func (b *decompressedBody) Close() error {
+	b.reader.Close()
+	return b.compressed.Close()
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	io.WriteString(writer, data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestRequestDecompression(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("X-Got-Encoding", r.Header.Get("Content-Encoding"))
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:      []BackendConfig{{URL: backend.URL}},
+		Decompression: &DecompressionConfig{MaxBodyBytes: 1000},
+	})
+	defer lb.Close()
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	post := func(body []byte, encoding string) (*http.Response, string) {
+		t.Helper()
+		request, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", encoding)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, _ := io.ReadAll(response.Body)
+		return response, string(data)
+	}
+
+	response, body := post(gzipped(t, `{"hello":"world"}`), "gzip")
+	if response.StatusCode != http.StatusOK || body != `{"hello":"world"}` || response.Header.Get("X-Got-Encoding") != "" {
+		t.Errorf("Expected the backend to get the plain body, got %d %q %q", response.StatusCode, body, response.Header.Get("X-Got-Encoding"))
+	}
+	if response, body := post([]byte("as is"), "br"); response.StatusCode != http.StatusOK || body != "as is" || response.Header.Get("X-Got-Encoding") != "br" {
+		t.Errorf("Expected other encodings to be passed on, got %d %q", response.StatusCode, body)
+	}
+
+	// A few hundred bytes that inflate to a megabyte.
+	bomb := gzipped(t, strings.Repeat("\x00", 1<<20))
+	if response, _ := post(bomb, "gzip"); response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a body decompressing past max_body_bytes to get a 413, got %d", response.StatusCode)
+	}
+	if response, _ := post([]byte("not gzip at all"), "gzip"); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a body that isn't gzip to get a 400, got %d", response.StatusCode)
+	}
+	corrupt := gzipped(t, strings.Repeat("abc", 100))
+	corrupt[len(corrupt)-5] ^= 0xff
+	if response, _ := post(corrupt, "gzip"); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a body failing its checksum to get a 400, got %d", response.StatusCode)
+	}
+}
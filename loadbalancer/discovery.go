@@ -0,0 +1,227 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"loadbalancer/discovery"
+)
+
+// discoveredBackend is one instance reported by a service registry.
+const discoveryRetryDelay = 2 * time.Second
+
+type discoveredBackend struct {
+	URL    string
+	Weight int
+	Labels map[string]string
+}
+
+// discoveryWatch holds the instances a registry currently reports for one
+// backend entry. It is filled by a background subscription that runs until
+// the entry disappears from the config or the load balancer is closed.
+type discoveryWatch struct {
+	mutex     sync.Mutex
+	instances []discovery.Instance
+	stop      chan struct{}
+}
+
+func (w *discoveryWatch) snapshot() []discovery.Instance {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.instances
+}
+
+// update replaces the instances and rebuilds the pool of lb.
+func (w *discoveryWatch) update(lb *LoadBalancer, instances []discovery.Instance) {
+	w.mutex.Lock()
+	w.instances = instances
+	w.mutex.Unlock()
+
+	go func() {
+		if lb.syncPool("service discovery") {
+			lb.logger.Infof("Discovered backends changed, probing the updated pool")
+			lb.healthCheck()
+		}
+	}()
+}
+
+// stopped reports whether the watch should end, waiting up to delay first.
+func (w *discoveryWatch) stopped(lb *LoadBalancer, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-lb.done:
+		return true
+	case <-w.stop:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// context returns a context that is cancelled once the watch should end.
+func (w *discoveryWatch) context(lb *LoadBalancer) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-lb.done:
+		case <-w.stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// discoveryKey identifies a registry query so watches survive reloads that
+// leave it unchanged.
+func discoveryKey(name string, config json.RawMessage) string {
+	var compact bytes.Buffer
+	if json.Compact(&compact, config) != nil {
+		return name + "|" + string(config)
+	}
+	return name + "|" + compact.String()
+}
+
+// startDiscovery builds the provider, fills the watch with its current
+// instances and keeps them up to date in the background, resubscribing
+// after errors.
+func (lb *LoadBalancer) startDiscovery(name string, config json.RawMessage) func(*discoveryWatch) {
+	return func(watch *discoveryWatch) {
+		provider, err := discovery.New(name, config)
+		if err != nil {
+			lb.logger.Errorf("Error configuring %s discovery: %v", name, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		instances, err := provider.List(ctx)
+		cancel()
+		if err != nil {
+			lb.logger.Warnf("Error listing %s instances: %v", name, err)
+		} else {
+			watch.mutex.Lock()
+			watch.instances = instances
+			watch.mutex.Unlock()
+		}
+
+		go func() {
+			for {
+				ctx, cancel := watch.context(lb)
+				err := provider.Subscribe(ctx, func(instances []discovery.Instance) {
+					watch.update(lb, instances)
+				})
+				cancel()
+				if watch.stopped(lb, 0) {
+					return
+				}
+				lb.logger.Warnf("Lost track of %s instances, retrying: %v", name, err)
+				if watch.stopped(lb, discoveryRetryDelay) {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// watchDiscovery returns the running watch for key, starting it with start
+// if needed. Watches that are not requested again by the end of a pool sync
+// are stopped by stopUnusedWatches. Callers hold poolMutex.
+func (lb *LoadBalancer) watchDiscovery(key string, start func(*discoveryWatch)) *discoveryWatch {
+	lb.usedWatches[key] = true
+	if watch, ok := lb.watches[key]; ok {
+		return watch
+	}
+	watch := &discoveryWatch{stop: make(chan struct{})}
+	lb.watches[key] = watch
+	start(watch)
+	return watch
+}
+
+func (lb *LoadBalancer) stopUnusedWatches() {
+	for key, watch := range lb.watches {
+		if !lb.usedWatches[key] {
+			close(watch.stop)
+			delete(lb.watches, key)
+		}
+	}
+	lb.usedWatches = make(map[string]bool)
+}
+
+// expandDiscovered turns the instances of a registry into backends that
+// inherit the entry's settings.
+func expandDiscovered(template BackendConfig, instances []discovery.Instance) []BackendConfig {
+	var expanded []BackendConfig
+	for _, instance := range instances {
+		backend := template
+		backend.URL = instance.URL
+		backend.Discovery = nil
+		if instance.Weight > 0 && template.Weight == 0 {
+			backend.Weight = instance.Weight
+		}
+		if len(instance.Labels) > 0 {
+			labels := make(map[string]string, len(template.Labels)+len(instance.Labels))
+			for name, value := range instance.Labels {
+				labels[name] = value
+			}
+			for name, value := range template.Labels {
+				labels[name] = value
+			}
+			backend.Labels = labels
+		}
+		expanded = append(expanded, backend)
+	}
+	return expanded
+}
+
+const (
+	originStatic = "static"
+	originLabel  = "origin"
+)
+
+// backendGroup is what one backend entry of the config expanded to.
+type backendGroup struct {
+	origin   string
+	backends []BackendConfig
+}
+
+// mergeBackends flattens the groups into the pool, labelling every backend
+// with where it came from unless the config already sets an origin label.
+// Static backends take precedence over discovered ones with the same URL,
+// so a pinned host keeps its configured weight and labels, and among
+// discovered duplicates the entry listed first wins.
+func mergeBackends(groups []backendGroup) []BackendConfig {
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		if group.origin == originStatic {
+			for _, backend := range group.backends {
+				seen[backend.URL] = true
+			}
+		}
+	}
+
+	var merged []BackendConfig
+	for _, group := range groups {
+		for _, backend := range group.backends {
+			if group.origin != originStatic {
+				if seen[backend.URL] {
+					continue
+				}
+				seen[backend.URL] = true
+			}
+
+			if _, ok := backend.Labels[originLabel]; !ok {
+				labels := map[string]string{originLabel: group.origin}
+				for name, value := range backend.Labels {
+					labels[name] = value
+				}
+				backend.Labels = labels
+			}
+			merged = append(merged, backend)
+		}
+	}
+	return merged
+}
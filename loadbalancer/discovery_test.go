@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"loadbalancer/discovery"
+)
+
+// testProvider reports whatever instances the test sets.
+type testProvider struct {
+	mutex     sync.Mutex
+	instances []discovery.Instance
+	changed   chan struct{}
+}
+
+func (p *testProvider) set(instances []discovery.Instance) {
+	p.mutex.Lock()
+	p.instances = instances
+	p.mutex.Unlock()
+	p.changed <- struct{}{}
+}
+
+func (p *testProvider) List(ctx context.Context) ([]discovery.Instance, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.instances, nil
+}
+
+func (p *testProvider) Subscribe(ctx context.Context, update func([]discovery.Instance)) error {
+	for {
+		instances, _ := p.List(ctx)
+		update(instances)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.changed:
+		}
+	}
+}
+
+func TestDiscoveryProvidersFeedThePool(t *testing.T) {
+	provider := &testProvider{
+		instances: []discovery.Instance{{URL: "http://10.0.0.1:8080", Weight: 2, Labels: map[string]string{"zone": "a"}}},
+		changed:   make(chan struct{}),
+	}
+	discovery.Register("test", func(config json.RawMessage) (discovery.Provider, error) {
+		return provider, nil
+	})
+
+	var config Config
+	data := `{"backends": [{"test": {"api_token": "secret"}, "labels": {"team": "web"}}]}`
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+	if string(config.Backends[0].Discovery["test"]) != `{"api_token": "secret"}` {
+		t.Fatalf("Expected the provider config to be picked up, got %v", config.Backends[0].Discovery)
+	}
+	if err := (Config{Port: "8080", Backends: config.Backends}).Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+
+	config.HealthCheck = HealthCheckConfig{Interval: -1, Timeout: Duration(10 * time.Millisecond)}
+	lb := NewLoadBalancer(config)
+	defer lb.Close()
+
+	pool := lb.poolSnapshot()
+	if len(pool) != 1 || pool[0].URL.String() != "http://10.0.0.1:8080" || pool[0].weight != 2 {
+		t.Fatalf("Unexpected pool: %+v", pool)
+	}
+	labels := pool[0].Labels
+	if labels["origin"] != "test" || labels["zone"] != "a" || labels["team"] != "web" {
+		t.Errorf("Expected registry, config and origin labels, got %v", labels)
+	}
+
+	provider.set(append(provider.instances, discovery.Instance{URL: "http://10.0.0.2:8080"}))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(lb.poolSnapshot()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool := lb.poolSnapshot(); len(pool) != 2 {
+		t.Errorf("Expected the new instance to join the pool, got %d backends", len(pool))
+	}
+
+	dumped, err := json.Marshal(lb.Config().Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dumped), `"test":{"api_token":"REDACTED"}`) {
+		t.Errorf("Expected the provider config to be dumped with its token redacted, got %s", dumped)
+	}
+}
@@ -0,0 +1,179 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	defaultResolveInterval = 30 * time.Second
+	minResolveInterval     = time.Second
+	resolveTimeout         = 5 * time.Second
+)
+
+// expandBackends replaces every backend with Resolve set by one backend per
+// address its hostname resolves to, every srv:// backend by one backend per
+// SRV record, and every registry entry by the instances it currently
+// reports, then merges them with mergeBackends. When a lookup fails the
+// backends from the previous successful lookup are kept, so a DNS outage
+// does not empty the pool. It also works out when the next lookup is due.
+func (lb *LoadBalancer) expandBackends(backends []BackendConfig) []BackendConfig {
+	known := lb.resolved
+	lb.resolved = make(map[string][]BackendConfig)
+	lb.resolveDelay = 0
+
+	var groups []backendGroup
+	for _, backend := range backends {
+		var (
+			origin   string
+			resolved []BackendConfig
+			ttl      time.Duration
+			err      error
+		)
+		switch {
+		case len(backend.Discovery) > 0:
+			for name, config := range backend.Discovery {
+				origin = name
+				watch := lb.watchDiscovery(discoveryKey(name, config), lb.startDiscovery(name, config))
+				resolved = expandDiscovered(backend, watch.snapshot())
+			}
+		case isSRV(backend.URL):
+			origin = "srv"
+			resolved, ttl, err = lb.resolveSRV(backend)
+		case backend.Resolve:
+			origin = "dns"
+			resolved, err = lb.resolveBackend(backend)
+		default:
+			groups = append(groups, backendGroup{origin: originStatic, backends: []BackendConfig{backend}})
+			continue
+		}
+		if origin == "srv" || origin == "dns" {
+			if err != nil {
+				resolved = known[backend.URL]
+				lb.logger.Warnf("Error resolving %s: %v, keeping %d known addresses", backend.URL, err, len(resolved))
+			}
+			lb.resolved[backend.URL] = resolved
+			lb.scheduleResolve(backend, ttl)
+		}
+		groups = append(groups, backendGroup{origin: origin, backends: resolved})
+	}
+	lb.stopUnusedWatches()
+	return mergeBackends(groups)
+}
+
+// scheduleResolve brings the next lookup forward to when backend is due: its
+// resolve_interval, or else the record TTL, or else the default.
+func (lb *LoadBalancer) scheduleResolve(backend BackendConfig, ttl time.Duration) {
+	delay := time.Duration(backend.ResolveInterval)
+	if delay == 0 {
+		delay = ttl
+	}
+	if delay == 0 {
+		delay = defaultResolveInterval
+	}
+	if delay < minResolveInterval && backend.ResolveInterval == 0 {
+		delay = minResolveInterval
+	}
+	if lb.resolveDelay == 0 || delay < lb.resolveDelay {
+		lb.resolveDelay = delay
+	}
+}
+
+// resolveBackend returns one copy of the backend per address of its
+// hostname, in a stable order.
+func (lb *LoadBalancer) resolveBackend(backend BackendConfig) ([]BackendConfig, error) {
+	parsed, err := url.Parse(backend.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := lb.lookupHost(ctx, parsed.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ips)
+
+	var resolved []BackendConfig
+	for _, ip := range ips {
+		address := *parsed
+		if port := parsed.Port(); port != "" {
+			address.Host = net.JoinHostPort(ip, port)
+		} else if net.ParseIP(ip).To4() == nil {
+			address.Host = "[" + ip + "]"
+		} else {
+			address.Host = ip
+		}
+		copied := backend
+		copied.URL = address.String()
+		copied.Resolve = false
+		if parsed.Scheme == "https" {
+			copied.serverName = parsed.Hostname()
+		}
+		resolved = append(resolved, copied)
+	}
+	return resolved, nil
+}
+
+// withServerName returns config, or a copy of it that checks certificates
+// against name when config does not name a server itself.
+func withServerName(config *tls.Config, name string) *tls.Config {
+	if config == nil {
+		return &tls.Config{ServerName: name}
+	}
+	if config.ServerName != "" {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = name
+	return config
+}
+
+func (lb *LoadBalancer) restartResolver() {
+	lb.poolMutex.Lock()
+	dynamic := lb.resolveDelay > 0
+	lb.poolMutex.Unlock()
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.stopResolve != nil {
+		close(lb.stopResolve)
+		lb.stopResolve = nil
+	}
+	if dynamic {
+		lb.stopResolve = make(chan struct{})
+		go lb.runResolver(lb.stopResolve)
+	}
+}
+
+func (lb *LoadBalancer) runResolver(stop chan struct{}) {
+	for {
+		lb.poolMutex.Lock()
+		delay := lb.resolveDelay
+		lb.poolMutex.Unlock()
+		if delay == 0 {
+			delay = defaultResolveInterval
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-lb.done:
+			timer.Stop()
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			if lb.syncPool("dns refresh") {
+				lb.logger.Infof("DNS answers changed, probing the updated pool")
+				lb.healthCheck()
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolvedBackendsFollowDNS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	var (
+		mutex   sync.Mutex
+		answers = []string{"127.0.0.1"}
+		failing bool
+	)
+	setAnswers := func(ips []string, fail bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		answers, failing = ips, fail
+	}
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if host != "service.internal" {
+			t.Errorf("Unexpected lookup of %q", host)
+		}
+		if failing {
+			return nil, errors.New("no such host")
+		}
+		return answers, nil
+	}
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{
+			URL:             "http://service.internal:" + serverURL.Port(),
+			Resolve:         true,
+			ResolveInterval: Duration(20 * time.Millisecond),
+		}},
+		HealthCheck: HealthCheckConfig{Interval: -1},
+	}, func(lb *LoadBalancer) { lb.lookupHost = lookup })
+	defer lb.Close()
+
+	poolURLs := func() []string {
+		var urls []string
+		for _, backend := range lb.poolSnapshot() {
+			urls = append(urls, backend.URL.String())
+		}
+		return urls
+	}
+	waitForPool := func(want int) []string {
+		deadline := time.Now().Add(2 * time.Second)
+		for len(poolURLs()) != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return poolURLs()
+	}
+
+	if urls := poolURLs(); len(urls) != 1 || urls[0] != server.URL {
+		t.Fatalf("Expected the pool to hold the resolved address, got %v", urls)
+	}
+
+	setAnswers([]string{"127.0.0.2", "127.0.0.1"}, false)
+	if urls := waitForPool(2); len(urls) != 2 {
+		t.Fatalf("Expected a second backend after DNS changed, got %v", urls)
+	}
+
+	setAnswers(nil, true)
+	time.Sleep(60 * time.Millisecond)
+	if urls := poolURLs(); len(urls) != 2 {
+		t.Errorf("Expected known addresses to be kept while DNS fails, got %v", urls)
+	}
+
+	setAnswers([]string{"127.0.0.1"}, false)
+	if urls := waitForPool(1); len(urls) != 1 || urls[0] != server.URL {
+		t.Errorf("Expected the removed address to leave the pool, got %v", urls)
+	}
+}
+
+func TestStaticBackendsTakePrecedenceOverDiscovered(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{URL: "http://web.internal:8080", Resolve: true},
+			{URL: "http://10.0.0.2:8080", Weight: 5, Labels: map[string]string{"role": "canary"}},
+			{URL: "http://10.0.0.9:8080", Labels: map[string]string{"origin": "pinned"}},
+		},
+		HealthCheck: HealthCheckConfig{Interval: -1, Timeout: Duration(10 * time.Millisecond)},
+	}, func(lb *LoadBalancer) { lb.lookupHost = lookup })
+	defer lb.Close()
+
+	pool := lb.poolSnapshot()
+	if len(pool) != 3 {
+		t.Fatalf("Expected the duplicate discovered address to be dropped, got %d backends", len(pool))
+	}
+	expected := []struct {
+		url, origin string
+		weight      int
+	}{
+		{"http://10.0.0.1:8080", "dns", 1},
+		{"http://10.0.0.2:8080", "static", 5},
+		{"http://10.0.0.9:8080", "pinned", 1},
+	}
+	for i, want := range expected {
+		if pool[i].URL.String() != want.url || pool[i].Labels["origin"] != want.origin || pool[i].weight != want.weight {
+			t.Errorf("Backend %d: expected %s from %s with weight %d, got %s from %s with weight %d",
+				i, want.url, want.origin, want.weight, pool[i].URL, pool[i].Labels["origin"], pool[i].weight)
+		}
+	}
+	if pool[1].Labels["role"] != "canary" {
+		t.Errorf("Expected the static backend to keep its labels, got %v", pool[1].Labels)
+	}
+}
+
+func TestResolvedHTTPSBackendsKeepTheirServerName(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t, t.TempDir(), "service.internal")
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Certificates are picked by SNI, which an address doesn't give.
+		if r.TLS.ServerName != "service.internal" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		io.WriteString(w, r.TLS.ServerName)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	lb := NewLoadBalancer(Config{
+		Backends:   []BackendConfig{{URL: "https://service.internal:" + serverURL.Port(), Resolve: true}},
+		BackendTLS: &ClientTLSConfig{CAFile: certFile},
+	}, func(lb *LoadBalancer) {
+		lb.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+			return []string{"127.0.0.1"}, nil
+		}
+	})
+	defer lb.Close()
+	if lb.AvailableBackends() != 1 {
+		t.Fatalf("Expected the resolved backend to pass its health check, got %d available", lb.AvailableBackends())
+	}
+
+	recorder := httptest.NewRecorder()
+	lb.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "service.internal" {
+		t.Errorf("Expected the request to reach the backend as service.internal, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+func (c Config) drainTimeout() time.Duration {
+	if c.DrainTimeout == 0 {
+		return defaultDrainTimeout
+	}
+	return time.Duration(c.DrainTimeout)
+}
+
+// serve proxies r to the backend, cutting it off if the backend's drain
+// deadline passes first.
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	drained := b.drained
+	b.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(drained, cancel)
+	defer stop()
+	b.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (b *Backend) draining() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.drainConfig || b.drainAdmin
+}
+
+// setDraining sets whether the config or, if byAdmin, the admin API drains
+// the backend, and reports whether it started or stopped draining. A
+// backend drains while either does. Once it starts, the requests it still
+// has in flight get timeout to finish before they are cancelled.
+func (lb *LoadBalancer) setDraining(b *Backend, byAdmin, drain bool, timeout time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	was := b.drainConfig || b.drainAdmin
+	if byAdmin {
+		b.drainAdmin = drain
+	} else {
+		b.drainConfig = drain
+	}
+	now := b.drainConfig || b.drainAdmin
+	switch {
+	case now && !was:
+		b.drainTimer = time.AfterFunc(timeout, func() { lb.cutOff(b, timeout) })
+	case was && !now:
+		b.drainTimer.Stop()
+		b.drainTimer = nil
+		if b.drained.Err() != nil {
+			b.drained, b.abort = context.WithCancel(context.Background())
+		}
+	}
+	return now != was
+}
+
+func (lb *LoadBalancer) cutOff(b *Backend, timeout time.Duration) {
+	if active := atomic.LoadInt64(&b.active); active > 0 {
+		lb.logger.Warnf("Backend %s still has %d requests in flight after draining for %v, cancelling them", b.URL.String(), active, timeout)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.abort()
+}
+
+// SetDraining drains every backend with the given URL, in the pool and in
+// routes, or puts it back into rotation, on behalf of actor. A draining
+// backend gets no new requests, and those in flight have drain_timeout to
+// finish. Drains set this way outlast reloads. It reports whether any
+// backend has that URL.
+func (lb *LoadBalancer) SetDraining(backendURL string, drain bool, actor string) bool {
+	lb.mutex.Lock()
+	timeout := lb.config.drainTimeout()
+	lb.mutex.Unlock()
+
+	found := false
+	for _, backend := range lb.poolSnapshot() {
+		if backend.URL.String() != backendURL {
+			continue
+		}
+		found = true
+		if !lb.setDraining(backend, true, drain, timeout) {
+			continue
+		}
+		lb.logDrain(backend, drain)
+		action := AuditBackendResumed
+		if drain {
+			action = AuditBackendDrained
+		}
+		lb.auditLog.Record(AuditEvent{Actor: actor, Action: action, Listener: lb.listener, Target: backendURL})
+	}
+	if found {
+		lb.refreshBackends()
+	}
+	for _, route := range lb.routeSnapshot() {
+		if route.lb.SetDraining(backendURL, drain, actor) {
+			found = true
+		}
+	}
+	return found
+}
+
+func (lb *LoadBalancer) logDrain(backend *Backend, drain bool) {
+	if drain {
+		lb.logger.Infof("Draining backend %s with %d requests in flight", backend.URL.String(), atomic.LoadInt64(&backend.active))
+	} else {
+		lb.logger.Infof("Backend %s no longer draining", backend.URL.String())
+	}
+}
@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainLetsRequestsInFlightFinish(t *testing.T) {
+	release := make(chan struct{})
+	var drainingServed atomic.Int32
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		drainingServed.Add(1)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer draining.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: draining.URL}}})
+	defer lb.Close()
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		done <- w.Code
+	}()
+	for drainingServed.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	lb.Reload(Config{Backends: []BackendConfig{{URL: draining.URL, Drain: true}, {URL: other.URL}}})
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if drainingServed.Load() != 1 {
+		t.Errorf("Expected a draining backend to get no new requests, it got %d", drainingServed.Load()-1)
+	}
+	for _, stats := range lb.Stats(time.Minute) {
+		if stats.URL == draining.URL && stats.State != BackendDraining {
+			t.Errorf("Expected the backend to show as draining, got %s", stats.State)
+		}
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the request in flight to finish, got %d", code)
+	}
+
+	lb.Reload(Config{Backends: []BackendConfig{{URL: draining.URL}, {URL: other.URL}}})
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if drainingServed.Load() == 1 {
+		t.Error("Expected the backend to be back in rotation once no longer draining")
+	}
+}
+
+func TestDrainTimeoutCancelsRequests(t *testing.T) {
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:     []BackendConfig{{URL: backend.URL}},
+		DrainTimeout: Duration(20 * time.Millisecond),
+	})
+	defer lb.Close()
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	if lb.SetDraining("http://unknown:80", true, "test") {
+		t.Error("Expected no backend to match an unknown URL")
+	}
+	if !lb.SetDraining(backend.URL, true, "test") {
+		t.Fatal("Expected the backend to be drained")
+	}
+	select {
+	case code := <-done:
+		if code != http.StatusBadGateway {
+			t.Errorf("Expected the cancelled request to fail with 502, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be cancelled at the drain timeout")
+	}
+
+	lb.SetDraining(backend.URL, false, "test")
+	if lb.AvailableBackends() != 1 {
+		t.Error("Expected the backend to be back in rotation")
+	}
+}
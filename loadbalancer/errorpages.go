@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// errorPageStatuses are the balancer's own errors that can be given a
+// custom body.
+var errorPageStatuses = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// ErrorPagesConfig replaces the bodies of the errors the balancer answers
+// with itself (429, 502, 503 and 504) by templates read from files, keyed
+// by status: HTML for browsers, JSON for clients that prefer
+// application/json in Accept. Clients asking for JSON get a built-in JSON
+// body for statuses without a JSON template. Templates can use .Status,
+// .StatusText, .Message, .RequestID, .Timestamp, .Method and .Path; JSON
+// templates have a json function to quote values.
+type ErrorPagesConfig struct {
+	HTML map[string]string `json:"html,omitempty"`
+	JSON map[string]string `json:"json,omitempty"`
+}
+
+func (c *ErrorPagesConfig) validate() error {
+	_, err := c.compile()
+	return err
+}
+
+// errorPages holds the parsed templates of an ErrorPagesConfig.
+type errorPages struct {
+	html map[int]*htmltemplate.Template
+	json map[int]*template.Template
+}
+
+var jsonFuncs = template.FuncMap{"json": func(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}}
+
+func (c *ErrorPagesConfig) compile() (*errorPages, error) {
+	if c == nil {
+		return nil, nil
+	}
+	pages := &errorPages{html: make(map[int]*htmltemplate.Template), json: make(map[int]*template.Template)}
+	for key, path := range c.HTML {
+		status, err := errorPageStatus(key)
+		if err != nil {
+			return nil, fmt.Errorf("html.%s: %v", key, err)
+		}
+		if pages.html[status], err = htmltemplate.ParseFiles(path); err != nil {
+			return nil, fmt.Errorf("html.%s: %v", key, err)
+		}
+	}
+	for key, path := range c.JSON {
+		status, err := errorPageStatus(key)
+		if err != nil {
+			return nil, fmt.Errorf("json.%s: %v", key, err)
+		}
+		if pages.json[status], err = template.New("").Funcs(jsonFuncs).ParseFiles(path); err != nil {
+			return nil, fmt.Errorf("json.%s: %v", key, err)
+		}
+		// ParseFiles names the template after the file.
+		pages.json[status] = pages.json[status].Lookup(filepath.Base(path))
+	}
+	return pages, nil
+}
+
+func errorPageStatus(key string) (int, error) {
+	status, err := strconv.Atoi(key)
+	if err != nil || !errorPageStatuses[status] {
+		return 0, fmt.Errorf("must be one of 429, 502, 503 and 504")
+	}
+	return status, nil
+}
+
+type errorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+	Timestamp  string `json:"timestamp"`
+	Method     string `json:"-"`
+	Path       string `json:"-"`
+}
+
+// httpError answers r with one of the balancer's own errors, in the
+// listener's error page for status if there is one.
+func (lb *LoadBalancer) httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	lb.mutex.Lock()
+	pages := lb.errorPages
+	lb.mutex.Unlock()
+	if pages == nil || !errorPageStatuses[status] {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  r.Header.Get(RequestIDHeader),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+	}
+	var body bytes.Buffer
+	var err error
+	contentType := "text/html; charset=utf-8"
+	if wantsJSON(r.Header.Get("Accept")) {
+		contentType = "application/json"
+		if page := pages.json[status]; page != nil {
+			err = page.Execute(&body, data)
+		} else {
+			err = json.NewEncoder(&body).Encode(data)
+		}
+	} else if page := pages.html[status]; page != nil {
+		err = page.Execute(&body, data)
+	} else {
+		http.Error(w, message, status)
+		return
+	}
+	if err != nil {
+		lb.logger.Errorf("Error rendering the error page for status %d: %v", status, err)
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// wantsJSON reports whether accept prefers JSON over HTML.
+func wantsJSON(accept string) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = max(jsonQ, q)
+		case mediaType == "text/html":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	html := filepath.Join(dir, "503.html")
+	if err := os.WriteFile(html, []byte("<h1>{{.StatusText}}</h1><p>{{.Message}} for {{.Path}} ({{.RequestID}})</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := NewLoadBalancer(Config{ErrorPages: &ErrorPagesConfig{HTML: map[string]string{"503": html}}})
+	defer lb.Close()
+
+	r := httptest.NewRequest("GET", "/<script>", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	id := w.Header().Get(RequestIDHeader)
+	expected := "<h1>Service Unavailable</h1><p>Service unavailable for /&lt;script&gt; (" + id + ")</p>"
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != expected || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Expected the HTML error page, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON error, got %q: %v", w.Body.String(), err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || body["status"] != float64(503) || body["request_id"] != w.Header().Get(RequestIDHeader) {
+		t.Errorf("Expected the built-in JSON error, got %v %q", w.Header(), w.Body.String())
+	}
+
+	jsonPage := filepath.Join(dir, "503.json")
+	if err := os.WriteFile(jsonPage, []byte(`{"code": {{.Status}}, "detail": {{json .Message}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lb.Reload(Config{ErrorPages: &ErrorPagesConfig{JSON: map[string]string{"503": jsonPage}}})
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Body.String() != `{"code": 503, "detail": "Service unavailable"}` {
+		t.Errorf("Expected the JSON template, got %q", w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected a plain text error without an HTML template, got %v %q", w.Header(), w.Body.String())
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                                  false,
+		"*/*":                               false,
+		"application/json":                  true,
+		"application/problem+json":          true,
+		"text/html, application/json":       false,
+		"text/html;q=0.5, application/json": true,
+		"application/json;q=0.1, text/html": false,
+	} {
+		if got := wantsJSON(accept); got != expected {
+			t.Errorf("wantsJSON(%q) = %v, expected %v", accept, got, expected)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// HealthEvent is emitted whenever a backend enters or leaves rotation.
+type HealthEvent struct {
+	Backend   string    `json:"backend"`
+	Healthy   bool      `json:"healthy"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// OnHealthChange registers a callback for backend health transitions.
+// Callbacks run on their own goroutine and must not block for long.
+func (lb *LoadBalancer) OnHealthChange(hook func(HealthEvent)) {
+	lb.hooksMutex.Lock()
+	defer lb.hooksMutex.Unlock()
+	lb.hooks = append(lb.hooks, hook)
+}
+
+func (lb *LoadBalancer) emitHealthEvent(backend *Backend, healthy bool, reason string) {
+	event := HealthEvent{
+		Backend:   backend.URL.String(),
+		Healthy:   healthy,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	}
+
+	lb.hooksMutex.Lock()
+	hooks := append(append([]func(HealthEvent){}, lb.hooks...), lb.webhooks...)
+	lb.hooksMutex.Unlock()
+	for parent := lb.parent; parent != nil; parent = parent.parent {
+		parent.hooksMutex.Lock()
+		hooks = append(hooks, parent.hooks...)
+		parent.hooksMutex.Unlock()
+	}
+
+	for _, hook := range hooks {
+		go hook(event)
+	}
+}
+
+func (lb *LoadBalancer) newWebhook(webhookURL string) func(HealthEvent) {
+	return func(event HealthEvent) {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			lb.logger.Errorf("Error encoding health event: %v", err)
+			return
+		}
+		resp, err := lb.client.Post(webhookURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			lb.logger.Warnf("Error sending health event to %s: %v", webhookURL, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			lb.logger.Warnf("Health webhook %s answered with status %d", webhookURL, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthEventsReachHooksAndWebhooks(t *testing.T) {
+	var down atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	webhookEvents := make(chan HealthEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event HealthEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Invalid webhook payload: %v", err)
+		}
+		webhookEvents <- event
+	}))
+	defer webhook.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:       []BackendConfig{{URL: backend.URL}},
+		HealthCheck:    HealthCheckConfig{Interval: Duration(20 * time.Millisecond)},
+		HealthWebhooks: []string{webhook.URL},
+	})
+	defer lb.Close()
+
+	hookEvents := make(chan HealthEvent, 1)
+	lb.OnHealthChange(func(event HealthEvent) { hookEvents <- event })
+
+	down.Store(true)
+
+	for name, events := range map[string]chan HealthEvent{"hook": hookEvents, "webhook": webhookEvents} {
+		select {
+		case event := <-events:
+			if event.Healthy || event.Backend != backend.URL {
+				t.Errorf("Unexpected %s event: %+v", name, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a %s event for the failing backend", name)
+		}
+	}
+}
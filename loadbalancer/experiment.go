@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const defaultExperimentHeader = "X-Variant"
+
+// ExperimentConfig runs an A/B test: requests are assigned one of Variants
+// in proportion to their weights by a hash of Key ("ip", "header:<name>"
+// or "cookie:<name>") and the experiment's Name, so a client keeps its
+// variant and experiments with different names assign independently. The
+// variant is passed to backends in Header (default X-Variant), replacing
+// any the client sent, and requests are counted per variant in metrics.
+// Requests without a key are not in the experiment.
+type ExperimentConfig struct {
+	Name     string              `json:"name"`
+	Key      string              `json:"key"`
+	Header   string              `json:"header,omitempty"`
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+type ExperimentVariant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+func (c *ExperimentConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("name: must be set")
+	}
+	if !validSplitKey(c.Key) {
+		return errors.New(`key: must be "ip", "header:<name>" or "cookie:<name>"`)
+	}
+	names := make(map[string]bool)
+	total := 0
+	for i, variant := range c.Variants {
+		if variant.Name == "" {
+			return fmt.Errorf("variants[%d].name: must be set", i)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("variants[%d].name: %q is used by another variant", i, variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			return fmt.Errorf("variants[%d].weight: must not be negative", i)
+		}
+		total += variant.Weight
+	}
+	if total == 0 {
+		return errors.New("variants: at least one variant needs a weight")
+	}
+	return nil
+}
+
+func (c *ExperimentConfig) header() string {
+	if c.Header == "" {
+		return defaultExperimentHeader
+	}
+	return c.Header
+}
+
+// assign returns the variant r is assigned to and sets it in r's header,
+// or returns "" if r is not in the experiment.
+func (c *ExperimentConfig) assign(r *http.Request) string {
+	if c == nil {
+		return ""
+	}
+	r.Header.Del(c.header())
+	value, ok := splitKey(c.Key, r)
+	if !ok {
+		return ""
+	}
+	weights := make([]int, len(c.Variants))
+	for i, variant := range c.Variants {
+		weights[i] = variant.Weight
+	}
+	i := pickWeighted(weights, hashPoint(c.Name+":"+value))
+	if i < 0 {
+		return ""
+	}
+	r.Header.Set(c.header(), c.Variants[i].Name)
+	return c.Variants[i].Name
+}
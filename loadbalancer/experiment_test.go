@@ -0,0 +1,66 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"loadbalancer/metrics"
+)
+
+func TestExperiment(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Checkout"))
+	}))
+	defer backend.Close()
+
+	registry := metrics.NewRegistry()
+	lb := NewLoadBalancer(Config{
+		Port:     "8080",
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Experiment: &ExperimentConfig{
+			Name:     "checkout",
+			Key:      "cookie:uid",
+			Header:   "X-Checkout",
+			Variants: []ExperimentVariant{{Name: "control", Weight: 50}, {Name: "one-page", Weight: 50}},
+		},
+	}, WithMetrics(NewMetrics(registry)))
+	defer lb.Close()
+
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		var variants []string
+		for j := 0; j < 2; j++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "uid", Value: fmt.Sprint(i)})
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, r)
+			variants = append(variants, w.Body.String())
+		}
+		if variants[0] != variants[1] {
+			t.Fatalf("Expected user %d to keep their variant, got %v", i, variants)
+		}
+		counts[variants[0]]++
+	}
+	if counts["control"] < 70 || counts["one-page"] < 70 {
+		t.Errorf("Expected users to be spread over both variants, got %v", counts)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Checkout", "one-page")
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Body.String() != "" {
+		t.Errorf("Expected a request without a key to stay out of the experiment, got %q", w.Body.String())
+	}
+
+	var exposition strings.Builder
+	registry.WriteTo(&exposition)
+	expected := fmt.Sprintf(`httpbalance_experiment_requests_total{listener="8080",experiment="checkout",variant="control",code="2xx"} %d`, 2*counts["control"])
+	if !strings.Contains(exposition.String(), expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, exposition.String())
+	}
+}
@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+)
+
+// FallbackConfig answers the requests that have no backend to go to,
+// because no route matches them and the listener has no backends of its
+// own or because none of the pool's backends is available. They are proxied
+// to Backends, a pool health checked like the listener's own, or when none
+// of those is available either answered with Status (default 503), Headers
+// and Body. A Body without a Content-Type header is sent as HTML.
+type FallbackConfig struct {
+	Backends []BackendConfig   `json:"backends,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+}
+
+func (c *FallbackConfig) validate() error {
+	if c.Status != 0 && (c.Status < 200 || c.Status > 599) {
+		return errors.New("status: must be an HTTP status from 200 to 599")
+	}
+	return nil
+}
+
+// static reports whether the fallback has a response of its own.
+func (c *FallbackConfig) static() bool {
+	return c.Status != 0 || c.Body != "" || len(c.Headers) > 0
+}
+
+// fallbackConfig returns the config of the fallback pool, set up like the
+// mirror's.
+func (c Config) fallbackConfig() Config {
+	fallback := c
+	fallback.Mirror = &MirrorConfig{Backends: c.Fallback.Backends}
+	return fallback.mirrorConfig()
+}
+
+// syncFallback gives the pool a fallback pool if config has one, reloading
+// the one it already has.
+func (lb *LoadBalancer) syncFallback(config Config) {
+	lb.mutex.Lock()
+	previous := lb.fallback
+	lb.mutex.Unlock()
+
+	var fallback *LoadBalancer
+	if config.Fallback != nil && len(config.Fallback.Backends) > 0 {
+		if previous != nil {
+			previous.Reload(config.fallbackConfig())
+			fallback = previous
+		} else {
+			fallback = NewLoadBalancer(config.fallbackConfig(), append(lb.options, withParent(lb))...)
+		}
+	} else if previous != nil {
+		previous.Close()
+	}
+
+	lb.mutex.Lock()
+	lb.fallback = fallback
+	lb.mutex.Unlock()
+}
+
+// serveFallback answers r, which has no backend to go to, from the
+// fallback pool or with the fallback response, and reports whether there
+// is a fallback.
+func (lb *LoadBalancer) serveFallback(w http.ResponseWriter, r *http.Request) bool {
+	lb.mutex.Lock()
+	config, pool := lb.config.Fallback, lb.fallback
+	lb.mutex.Unlock()
+	if config == nil {
+		return false
+	}
+	if pool != nil {
+		if backend, _ := pool.acquireBackend(r.Context()); backend != nil {
+			lb.logger.Debugf("Forwarding request %s to fallback backend %s", r.Header.Get(RequestIDHeader), backend.URL.String())
+			pool.forward(w, r, backend, nil)
+			return true
+		}
+	}
+	if !config.static() {
+		return false
+	}
+	lb.logger.Debugf("Answering request %s with the fallback response", r.Header.Get(RequestIDHeader))
+	serveStatic(w, config.Status, config.Headers, config.Body)
+	return true
+}
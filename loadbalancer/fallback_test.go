@@ -0,0 +1,54 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback " + r.URL.Path))
+	}))
+	defer fallback.Close()
+
+	lb := NewLoadBalancer(Config{
+		Fallback: &FallbackConfig{Backends: []BackendConfig{{URL: fallback.URL}}},
+		Routes: []RouteConfig{{
+			Name:       "api",
+			PathPrefix: "/api",
+			Backends:   []BackendConfig{{URL: down.URL}},
+			Fallback: &FallbackConfig{
+				Status:  http.StatusServiceUnavailable,
+				Headers: map[string]string{"Retry-After": "30"},
+				Body:    "<h1>Try again soon</h1>",
+			},
+		}},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/unrouted", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "fallback /unrouted" {
+		t.Errorf("Expected unrouted requests to go to the fallback pool, got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/api/orders", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" || w.Body.String() != "<h1>Try again soon</h1>" {
+		t.Errorf("Expected the route's fallback response with its pool down, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	lb.Reload(Config{
+		Fallback: &FallbackConfig{Status: http.StatusNotFound, Body: "nothing here"},
+		Routes:   []RouteConfig{{Name: "api", PathPrefix: "/api", Backends: []BackendConfig{{URL: down.URL}}}},
+	})
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/unrouted", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "nothing here" {
+		t.Errorf("Expected the fallback response once the pool is removed, got %d %q", w.Code, w.Body.String())
+	}
+}
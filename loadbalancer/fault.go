@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// FaultConfig injects faults into requests to test how clients cope:
+// DelayPercent of requests are held back for Delay before they are
+// proxied, and AbortPercent are answered with AbortStatus without reaching
+// a backend. A percentage left at 0 means every request.
+type FaultConfig struct {
+	Delay        Duration `json:"delay,omitempty"`
+	DelayPercent float64  `json:"delay_percent,omitempty"`
+	AbortStatus  int      `json:"abort_status,omitempty"`
+	AbortPercent float64  `json:"abort_percent,omitempty"`
+}
+
+func (c *FaultConfig) validate() error {
+	if c.Delay < 0 {
+		return errors.New("delay: must not be negative")
+	}
+	if c.DelayPercent < 0 || c.DelayPercent > 100 {
+		return errors.New("delay_percent: must be between 0 and 100")
+	}
+	if c.AbortStatus != 0 && (c.AbortStatus < 200 || c.AbortStatus > 599) {
+		return errors.New("abort_status: must be an HTTP status from 200 to 599")
+	}
+	if c.AbortPercent < 0 || c.AbortPercent > 100 {
+		return errors.New("abort_percent: must be between 0 and 100")
+	}
+	return nil
+}
+
+func hitPercent(percent float64) bool {
+	return percent == 0 || rand.Float64()*100 < percent
+}
+
+// SetFaultsEnabled turns fault injection on or off for the listener and
+// its routes on behalf of actor, without changing their config. It is on
+// to begin with.
+func (lb *LoadBalancer) SetFaultsEnabled(enabled bool, actor string) {
+	if lb.faultsOff.Swap(!enabled) == !enabled {
+		return
+	}
+	action, state := AuditFaultsDisabled, "disabled"
+	if enabled {
+		action, state = AuditFaultsEnabled, "enabled"
+	}
+	lb.logger.Infof("Fault injection %s on port %s", state, lb.listener)
+	lb.auditLog.Record(AuditEvent{Actor: actor, Action: action, Listener: lb.listener})
+}
+
+func (lb *LoadBalancer) faultsEnabled() bool {
+	listener := lb
+	for listener.parent != nil {
+		listener = listener.parent
+	}
+	return !listener.faultsOff.Load()
+}
+
+// injectFault delays r or answers it with the abort status as config says,
+// and reports whether the request is to be proxied.
+func (lb *LoadBalancer) injectFault(config *FaultConfig, w http.ResponseWriter, r *http.Request) bool {
+	if config == nil || !lb.faultsEnabled() {
+		return true
+	}
+	if config.Delay > 0 && hitPercent(config.DelayPercent) {
+		timer := time.NewTimer(time.Duration(config.Delay))
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+	}
+	if config.AbortStatus != 0 && hitPercent(config.AbortPercent) {
+		lb.logger.Debugf("Aborting request %s with injected status %d", r.Header.Get(RequestIDHeader), config.AbortStatus)
+		lb.recordError(r, nil, config.AbortStatus, "fault injected")
+		http.Error(w, "Fault injected", config.AbortStatus)
+		return false
+	}
+	return true
+}
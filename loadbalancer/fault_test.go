@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Routes: []RouteConfig{{
+			ServerNames: []string{"chaos.example.com"},
+			Backends:    []BackendConfig{{URL: backend.URL}},
+			Fault:       &FaultConfig{Delay: Duration(50 * time.Millisecond), AbortStatus: http.StatusServiceUnavailable, AbortPercent: 50},
+		}},
+	})
+	defer lb.Close()
+
+	chaos := func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: "chaos.example.com"}
+		return r
+	}
+	codes := make(map[int]int)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, chaos())
+		codes[w.Code]++
+	}
+	if codes[http.StatusServiceUnavailable] == 0 || codes[http.StatusOK] == 0 {
+		t.Errorf("Expected about half of the requests to be aborted, got %v", codes)
+	}
+	if elapsed := time.Since(start); elapsed < 20*50*time.Millisecond {
+		t.Errorf("Expected every request to be delayed, 20 took %v", elapsed)
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected requests outside the route to be left alone, got %d", w.Code)
+	}
+
+	lb.SetFaultsEnabled(false, "test")
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		lb.ServeHTTP(w, chaos())
+		if w.Code != http.StatusOK || time.Since(start) >= 50*time.Millisecond {
+			t.Fatalf("Expected no faults once disabled, got %d after %v", w.Code, time.Since(start))
+		}
+	}
+}
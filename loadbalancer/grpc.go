@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcCodes are the gRPC status codes by number.
+var grpcCodes = []string{
+	"ok", "cancelled", "unknown", "invalid_argument", "deadline_exceeded",
+	"not_found", "already_exists", "permission_denied", "resource_exhausted",
+	"failed_precondition", "aborted", "out_of_range", "unimplemented",
+	"internal", "unavailable", "data_loss", "unauthenticated",
+}
+
+const grpcUnavailable = 14
+
+// GRPCConfig proxies gRPC: requests reach the backends over HTTP/2, over
+// TLS to https:// backends and cleartext (h2c) to http:// ones, and a plain
+// listener also accepts h2c. RetryOn names the gRPC status codes (such as
+// unavailable) a retry policy retries on when a backend answers without
+// any message, default unavailable.
+type GRPCConfig struct {
+	RetryOn []string `json:"retry_on,omitempty"`
+}
+
+func (c *GRPCConfig) validate() error {
+	for _, name := range c.RetryOn {
+		if grpcCode(name) < 0 {
+			return fmt.Errorf("retry_on: %q is not a gRPC status code", name)
+		}
+	}
+	return nil
+}
+
+// retryCodes returns the codes of RetryOn.
+func (c *GRPCConfig) retryCodes() map[int]bool {
+	if c == nil {
+		return nil
+	}
+	codes := map[int]bool{grpcUnavailable: true}
+	if len(c.RetryOn) > 0 {
+		codes = make(map[int]bool)
+		for _, name := range c.RetryOn {
+			codes[grpcCode(name)] = true
+		}
+	}
+	return codes
+}
+
+// grpcCode returns the number of the status code called name, -1 if there
+// is none.
+func grpcCode(name string) int {
+	for code, codeName := range grpcCodes {
+		if strings.EqualFold(name, codeName) {
+			return code
+		}
+	}
+	return -1
+}
+
+// isGRPC reports whether r is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus returns the gRPC status of a response from its headers or
+// trailers, -1 if it has none.
+func grpcStatus(header http.Header) int {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		value = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return -1
+	}
+	return code
+}
+
+// grpcStatusName returns the name of the gRPC status of a response with
+// status and header. Responses without one, such as the balancer's own
+// errors, get the code gRPC clients make of their HTTP status.
+func grpcStatusName(status int, header http.Header) string {
+	code := grpcStatus(header)
+	if code < 0 {
+		switch status {
+		case http.StatusBadRequest:
+			code = 13
+		case http.StatusUnauthorized:
+			code = 16
+		case http.StatusForbidden:
+			code = 7
+		case http.StatusNotFound:
+			code = 12
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			code = grpcUnavailable
+		default:
+			code = 2
+		}
+	}
+	if code >= len(grpcCodes) {
+		return strconv.Itoa(code)
+	}
+	return grpcCodes[code]
+}
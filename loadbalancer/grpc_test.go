@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"loadbalancer/metrics"
+)
+
+func TestGRPCProxying(t *testing.T) {
+	var unavailableCalls atomic.Int32
+	unavailable := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		unavailableCalls.Add(1)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+	}), &http2.Server{}))
+	defer unavailable.Close()
+	serving := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcFrame([]byte("reply")))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}), &http2.Server{}))
+	defer serving.Close()
+
+	registry := metrics.NewRegistry()
+	lb := NewLoadBalancer(Config{
+		Port:     "8080",
+		Backends: []BackendConfig{{URL: unavailable.URL}, {URL: serving.URL}},
+		Retry:    &RetryConfig{Methods: []string{"POST"}},
+		GRPC:     &GRPCConfig{},
+	}, WithMetrics(NewMetrics(registry)))
+	defer lb.Close()
+	frontend := httptest.NewServer(lb.Handler())
+	defer frontend.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", frontend.URL+"/echo.Echo/Say", strings.NewReader(string(grpcFrame([]byte("hi")))))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Expected the call to go through over h2c, got %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != string(grpcFrame([]byte("reply"))) {
+			t.Fatalf("Expected the serving backend's reply, got %d %q", resp.StatusCode, body)
+		}
+		if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "done" {
+			t.Errorf("Expected the trailers to reach the client, got %v", resp.Trailer)
+		}
+	}
+	if unavailableCalls.Load() == 0 {
+		t.Error("Expected a call to be retried after UNAVAILABLE")
+	}
+
+	var exposition strings.Builder
+	registry.WriteTo(&exposition)
+	if expected := `httpbalance_grpc_requests_total{listener="8080",code="ok"} 2`; !strings.Contains(exposition.String(), expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, exposition.String())
+	}
+}
+
+func TestGRPCStatusName(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		header   http.Header
+		expected string
+	}{
+		{http.StatusOK, http.Header{"Grpc-Status": {"5"}}, "not_found"},
+		{http.StatusOK, http.Header{http.TrailerPrefix + "Grpc-Status": {"0"}}, "ok"},
+		{http.StatusServiceUnavailable, http.Header{}, "unavailable"},
+		{http.StatusNotFound, http.Header{}, "unimplemented"},
+		{http.StatusInternalServerError, http.Header{}, "unknown"},
+	} {
+		if name := grpcStatusName(test.status, test.header); name != test.expected {
+			t.Errorf("Expected %s for %d %v, got %s", test.expected, test.status, test.header, name)
+		}
+	}
+}
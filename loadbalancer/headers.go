@@ -0,0 +1,69 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// HeaderRules changes the headers of requests sent to backends or of
+// responses sent to clients: the headers in Remove are dropped, those in
+// Set replace any the message has and those in Add are added to them.
+type HeaderRules struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+func (rules *HeaderRules) validate() error {
+	for _, name := range rules.Remove {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("remove: %q is not a valid header name", name)
+		}
+	}
+	for field, values := range map[string]map[string]string{"add": rules.Add, "set": rules.Set} {
+		for name, value := range values {
+			if !httpguts.ValidHeaderFieldName(name) {
+				return fmt.Errorf("%s: %q is not a valid header name", field, name)
+			}
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("%s.%s: invalid value %q", field, name, value)
+			}
+		}
+	}
+	return nil
+}
+
+func (rules *HeaderRules) apply(header http.Header) {
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		header.Add(name, value)
+	}
+}
+
+// applyRequest returns r with the rules applied to the headers sent to
+// the backend, leaving r itself alone.
+func (rules *HeaderRules) applyRequest(r *http.Request) *http.Request {
+	if rules == nil {
+		return r
+	}
+	changed := r.WithContext(r.Context())
+	changed.Header = r.Header.Clone()
+	rules.apply(changed.Header)
+	return changed
+}
+
+func (lb *LoadBalancer) setResponseHeaders(resp *http.Response) {
+	lb.mutex.Lock()
+	rules := lb.config.ResponseHeaders
+	lb.mutex.Unlock()
+	if rules != nil {
+		rules.apply(resp.Header)
+	}
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Server", "nginx/1.25")
+		w.Header().Set("Cache-Control", "no-store")
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		RequestHeaders: &HeaderRules{
+			Add:    map[string]string{"X-Env": "prod"},
+			Set:    map[string]string{"X-Tenant": "acme"},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: &HeaderRules{
+			Set:    map[string]string{"Cache-Control": "public"},
+			Remove: []string{"Server"},
+		},
+	})
+	defer lb.Close()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tenant", "other")
+	r.Header.Set("X-Env", "dev")
+	r.Header.Set("Cookie", "session=1")
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+
+	if received.Get("X-Tenant") != "acme" || len(received.Values("X-Env")) != 2 || received.Get("Cookie") != "" {
+		t.Errorf("Expected the request header rules to apply, the backend got %v", received)
+	}
+	if r.Header.Get("X-Tenant") != "other" {
+		t.Errorf("Expected the client's request to be left alone, got %v", r.Header)
+	}
+	if w.Header().Get("Server") != "" || w.Header().Get("Cache-Control") != "public" {
+		t.Errorf("Expected the response header rules to apply, got %v", w.Header())
+	}
+}
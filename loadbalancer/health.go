@@ -0,0 +1,234 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type healthChecker interface {
+	check(target *url.URL) error
+}
+
+type httpHealthChecker struct {
+	client  *http.Client
+	path    string
+	headers map[string]string
+}
+
+func (c *httpHealthChecker) check(target *url.URL) error {
+	req, err := http.NewRequest(http.MethodGet, target.String()+c.path, nil)
+	if err != nil {
+		return err
+	}
+	setProbeHeaders(req, c.headers)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type tcpHealthChecker struct {
+	timeout time.Duration
+}
+
+func (c *tcpHealthChecker) check(target *url.URL) error {
+	conn, err := net.DialTimeout("tcp", hostPort(target), c.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func setProbeHeaders(req *http.Request, headers map[string]string) {
+	for name, value := range headers {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// hostPort returns the dial address of target, filling in the default port
+// for its scheme when the URL doesn't carry one.
+func hostPort(target *url.URL) string {
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(target.Hostname(), port)
+}
+
+func (lb *LoadBalancer) newHealthChecker(config HealthCheckConfig) (healthChecker, error) {
+	timeout := time.Duration(config.Timeout)
+
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		var err error
+		if tlsConfig, err = config.TLS.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.Type {
+	case HealthCheckHTTP:
+		client := &http.Client{Transport: lb.client.Transport, Timeout: timeout}
+		if tlsConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			client.Transport = transport
+		}
+		return &httpHealthChecker{client: client, path: config.Path, headers: config.Headers}, nil
+	case HealthCheckTCP:
+		return &tcpHealthChecker{timeout: timeout}, nil
+	case HealthCheckGRPC:
+		return newGRPCHealthChecker(config.Service, timeout, config.Headers, tlsConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown health check type %q", config.Type)
+	}
+}
+
+// probe checks backend right now, ignoring results cached by the prober.
+func (lb *LoadBalancer) probe(backend *Backend) bool {
+	return lb.prober.check(backend.probeKey, backend.URL, backend.checker, 0) == nil
+}
+
+// restartHealthChecks replaces the periodic health check loop with one
+// using the given interval and jitter. A non-positive interval only stops
+// the current loop.
+func (lb *LoadBalancer) restartHealthChecks(config HealthCheckConfig) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.stopChecks != nil {
+		close(lb.stopChecks)
+		lb.stopChecks = nil
+	}
+	if config.Interval > 0 {
+		lb.stopChecks = make(chan struct{})
+		lb.startHealthChecks(time.Duration(config.Interval), time.Duration(config.Jitter), lb.stopChecks)
+	}
+}
+
+// startHealthChecks re-runs the health check every interval plus a random
+// delay of up to jitter, so several balancers sharing backends drift apart
+// instead of probing in lockstep. Within a cycle the probes are spread
+// evenly across the jitter window.
+func (lb *LoadBalancer) startHealthChecks(interval, jitter time.Duration, stop chan struct{}) {
+	go func() {
+		for {
+			timer := time.NewTimer(interval + randomDuration(jitter))
+			select {
+			case <-lb.done:
+				timer.Stop()
+				return
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				lb.runHealthCheck(jitter)
+			}
+		}
+	}()
+}
+
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (lb *LoadBalancer) healthCheck() {
+	lb.runHealthCheck(0)
+}
+
+// runHealthCheck probes every backend in the pool, running at most
+// health_check.concurrency probes at a time so a few slow backends can't
+// stall the whole cycle. Probe i is started i*spread/len(pool) into the cycle.
+func (lb *LoadBalancer) runHealthCheck(spread time.Duration) {
+	var (
+		wg      sync.WaitGroup
+		healthy int
+		counter sync.Mutex
+	)
+
+	lb.mutex.Lock()
+	select {
+	case <-lb.done:
+		lb.mutex.Unlock()
+		return
+	default:
+	}
+	// Added under the lock, so Close either sees the cycle or it sees
+	// done closed.
+	lb.checks.Add(1)
+	defer lb.checks.Done()
+	pool := lb.pool
+	interval := lb.healthInterval
+	slots := make(chan struct{}, lb.healthConcurrency)
+	lb.mutex.Unlock()
+
+	for i, backend := range pool {
+		if spread > 0 && i > 0 {
+			select {
+			case <-lb.done:
+				// The probes already on their way finish first.
+				wg.Wait()
+				return
+			case <-time.After(spread / time.Duration(len(pool))):
+			}
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(backend *Backend) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := lb.prober.check(backend.probeKey, backend.URL, backend.checker, interval)
+			lb.metrics.healthChecked(lb.listener, backend, err)
+			if err != nil {
+				lb.logger.Warnf("Backend %s is unavailable: %v", backend.URL.String(), err)
+			} else {
+				counter.Lock()
+				healthy++
+				counter.Unlock()
+			}
+
+			backend.mutex.Lock()
+			changed := backend.healthy != (err == nil)
+			backend.healthy = err == nil
+			backend.passed = backend.passed || err == nil
+			backend.mutex.Unlock()
+
+			if changed && err != nil {
+				lb.emitHealthEvent(backend, false, "health check failed: "+err.Error())
+			} else if changed {
+				lb.emitHealthEvent(backend, true, "health check passed")
+			}
+		}(backend)
+	}
+	wg.Wait()
+
+	lb.refreshBackends()
+	// Listeners and routes that only route, split or redirect have no pool.
+	if healthy == 0 && len(pool) > 0 && !time.Now().Before(lb.graceUntil) {
+		lb.logger.Errorf("All backends are unavailable, serving 503 until one recovers")
+	}
+}
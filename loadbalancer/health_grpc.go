@@ -0,0 +1,153 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcServingStatus   = 1
+)
+
+// grpcHealthChecker implements the standard grpc.health.v1.Health/Check
+// probe. The request and response messages are small enough that they are
+// encoded by hand instead of depending on the protobuf runtime.
+type grpcHealthChecker struct {
+	service string
+	timeout time.Duration
+	headers map[string]string
+	client  *http.Client
+}
+
+func newGRPCHealthChecker(service string, timeout time.Duration, headers map[string]string, tlsConfig *tls.Config) *grpcHealthChecker {
+	return &grpcHealthChecker{
+		service: service,
+		timeout: timeout,
+		headers: headers,
+		client:  &http.Client{Transport: newHTTP2Transport(tlsConfig, nil, nil)},
+	}
+}
+
+func (c *grpcHealthChecker) check(target *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	endpoint := *target
+	endpoint.Path = grpcHealthCheckPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(grpcFrame(encodeHealthCheckRequest(c.service))))
+	if err != nil {
+		return err
+	}
+	setProbeHeaders(req, c.headers)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	if grpcStatus != "0" {
+		return fmt.Errorf("grpc status %s: %s", grpcStatus, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	message, err := readGRPCFrame(body)
+	if err != nil {
+		return err
+	}
+	status, err := decodeHealthCheckResponse(message)
+	if err != nil {
+		return err
+	}
+	if status != grpcServingStatus {
+		return fmt.Errorf("service is not serving (status %d)", status)
+	}
+	return nil
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+func readGRPCFrame(data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, errors.New("short grpc response")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("compressed grpc responses are not supported")
+	}
+	length := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < length {
+		return nil, errors.New("truncated grpc response")
+	}
+	return data[5 : 5+length], nil
+}
+
+// encodeHealthCheckRequest encodes HealthCheckRequest{service = 1}.
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	message := []byte{0x0a}
+	message = binary.AppendUvarint(message, uint64(len(service)))
+	return append(message, service...)
+}
+
+// decodeHealthCheckResponse extracts the status field (1, varint) of a
+// HealthCheckResponse, skipping any fields it doesn't know.
+func decodeHealthCheckResponse(message []byte) (uint64, error) {
+	var status uint64
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("malformed health check response")
+		}
+		message = message[n:]
+
+		switch key & 0x7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("malformed health check response")
+			}
+			message = message[n:]
+			if key>>3 == 1 {
+				status = value
+			}
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0, errors.New("malformed health check response")
+			}
+			message = message[n+int(length):]
+		default:
+			return 0, fmt.Errorf("unsupported wire type %d in health check response", key&0x7)
+		}
+	}
+	return status, nil
+}
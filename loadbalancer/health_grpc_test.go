@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newGRPCHealthServer(status byte) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcHealthCheckPath || r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcFrame([]byte{0x08, status}))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	serving := newGRPCHealthServer(grpcServingStatus)
+	defer serving.Close()
+	notServing := newGRPCHealthServer(2)
+	defer notServing.Close()
+
+	checker := newGRPCHealthChecker("", time.Second, nil, nil)
+
+	servingURL, _ := url.Parse(serving.URL)
+	if err := checker.check(servingURL); err != nil {
+		t.Errorf("Expected serving backend to pass, got %v", err)
+	}
+
+	notServingURL, _ := url.Parse(notServing.URL)
+	if err := checker.check(notServingURL); err == nil {
+		t.Error("Expected not-serving backend to fail")
+	}
+}
@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTCPHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer httpServer.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{URL: httpServer.URL},
+			{URL: "http://" + listener.Addr().String(), HealthCheck: &HealthCheckConfig{Type: HealthCheckTCP}},
+		},
+	})
+
+	if len(lb.backends) != 2 {
+		t.Errorf("Expected 2 healthy backends, got %d", len(lb.backends))
+	}
+}
+
+func TestBackendConfigAcceptsStringOrObject(t *testing.T) {
+	var config Config
+	data := `{"backends": ["http://a:80", {"url": "http://b:80", "health_check": {"type": "tcp"}}]}`
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Backends) != 2 || config.Backends[0].URL != "http://a:80" || config.Backends[1].URL != "http://b:80" {
+		t.Fatalf("Unexpected backends: %+v", config.Backends)
+	}
+	if config.Backends[1].HealthCheck == nil || config.Backends[1].HealthCheck.Type != HealthCheckTCP {
+		t.Errorf("Expected tcp health check on second backend")
+	}
+}
+
+func TestHealthCheckTimeoutAndConcurrency(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	var backends []BackendConfig
+	for i := 0; i < 5; i++ {
+		backends = append(backends, BackendConfig{URL: slow.URL})
+	}
+	backends = append(backends, BackendConfig{URL: slow.URL, HealthCheck: &HealthCheckConfig{Timeout: Duration(50 * time.Millisecond)}})
+
+	start := time.Now()
+	lb := NewLoadBalancer(Config{
+		Backends:    backends,
+		HealthCheck: HealthCheckConfig{Timeout: Duration(time.Second), Concurrency: 6},
+	})
+	elapsed := time.Since(start)
+
+	if len(lb.backends) != 5 {
+		t.Errorf("Expected the backend with a short timeout to fail, got %d healthy backends", len(lb.backends))
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected probes to run concurrently, health check took %v", elapsed)
+	}
+}
+
+func TestPeriodicHealthCheckRecoversBackend(t *testing.T) {
+	var recovered atomic.Bool
+	flapping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !recovered.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer flapping.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:    []BackendConfig{{URL: flapping.URL}, {URL: healthy.URL}},
+		HealthCheck: HealthCheckConfig{Interval: Duration(20 * time.Millisecond), Jitter: Duration(10 * time.Millisecond)},
+	})
+	defer lb.Close()
+
+	recovered.Store(true)
+	time.Sleep(200 * time.Millisecond)
+
+	lb.mutex.Lock()
+	count := len(lb.backends)
+	lb.mutex.Unlock()
+	if count != 2 {
+		t.Errorf("Expected recovered backend to be back in rotation, got %d backends", count)
+	}
+}
+
+func TestGracePeriodKeepsUnprobedBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:    []BackendConfig{{URL: backend.URL}},
+		HealthCheck: HealthCheckConfig{GracePeriod: Duration(100 * time.Millisecond)},
+	})
+	defer lb.Close()
+
+	if lb.AvailableBackends() != 1 {
+		t.Errorf("Expected backend to stay eligible during the grace period, got %d", lb.AvailableBackends())
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if lb.AvailableBackends() != 0 {
+		t.Errorf("Expected backend to leave rotation after the grace period, got %d", lb.AvailableBackends())
+	}
+}
+
+func TestDefaultsAreLayeredUnderListenersAndBackends(t *testing.T) {
+	var config Config
+	data := `{
+		"defaults": {"strategy": "random", "health_check": {"type": "tcp", "timeout": "3s", "path": "/ping"}},
+		"listeners": [
+			{"port": "8081", "backends": ["http://a:80"], "health_check": {"timeout": "1s"}},
+			{"port": "8082", "strategy": "least_connections", "backends": [{"url": "http://b:80", "health_check": {"type": "http"}}]}
+		]
+	}`
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := config.ListenerConfigs()
+	if len(listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(listeners))
+	}
+
+	first := listeners[0].Backends[0].healthCheck(listeners[0].HealthCheck)
+	if first.Type != HealthCheckTCP || time.Duration(first.Timeout) != time.Second || listeners[0].Strategy != StrategyRandom {
+		t.Errorf("Expected defaults with the listener's timeout, got %+v (strategy %q)", first, listeners[0].Strategy)
+	}
+
+	second := listeners[1].Backends[0].healthCheck(listeners[1].HealthCheck)
+	if second.Type != HealthCheckHTTP || second.Path != "/ping" || time.Duration(second.Timeout) != 3*time.Second {
+		t.Errorf("Expected the backend's type on top of the defaults, got %+v", second)
+	}
+	if listeners[1].Strategy != StrategyLeastConnections {
+		t.Errorf("Expected the listener's strategy to win, got %q", listeners[1].Strategy)
+	}
+}
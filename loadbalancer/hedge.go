@@ -0,0 +1,230 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHedgeDelay = 50 * time.Millisecond
+
+// HedgeConfig sends a request to a second backend as well when the first
+// has not started answering within Delay (default 50ms), and answers with
+// whichever response comes first, cancelling the other request. Only the
+// idempotent Methods are hedged by default, and only requests with a body
+// of up to 64 KB, which is buffered to be sent twice.
+type HedgeConfig struct {
+	Delay   Duration `json:"delay,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (c *HedgeConfig) validate() error {
+	if c.Delay < 0 {
+		return errors.New("delay: must not be negative")
+	}
+	for _, method := range c.Methods {
+		if method == "" {
+			return errors.New("methods: must not contain empty methods")
+		}
+	}
+	return nil
+}
+
+func (c *HedgeConfig) delay() time.Duration {
+	if c.Delay == 0 {
+		return defaultHedgeDelay
+	}
+	return time.Duration(c.Delay)
+}
+
+// eligible reports whether r may be hedged. Upgrades are not, as only one
+// backend can take over the connection.
+func (c *HedgeConfig) eligible(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	for _, method := range methods {
+		if strings.EqualFold(method, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// hedgeRace decides which of a request's attempts answers the client: the
+// first to write its response header.
+type hedgeRace struct {
+	mutex    sync.Mutex
+	winner   *hedgeWriter
+	attempts []*hedgeWriter
+}
+
+// hedgeWriter is the response writer of one attempt. Until the race is
+// decided headers are collected apart; the winner's then go to the client
+// and the other attempts are cancelled.
+type hedgeWriter struct {
+	http.ResponseWriter
+	race    *hedgeRace
+	backend *Backend
+	header  http.Header
+	cancel  context.CancelFunc
+
+	wroteHeader bool
+	// panicked holds what the attempt panicked with, to be rethrown on
+	// the handler's goroutine.
+	panicked any
+}
+
+var errHedgeLost = errors.New("another backend answered first")
+
+func (w *hedgeWriter) lost() bool {
+	w.race.mutex.Lock()
+	defer w.race.mutex.Unlock()
+	return w.race.winner != nil && w.race.winner != w
+}
+
+func (w *hedgeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *hedgeWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.race.mutex.Lock()
+	if w.race.winner != nil {
+		w.race.mutex.Unlock()
+		return
+	}
+	w.race.winner = w
+	for _, attempt := range w.race.attempts {
+		if attempt != w {
+			attempt.cancel()
+		}
+	}
+	w.race.mutex.Unlock()
+
+	header := w.ResponseWriter.Header()
+	for name := range header {
+		delete(header, name)
+	}
+	for name, values := range w.header {
+		header[name] = values
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *hedgeWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.lost() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *hedgeWriter) Flush() {
+	if w.wroteHeader && !w.lost() {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// hedge proxies r to backend, and to a second backend too if the first
+// has not answered within the hedging delay. It returns the backend that
+// answered and gives back every backend's slot.
+func (lb *LoadBalancer) hedge(w http.ResponseWriter, r *http.Request, backend *Backend, config *HedgeConfig) *Backend {
+	body, replayable := bufferBody(r, defaultRetryMaxBodyBytes)
+	if !replayable {
+		return lb.forward(w, r, backend, nil)
+	}
+
+	race := &hedgeRace{}
+	header := w.Header().Clone()
+	done := make(chan *hedgeWriter, 2)
+	// start sends an attempt to backend unless the race is already
+	// decided, and reports whether it did.
+	start := func(backend *Backend) bool {
+		ctx, cancel := context.WithCancel(r.Context())
+		hw := &hedgeWriter{ResponseWriter: w, race: race, backend: backend, header: header.Clone(), cancel: cancel}
+		race.mutex.Lock()
+		if race.winner != nil {
+			race.mutex.Unlock()
+			cancel()
+			return false
+		}
+		race.attempts = append(race.attempts, hw)
+		race.mutex.Unlock()
+
+		attempt := r.Clone(ctx)
+		if body != nil {
+			attempt.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		go func() {
+			defer func() {
+				// The proxy panics with http.ErrAbortHandler when
+				// copying a response fails, as it does for a
+				// cancelled attempt.
+				hw.panicked = recover()
+				cancel()
+				lb.releaseBackend(backend)
+				done <- hw
+			}()
+			backend.serve(hw, attempt)
+		}()
+		return true
+	}
+	start(backend)
+
+	timer := time.NewTimer(config.delay())
+	select {
+	case hw := <-done:
+		timer.Stop()
+		return hw.finish()
+	case <-r.Context().Done():
+		timer.Stop()
+		return (<-done).finish()
+	case <-timer.C:
+	}
+
+	second, _ := lb.acquireBackend(r.Context(), backend)
+	hedged := false
+	if second != nil && second != backend {
+		hedged = start(second)
+	}
+	if !hedged {
+		if second != nil {
+			lb.releaseBackend(second)
+		}
+		return (<-done).finish()
+	}
+	lb.logger.Debugf("Hedging request %s to %s after %v", r.Header.Get(RequestIDHeader), second.URL.String(), config.delay())
+	lb.metrics.requestHedged(lb.listener)
+
+	winner, loser := <-done, <-done
+	if winner.lost() {
+		winner, loser = loser, winner
+	}
+	if loser.panicked != http.ErrAbortHandler {
+		loser.finish()
+	}
+	return winner.finish()
+}
+
+// finish rethrows a panic of the attempt and returns its backend.
+func (w *hedgeWriter) finish() *Backend {
+	if w.panicked != nil {
+		panic(w.panicked)
+	}
+	return w.backend
+}
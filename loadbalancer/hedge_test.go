@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadbalancer/metrics"
+)
+
+func TestHedgeAnswersWithTheFasterBackend(t *testing.T) {
+	var cancelled atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.Header().Set("X-Backend", "slow")
+		select {
+		case <-time.After(time.Second):
+			w.Write([]byte("slow"))
+		case <-r.Context().Done():
+			cancelled.Add(1)
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	registry := metrics.NewRegistry()
+	lb := NewLoadBalancer(Config{
+		Port:     "8080",
+		Backends: []BackendConfig{{URL: slow.URL}, {URL: fast.URL}},
+		Hedge:    &HedgeConfig{Delay: Duration(10 * time.Millisecond)},
+	}, WithMetrics(NewMetrics(registry)))
+	defer lb.Close()
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Body.String() != "fast" || w.Header().Get("X-Backend") != "" {
+			t.Errorf("Expected request %d to be answered by the fast backend alone, got %q with %v", i+1, w.Body.String(), w.Header())
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected request %d not to wait for the slow backend, took %v", i+1, elapsed)
+		}
+	}
+	if cancelled.Load() == 0 {
+		t.Error("Expected the slow backend's requests to be cancelled")
+	}
+
+	var exposition strings.Builder
+	registry.WriteTo(&exposition)
+	if !strings.Contains(exposition.String(), `httpbalance_hedged_requests_total{listener="8080"}`) {
+		t.Errorf("Expected hedged requests to be counted, got:\n%s", exposition.String())
+	}
+
+	// POST is not idempotent, so it waits for the slow backend.
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if !strings.Contains(w.Body.String(), "slow") {
+		t.Errorf("Expected POST requests not to be hedged, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,143 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP2Config sets up HTTP/2 on a listener. HTTPS listeners speak it with
+// clients that offer it anyway; H2C also accepts cleartext HTTP/2 on a
+// plain listener. MaxConcurrentStreams caps the requests a client may have
+// in flight on one connection (default 250).
+type HTTP2Config struct {
+	H2C                  bool   `json:"h2c,omitempty"`
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams,omitempty"`
+}
+
+func (c *HTTP2Config) server() *http2.Server {
+	if c == nil {
+		return &http2.Server{}
+	}
+	return &http2.Server{MaxConcurrentStreams: c.MaxConcurrentStreams}
+}
+
+// ConfigureServer applies the settings to server, which serves HTTP/2
+// with its defaults without them.
+func (c *HTTP2Config) ConfigureServer(server *http.Server) error {
+	if c == nil {
+		return nil
+	}
+	return http2.ConfigureServer(server, c.server())
+}
+
+// BackendHTTP2Config makes the balancer speak HTTP/2 to backends, over TLS
+// to https:// backends and cleartext (h2c) to http:// ones, with requests
+// sharing connections. A connection that has been quiet for ReadIdleTimeout
+// is pinged, and closed when the ping is not answered within PingTimeout
+// (default 15s). With StrictMaxConcurrentStreams, requests wait for a
+// stream once a connection carries as many as the backend allows, rather
+// than opening another connection.
+type BackendHTTP2Config struct {
+	ReadIdleTimeout            Duration `json:"read_idle_timeout,omitempty"`
+	PingTimeout                Duration `json:"ping_timeout,omitempty"`
+	StrictMaxConcurrentStreams bool     `json:"strict_max_concurrent_streams,omitempty"`
+}
+
+func (c *BackendHTTP2Config) validate() error {
+	if c.ReadIdleTimeout < 0 {
+		return errors.New("read_idle_timeout: must not be negative")
+	}
+	if c.PingTimeout < 0 {
+		return errors.New("ping_timeout: must not be negative")
+	}
+	return nil
+}
+
+// backendHTTP2 returns how HTTP/2 is spoken to the backends, nil if it is
+// not. gRPC needs it.
+func (c Config) backendHTTP2() *BackendHTTP2Config {
+	if c.BackendHTTP2 == nil && c.GRPC != nil {
+		return &BackendHTTP2Config{}
+	}
+	return c.BackendHTTP2
+}
+
+// http2Transport speaks HTTP/2 over TLS to https:// targets and cleartext
+// HTTP/2 (h2c) to http:// targets.
+type http2Transport struct {
+	h2c *http2.Transport
+	tls *http2.Transport
+}
+
+func newHTTP2Transport(tlsConfig *tls.Config, timeouts *TimeoutsConfig, settings *BackendHTTP2Config) http2Transport {
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	if timeouts != nil && timeouts.Dial > 0 {
+		dialer.Timeout = time.Duration(timeouts.Dial)
+	}
+	t := http2Transport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		tls: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+				tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config}
+				return tlsDialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	if settings != nil {
+		for _, transport := range []*http2.Transport{t.h2c, t.tls} {
+			transport.ReadIdleTimeout = time.Duration(settings.ReadIdleTimeout)
+			transport.PingTimeout = time.Duration(settings.PingTimeout)
+			transport.StrictMaxConcurrentStreams = settings.StrictMaxConcurrentStreams
+		}
+	}
+	return t
+}
+
+func (t http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.tls.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+// acceptsH2C reports whether the listener takes cleartext HTTP/2: when
+// its http2 settings say so, or when it or one of its routes proxies gRPC.
+func (lb *LoadBalancer) acceptsH2C() bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.config.HTTP2 != nil && lb.config.HTTP2.H2C || lb.config.GRPC != nil {
+		return true
+	}
+	for _, route := range lb.config.Routes {
+		if route.GRPC != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns lb as the handler of a plain HTTP server, taking
+// cleartext HTTP/2 too while the listener accepts it.
+func (lb *LoadBalancer) Handler() http.Handler {
+	withH2C := h2c.NewHandler(lb, lb.Config().HTTP2.server())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lb.acceptsH2C() {
+			withH2C.ServeHTTP(w, r)
+			return
+		}
+		lb.ServeHTTP(w, r)
+	})
+}
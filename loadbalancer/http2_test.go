@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestHTTP2(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		HTTP2:    &HTTP2Config{H2C: true},
+		Routes: []RouteConfig{{
+			PathPrefix:   "/h2",
+			Backends:     []BackendConfig{{URL: backend.URL}},
+			BackendHTTP2: &BackendHTTP2Config{StrictMaxConcurrentStreams: true},
+		}},
+	})
+	defer lb.Close()
+	frontend := httptest.NewServer(lb.Handler())
+	defer frontend.Close()
+
+	newH2CClient := func() *http.Client {
+		return &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}}
+	}
+	h2cClient := newH2CClient()
+	get := func(client *http.Client, path string) string {
+		resp, err := client.Get(frontend.URL + path)
+		if err != nil {
+			t.Fatalf("Expected %s to be answered, got %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Proto + " " + string(body)
+	}
+	if proto := get(h2cClient, "/h2"); proto != "HTTP/2.0 HTTP/2.0" {
+		t.Errorf("Expected HTTP/2 from the client to the backend, got %q", proto)
+	}
+	if proto := get(h2cClient, "/"); proto != "HTTP/2.0 HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 to backends without backend_http2, got %q", proto)
+	}
+	if proto := get(http.DefaultClient, "/h2"); proto != "HTTP/1.1 HTTP/2.0" {
+		t.Errorf("Expected HTTP/1.1 clients to be served too, got %q", proto)
+	}
+
+	lb.Reload(Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	if _, err := newH2CClient().Get(frontend.URL + "/"); err == nil {
+		t.Error("Expected h2c to be refused once switched off")
+	}
+}
+
+func TestHTTP2ConfigureServer(t *testing.T) {
+	server := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1"}}}
+	if err := (&HTTP2Config{MaxConcurrentStreams: 10}).ConfigureServer(server); err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSNextProto["h2"] == nil || !strings.Contains(strings.Join(server.TLSConfig.NextProtos, ","), "h2") {
+		t.Error("Expected the server to be set up for HTTP/2")
+	}
+}
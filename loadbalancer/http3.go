@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Config serves HTTP/3 over QUIC next to an HTTPS listener, on UDP
+// Port (default the listener's own port), and advertises it to clients in
+// Alt-Svc for MaxAge (default 24h). Backends are still reached over
+// HTTP/1.1 or HTTP/2. Experimental.
+type HTTP3Config struct {
+	Port   string   `json:"port,omitempty"`
+	MaxAge Duration `json:"max_age,omitempty"`
+}
+
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+func (c *HTTP3Config) validate() error {
+	if c.Port != "" {
+		if err := validatePort(c.Port); err != nil {
+			return fmt.Errorf("port: %v", err)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("max_age: must not be negative")
+	}
+	return nil
+}
+
+func (c *HTTP3Config) port(listenerPort string) string {
+	if c.Port == "" {
+		return listenerPort
+	}
+	return c.Port
+}
+
+// HTTP3Server is the QUIC server of an HTTPS listener. It counts the
+// requests it serves so that Shutdown can wait for them, which quic-go's
+// own server can't.
+type HTTP3Server struct {
+	*http3.Server
+	requests requestTracker
+}
+
+// Server returns the QUIC server of the HTTPS listener on listenerPort,
+// serving handler with the listener's tlsConfig.
+func (c *HTTP3Config) Server(listenerPort string, handler http.Handler, tlsConfig *tls.Config) *HTTP3Server {
+	s := &HTTP3Server{}
+	s.Server = &http3.Server{
+		Addr: ":" + c.port(listenerPort),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Once shutting down, the balancer refuses the request itself.
+			if s.requests.start() {
+				defer s.requests.finish()
+			}
+			handler.ServeHTTP(w, r)
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+	}
+	return s
+}
+
+// Shutdown waits for the requests in flight to finish until ctx is done,
+// and closes the server then.
+func (s *HTTP3Server) Shutdown(ctx context.Context) error {
+	var err error
+	select {
+	case <-s.requests.close():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Advertise makes handler announce the HTTP/3 server of the listener on
+// listenerPort in the Alt-Svc header of responses sent over TCP.
+func (c *HTTP3Config) Advertise(listenerPort string, handler http.Handler) http.Handler {
+	maxAge := time.Duration(c.MaxAge)
+	if maxAge == 0 {
+		maxAge = defaultAltSvcMaxAge
+	}
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=%d`, c.port(listenerPort), int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	defer backend.Close()
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	defer lb.Close()
+
+	certFile, keyFile, cert := writeTestCertificate(t, t.TempDir(), "server")
+	store, err := NewCertificateStore(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &HTTP3Config{Port: "8443"}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := config.Server("443", lb.Handler(), store.TLSConfig())
+	if server.Addr != ":8443" {
+		t.Errorf("Expected the QUIC server on UDP 8443, got %s", server.Addr)
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	transport := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "server"}}
+	defer transport.Close()
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Expected an HTTP/3 request to go through, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || string(body) != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/3 to the client and HTTP/1.1 to the backend, got %s and %q", resp.Proto, body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("Expected no Alt-Svc over HTTP/3, got %q", resp.Header.Get("Alt-Svc"))
+	}
+
+	recorder := httptest.NewRecorder()
+	config.Advertise("443", lb.Handler()).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if altSvc := recorder.Header().Get("Alt-Svc"); altSvc != `h3=":8443"; ma=86400` {
+		t.Errorf("Expected HTTP/3 to be advertised on TCP responses, got %q", altSvc)
+	}
+}
+
+func TestHTTP3ShutdownWaitsForRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "done")
+	}))
+	defer backend.Close()
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	defer lb.Close()
+
+	certFile, keyFile, cert := writeTestCertificate(t, t.TempDir(), "server")
+	store, err := NewCertificateStore(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := (&HTTP3Config{}).Server("443", lb.Handler(), store.TLSConfig())
+	go server.Serve(conn)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	transport := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "server"}}
+	defer transport.Close()
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + conn.LocalAddr().String() + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		results <- result{string(body), err}
+	}()
+	select {
+	case <-started:
+	case result := <-results:
+		t.Fatalf("Expected the request to reach the backend, got %v", result.err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for the request in flight, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if result := <-results; result.err != nil || result.body != "done" {
+		t.Errorf("Expected the request in flight to finish, got %q, %v", result.body, result.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected Shutdown to return once the request finished, got %v", err)
+	}
+}
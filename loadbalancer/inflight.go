@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimitConfig caps the requests a listener proxies at once,
+// those of its routes included. Requests over MaxInFlight wait in a FIFO
+// queue of up to QueueSize for at most QueueTimeout (1s by default) and are
+// answered with 503 when the queue is full or the wait runs out.
+type ConcurrencyLimitConfig struct {
+	MaxInFlight  int      `json:"max_in_flight"`
+	QueueSize    int      `json:"queue_size,omitempty"`
+	QueueTimeout Duration `json:"queue_timeout,omitempty"`
+}
+
+const defaultQueueTimeout = time.Second
+
+func (c *ConcurrencyLimitConfig) validate() error {
+	if c.MaxInFlight <= 0 {
+		return errors.New("max_in_flight: must be positive")
+	}
+	if c.QueueSize < 0 {
+		return errors.New("queue_size: must not be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return errors.New("queue_timeout: must not be negative")
+	}
+	return nil
+}
+
+func (c *ConcurrencyLimitConfig) queueTimeout() time.Duration {
+	if c.QueueTimeout == 0 {
+		return defaultQueueTimeout
+	}
+	return time.Duration(c.QueueTimeout)
+}
+
+// inFlightLimiter hands out up to max slots. Requests that find none wait
+// in queue, each on a channel that is closed once a slot is theirs.
+type inFlightLimiter struct {
+	mutex     sync.Mutex
+	max       int
+	queueSize int
+	timeout   time.Duration
+	active    int
+	queue     list.List
+}
+
+func newInFlightLimiter(config *ConcurrencyLimitConfig) *inFlightLimiter {
+	l := &inFlightLimiter{}
+	l.configure(config)
+	return l
+}
+
+// configure applies a reloaded config without forgetting the requests in
+// flight. Waiters beyond a smaller queue keep their place.
+func (l *inFlightLimiter) configure(config *ConcurrencyLimitConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.max = config.MaxInFlight
+	l.queueSize = config.QueueSize
+	l.timeout = config.queueTimeout()
+	l.grant()
+}
+
+// acquire takes a slot, waiting for one in the queue if there is room,
+// and reports whether it got one. Callers that did give it back with
+// release.
+func (l *inFlightLimiter) acquire(ctx context.Context) bool {
+	l.mutex.Lock()
+	if l.active < l.max && l.queue.Len() == 0 {
+		l.active++
+		l.mutex.Unlock()
+		return true
+	}
+	if l.queue.Len() >= l.queueSize {
+		l.mutex.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	waiter := l.queue.PushBack(ready)
+	timer := time.NewTimer(l.timeout)
+	l.mutex.Unlock()
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-ready:
+		// The slot was handed over just as the wait ran out.
+		return true
+	default:
+		l.queue.Remove(waiter)
+		return false
+	}
+}
+
+func (l *inFlightLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	l.grant()
+}
+
+// grant hands free slots to the longest waiting requests. The caller holds
+// l.mutex.
+func (l *inFlightLimiter) grant() {
+	for l.active < l.max && l.queue.Len() > 0 {
+		ready := l.queue.Remove(l.queue.Front()).(chan struct{})
+		close(ready)
+		l.active++
+	}
+}
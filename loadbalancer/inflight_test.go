@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"loadbalancer/metrics"
+)
+
+func TestInFlightLimiterQueuesInOrder(t *testing.T) {
+	l := newInFlightLimiter(&ConcurrencyLimitConfig{MaxInFlight: 1, QueueSize: 2, QueueTimeout: Duration(time.Second)})
+	if !l.acquire(context.Background()) {
+		t.Fatal("Expected the first request to get a slot")
+	}
+
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		i := i
+		go func() {
+			if l.acquire(context.Background()) {
+				order <- i
+				l.release()
+			}
+		}()
+		for queued(l) < i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if l.acquire(context.Background()) {
+		t.Error("Expected a request to be refused once the queue is full")
+	}
+
+	l.release()
+	if first, second := <-order, <-order; first != 1 || second != 2 {
+		t.Errorf("Expected queued requests to be served in order, got %d then %d", first, second)
+	}
+}
+
+func TestInFlightLimiterQueueTimeout(t *testing.T) {
+	l := newInFlightLimiter(&ConcurrencyLimitConfig{MaxInFlight: 1, QueueSize: 1, QueueTimeout: Duration(20 * time.Millisecond)})
+	l.acquire(context.Background())
+
+	start := time.Now()
+	if l.acquire(context.Background()) {
+		t.Fatal("Expected the queued request to give up")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected the request to wait for the queue timeout, gave up after %v", elapsed)
+	}
+	if queued(l) != 0 {
+		t.Errorf("Expected the request to leave the queue, %d still queued", queued(l))
+	}
+
+	l.configure(&ConcurrencyLimitConfig{MaxInFlight: 2})
+	if !l.acquire(context.Background()) {
+		t.Error("Expected a raised limit to apply to the requests in flight")
+	}
+}
+
+func TestConcurrencyLimitShedsLoad(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	registry := metrics.NewRegistry()
+	lb := NewLoadBalancer(Config{
+		Port:             "8080",
+		Backends:         []BackendConfig{{URL: backend.URL}},
+		ConcurrencyLimit: &ConcurrencyLimitConfig{MaxInFlight: 1},
+	}, WithMetrics(NewMetrics(registry)))
+	defer lb.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	for activeSlots(lb.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 over the concurrency limit, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on a shed request")
+	}
+	close(release)
+	<-done
+
+	var exposition strings.Builder
+	registry.WriteTo(&exposition)
+	if !strings.Contains(exposition.String(), `httpbalance_shed_requests_total{listener="8080"} 1`) {
+		t.Error("Expected the shed request to be counted")
+	}
+}
+
+func queued(l *inFlightLimiter) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.queue.Len()
+}
+
+func activeSlots(l *inFlightLimiter) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.active
+}
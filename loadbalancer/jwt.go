@@ -0,0 +1,138 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadbalancer/jwt"
+)
+
+// JWTConfig requires requests to carry a valid JSON Web Token as a bearer
+// token. The signing keys come from one of JWKSURL, KeyFile (a PEM public
+// key or certificate) and Secret (HMAC). ClaimHeaders maps claims to the
+// request headers they are passed to backends in.
+type JWTConfig struct {
+	JWKSURL      string            `json:"jwks_url,omitempty"`
+	KeyFile      string            `json:"key_file,omitempty"`
+	Secret       string            `json:"secret,omitempty"`
+	Issuer       string            `json:"issuer,omitempty"`
+	Audience     []string          `json:"audience,omitempty"`
+	Leeway       Duration          `json:"leeway,omitempty"`
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+}
+
+func (c *JWTConfig) verifierConfig() jwt.Config {
+	return jwt.Config{
+		JWKSURL:  c.JWKSURL,
+		KeyFile:  c.KeyFile,
+		Secret:   c.Secret,
+		Issuer:   c.Issuer,
+		Audience: c.Audience,
+		Leeway:   time.Duration(c.Leeway),
+	}
+}
+
+func (c *JWTConfig) validate() error {
+	sources := 0
+	for _, source := range []string{c.JWKSURL, c.KeyFile, c.Secret} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of jwks_url, key_file and secret must be set")
+	}
+	if c.JWKSURL != "" {
+		if err := validateURL(c.JWKSURL); err != nil {
+			return fmt.Errorf("jwks_url: %v", err)
+		}
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("leeway: must not be negative")
+	}
+	return nil
+}
+
+// jwtAuth checks the bearer tokens of requests. A nil *jwtAuth lets every
+// request through; one without a verifier, whose keys failed to load, none.
+type jwtAuth struct {
+	verifier     *jwt.Verifier
+	claimHeaders map[string]string
+}
+
+func newJWTAuth(config *JWTConfig) (*jwtAuth, error) {
+	if config == nil {
+		return nil, nil
+	}
+	auth := &jwtAuth{claimHeaders: config.ClaimHeaders}
+	verifier, err := jwt.NewVerifier(config.verifierConfig())
+	if err != nil {
+		return auth, err
+	}
+	auth.verifier = verifier
+	return auth, nil
+}
+
+// admitJWT answers 401 to requests without a valid token. Accepted requests
+// get the configured claims as headers, replacing any the client sent.
+func (lb *LoadBalancer) admitJWT(auth *jwtAuth, w http.ResponseWriter, r *http.Request) bool {
+	if auth == nil {
+		return true
+	}
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if auth.verifier == nil {
+		lb.logger.Warnf("Rejecting request %s: the JWT keys could not be loaded", r.Header.Get(RequestIDHeader))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	claims, err := auth.verifier.Verify(token)
+	if err != nil {
+		lb.logger.Debugf("Rejecting request %s: %v", r.Header.Get(RequestIDHeader), err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	for claim, header := range auth.claimHeaders {
+		r.Header.Del(header)
+		if value, ok := claimValue(claims[claim]); ok {
+			r.Header.Set(header, value)
+		}
+	}
+	return true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// claimValue formats a claim for a header: strings and numbers as they
+// are, anything else as JSON.
+func claimValue(claim interface{}) (string, bool) {
+	switch value := claim.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	default:
+		data, err := json.Marshal(value)
+		return string(data), err == nil
+	}
+}
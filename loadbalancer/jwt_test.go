@@ -0,0 +1,73 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func hs256Token(secret string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		JWT: &JWTConfig{
+			Secret:       "secret",
+			Issuer:       "https://issuer",
+			ClaimHeaders: map[string]string{"sub": "X-User", "roles": "X-Roles"},
+		},
+		Routes: []RouteConfig{{
+			ServerNames: []string{"public.example.com"},
+			Backends:    []BackendConfig{{URL: backend.URL}},
+			JWT:         &JWTConfig{Secret: "other secret"},
+		}},
+	})
+	defer lb.Close()
+
+	valid := hs256Token("secret", map[string]interface{}{"iss": "https://issuer", "sub": "alice", "roles": []string{"admin"}})
+	for _, test := range []struct {
+		name, target, token string
+		expected            int
+	}{
+		{"valid", "http://example.com/", valid, http.StatusOK},
+		{"missing", "http://example.com/", "", http.StatusUnauthorized},
+		{"wrong issuer", "http://example.com/", hs256Token("secret", map[string]interface{}{"iss": "https://other"}), http.StatusUnauthorized},
+		{"route key", "https://public.example.com/", hs256Token("other secret", nil), http.StatusOK},
+		{"listener key on route", "https://public.example.com/", valid, http.StatusUnauthorized},
+	} {
+		received = nil
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Header.Set("X-User", "mallory")
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		recorder := httptest.NewRecorder()
+		lb.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expected, recorder.Code)
+		}
+		if test.expected == http.StatusUnauthorized && (received != nil || recorder.Header().Get("WWW-Authenticate") == "") {
+			t.Errorf("%s: expected a bearer challenge without reaching the backend", test.name)
+		}
+		if test.name == "valid" && (received.Get("X-User") != "alice" || received.Get("X-Roles") != `["admin"]`) {
+			t.Errorf("Expected the claims to be passed on, got X-User %q and X-Roles %q", received.Get("X-User"), received.Get("X-Roles"))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RequestLimitsConfig caps the size of requests before they reach a
+// backend. Zero leaves a limit off. Headers are also capped at 1 MB by the
+// HTTP server itself.
+type RequestLimitsConfig struct {
+	MaxBodyBytes   int64 `json:"max_body_bytes,omitempty"`
+	MaxHeaderBytes int   `json:"max_header_bytes,omitempty"`
+	MaxURLLength   int   `json:"max_url_length,omitempty"`
+}
+
+func (c *RequestLimitsConfig) validate() error {
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes: must not be negative")
+	}
+	if c.MaxHeaderBytes < 0 {
+		return fmt.Errorf("max_header_bytes: must not be negative")
+	}
+	if c.MaxURLLength < 0 {
+		return fmt.Errorf("max_url_length: must not be negative")
+	}
+	return nil
+}
+
+// headerSize returns the size of r's header section as sent on the wire
+// in HTTP/1.1, without the request line.
+func headerSize(r *http.Request) int {
+	size := len("Host: \r\n") + len(r.Host)
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(": \r\n") + len(value)
+		}
+	}
+	return size
+}
+
+// admitLimits turns away requests over the limits: 414 for the URL, 431
+// for the headers and 413 for a body whose declared length is too large.
+// Bodies of unknown length are cut off at the limit while they are
+// proxied, see isBodyTooLarge.
+func (lb *LoadBalancer) admitLimits(limits *RequestLimitsConfig, w http.ResponseWriter, r *http.Request) bool {
+	if limits == nil {
+		return true
+	}
+	if limits.MaxURLLength > 0 && len(r.URL.RequestURI()) > limits.MaxURLLength {
+		http.Error(w, "URI too long", http.StatusRequestURITooLong)
+		return false
+	}
+	if limits.MaxHeaderBytes > 0 && headerSize(r) > limits.MaxHeaderBytes {
+		http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	}
+	if limits.MaxBodyBytes > 0 {
+		if r.ContentLength > limits.MaxBodyBytes {
+			http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+		}
+	}
+	return true
+}
+
+// isBodyTooLarge reports whether a proxy error was caused by the request
+// body running over its limit, which is the client's fault rather than the
+// backend's.
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLimits(t *testing.T) {
+	var received int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = len(body)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:      []BackendConfig{{URL: backend.URL}},
+		RequestLimits: &RequestLimitsConfig{MaxBodyBytes: 10, MaxHeaderBytes: 200, MaxURLLength: 30},
+	})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		name, target, header, body string
+		chunked                    bool
+		expected                   int
+	}{
+		{"within limits", "/upload", "", "0123456789", false, http.StatusOK},
+		{"long URL", "/upload?query=" + strings.Repeat("x", 20), "", "", false, http.StatusRequestURITooLong},
+		{"large headers", "/upload", strings.Repeat("x", 200), "", false, http.StatusRequestHeaderFieldsTooLarge},
+		{"large body", "/upload", "", "0123456789a", false, http.StatusRequestEntityTooLarge},
+		{"large chunked body", "/upload", "", strings.Repeat("x", 1<<20), true, http.StatusRequestEntityTooLarge},
+	} {
+		received = -1
+		req := httptest.NewRequest("POST", test.target, strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set("X-Padding", test.header)
+		}
+		if test.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, w.Code)
+		}
+		if test.expected == http.StatusOK && received != len(test.body) {
+			t.Errorf("%s: expected the backend to get %d bytes, got %d", test.name, len(test.body), received)
+		}
+	}
+}
@@ -1,98 +1,888 @@
 package loadbalancer
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
-)
 
-type Config struct {
-	Port     string
-	Backends []string
-}
+	"loadbalancer/logging"
+	"loadbalancer/tracing"
+)
 
 type LoadBalancer struct {
-	config         Config
-	backends       []*url.URL
-	currentBackend int
-	mutex          sync.Mutex
-	client        *http.Client
+	config   Config
+	pool     []*Backend
+	backends []*Backend
+	mutex    sync.Mutex
+	client   *http.Client
+	outlier  *OutlierDetectionConfig
+	strategy string
+
+	// backendTLS is what proxied requests to https backends are made with,
+	// loaded from the config's backend_tls.
+	backendTLS *tls.Config
+
+	// securityHeaders are added to every proxied response, secureHeaders
+	// only to those sent over HTTPS.
+	securityHeaders http.Header
+	secureHeaders   http.Header
+
+	accessList     *accessList
+	trustedProxies []netip.Prefix
+	// proxyTrusted are the peers allowed to send a PROXY header.
+	proxyTrusted []netip.Prefix
+	jwt          *jwtAuth
+	credentials  *credentials
+	oidc         *oidcAuth
+	waf          *waf
+	rateLimit    *rateLimits
+	retry        *retryPolicy
+	inFlight     *inFlightLimiter
+	requests     requestTracker
+	mirror       *mirror
+	fallback     *LoadBalancer
+	errorPages   *errorPages
+	rewrite      *rewriter
+	redirect     *redirector
+	canary       *canaryRollout
+	// activeSwitched is the split pool the admin API gave all requests to
+	// while the configured active pool was activeConfigured.
+	activeSwitched   string
+	activeConfigured string
+	// faultsOff turns fault injection off for the listener and its
+	// routes.
+	faultsOff atomic.Bool
+	// maintenanceOn is set by the admin API to put the pool, and those of
+	// its routes, in maintenance.
+	maintenanceOn atomic.Bool
+
+	// released is closed, and replaced, when a request frees a backend
+	// slot while others wait for one. Both are guarded by mutex.
+	released chan struct{}
+	waiting  int
+
+	// poolMutex serializes pool rebuilds from reloads and DNS refreshes.
+	poolMutex sync.Mutex
+
+	healthConcurrency int
+	healthInterval    time.Duration
+	graceUntil        time.Time
+	prober            *Prober
+	stopChecks        chan struct{}
+
+	// listener names the load balancer in metrics; it is the port, which
+	// reloads never change.
+	listener  string
+	metrics   *Metrics
+	accessLog *AccessLog
+	auditLog  *AuditLog
+	logger    logging.Logger
+	tracer    *tracing.Tracer
+
+	lookupHost   func(ctx context.Context, host string) ([]string, error)
+	lookupSRV    func(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+	resolved     map[string][]BackendConfig
+	resolveDelay time.Duration
+	stopResolve  chan struct{}
+	watches      map[string]*discoveryWatch
+	usedWatches  map[string]bool
+
+	errorsMutex  sync.Mutex
+	recentErrors []RequestError
+
+	hooksMutex sync.Mutex
+	hooks      []func(HealthEvent)
+	webhooks   []func(HealthEvent)
+
+	// options are passed on to the load balancers of routes, which report
+	// to their parent.
+	options []Option
+	parent  *LoadBalancer
+	routes  []*route
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// checks tracks the health check cycles running, which Close waits
+	// for so that no probe changes a backend afterwards.
+	checks sync.WaitGroup
+	// reprobes are the timers re-probing ejected backends, which Close
+	// stops.
+	reprobes map[*time.Timer]bool
 }
 
-func NewLoadBalancer(config Config) *LoadBalancer {
+func NewLoadBalancer(config Config, options ...Option) *LoadBalancer {
 	lb := &LoadBalancer{
-		config:   config,
-		client:   &http.Client{Timeout: 5 * time.Second},
+		client:      &http.Client{Timeout: 5 * time.Second},
+		lookupHost:  net.DefaultResolver.LookupHost,
+		lookupSRV:   lookupSRV,
+		watches:     make(map[string]*discoveryWatch),
+		usedWatches: make(map[string]bool),
+		done:        make(chan struct{}),
+		options:     options,
+	}
+	for _, option := range options {
+		option(lb)
+	}
+	if lb.prober == nil {
+		lb.prober = NewProber()
+	}
+	if lb.logger == nil {
+		lb.logger = logging.Default()
 	}
 
-	for _, backend := range config.Backends {
-		backendURL, err := url.Parse(backend)
-		if err != nil {
-			log.Printf("Error parsing backend URL %s: %v", backend, err)
-			continue
-		}
-		lb.backends = append(lb.backends, backendURL)
+	lb.listener = config.Port
+	lb.applyConfig(config, "")
+
+	healthConfig := lb.Config().HealthCheck.withDefaults()
+	if healthConfig.GracePeriod > 0 {
+		lb.graceUntil = time.Now().Add(time.Duration(healthConfig.GracePeriod))
+		time.AfterFunc(time.Duration(healthConfig.GracePeriod), lb.refreshBackends)
 	}
 
 	lb.healthCheck()
+	lb.restartHealthChecks(healthConfig)
+	lb.restartResolver()
 	return lb
 }
 
-func (lb *LoadBalancer) healthCheck() {
-	var healthyBackends []*url.URL
+// WithLogger sends the load balancer's logs to logger instead of
+// logging.Default().
+func WithLogger(logger logging.Logger) Option {
+	return func(lb *LoadBalancer) {
+		lb.logger = logger
+	}
+}
+
+// WithTracer makes the load balancer start a span for every request and
+// pass its trace context on to backends.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(lb *LoadBalancer) {
+		lb.tracer = tracer
+	}
+}
+
+// Reload applies a new configuration without interrupting traffic. Backends
+// whose URL and health check settings are unchanged keep their health and
+// outlier state, new ones are probed before they join the rotation and
+// removed ones stop receiving new requests while in-flight requests finish.
+func (lb *LoadBalancer) Reload(config Config) {
+	lb.applyConfig(config, "config reload")
+	lb.healthCheck()
+	lb.restartHealthChecks(lb.Config().HealthCheck.withDefaults())
+	lb.restartResolver()
+}
+
+// applyConfig switches to config. actor names what caused the change in the
+// audit log; the initial config is not audited.
+func (lb *LoadBalancer) applyConfig(config Config, actor string) {
+	config = config.resolve()
+	healthConfig := config.HealthCheck.withDefaults()
+
+	var outlier *OutlierDetectionConfig
+	if config.OutlierDetection != nil {
+		defaults := config.OutlierDetection.withDefaults()
+		outlier = &defaults
+	}
+
+	var webhooks []func(HealthEvent)
+	for _, webhookURL := range config.HealthWebhooks {
+		webhooks = append(webhooks, lb.newWebhook(webhookURL))
+	}
+	lb.hooksMutex.Lock()
+	lb.webhooks = webhooks
+	lb.hooksMutex.Unlock()
+
+	accessList, err := config.AccessControl.compile()
+	if err != nil {
+		lb.logger.Errorf("Error in access_control, refusing all requests: %v", err)
+		accessList = denyAll
+	}
+	trustedProxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		lb.logger.Errorf("Error in trusted_proxies, trusting none: %v", err)
+		trustedProxies = nil
+	}
+	var proxyTrusted []netip.Prefix
+	if config.ProxyProtocol != nil {
+		if proxyTrusted, err = parsePrefixes(config.ProxyProtocol.Trusted); err != nil {
+			lb.logger.Errorf("Error in proxy_protocol.trusted, reading PROXY headers from no one: %v", err)
+			// An invalid prefix contains no address.
+			proxyTrusted = []netip.Prefix{{}}
+		}
+	}
+
+	jwt, err := newJWTAuth(config.JWT)
+	if err != nil {
+		lb.logger.Errorf("Error loading JWT keys, rejecting all requests: %v", err)
+	}
+	credentials, err := newCredentials(config.Auth)
+	if err != nil {
+		lb.logger.Errorf("Error loading auth credentials, rejecting all requests: %v", err)
+	}
+	oidc, err := newOIDCAuth(config.OIDC)
+	if err != nil {
+		lb.logger.Errorf("Error configuring OIDC, rejecting all requests: %v", err)
+	}
+	filter, err := config.WAF.compile()
+	if err != nil {
+		lb.logger.Errorf("Error in waf, rejecting all requests: %v", err)
+		filter = &waf{rejectAll: true}
+	}
+	pages, err := config.ErrorPages.compile()
+	if err != nil {
+		lb.logger.Errorf("Error loading error_pages, sending plain text errors: %v", err)
+	}
+	redirect, err := config.Redirect.compile()
+	if err != nil {
+		lb.logger.Errorf("Error in redirect, proxying requests instead: %v", err)
+	}
+	rewrite, err := config.Rewrite.compile()
+	if err != nil {
+		lb.logger.Errorf("Error in rewrite, proxying paths unchanged: %v", err)
+	}
+
+	var backendTLS *tls.Config
+	if config.BackendTLS != nil {
+		var err error
+		if backendTLS, err = config.BackendTLS.load(); err != nil {
+			lb.logger.Errorf("Error loading backend_tls, using the default TLS settings: %v", err)
+		}
+		if config.BackendTLS.InsecureSkipVerify {
+			lb.logger.Warnf("backend_tls.insecure_skip_verify is set, backend certificates are not verified")
+		}
+	}
+
+	lb.mutex.Lock()
+	// Buckets are kept across reloads that leave the rate limit alone.
+	if lb.rateLimit == nil || !reflect.DeepEqual(config.RateLimit, lb.config.RateLimit) {
+		lb.rateLimit.close()
+		lb.rateLimit = newRateLimits(config.RateLimit, lb.logger)
+	}
+	// Requests in flight keep their slots when the limit changes.
+	if config.ConcurrencyLimit == nil {
+		lb.inFlight = nil
+	} else if lb.inFlight == nil {
+		lb.inFlight = newInFlightLimiter(config.ConcurrencyLimit)
+	} else {
+		lb.inFlight.configure(config.ConcurrencyLimit)
+	}
+	// The retry budget is kept across reloads that leave retry alone.
+	if !reflect.DeepEqual(config.Retry, lb.config.Retry) || !reflect.DeepEqual(config.GRPC, lb.config.GRPC) {
+		lb.retry = newRetryPolicy(config.Retry, config.GRPC)
+	}
+	lb.config = config
+	lb.backendTLS = backendTLS
+	lb.securityHeaders, lb.secureHeaders = config.SecurityHeaders.headers()
+	lb.accessList = accessList
+	lb.trustedProxies = trustedProxies
+	lb.proxyTrusted = proxyTrusted
+	lb.jwt = jwt
+	lb.credentials = credentials
+	lb.oidc = oidc
+	lb.waf = filter
+	lb.errorPages = pages
+	lb.rewrite = rewrite
+	lb.redirect = redirect
+	lb.outlier = outlier
+	lb.strategy = config.Strategy
+	lb.healthConcurrency = healthConfig.Concurrency
+	lb.healthInterval = time.Duration(healthConfig.Interval)
+	lb.mutex.Unlock()
+
+	lb.syncPool(actor)
+	lb.syncRoutes(config)
+	lb.syncCanary(config)
+	lb.syncActivePool(config)
+	lb.syncMirror(config)
+	lb.syncFallback(config)
+}
+
+// syncPool rebuilds the pool from the current config and the latest DNS
+// answers and audits the changes on behalf of actor, unless it is empty. It
+// reports whether any backend was added or removed.
+func (lb *LoadBalancer) syncPool(actor string) bool {
+	lb.poolMutex.Lock()
+	defer lb.poolMutex.Unlock()
+	select {
+	case <-lb.done:
+		// Close already released the pool's probes.
+		return false
+	default:
+	}
+
+	lb.mutex.Lock()
+	config := lb.config
+	outlier := lb.outlier
+	breaker := config.CircuitBreaker
+	drainTimeout := config.drainTimeout()
+	backendTLS := lb.backendTLS
+	var backendTLSConfig ClientTLSConfig
+	if config.BackendTLS != nil {
+		backendTLSConfig = *config.BackendTLS
+	}
+	var timeouts TimeoutsConfig
+	if config.Timeouts != nil {
+		timeouts = *config.Timeouts
+	}
+	// Unlike the others, these two are switched on by being set at all.
+	streaming, http2 := "off", "off"
+	if config.Streaming != nil {
+		streaming = fmt.Sprintf("%+v", *config.Streaming)
+	}
+	if settings := config.backendHTTP2(); settings != nil {
+		http2 = fmt.Sprintf("%+v", *settings)
+	}
+	previous := make(map[string][]*Backend)
+	for _, backend := range lb.pool {
+		previous[backend.identity] = append(previous[backend.identity], backend)
+	}
+	lb.mutex.Unlock()
 
-	for _, backend := range lb.backends {
-		resp, err := lb.client.Get(backend.String() + "/health")
-		if err != nil || resp.StatusCode != http.StatusOK {
-			log.Printf("Backend %s is unavailable", backend.String())
+	var (
+		pool     []*Backend
+		settings []BackendConfig
+		added    = make(map[*Backend]bool)
+		events   []AuditEvent
+		changed  bool
+	)
+	for _, backendConfig := range lb.expandBackends(config.Backends) {
+		backendURL, err := url.Parse(backendConfig.URL)
+		if err != nil {
+			lb.logger.Errorf("Error parsing backend URL %s: %v", backendConfig.URL, err)
 			continue
 		}
-		healthyBackends = append(healthyBackends, backend)
-		resp.Body.Close()
+		checkConfig := backendConfig.healthCheck(config.healthCheckDefaults())
+		if checkConfig.TLS == nil {
+			checkConfig.TLS = config.BackendTLS
+		}
+		backendTLS := backendTLS
+		if backendConfig.serverName != "" {
+			backendTLS = withServerName(backendTLS, backendConfig.serverName)
+			checkTLS := ClientTLSConfig{}
+			if checkConfig.TLS != nil {
+				checkTLS = *checkConfig.TLS
+			}
+			if checkTLS.ServerName == "" {
+				checkTLS.ServerName = backendConfig.serverName
+				checkConfig.TLS = &checkTLS
+			}
+		}
+		key := probeKey(backendURL, checkConfig)
+		identity := fmt.Sprintf("%s|%d|%+v|%+v|%s|%s", key, backendConfig.MaxConnections, backendTLSConfig, timeouts, http2, streaming)
+
+		backend := lb.reuseBackend(previous, identity)
+		if backend == nil {
+			checker, err := lb.newHealthChecker(checkConfig)
+			if err != nil {
+				lb.logger.Errorf("Error configuring health check for %s: %v", backendConfig.URL, err)
+				continue
+			}
+			backend = lb.newPoolBackend(backendURL, backendConfig.MaxConnections, backendTLS, config.Timeouts, config.backendHTTP2(), config.Streaming)
+			backend.checker = checker
+			backend.probeKey = key
+			backend.identity = identity
+			lb.prober.acquire(key)
+			added[backend] = true
+			changed = true
+		}
+		backend.setOutlierWindow(outlier)
+		backend.setCircuitBreaker(breaker)
+		if lb.setDraining(backend, false, backendConfig.Drain, drainTimeout) {
+			lb.logDrain(backend, backendConfig.Drain)
+			action := AuditBackendResumed
+			if backendConfig.Drain {
+				action = AuditBackendDrained
+			}
+			events = append(events, AuditEvent{Action: action, Target: backend.URL.String()})
+		}
+		pool = append(pool, backend)
+		settings = append(settings, backendConfig)
+	}
+
+	for _, removed := range previous {
+		for _, backend := range removed {
+			backend.mutex.Lock()
+			backend.removed = true
+			backend.mutex.Unlock()
+			lb.prober.release(backend.probeKey)
+			// Requests still in flight get the drain timeout to finish.
+			lb.setDraining(backend, false, true, drainTimeout)
+			lb.metrics.forgetBackend(lb.listener, backend)
+			lb.logger.Infof("Backend %s removed from pool", backend.URL.String())
+			events = append(events, AuditEvent{Action: AuditBackendRemoved, Target: backend.URL.String(), Before: lb.audited(backend)})
+			changed = true
+		}
 	}
 
 	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-	lb.backends = healthyBackends
-	if len(lb.backends) == 0 {
-		log.Fatal("All backends are unavailable")
+	for i, backend := range pool {
+		weight := settings[i].weight()
+		if added[backend] {
+			events = append(events, AuditEvent{Action: AuditBackendAdded, Target: backend.URL.String(),
+				After: auditedBackend{URL: backend.URL.String(), Weight: weight, Labels: settings[i].Labels}})
+		} else if backend.weight != weight {
+			events = append(events, AuditEvent{Action: AuditWeightChanged, Target: backend.URL.String(), Before: backend.weight, After: weight})
+		}
+		backend.weight = weight
+		backend.maxActive = settings[i].MaxConcurrentRequests
+		backend.Labels = settings[i].Labels
 	}
-	if lb.currentBackend >= len(lb.backends) {
-		lb.currentBackend = 0
+	lb.pool = pool
+	lb.mutex.Unlock()
+
+	if actor != "" {
+		for _, event := range events {
+			event.Actor = actor
+			event.Listener = lb.listener
+			lb.auditLog.Record(event)
+		}
 	}
+
+	lb.refreshBackends()
+	return changed
 }
 
-func (lb *LoadBalancer) getNextBackend() *url.URL {
+func (lb *LoadBalancer) audited(backend *Backend) auditedBackend {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
+	return auditedBackend{URL: backend.URL.String(), Weight: backend.weight, Labels: backend.Labels}
+}
 
-	if len(lb.backends) == 0 {
+func (lb *LoadBalancer) reuseBackend(previous map[string][]*Backend, identity string) *Backend {
+	existing := previous[identity]
+	if len(existing) == 0 {
 		return nil
 	}
+	previous[identity] = existing[1:]
+	return existing[0]
+}
+
+// Config returns the configuration the load balancer is currently running.
+func (lb *LoadBalancer) Config() Config {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.config
+}
+
+// AvailableBackends returns how many backends are currently in rotation,
+// including those of routes.
+func (lb *LoadBalancer) AvailableBackends() int {
+	lb.mutex.Lock()
+	available := len(lb.backends)
+	routes := lb.routes
+	lb.mutex.Unlock()
+	for _, route := range routes {
+		available += route.lb.AvailableBackends()
+	}
+	return available
+}
+
+// Close stops the background health checks.
+func (lb *LoadBalancer) Close() {
+	lb.closeOnce.Do(func() {
+		lb.poolMutex.Lock()
+		close(lb.done)
+		lb.mutex.Lock()
+		pool := lb.pool
+		lb.mutex.Unlock()
+		for _, backend := range pool {
+			lb.prober.release(backend.probeKey)
+		}
+		lb.poolMutex.Unlock()
+	})
+	lb.mutex.Lock()
+	lb.rateLimit.close()
+	for timer := range lb.reprobes {
+		timer.Stop()
+	}
+	lb.reprobes = nil
+	m, fallback := lb.mirror, lb.fallback
+	lb.mutex.Unlock()
+	lb.checks.Wait()
+	for _, route := range lb.routeSnapshot() {
+		route.lb.Close()
+	}
+	if m != nil {
+		m.lb.Close()
+	}
+	if fallback != nil {
+		fallback.Close()
+	}
+}
+
+func (lb *LoadBalancer) newPoolBackend(backendURL *url.URL, maxConnections int, tlsConfig *tls.Config, timeouts *TimeoutsConfig, http2 *BackendHTTP2Config, streaming *StreamingConfig) *Backend {
+	backend := newBackend(backendURL, maxConnections, tlsConfig, timeouts, http2, streaming)
 
-	backend := lb.backends[lb.currentBackend]
-	lb.currentBackend = (lb.currentBackend + 1) % len(lb.backends)
+	backend.proxy.ModifyResponse = func(resp *http.Response) error {
+		lb.recordOutcome(backend, isFailureStatus(resp.StatusCode))
+		if isFailureStatus(resp.StatusCode) {
+			lb.recordError(resp.Request, backend, resp.StatusCode, fmt.Sprintf("backend answered %s", resp.Status))
+		}
+		// The balancer already set its own request ID on the response.
+		resp.Header.Del(RequestIDHeader)
+		lb.setSecurityHeaders(resp)
+		lb.setResponseHeaders(resp)
+		lb.stripCORSHeaders(resp)
+		return nil
+	}
+	backend.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if isBodyTooLarge(err) {
+			http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errCorruptBody) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if hw, ok := w.(*hedgeWriter); ok && hw.lost() {
+			return
+		}
+		lb.logger.Warnf("Error proxying request %s to %s: %v", r.Header.Get(RequestIDHeader), backendURL.String(), err)
+		lb.recordOutcome(backend, true)
+		status, message := http.StatusBadGateway, "Bad gateway"
+		if isTimeout(err) {
+			status, message = http.StatusGatewayTimeout, "Gateway timeout"
+		}
+		lb.recordError(r, backend, status, err.Error())
+		if rw, ok := w.(*retryWriter); ok && rw.retryError(err) {
+			return
+		}
+		lb.httpError(w, r, message, status)
+	}
 	return backend
 }
 
+func (lb *LoadBalancer) poolSnapshot() []*Backend {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.pool
+}
+
+// refreshBackends rebuilds the rotation from the backends that are both
+// healthy and not ejected by outlier detection.
+func (lb *LoadBalancer) refreshBackends() {
+	inGrace := time.Now().Before(lb.graceUntil)
+
+	var available []*Backend
+	for _, backend := range lb.poolSnapshot() {
+		up := backend.available(inGrace)
+		if up {
+			available = append(available, backend)
+		}
+		lb.metrics.backendAvailable(lb.listener, backend, up)
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.backends = available
+}
+
+// acquireBackend picks a backend and reserves a slot on it, which the
+// caller gives back with releaseBackend. Backends in exclude are only
+// picked when there is no other. When every available backend is at its
+// max_concurrent_requests it waits up to backend_queue_timeout for one to
+// free up; saturated reports that it gave up.
+func (lb *LoadBalancer) acquireBackend(ctx context.Context, exclude ...*Backend) (backend *Backend, saturated bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	for {
+		backend, saturated = lb.pickBackend(exclude)
+		if backend != nil || !saturated || lb.config.BackendQueueTimeout <= 0 {
+			return backend, saturated
+		}
+		if timeout == nil {
+			timer := time.NewTimer(time.Duration(lb.config.BackendQueueTimeout))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		if lb.released == nil {
+			lb.released = make(chan struct{})
+		}
+		released := lb.released
+		lb.waiting++
+		lb.mutex.Unlock()
+		gaveUp := false
+		select {
+		case <-released:
+		case <-timeout:
+			gaveUp = true
+		case <-ctx.Done():
+			gaveUp = true
+		}
+		lb.mutex.Lock()
+		lb.waiting--
+		if gaveUp {
+			return nil, true
+		}
+	}
+}
+
+// pickBackend runs the strategy over the available backends that have
+// room for another request, preferring those not in exclude. The caller
+// holds lb.mutex.
+func (lb *LoadBalancer) pickBackend(exclude []*Backend) (*Backend, bool) {
+	backends := lb.backends
+	if lb.config.CircuitBreaker != nil {
+		backends = withClosedCircuits(backends, time.Now())
+	}
+	if len(backends) == 0 {
+		return nil, false
+	}
+	candidates := eligibleBackends(backends, exclude)
+	if len(candidates) == 0 && len(exclude) > 0 {
+		candidates = eligibleBackends(backends, nil)
+	}
+	if len(candidates) == 0 {
+		return nil, true
+	}
+	backend := lb.nextBackend(candidates)
+	backend.admitByCircuit()
+	atomic.AddInt64(&backend.active, 1)
+	return backend, false
+}
+
+// withClosedCircuits returns the backends whose circuit lets requests
+// through.
+func withClosedCircuits(backends []*Backend, now time.Time) []*Backend {
+	var allowed []*Backend
+	for _, backend := range backends {
+		if backend.allowedByCircuit(now) {
+			allowed = append(allowed, backend)
+		}
+	}
+	return allowed
+}
+
+// eligibleBackends returns the backends with room for another request
+// that are not in exclude, without copying when that is all of them.
+func eligibleBackends(backends, exclude []*Backend) []*Backend {
+	eligible := func(backend *Backend) bool {
+		for _, excluded := range exclude {
+			if backend == excluded {
+				return false
+			}
+		}
+		return backend.hasCapacity()
+	}
+	for i, backend := range backends {
+		if eligible(backend) {
+			continue
+		}
+		candidates := append([]*Backend(nil), backends[:i]...)
+		for _, backend := range backends[i+1:] {
+			if eligible(backend) {
+				candidates = append(candidates, backend)
+			}
+		}
+		return candidates
+	}
+	return backends
+}
+
+// releaseBackend gives back the slot acquireBackend reserved and wakes
+// any requests waiting for one.
+func (lb *LoadBalancer) releaseBackend(backend *Backend) {
+	atomic.AddInt64(&backend.active, -1)
+	lb.mutex.Lock()
+	if lb.waiting > 0 {
+		close(lb.released)
+		lb.released = make(chan struct{})
+	}
+	lb.mutex.Unlock()
+}
+
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backend := lb.getNextBackend()
+	lb.mutex.Lock()
+	accessList, trustedProxies, inFlight := lb.accessList, lb.trustedProxies, lb.inFlight
+	timeouts, fault, redirect, static, experiment := lb.config.Timeouts, lb.config.Fault, lb.redirect, lb.config.Static, lb.config.Experiment
+	grpc := lb.config.GRPC != nil && isGRPC(r)
+	websocket, upgrade := lb.config.WebSocket, isWebSocket(r)
+	streaming, compression := lb.config.Streaming, lb.config.Compression
+	// Without backends of its own, a listener with routes has no pool for
+	// the requests no route matches.
+	unrouted := len(lb.config.Routes) > 0 && len(lb.config.Backends) == 0 && redirect == nil && static == nil && lb.config.Split == nil && lb.config.Fallback == nil
+	lb.mutex.Unlock()
+	r, client := withClientIP(r, trustedProxies)
+	allowed := accessList.allows(client)
+	closing := !lb.requests.start()
+	if !closing {
+		defer lb.requests.finish()
+	}
+	shed := false
+	if allowed && !closing && inFlight != nil {
+		if inFlight.acquire(r.Context()) {
+			defer inFlight.release()
+		} else {
+			shed = true
+		}
+	}
+	if allowed && !closing && !shed {
+		if route := lb.route(r); route != nil {
+			route.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	start := time.Now()
+	// Streamed responses are left alone so that nothing is held back.
+	if compression != nil && !upgrade && streaming == nil && r.Method != http.MethodHead && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		compressor := newCompressWriter(w, compression)
+		defer compressor.Close()
+		w = compressor
+	}
+	recorder := newResponseRecorder(w)
+
+	id := requestID(r)
+	r.Header.Set(RequestIDHeader, id)
+	w.Header().Set(RequestIDHeader, id)
+	if r.TLS != nil {
+		setClientCertHeaders(r)
+	}
+	setForwardedHeaders(r, trustedProxies)
+
+	span := lb.tracer.Start(r)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("client.address", clientIP(r))
+	span.SetAttribute("httpbalance.listener", lb.listener)
+	span.SetAttribute("httpbalance.request_id", id)
+
+	var backend *Backend
+	admitted, saturated := false, false
+	if !allowed {
+		lb.logger.Debugf("Refusing request %s from %s", id, clientIP(r))
+		http.Error(recorder, "Forbidden", http.StatusForbidden)
+	} else if closing {
+		lb.logger.Debugf("Refusing request %s, shutting down", id)
+		recorder.Header().Set("Connection", "close")
+		lb.httpError(recorder, r, "Service unavailable", http.StatusServiceUnavailable)
+	} else if unrouted {
+		lb.logger.Debugf("No route matches request %s", id)
+		http.Error(recorder, "Not found", http.StatusNotFound)
+	} else if maintenance, on := lb.maintenance(); on {
+		lb.logger.Debugf("Answering request %s with the maintenance response", id)
+		serveMaintenance(recorder, maintenance)
+	} else if shed {
+		lb.logger.Debugf("Shedding request %s, too many requests in flight", id)
+		lb.metrics.requestShed(lb.listener)
+		lb.recordError(r, nil, http.StatusServiceUnavailable, "too many requests in flight")
+		recorder.Header().Set("Retry-After", "1")
+		lb.httpError(recorder, r, "Service unavailable", http.StatusServiceUnavailable)
+	} else if redirect != nil {
+		lb.serveRedirect(recorder, r, redirect)
+	} else if lb.admit(recorder, r) && lb.injectFault(fault, recorder, r) {
+		admitted = true
+		var cancel context.CancelFunc
+		if upgrade {
+			r, cancel = websocket.withLifetime(r)
+		} else if streaming != nil {
+			r, cancel = streaming.withMaxDuration(r)
+		} else {
+			r, cancel = withRequestTimeout(r, timeouts)
+		}
+		defer cancel()
+		if static == nil {
+			backend, saturated = lb.acquireBackend(r.Context())
+		}
+	}
+	lb.metrics.requestStarted(lb.listener, backend)
+	variant := ""
+	defer func() {
+		elapsed := time.Since(start)
+		if backend != nil {
+			backend.stats.record(start.Add(elapsed), elapsed, isFailureStatus(recorder.status))
+		}
+		lb.metrics.requestFinished(lb.listener, backend, recorder.status, elapsed)
+		if variant != "" {
+			lb.metrics.variantFinished(lb.listener, experiment.Name, variant, recorder.status, elapsed)
+		}
+		if grpc {
+			lb.metrics.grpcFinished(lb.listener, grpcStatusName(recorder.status, recorder.Header()))
+		}
+		lb.accessLog.record(lb.listener, r, backend, recorder, start)
+		span.End(recorder.status)
+	}()
+
+	if !admitted {
+		return
+	}
+	variant = experiment.assign(r)
+	if static != nil {
+		lb.mutex.Lock()
+		rewrite := lb.rewrite
+		lb.mutex.Unlock()
+		lb.serveFiles(recorder, rewrite.apply(r), static)
+		return
+	}
+	if backend == nil && r.Context().Err() == context.DeadlineExceeded {
+		lb.recordError(r, nil, http.StatusGatewayTimeout, "request timed out waiting for a backend")
+		lb.httpError(recorder, r, "Gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if saturated {
+		lb.logger.Debugf("Rejecting request %s, every backend is at max_concurrent_requests", id)
+		lb.recordError(r, nil, http.StatusServiceUnavailable, "all backends at capacity")
+		lb.httpError(recorder, r, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	if backend == nil {
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		if lb.serveFallback(recorder, r) {
+			return
+		}
+		lb.recordError(r, nil, http.StatusServiceUnavailable, "no backend available")
+		lb.httpError(recorder, r, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
-	log.Printf("Forwarding request to %s", backend.String())
+	lb.logger.Debugf("Forwarding request %s to %s", id, backend.URL.String())
 
-	proxy := httputil.NewSingleHostReverseProxy(backend)
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Error proxying to %s: %v", backend.String(), err)
-		lb.healthCheck()
-		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	span.SetAttribute("httpbalance.backend", backend.URL.String())
+	span.Inject(r.Header)
+
+	lb.mutex.Lock()
+	retry, hedge, rewrite, requestHeaders := lb.retry, lb.config.Hedge, lb.rewrite, lb.config.RequestHeaders
+	lb.mutex.Unlock()
+	// The access log keeps the request the client sent.
+	proxied := requestHeaders.applyRequest(rewrite.apply(r))
+	lb.mirrorRequest(proxied)
+	if hedge != nil && hedge.eligible(proxied) {
+		backend = lb.hedge(recorder, proxied, backend, hedge)
+		return
 	}
+	if upgrade {
+		backend = lb.forward(lb.newWebSocketWriter(recorder, websocket), proxied, backend, retry)
+		return
+	}
+	backend = lb.forward(recorder, proxied, backend, retry)
+}
 
-	proxy.ServeHTTP(w, r)
-}
\ No newline at end of file
+// admit runs the checks a request has to pass before it is proxied. The
+// first one to turn it away writes the response.
+func (lb *LoadBalancer) admit(w http.ResponseWriter, r *http.Request) bool {
+	lb.mutex.Lock()
+	rateLimit, limits, decompression, filter, cors := lb.rateLimit, lb.config.RequestLimits, lb.config.Decompression, lb.waf, lb.config.CORS
+	jwt, credentials, oidc := lb.jwt, lb.credentials, lb.oidc
+	lb.mutex.Unlock()
+
+	// Preflight requests carry no credentials, so CORS goes before the
+	// authentication checks.
+	return lb.admitRateLimit(rateLimit, w, r) &&
+		lb.admitLimits(limits, w, r) &&
+		lb.admitDecompression(decompression, w, r) &&
+		lb.admitWAF(filter, w, r) &&
+		lb.admitCORS(cors, w, r) &&
+		lb.admitJWT(jwt, w, r) &&
+		lb.admitAuth(credentials, w, r) &&
+		lb.admitOIDC(oidc, w, r)
+}
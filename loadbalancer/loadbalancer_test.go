@@ -3,7 +3,13 @@ package loadbalancer
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"loadbalancer/tracing"
 )
 
 func TestHealthCheck(t *testing.T) {
@@ -18,10 +24,254 @@ func TestHealthCheck(t *testing.T) {
 	defer unhealthyServer.Close()
 
 	lb := NewLoadBalancer(Config{
-		Backends: []string{healthyServer.URL, unhealthyServer.URL},
+		Backends: []BackendConfig{{URL: healthyServer.URL}, {URL: unhealthyServer.URL}},
 	})
 
 	if len(lb.backends) != 1 {
 		t.Errorf("Expected 1 healthy backend, got %d", len(lb.backends))
 	}
-}
\ No newline at end of file
+}
+
+func TestAllBackendsDownServesUnavailable(t *testing.T) {
+	var up atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:    []BackendConfig{{URL: backend.URL}},
+		HealthCheck: HealthCheckConfig{Interval: Duration(20 * time.Millisecond)},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 with no healthy backends, got %d", w.Code)
+	}
+
+	up.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	if lb.AvailableBackends() != 1 {
+		t.Errorf("Expected backend to recover, got %d available", lb.AvailableBackends())
+	}
+}
+
+func TestReloadDiffsBackends(t *testing.T) {
+	newBackendServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	kept, removed, added := newBackendServer(), newBackendServer(), newBackendServer()
+	defer kept.Close()
+	defer removed.Close()
+	defer added.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: kept.URL}, {URL: removed.URL}}})
+	defer lb.Close()
+	keptBackend := lb.poolSnapshot()[0]
+
+	lb.Reload(Config{Backends: []BackendConfig{{URL: kept.URL}, {URL: added.URL}}})
+
+	pool := lb.poolSnapshot()
+	if len(pool) != 2 || pool[0] != keptBackend || pool[1].URL.String() != added.URL {
+		t.Fatalf("Expected the unchanged backend to be kept and the new one added, got %d backends", len(pool))
+	}
+	if lb.AvailableBackends() != 2 {
+		t.Errorf("Expected 2 backends in rotation after reload, got %d", lb.AvailableBackends())
+	}
+}
+
+func TestWeightedBackends(t *testing.T) {
+	hits := map[string]int{}
+	var mutex sync.Mutex
+	newBackendServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ready" {
+				return
+			}
+			if r.URL.Path == "/health" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			mutex.Lock()
+			hits[name]++
+			mutex.Unlock()
+		}))
+	}
+	heavy, light := newBackendServer("heavy"), newBackendServer("light")
+	defer heavy.Close()
+	defer light.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{
+		{URL: heavy.URL, Weight: 3, HealthPath: "/ready"},
+		{URL: light.URL, HealthPath: "/ready", Labels: map[string]string{"zone": "b"}},
+	}})
+	defer lb.Close()
+
+	for i := 0; i < 8; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	if hits["heavy"] != 6 || hits["light"] != 2 {
+		t.Errorf("Expected a 3:1 split, got %v", hits)
+	}
+}
+
+func TestTraceContextIsPropagated(t *testing.T) {
+	traceparents := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/traced" {
+			traceparents <- r.Header.Get("traceparent")
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+	}, WithTracer(tracing.NewTracer(tracing.Config{})))
+	defer lb.Close()
+
+	r := httptest.NewRequest("GET", "/traced", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	lb.ServeHTTP(httptest.NewRecorder(), r)
+
+	traceparent := <-traceparents
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("Expected the backend to see a child of the incoming span, got %q", traceparent)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	forwarded := make(chan string, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/items" {
+			forwarded <- r.Header.Get(RequestIDHeader)
+			w.Header().Set(RequestIDHeader, "backend-generated")
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	defer lb.Close()
+
+	r := httptest.NewRequest("GET", "/items", nil)
+	r.Header.Set(RequestIDHeader, "client-42")
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if id := <-forwarded; id != "client-42" {
+		t.Errorf("Expected the client's ID to be forwarded, got %q", id)
+	}
+	if ids := w.Header().Values(RequestIDHeader); len(ids) != 1 || ids[0] != "client-42" {
+		t.Errorf("Expected the client's ID to be echoed once, got %v", ids)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/items", nil))
+	generated := <-forwarded
+	if len(generated) != 36 || w.Header().Get(RequestIDHeader) != generated {
+		t.Errorf("Expected a generated UUID to be forwarded and echoed, got %q and %q", generated, w.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	var slowHits atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		slowHits.Add(1)
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: slow.URL, MaxConcurrentRequests: 1}, {URL: fast.URL, MaxConcurrentRequests: 1}},
+	})
+	defer lb.Close()
+
+	// Requests may go to either backend at first; keep sending them until
+	// one is stuck on the slow one.
+	var stuck sync.WaitGroup
+	deadline := time.Now().Add(time.Second)
+	for slowHits.Load() == 0 && time.Now().Before(deadline) {
+		stuck.Add(1)
+		go func() {
+			defer stuck.Done()
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slowHits.Load() != 1 {
+		t.Fatalf("Expected one request stuck on the slow backend, got %d", slowHits.Load())
+	}
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected saturated backend to be skipped, got %d", w.Code)
+		}
+	}
+	if slowHits.Load() != 1 {
+		t.Errorf("Expected no more requests for the saturated backend, got %d", slowHits.Load())
+	}
+	close(release)
+	stuck.Wait()
+}
+
+func TestBackendQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:            []BackendConfig{{URL: backend.URL, MaxConcurrentRequests: 1}},
+		BackendQueueTimeout: Duration(50 * time.Millisecond),
+	})
+	defer lb.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	for atomic.LoadInt64(&lb.pool[0].active) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the queue timeout passed, got %d", w.Code)
+	}
+
+	lb.mutex.Lock()
+	lb.config.BackendQueueTimeout = Duration(time.Second)
+	lb.mutex.Unlock()
+	queued := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		queued <- w.Code
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("Expected queued request to be served once a slot freed up, got %d", code)
+	}
+	<-done
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+)
+
+// MaintenanceConfig answers every request with a static response instead
+// of proxying it while Enabled: Status (default 503) with Headers and
+// Body. A Body without a Content-Type header is sent as HTML.
+type MaintenanceConfig struct {
+	Enabled bool              `json:"enabled,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+func (c *MaintenanceConfig) validate() error {
+	if c.Status != 0 && (c.Status < 200 || c.Status > 599) {
+		return errors.New("status: must be an HTTP status from 200 to 599")
+	}
+	return nil
+}
+
+// maintenance reports whether the pool is in maintenance, because its
+// config says so or the admin API switched it or its listener on, and
+// returns the response to send.
+func (lb *LoadBalancer) maintenance() (*MaintenanceConfig, bool) {
+	lb.mutex.Lock()
+	config := lb.config.Maintenance
+	lb.mutex.Unlock()
+	on := config != nil && config.Enabled
+	for pool := lb; pool != nil && !on; pool = pool.parent {
+		on = pool.maintenanceOn.Load()
+	}
+	return config, on
+}
+
+func serveMaintenance(w http.ResponseWriter, config *MaintenanceConfig) {
+	if config == nil {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	serveStatic(w, config.Status, config.Headers, config.Body)
+}
+
+// serveStatic sends a configured response: status (default 503) with
+// headers and body, as HTML unless headers set a Content-Type.
+func serveStatic(w http.ResponseWriter, status int, headers map[string]string, body string) {
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+	if body != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// SetMaintenance switches maintenance on or off for the listener and its
+// routes, or only for the route with the given name, on behalf of actor.
+// Switching it off does not end maintenance enabled in the config. It
+// reports whether there is such a route.
+func (lb *LoadBalancer) SetMaintenance(on bool, routeName, actor string) bool {
+	pool := lb
+	if routeName != "" {
+		pool = nil
+		for _, route := range lb.routeSnapshot() {
+			if route.name == routeName {
+				pool = route.lb
+			}
+		}
+		if pool == nil {
+			return false
+		}
+	}
+	if pool.maintenanceOn.Swap(on) == on {
+		return true
+	}
+	action, state := AuditMaintenanceDisabled, "disabled"
+	if on {
+		action, state = AuditMaintenanceEnabled, "enabled"
+	}
+	if routeName != "" {
+		lb.logger.Infof("Maintenance %s for route %s on port %s", state, routeName, lb.listener)
+	} else {
+		lb.logger.Infof("Maintenance %s on port %s", state, lb.listener)
+	}
+	lb.auditLog.Record(AuditEvent{Actor: actor, Action: action, Listener: lb.listener, Target: routeName})
+	return true
+}
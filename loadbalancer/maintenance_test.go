@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Maintenance: &MaintenanceConfig{
+			Status:  http.StatusServiceUnavailable,
+			Headers: map[string]string{"Retry-After": "600", "Content-Type": "application/json"},
+			Body:    `{"error": "down for maintenance"}`,
+		},
+		Routes: []RouteConfig{{
+			Name:        "api",
+			ServerNames: []string{"api.example.com"},
+			Backends:    []BackendConfig{{URL: backend.URL}},
+			Maintenance: &MaintenanceConfig{Enabled: true, Body: "<h1>Back soon</h1>"},
+		}},
+	})
+	defer lb.Close()
+
+	api := func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: "api.example.com"}
+		return r
+	}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, api())
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<h1>Back soon</h1>" || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Expected the route's maintenance page, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the listener's own pool to be proxied, got %d", w.Code)
+	}
+
+	if lb.SetMaintenance(true, "web", "test") {
+		t.Error("Expected no route named web")
+	}
+	lb.SetMaintenance(true, "", "test")
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "600" || w.Body.String() != `{"error": "down for maintenance"}` {
+		t.Errorf("Expected the configured maintenance response, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	lb.SetMaintenance(false, "", "test")
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected requests to be proxied again, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, api())
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected maintenance enabled in the config to stay on, got %d", w.Code)
+	}
+}
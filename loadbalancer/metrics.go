@@ -0,0 +1,241 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"loadbalancer/metrics"
+)
+
+// Metrics are the balancer's Prometheus metrics. One instance is shared by
+// every listener; each series carries the listener's port as a label.
+type Metrics struct {
+	requests         *metrics.CounterVec
+	backendResponses *metrics.CounterVec
+	duration         *metrics.HistogramVec
+	inFlight         *metrics.GaugeVec
+	backendInFlight  *metrics.GaugeVec
+	backendUp        *metrics.GaugeVec
+	healthChecks     *metrics.CounterVec
+	rateLimited      *metrics.CounterVec
+	shed             *metrics.CounterVec
+	retries          *metrics.CounterVec
+	hedges           *metrics.CounterVec
+	mirrored         *metrics.CounterVec
+	variants         *metrics.CounterVec
+	variantDuration  *metrics.HistogramVec
+	grpcRequests     *metrics.CounterVec
+	websockets       *metrics.GaugeVec
+	websocketsTotal  *metrics.CounterVec
+	tcpConnections   *metrics.GaugeVec
+	tcpTotal         *metrics.CounterVec
+}
+
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		requests: registry.Counter("httpbalance_requests_total",
+			"Requests received, by status class of the response.", "listener", "code"),
+		backendResponses: registry.Counter("httpbalance_backend_requests_total",
+			"Requests proxied to a backend, by status class of the response.", "listener", "backend", "code"),
+		duration: registry.Histogram("httpbalance_request_duration_seconds",
+			"Time from receiving a request to finishing its response.", metrics.DefaultBuckets, "listener", "backend"),
+		inFlight: registry.Gauge("httpbalance_in_flight_requests",
+			"Requests currently being served.", "listener"),
+		backendInFlight: registry.Gauge("httpbalance_backend_in_flight_requests",
+			"Requests currently proxied to a backend.", "listener", "backend"),
+		backendUp: registry.Gauge("httpbalance_backend_up",
+			"Whether the backend is in rotation (1) or not (0).", "listener", "backend"),
+		healthChecks: registry.Counter("httpbalance_health_checks_total",
+			"Health check results, by outcome.", "listener", "backend", "result"),
+		rateLimited: registry.Counter("httpbalance_ratelimit_rejections_total",
+			"Requests rejected by the rate limiter.", "listener"),
+		shed: registry.Counter("httpbalance_shed_requests_total",
+			"Requests rejected by the concurrency limit.", "listener"),
+		retries: registry.Counter("httpbalance_retries_total",
+			"Requests retried on another backend.", "listener"),
+		hedges: registry.Counter("httpbalance_hedged_requests_total",
+			"Requests also sent to a second backend after the hedging delay.", "listener"),
+		mirrored: registry.Counter("httpbalance_mirrored_requests_total",
+			"Requests copied to the shadow pool.", "listener"),
+		variants: registry.Counter("httpbalance_experiment_requests_total",
+			"Requests in an experiment, by variant and status class of the response.", "listener", "experiment", "variant", "code"),
+		variantDuration: registry.Histogram("httpbalance_experiment_request_duration_seconds",
+			"Time from receiving a request in an experiment to finishing its response.", metrics.DefaultBuckets, "listener", "experiment", "variant"),
+		grpcRequests: registry.Counter("httpbalance_grpc_requests_total",
+			"gRPC calls received, by gRPC status of the response.", "listener", "code"),
+		websockets: registry.Gauge("httpbalance_websocket_connections",
+			"WebSocket connections currently open.", "listener"),
+		websocketsTotal: registry.Counter("httpbalance_websocket_connections_total",
+			"WebSocket connections opened.", "listener"),
+		tcpConnections: registry.Gauge("httpbalance_tcp_connections",
+			"Connections currently proxied by tcp listeners.", "listener"),
+		tcpTotal: registry.Counter("httpbalance_tcp_connections_total",
+			"Connections accepted by tcp listeners, by the backend they went to, none if no backend could be reached.", "listener", "backend"),
+	}
+}
+
+// WithMetrics makes the load balancer record its metrics in m.
+func WithMetrics(m *Metrics) Option {
+	return func(lb *LoadBalancer) {
+		lb.metrics = m
+	}
+}
+
+// RecordRateLimited counts a request the rate limiter in front of listener
+// turned away.
+func (m *Metrics) RecordRateLimited(listener string) {
+	if m == nil {
+		return
+	}
+	m.rateLimited.Inc(listener)
+}
+
+func (m *Metrics) requestShed(listener string) {
+	if m == nil {
+		return
+	}
+	m.shed.Inc(listener)
+}
+
+func (m *Metrics) requestRetried(listener string) {
+	if m == nil {
+		return
+	}
+	m.retries.Inc(listener)
+}
+
+func (m *Metrics) requestHedged(listener string) {
+	if m == nil {
+		return
+	}
+	m.hedges.Inc(listener)
+}
+
+func (m *Metrics) requestMirrored(listener string) {
+	if m == nil {
+		return
+	}
+	m.mirrored.Inc(listener)
+}
+
+func (m *Metrics) variantFinished(listener, experiment, variant string, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.variants.Inc(listener, experiment, variant, statusClass(status))
+	m.variantDuration.Observe(elapsed.Seconds(), listener, experiment, variant)
+}
+
+func (m *Metrics) grpcFinished(listener, code string) {
+	if m == nil {
+		return
+	}
+	m.grpcRequests.Inc(listener, code)
+}
+
+func (m *Metrics) websocketOpened(listener string) {
+	if m == nil {
+		return
+	}
+	m.websockets.Add(1, listener)
+	m.websocketsTotal.Inc(listener)
+}
+
+func (m *Metrics) websocketClosed(listener string) {
+	if m == nil {
+		return
+	}
+	m.websockets.Add(-1, listener)
+}
+
+func (m *Metrics) tcpOpened(listener, backend string) {
+	if m == nil {
+		return
+	}
+	m.tcpConnections.Add(1, listener)
+	m.tcpTotal.Inc(listener, backend)
+}
+
+func (m *Metrics) tcpClosed(listener string) {
+	if m == nil {
+		return
+	}
+	m.tcpConnections.Add(-1, listener)
+}
+
+func (m *Metrics) tcpRefused(listener string) {
+	if m == nil {
+		return
+	}
+	m.tcpTotal.Inc(listener, "")
+}
+
+func (m *Metrics) requestStarted(listener string, backend *Backend) {
+	if m == nil {
+		return
+	}
+	m.inFlight.Add(1, listener)
+	if backend != nil {
+		m.backendInFlight.Add(1, listener, backend.URL.String())
+	}
+}
+
+func (m *Metrics) requestFinished(listener string, backend *Backend, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	code := statusClass(status)
+	m.inFlight.Add(-1, listener)
+	m.requests.Inc(listener, code)
+
+	backendURL := ""
+	if backend != nil {
+		backendURL = backend.URL.String()
+		m.backendInFlight.Add(-1, listener, backendURL)
+		m.backendResponses.Inc(listener, backendURL, code)
+	}
+	// WebSocket connections would swamp the request latencies.
+	if status != http.StatusSwitchingProtocols {
+		m.duration.Observe(elapsed.Seconds(), listener, backendURL)
+	}
+}
+
+func (m *Metrics) healthChecked(listener string, backend *Backend, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.healthChecks.Inc(listener, backend.URL.String(), result)
+}
+
+func (m *Metrics) backendAvailable(listener string, backend *Backend, up bool) {
+	if m == nil {
+		return
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	m.backendUp.Set(value, listener, backend.URL.String())
+}
+
+// forgetBackend drops the series of a backend that left the pool.
+func (m *Metrics) forgetBackend(listener string, backend *Backend) {
+	if m == nil {
+		return
+	}
+	match := map[string]string{"listener": listener, "backend": backend.URL.String()}
+	m.backendResponses.Delete(match)
+	m.duration.Delete(match)
+	m.backendInFlight.Delete(match)
+	m.backendUp.Delete(match)
+	m.healthChecks.Delete(match)
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,157 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMirrorTimeout     = 10 * time.Second
+	defaultMirrorMaxInFlight = 100
+)
+
+// MirrorConfig copies Percent of requests (default all) to a shadow pool
+// of Backends, whose responses are thrown away. Mirrored requests are sent
+// in the background and never slow down the original: at most MaxInFlight
+// (default 100) run at once and further ones are skipped, each gets up to
+// Timeout (default 10s), and requests with a body over 64 KB are not
+// mirrored. The shadow pool is health checked like the listener's own.
+type MirrorConfig struct {
+	Backends    []BackendConfig `json:"backends"`
+	Percent     float64         `json:"percent,omitempty"`
+	Timeout     Duration        `json:"timeout,omitempty"`
+	MaxInFlight int             `json:"max_in_flight,omitempty"`
+}
+
+func (c *MirrorConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.New("percent: must be between 0 and 100")
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout: must not be negative")
+	}
+	if c.MaxInFlight < 0 {
+		return errors.New("max_in_flight: must not be negative")
+	}
+	return nil
+}
+
+// mirrorConfig returns the config of the shadow pool: the listener's
+// settings for reaching and checking backends, and nothing that would turn
+// requests away.
+func (c Config) mirrorConfig() Config {
+	return Config{
+		Port:         c.Port,
+		Backends:     c.Mirror.Backends,
+		BackendTLS:   c.BackendTLS,
+		Strategy:     c.Strategy,
+		HealthCheck:  c.HealthCheck,
+		Timeouts:     c.Timeouts,
+		GRPC:         c.GRPC,
+		BackendHTTP2: c.BackendHTTP2,
+		Streaming:    c.Streaming,
+	}
+}
+
+// mirror is a listener's shadow pool.
+type mirror struct {
+	lb      *LoadBalancer
+	percent float64
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+// syncMirror gives the listener a shadow pool if config has one, reloading
+// the one it already has.
+func (lb *LoadBalancer) syncMirror(config Config) {
+	lb.mutex.Lock()
+	previous := lb.mirror
+	lb.mutex.Unlock()
+
+	var m *mirror
+	if config.Mirror != nil {
+		m = &mirror{percent: config.Mirror.Percent, timeout: time.Duration(config.Mirror.Timeout)}
+		if m.percent == 0 {
+			m.percent = 100
+		}
+		if m.timeout == 0 {
+			m.timeout = defaultMirrorTimeout
+		}
+		maxInFlight := config.Mirror.MaxInFlight
+		if maxInFlight == 0 {
+			maxInFlight = defaultMirrorMaxInFlight
+		}
+		if previous != nil && cap(previous.slots) == maxInFlight {
+			m.slots = previous.slots
+		} else {
+			m.slots = make(chan struct{}, maxInFlight)
+		}
+		if previous != nil {
+			previous.lb.Reload(config.mirrorConfig())
+			m.lb = previous.lb
+		} else {
+			m.lb = NewLoadBalancer(config.mirrorConfig(), append(lb.options, withParent(lb))...)
+		}
+	} else if previous != nil {
+		previous.lb.Close()
+	}
+
+	lb.mutex.Lock()
+	lb.mirror = m
+	lb.mutex.Unlock()
+}
+
+// mirrorRequest sends a copy of r to the shadow pool in the background, if
+// the listener has one and r is picked. r's body is read into memory to be
+// sent twice.
+func (lb *LoadBalancer) mirrorRequest(r *http.Request) {
+	lb.mutex.Lock()
+	m := lb.mirror
+	lb.mutex.Unlock()
+	// Upgrades are not mirrored, as only one connection can be switched.
+	if m == nil || r.Header.Get("Upgrade") != "" || m.percent < 100 && rand.Float64()*100 >= m.percent {
+		return
+	}
+	body, replayable := bufferBody(r, defaultRetryMaxBodyBytes)
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if !replayable {
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		lb.logger.Debugf("Not mirroring request %s, too many mirrored requests in flight", r.Header.Get(RequestIDHeader))
+		return
+	}
+	// The copy outlives r, so it must not share r's context.
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	shadow := r.Clone(ctx)
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	lb.metrics.requestMirrored(lb.listener)
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		if backend, _ := m.lb.acquireBackend(ctx); backend != nil {
+			m.lb.forward(discardResponse{http.Header{}}, shadow, backend, nil)
+		}
+	}()
+}
+
+// discardResponse throws a mirrored response away.
+type discardResponse struct {
+	header http.Header
+}
+
+func (w discardResponse) Header() http.Header            { return w.header }
+func (w discardResponse) Write(data []byte) (int, error) { return len(data), nil }
+func (w discardResponse) WriteHeader(int)                {}
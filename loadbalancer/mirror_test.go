@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: primary.URL}},
+		Mirror:   &MirrorConfig{Backends: []BackendConfig{{URL: shadow.URL}}},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "/orders", strings.NewReader("payload")))
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Errorf("Expected the primary's response, got %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case request := <-mirrored:
+		if request != "POST /orders payload" {
+			t.Errorf("Expected the shadow pool to get a copy of the request, got %q", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+
+	lb.Reload(Config{
+		Backends: []BackendConfig{{URL: primary.URL}},
+		Mirror:   &MirrorConfig{Backends: []BackendConfig{{URL: shadow.URL}}, Percent: 0.0001},
+	})
+	for i := 0; i < 10; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	lb.Reload(Config{Backends: []BackendConfig{{URL: primary.URL}}})
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	select {
+	case request := <-mirrored:
+		t.Errorf("Expected no requests mirrored below the percentage or without a mirror, got %q", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
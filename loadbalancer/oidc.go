@@ -0,0 +1,127 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"loadbalancer/oidc"
+)
+
+// OIDCConfig requires users to log in with an OpenID Connect provider.
+// RedirectURL is the callback registered with the provider and must point
+// back at what it protects. Sessions are kept in cookies signed with
+// CookieSecret; ClaimHeaders passes claims of the ID token to backends.
+type OIDCConfig struct {
+	Issuer       string            `json:"issuer"`
+	ClientID     string            `json:"client_id"`
+	ClientSecret string            `json:"client_secret,omitempty"`
+	RedirectURL  string            `json:"redirect_url"`
+	Scopes       []string          `json:"scopes,omitempty"`
+	CookieSecret string            `json:"cookie_secret"`
+	CookieName   string            `json:"cookie_name,omitempty"`
+	SessionTTL   Duration          `json:"session_ttl,omitempty"`
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+}
+
+// minCookieSecretLength keeps session cookies from being forged by
+// guessing the key.
+const minCookieSecretLength = 16
+
+// NewAuthenticator returns the authenticator logging users in as c says.
+func (c *OIDCConfig) NewAuthenticator() (*oidc.Authenticator, error) {
+	config := oidc.Config{
+		Issuer:       c.Issuer,
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Scopes:       c.Scopes,
+		CookieSecret: c.CookieSecret,
+		CookieName:   c.CookieName,
+		SessionTTL:   time.Duration(c.SessionTTL),
+	}
+	for claim := range c.ClaimHeaders {
+		config.Claims = append(config.Claims, claim)
+	}
+	return oidc.New(config)
+}
+
+func (c *OIDCConfig) validate() error {
+	if err := validateURL(c.Issuer); err != nil {
+		return fmt.Errorf("issuer: %v", err)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("client_id: is required")
+	}
+	if err := validateURL(c.RedirectURL); err != nil {
+		return fmt.Errorf("redirect_url: %v", err)
+	}
+	if redirect, _ := url.Parse(c.RedirectURL); redirect.Path == "" || redirect.Path == "/" {
+		return fmt.Errorf("redirect_url: needs a path of its own, such as /oauth2/callback")
+	}
+	if len(c.CookieSecret) < minCookieSecretLength {
+		return fmt.Errorf("cookie_secret: must be at least %d characters", minCookieSecretLength)
+	}
+	if c.SessionTTL < 0 {
+		return fmt.Errorf("session_ttl: must not be negative")
+	}
+	return nil
+}
+
+func (c *OIDCConfig) redacted() *OIDCConfig {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	if out.ClientSecret != "" {
+		out.ClientSecret = redacted
+	}
+	out.CookieSecret = redacted
+	return &out
+}
+
+// oidcAuth logs users in before their requests are proxied. One without an
+// authenticator, whose config failed to load, lets nobody in.
+type oidcAuth struct {
+	authenticator *oidc.Authenticator
+	claimHeaders  map[string]string
+}
+
+func newOIDCAuth(config *OIDCConfig) (*oidcAuth, error) {
+	if config == nil {
+		return nil, nil
+	}
+	auth := &oidcAuth{claimHeaders: config.ClaimHeaders}
+	authenticator, err := config.NewAuthenticator()
+	if err != nil {
+		return auth, err
+	}
+	auth.authenticator = authenticator
+	return auth, nil
+}
+
+// admitOIDC lets requests with a session through, without the session
+// cookies and with the configured claims as headers. The authenticator
+// answers all others.
+func (lb *LoadBalancer) admitOIDC(auth *oidcAuth, w http.ResponseWriter, r *http.Request) bool {
+	if auth == nil {
+		return true
+	}
+	if auth.authenticator == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	session, ok := auth.authenticator.Authenticate(w, r)
+	if !ok {
+		return false
+	}
+	auth.authenticator.StripCookies(r)
+	for claim, header := range auth.claimHeaders {
+		r.Header.Del(header)
+		if value, ok := claimValue(session.Claims[claim]); ok {
+			r.Header.Set(header, value)
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOIDCRedirectsToProvider(t *testing.T) {
+	var issuer string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/authorize",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+
+	proxied := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			proxied = true
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Routes: []RouteConfig{{
+			ServerNames: []string{"app.example.com"},
+			Backends:    []BackendConfig{{URL: backend.URL}},
+			OIDC: &OIDCConfig{
+				Issuer:       issuer,
+				ClientID:     "lb",
+				RedirectURL:  "https://app.example.com/oauth2/callback",
+				CookieSecret: "0123456789abcdef",
+			},
+		}},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/reports", nil))
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.HasPrefix(location, issuer+"/authorize?") {
+		t.Errorf("Expected a redirect to the provider, got %d to %q", w.Code, location)
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "https://app.example.com/reports", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a POST without a session to be rejected, got %d", w.Code)
+	}
+	if proxied {
+		t.Error("Expected nothing to reach the backend without a session")
+	}
+
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/", nil))
+	if w.Code != http.StatusOK || !proxied {
+		t.Errorf("Expected routes without oidc to stay open, got %d", w.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const outlierWindowBuckets = 10
+
+type outcomeBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// outcomeWindow counts request outcomes over a sliding window split into
+// fixed-width buckets, so old results age out without storing every request.
+type outcomeWindow struct {
+	width   time.Duration
+	buckets [outlierWindowBuckets]outcomeBucket
+}
+
+func newOutcomeWindow(window time.Duration) *outcomeWindow {
+	width := window / outlierWindowBuckets
+	if width <= 0 {
+		width = time.Millisecond
+	}
+	return &outcomeWindow{width: width}
+}
+
+func (w *outcomeWindow) record(now time.Time, failed bool) {
+	start := now.Truncate(w.width)
+	bucket := &w.buckets[(start.UnixNano()/int64(w.width))%outlierWindowBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = outcomeBucket{start: start}
+	}
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+}
+
+func (w *outcomeWindow) counts(now time.Time) (total, failures int) {
+	oldest := now.Truncate(w.width).Add(-w.width * (outlierWindowBuckets - 1))
+	for _, bucket := range w.buckets {
+		if bucket.start.Before(oldest) {
+			continue
+		}
+		total += bucket.total
+		failures += bucket.failures
+	}
+	return total, failures
+}
+
+func (w *outcomeWindow) reset() {
+	w.buckets = [outlierWindowBuckets]outcomeBucket{}
+}
+
+func isFailureStatus(status int) bool {
+	return status >= http.StatusInternalServerError
+}
+
+// recordOutcome feeds the result of a proxied request into the backend's
+// circuit breaker and window, and ejects the backend once its error rate
+// crosses the threshold.
+func (lb *LoadBalancer) recordOutcome(backend *Backend, failed bool) {
+	lb.recordCircuit(backend, failed)
+
+	lb.mutex.Lock()
+	outlier := lb.outlier
+	lb.mutex.Unlock()
+	if outlier == nil {
+		return
+	}
+
+	backend.mutex.Lock()
+	if backend.ejected || backend.window == nil {
+		backend.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	backend.window.record(now, failed)
+	total, failures := backend.window.counts(now)
+	eject := failed && total >= outlier.MinRequests &&
+		float64(failures)/float64(total) >= outlier.ErrorThreshold
+	if eject {
+		backend.ejected = true
+		backend.window.reset()
+	}
+	backend.mutex.Unlock()
+
+	if eject {
+		reason := fmt.Sprintf("ejected by outlier detection: %d of %d requests failed", failures, total)
+		lb.logger.Warnf("Backend %s %s", backend.URL.String(), reason)
+		lb.refreshBackends()
+		lb.emitHealthEvent(backend, false, reason)
+		lb.scheduleReprobe(backend, time.Duration(outlier.EjectionTime))
+	}
+}
+
+// scheduleReprobe probes an ejected backend again after ejectionTime,
+// until it passes or the balancer is closed.
+func (lb *LoadBalancer) scheduleReprobe(backend *Backend, ejectionTime time.Duration) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	select {
+	case <-lb.done:
+		return
+	default:
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ejectionTime, func() {
+		lb.mutex.Lock()
+		pending := lb.reprobes[timer]
+		delete(lb.reprobes, timer)
+		lb.mutex.Unlock()
+		if !pending {
+			// Close came too late to stop the timer.
+			return
+		}
+
+		backend.mutex.Lock()
+		removed := backend.removed
+		backend.mutex.Unlock()
+		if removed {
+			return
+		}
+
+		if !lb.probe(backend) {
+			lb.logger.Warnf("Backend %s is still failing, keeping it ejected", backend.URL.String())
+			lb.scheduleReprobe(backend, ejectionTime)
+			return
+		}
+
+		backend.mutex.Lock()
+		backend.ejected = false
+		backend.healthy = true
+		backend.passed = true
+		backend.mutex.Unlock()
+
+		lb.logger.Infof("Backend %s passed re-probe, re-admitting", backend.URL.String())
+		lb.refreshBackends()
+		lb.emitHealthEvent(backend, true, "re-admitted after passing re-probe")
+	})
+	if lb.reprobes == nil {
+		lb.reprobes = make(map[*time.Timer]bool)
+	}
+	lb.reprobes[timer] = true
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetectionEjectsFailingBackend(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: failing.URL}, {URL: healthy.URL}},
+		OutlierDetection: &OutlierDetectionConfig{
+			MinRequests:    2,
+			ErrorThreshold: 0.5,
+			EjectionTime:   Duration(50 * time.Millisecond),
+		},
+	})
+
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	lb.mutex.Lock()
+	remaining := lb.backends
+	lb.mutex.Unlock()
+	if len(remaining) != 1 || remaining[0].URL.String() != healthy.URL {
+		t.Fatalf("Expected only the healthy backend after ejection, got %d backends", len(remaining))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	lb.mutex.Lock()
+	count := len(lb.backends)
+	lb.mutex.Unlock()
+	if count != 2 {
+		t.Errorf("Expected ejected backend to be re-admitted after passing re-probe, got %d backends", count)
+	}
+}
+
+func TestClosedLoadBalancerStopsReprobing(t *testing.T) {
+	var down atomic.Bool
+	var probes atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && !down.Load() {
+			return
+		}
+		if r.URL.Path == "/health" {
+			probes.Add(1)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: failing.URL}, {URL: healthy.URL}},
+		OutlierDetection: &OutlierDetectionConfig{
+			MinRequests:    2,
+			ErrorThreshold: 0.5,
+			EjectionTime:   Duration(20 * time.Millisecond),
+		},
+	})
+	down.Store(true)
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if probes.Load() == 0 {
+		t.Fatal("Expected the ejected backend to be re-probed")
+	}
+
+	lb.Close()
+	// A probe may still be on its way.
+	closed := probes.Load() + 1
+	time.Sleep(100 * time.Millisecond)
+	if probes.Load() > closed {
+		t.Errorf("Expected no re-probes after Close, got %d more", probes.Load()-closed+1)
+	}
+}
@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Prober runs health checks on behalf of one or more load balancers. When
+// the same backend with the same check settings appears in several pools it
+// is probed once and the result is shared until it is older than the
+// caller's interval; concurrent callers wait for the probe already running.
+// Results are kept while some pool has the backend.
+type Prober struct {
+	mutex   sync.Mutex
+	targets map[string]*probeTarget
+}
+
+type probeTarget struct {
+	// backends counts the pool backends probed under the target's key.
+	backends  int
+	checkedAt time.Time
+	err       error
+	running   chan struct{}
+}
+
+func NewProber() *Prober {
+	return &Prober{targets: make(map[string]*probeTarget)}
+}
+
+// Option customizes a LoadBalancer beyond what the config file describes.
+type Option func(*LoadBalancer)
+
+// WithProber makes the load balancer share prober with other pools.
+func WithProber(prober *Prober) Option {
+	return func(lb *LoadBalancer) {
+		lb.prober = prober
+	}
+}
+
+func probeKey(target *url.URL, config HealthCheckConfig) string {
+	tlsConfig := ClientTLSConfig{}
+	if config.TLS != nil {
+		tlsConfig = *config.TLS
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%v|%v|%+v", target.String(), config.Type, config.Path, config.Service,
+		time.Duration(config.Timeout), config.Headers, tlsConfig)
+}
+
+// acquire makes the prober keep the results for key, for a backend added
+// to a pool.
+func (p *Prober) acquire(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, ok := p.targets[key]
+	if !ok {
+		entry = &probeTarget{}
+		p.targets[key] = entry
+	}
+	entry.backends++
+}
+
+// release undoes acquire once the backend left its pool, forgetting the
+// results for key when no pool has such a backend anymore.
+func (p *Prober) release(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if entry, ok := p.targets[key]; ok {
+		if entry.backends--; entry.backends <= 0 {
+			delete(p.targets, key)
+		}
+	}
+}
+
+// check returns the result of a probe of target that is at most maxAge old,
+// running checker if there is none.
+func (p *Prober) check(key string, target *url.URL, checker healthChecker, maxAge time.Duration) error {
+	p.mutex.Lock()
+	entry, ok := p.targets[key]
+	if !ok {
+		// A backend that already left its pool is probed on its own.
+		p.mutex.Unlock()
+		return checker.check(target)
+	}
+	if running := entry.running; running != nil {
+		p.mutex.Unlock()
+		<-running
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return entry.err
+	}
+	if maxAge > 0 && !entry.checkedAt.IsZero() && time.Since(entry.checkedAt) < maxAge {
+		defer p.mutex.Unlock()
+		return entry.err
+	}
+	running := make(chan struct{})
+	entry.running = running
+	p.mutex.Unlock()
+
+	err := checker.check(target)
+
+	p.mutex.Lock()
+	entry.err = err
+	entry.checkedAt = time.Now()
+	entry.running = nil
+	p.mutex.Unlock()
+	close(running)
+	return err
+}
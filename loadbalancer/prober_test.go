@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedProberDeduplicatesChecks(t *testing.T) {
+	var probes atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			probes.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	prober := NewProber()
+	config := Config{
+		Backends:    []BackendConfig{{URL: backend.URL}},
+		HealthCheck: HealthCheckConfig{Interval: Duration(time.Hour)},
+	}
+
+	first := NewLoadBalancer(config, WithProber(prober))
+	defer first.Close()
+	second := NewLoadBalancer(config, WithProber(prober))
+	defer second.Close()
+
+	if probes.Load() != 1 {
+		t.Errorf("Expected one probe shared by both pools, got %d", probes.Load())
+	}
+	if first.AvailableBackends() != 1 || second.AvailableBackends() != 1 {
+		t.Errorf("Expected both pools to see the backend as healthy")
+	}
+}
+
+func TestProberForgetsBackendsNoPoolHas(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	prober := NewProber()
+	targets := func() int {
+		prober.mutex.Lock()
+		defer prober.mutex.Unlock()
+		return len(prober.targets)
+	}
+	first := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: a.URL}}}, WithProber(prober))
+	defer first.Close()
+	second := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: a.URL}}}, WithProber(prober))
+	defer second.Close()
+
+	first.Reload(Config{Backends: []BackendConfig{{URL: b.URL}}})
+	if targets() != 2 {
+		t.Errorf("Expected the backend still in the second pool to be kept next to the new one, got %d targets", targets())
+	}
+	second.Close()
+	if targets() != 1 {
+		t.Errorf("Expected the backend of the closed pool to be forgotten, got %d targets", targets())
+	}
+	first.Close()
+	if targets() != 0 {
+		t.Errorf("Expected nothing to be kept once every pool is closed, got %d targets", targets())
+	}
+}
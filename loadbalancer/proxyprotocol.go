@@ -0,0 +1,280 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/logging"
+)
+
+// ProxyProtocolConfig handles the PROXY protocol (v1 and v2) that HAProxy
+// and L4 load balancers use to pass on the client's address. With Accept,
+// connections must start with a PROXY header, whose source address then
+// stands in for the peer's. Trusted limits that to peers in the listed
+// addresses and CIDR ranges; connections from anyone else are served as
+// they are. Send ("v1" or "v2") starts every connection a tcp listener
+// opens to a backend with a header carrying the client's address.
+type ProxyProtocolConfig struct {
+	Accept  bool     `json:"accept,omitempty"`
+	Trusted []string `json:"trusted,omitempty"`
+	Send    string   `json:"send,omitempty"`
+}
+
+const (
+	proxyHeaderTimeout = 10 * time.Second
+	// proxyV1MaxLength is the longest v1 header the spec allows.
+	proxyV1MaxLength = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func (c *ProxyProtocolConfig) validate() error {
+	if _, err := parsePrefixes(c.Trusted); err != nil {
+		return fmt.Errorf("trusted: %v", err)
+	}
+	switch c.Send {
+	case "", "v1", "v2":
+	default:
+		return errors.New("send: must be v1 or v2")
+	}
+	return nil
+}
+
+// WrapListener makes the connections accepted by inner report the client
+// address of their PROXY header while the listener's proxy_protocol
+// accepts one.
+func (lb *LoadBalancer) WrapListener(inner net.Listener) net.Listener {
+	return &proxyListener{Listener: inner, lb: lb}
+}
+
+type proxyListener struct {
+	net.Listener
+	lb *LoadBalancer
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.lb.mutex.Lock()
+	config, trusted := l.lb.config.ProxyProtocol, l.lb.proxyTrusted
+	l.lb.mutex.Unlock()
+	if config == nil || !config.Accept {
+		return conn, nil
+	}
+	if len(trusted) > 0 {
+		peer, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if !containsAddr(trusted, peer.Addr()) {
+			return conn, nil
+		}
+	}
+	return &proxiedConn{Conn: conn, reader: bufio.NewReader(conn), logger: l.lb.logger}, nil
+}
+
+// proxiedConn reads the PROXY header of a connection the first time it is
+// read from or asked for its addresses, which happens on the goroutine
+// serving it rather than the one accepting connections.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	logger logging.Logger
+
+	once        sync.Once
+	source      net.Addr
+	destination net.Addr
+	err         error
+}
+
+func (c *proxiedConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.source, c.destination, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.logger.Debugf("Closing connection from %s: invalid PROXY header: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	if c.readHeader(); c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from r. The addresses are
+// nil when the header carries none, as for health checks of the proxy in
+// front.
+func readProxyHeader(r *bufio.Reader) (source, destination net.Addr, err error) {
+	if prefix, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = errors.New("v1 header too long")
+		}
+		return nil, nil, err
+	}
+	if len(line) > proxyV1MaxLength {
+		return nil, nil, errors.New("v1 header too long")
+	}
+	return parseProxyV1(string(line))
+}
+
+func parseProxyV1(line string) (net.Addr, net.Addr, error) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, nil, errors.New("v1 header must end with CRLF")
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errors.New("not a PROXY header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("unknown protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, errors.New("v1 header needs two addresses and two ports")
+	}
+	var addrs [2]net.Addr
+	for i := range addrs {
+		ip, err := netip.ParseAddr(fields[2+i])
+		if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+			return nil, nil, fmt.Errorf("invalid %s address %q", fields[1], fields[2+i])
+		}
+		port, err := strconv.ParseUint(fields[4+i], 10, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid port %q", fields[4+i])
+		}
+		addrs[i] = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port)))
+	}
+	return addrs[0], addrs[1], nil
+}
+
+func readProxyV2(r io.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unknown version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch header[12] & 0xf {
+	case 0:
+		// LOCAL: the proxy's own connection, e.g. a health check.
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("unknown command %d", header[12]&0xf)
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 1:
+		size = 4
+	case 2:
+		size = 16
+	default:
+		// Unix sockets and unspecified families have no address to use.
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("v2 address block too short")
+	}
+	source, _ := netip.AddrFromSlice(payload[:size])
+	destination, _ := netip.AddrFromSlice(payload[size : 2*size])
+	ports := payload[2*size:]
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, binary.BigEndian.Uint16(ports))),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(destination, binary.BigEndian.Uint16(ports[2:]))), nil
+}
+
+// writeProxyHeader starts a connection to a backend with a PROXY header of
+// version for a client connected from source to destination.
+func writeProxyHeader(w io.Writer, version string, source, destination net.Addr) error {
+	src, dst := tcpAddrPort(source), tcpAddrPort(destination)
+	known := src.IsValid() && dst.IsValid()
+	ipv4 := src.Addr().Is4() && dst.Addr().Is4()
+	if known && !ipv4 {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	var header []byte
+	switch {
+	case version == "v1" && !known:
+		header = []byte("PROXY UNKNOWN\r\n")
+	case version == "v1":
+		protocol := "TCP6"
+		if ipv4 {
+			protocol = "TCP4"
+		}
+		header = fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", protocol, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	case !known:
+		header = append(append(header, proxyV2Signature...), 0x20, 0x00, 0, 0)
+	default:
+		family, addrs := byte(0x21), append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+		if ipv4 {
+			family = 0x11
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+		header = append(append(header, proxyV2Signature...), 0x21, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+		header = append(header, addrs...)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// tcpAddrPort returns the address of a TCP connection end, invalid for
+// anything else.
+func tcpAddrPort(addr net.Addr) netip.AddrPort {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	addrPort := tcp.AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
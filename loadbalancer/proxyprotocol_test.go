@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	addrs := []struct{ source, destination string }{
+		{"203.0.113.7:5555", "10.0.0.1:80"},
+		{"[2001:db8::7]:5555", "[2001:db8::1]:443"},
+		{"203.0.113.7:5555", "[2001:db8::1]:443"},
+	}
+	for _, version := range []string{"v1", "v2"} {
+		for _, addr := range addrs {
+			source, _ := net.ResolveTCPAddr("tcp", addr.source)
+			destination, _ := net.ResolveTCPAddr("tcp", addr.destination)
+			var header bytes.Buffer
+			if err := writeProxyHeader(&header, version, source, destination); err != nil {
+				t.Fatal(err)
+			}
+			gotSource, gotDestination, err := readProxyHeader(bufio.NewReader(&header))
+			if err != nil {
+				t.Fatalf("Expected the %s header for %v to be read back, got %v", version, addr, err)
+			}
+			if tcpAddrPort(gotSource).Addr().Unmap() != tcpAddrPort(source).Addr() || tcpAddrPort(gotSource).Port() != 5555 ||
+				tcpAddrPort(gotDestination).Addr().Unmap() != tcpAddrPort(destination).Addr() {
+				t.Errorf("Expected %v from the %s header, got %v -> %v", addr, version, gotSource, gotDestination)
+			}
+		}
+
+		var header bytes.Buffer
+		writeProxyHeader(&header, version, nil, nil)
+		if source, _, err := readProxyHeader(bufio.NewReader(&header)); err != nil || source != nil {
+			t.Errorf("Expected a %s header without addresses, got %v %v", version, source, err)
+		}
+	}
+
+	for _, header := range []string{"PROXY TCP4 203.0.113.7 10.0.0.1 5555\r\n", "PROXY TCP4 2001:db8::7 10.0.0.1 5555 80\r\n", "GET / HTTP/1.1\r\n"} {
+		if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("Expected %q to be refused", header)
+		}
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	config := Config{
+		Port:          "8080",
+		Backends:      []BackendConfig{{URL: backend.URL}},
+		ProxyProtocol: &ProxyProtocolConfig{Accept: true},
+	}
+	lb := NewLoadBalancer(config)
+	defer lb.Close()
+	server := httptest.NewUnstartedServer(lb.Handler())
+	server.Listener = lb.WrapListener(server.Listener)
+	server.Start()
+	defer server.Close()
+
+	get := func(header string) string {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "%sGET / HTTP/1.0\r\nHost: example.com\r\n\r\n", header)
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return ""
+		}
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	if client := get("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n"); client != "203.0.113.7" {
+		t.Errorf("Expected the client address from the v1 header, got %q", client)
+	}
+	var v2 bytes.Buffer
+	source, _ := net.ResolveTCPAddr("tcp", "[2001:db8::7]:5555")
+	destination, _ := net.ResolveTCPAddr("tcp", "[2001:db8::1]:80")
+	writeProxyHeader(&v2, "v2", source, destination)
+	if client := get(v2.String()); client != "2001:db8::7" {
+		t.Errorf("Expected the client address from the v2 header, got %q", client)
+	}
+	if client := get(""); client != "" {
+		t.Errorf("Expected connections without a PROXY header to be closed, got %q", client)
+	}
+
+	// Peers that aren't trusted to send a header are served as they are.
+	config.ProxyProtocol = &ProxyProtocolConfig{Accept: true, Trusted: []string{"10.0.0.0/8"}}
+	lb.Reload(config)
+	if client := get(""); client != "127.0.0.1" {
+		t.Errorf("Expected an untrusted peer's own address, got %q", client)
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			source, _, err := readProxyHeader(reader)
+			if err == nil && source != nil {
+				io.WriteString(conn, source.String())
+			}
+			conn.Close()
+		}
+	}()
+
+	config := Config{
+		Port:          "5432",
+		Mode:          ModeTCP,
+		Backends:      []BackendConfig{{URL: "tcp://" + backend.Addr().String()}},
+		ProxyProtocol: &ProxyProtocolConfig{Accept: true, Send: "v2"},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid tcp listener, got %v", err)
+	}
+	lb := NewLoadBalancer(config)
+	defer lb.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.ServeTCP(lb.WrapListener(listener))
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 198.51.100.2 10.0.0.1 40000 5432\r\n")
+	reply, _ := io.ReadAll(conn)
+	if string(reply) != "198.51.100.2:40000" {
+		t.Errorf("Expected the backend to get the client address in a PROXY header, got %q", reply)
+	}
+
+	config.Mode = ModeHTTP
+	config.Backends = []BackendConfig{{URL: "http://10.0.0.1"}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "proxy_protocol.send: only available in tcp mode") {
+		t.Errorf("Expected send to be refused outside tcp mode, got %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadbalancer/logging"
+	"loadbalancer/ratelimiter"
+)
+
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+	RateLimitLeakyBucket   = "leaky_bucket"
+
+	RateLimitHeadersLegacy = "x-ratelimit"
+	RateLimitHeadersDraft  = "draft"
+	RateLimitHeadersNone   = "none"
+
+	defaultRateLimitIdleTTL    = 10 * time.Minute
+	defaultRateLimitMaxClients = 100000
+)
+
+// RateLimit is how many requests each client gets. With the token_bucket
+// algorithm (the default) that is Capacity in a burst, refilled at Rate
+// per Per (default a second) or at RatePerMinute; rates may be fractional.
+// sliding_window allows Capacity in any Window (default a second) without
+// bursts at window edges, and leaky_bucket lets requests through at the
+// rate, with up to Capacity waiting their turn. Clients are told apart by
+// Key, "client_ip" (the default) or "header:<name>"; requests without the
+// header fall back to the client IP.
+type RateLimit struct {
+	Algorithm     string   `json:"algorithm,omitempty"`
+	Capacity      int      `json:"capacity,omitempty"`
+	Rate          float64  `json:"rate,omitempty"`
+	Per           Duration `json:"per,omitempty"`
+	RatePerMinute float64  `json:"rate_per_minute,omitempty"`
+	Window        Duration `json:"window,omitempty"`
+	Key           string   `json:"key,omitempty"`
+}
+
+// RateLimitConfig limits requests by its RateLimit. Rules are tried in
+// order and the first one matching a request limits it instead, with
+// buckets of its own; requests no rule matches are limited by the
+// RateLimit if it sets a capacity. With Redis, token buckets are shared
+// by every balancer using it, falling back to local ones while it is
+// unavailable. Headers tells clients about their quota: in X-RateLimit-*
+// headers (the default), in the IETF draft's RateLimit-* ones or not at
+// all. Clients are forgotten after IdleTTL without requests (default 10
+// minutes, and never before their limit has fully recovered), and past
+// MaxClients per rule (default 100000) one not seen recently is. Costs
+// weigh requests by what they cost the backends.
+type RateLimitConfig struct {
+	RateLimit
+	Rules      []RateLimitRule `json:"rules,omitempty"`
+	Costs      []RateLimitCost `json:"costs,omitempty"`
+	Redis      *RedisConfig    `json:"redis,omitempty"`
+	Headers    string          `json:"headers,omitempty"`
+	IdleTTL    Duration        `json:"idle_ttl,omitempty"`
+	MaxClients int             `json:"max_clients,omitempty"`
+}
+
+// RateLimitRule matches requests by path prefix, host, method and header
+// values, all of which have to match when set. Algorithm and Key default
+// to the RateLimitConfig's.
+type RateLimitRule struct {
+	Name       string            `json:"name,omitempty"`
+	PathPrefix string            `json:"path_prefix,omitempty"`
+	Hosts      []string          `json:"hosts,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	RateLimit
+}
+
+// RateLimitCost makes the requests it matches take Cost tokens from the
+// limit that applies to them instead of one; zero lets them through
+// without taking any. It matches requests like a RateLimitRule, and the
+// first matching cost applies.
+type RateLimitCost struct {
+	PathPrefix string            `json:"path_prefix,omitempty"`
+	Hosts      []string          `json:"hosts,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Cost       int               `json:"cost"`
+}
+
+func (c *RateLimit) validate() error {
+	if c.Capacity <= 0 {
+		return fmt.Errorf("capacity: must be positive")
+	}
+	if c.Rate < 0 || c.RatePerMinute < 0 {
+		return fmt.Errorf("rate: must be positive")
+	}
+	if c.Per < 0 {
+		return fmt.Errorf("per: must not be negative")
+	}
+	switch c.Algorithm {
+	case "", RateLimitTokenBucket, RateLimitLeakyBucket:
+		if (c.Rate > 0) == (c.RatePerMinute > 0) {
+			return fmt.Errorf("rate: exactly one of rate and rate_per_minute must be set")
+		}
+		if c.Per != 0 && c.Rate == 0 {
+			return fmt.Errorf("per: only applies to rate")
+		}
+	case RateLimitSlidingWindow:
+	default:
+		return fmt.Errorf("algorithm: must be %s, %s or %s, got %q", RateLimitTokenBucket, RateLimitSlidingWindow, RateLimitLeakyBucket, c.Algorithm)
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("window: must not be negative")
+	}
+	if c.Key != "" && c.Key != "client_ip" && (!strings.HasPrefix(c.Key, "header:") || c.Key == "header:") {
+		return fmt.Errorf("key: must be client_ip or header:<name>, got %q", c.Key)
+	}
+	return nil
+}
+
+func (c *RateLimitConfig) validate() error {
+	if len(c.Rules) == 0 || c.Capacity != 0 || c.Rate != 0 || c.RatePerMinute != 0 {
+		if err := c.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if c.IdleTTL < 0 {
+		return fmt.Errorf("idle_ttl: must not be negative")
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("max_clients: must not be negative")
+	}
+	switch c.Headers {
+	case "", RateLimitHeadersLegacy, RateLimitHeadersDraft, RateLimitHeadersNone:
+	default:
+		return fmt.Errorf("headers: must be %s, %s or %s, got %q", RateLimitHeadersLegacy, RateLimitHeadersDraft, RateLimitHeadersNone, c.Headers)
+	}
+	for i, cost := range c.Costs {
+		if cost.Cost < 0 {
+			return fmt.Errorf("costs[%d].cost: must not be negative", i)
+		}
+	}
+	for i, rule := range c.Rules {
+		if rule.Algorithm == "" {
+			rule.Algorithm = c.Algorithm
+		}
+		if err := rule.RateLimit.validate(); err != nil {
+			return fmt.Errorf("rules[%d].%v", i, err)
+		}
+		if c.Redis != nil && rule.Algorithm != "" && rule.Algorithm != RateLimitTokenBucket {
+			return fmt.Errorf("rules[%d].algorithm: redis only supports %s", i, RateLimitTokenBucket)
+		}
+	}
+	if c.Redis != nil {
+		if c.Algorithm != "" && c.Algorithm != RateLimitTokenBucket {
+			return fmt.Errorf("algorithm: redis only supports %s", RateLimitTokenBucket)
+		}
+		if err := c.Redis.validate(); err != nil {
+			return fmt.Errorf("redis.%v", err)
+		}
+	}
+	return nil
+}
+
+// recovery returns how long a client's limit takes to recover fully from
+// being used up.
+func (c RateLimit) recovery() time.Duration {
+	switch c.Algorithm {
+	case RateLimitSlidingWindow:
+		if c.Window == 0 {
+			return 2 * time.Second
+		}
+		return 2 * time.Duration(c.Window)
+	}
+	return time.Duration(float64(c.Capacity)/c.perSecond()*float64(time.Second)) + time.Second
+}
+
+// perSecond returns the rate in requests per second.
+func (c RateLimit) perSecond() float64 {
+	if c.RatePerMinute > 0 {
+		return c.RatePerMinute / 60
+	}
+	if c.Per > 0 {
+		return c.Rate / time.Duration(c.Per).Seconds()
+	}
+	return c.Rate
+}
+
+func (c RateLimit) newLimiter(store ratelimiter.Store, key string) ratelimiter.Limiter {
+	if store != nil {
+		return ratelimiter.NewSharedTokenBucket(store, key, c.Capacity, c.perSecond())
+	}
+	switch c.Algorithm {
+	case RateLimitSlidingWindow:
+		window := time.Duration(c.Window)
+		if window == 0 {
+			window = time.Second
+		}
+		return ratelimiter.NewSlidingWindow(c.Capacity, window)
+	case RateLimitLeakyBucket:
+		return ratelimiter.NewLeakyBucket(c.Capacity, c.perSecond())
+	}
+	return ratelimiter.NewTokenBucket(c.Capacity, c.perSecond())
+}
+
+func (rule *RateLimitRule) matches(r *http.Request) bool {
+	return requestMatches(r, rule.PathPrefix, rule.Hosts, rule.Methods, rule.Headers)
+}
+
+func (cost *RateLimitCost) matches(r *http.Request) bool {
+	return requestMatches(r, cost.PathPrefix, cost.Hosts, cost.Methods, cost.Headers)
+}
+
+func requestMatches(r *http.Request, pathPrefix string, hosts, methods []string, headers map[string]string) bool {
+	if !strings.HasPrefix(r.URL.Path, pathPrefix) {
+		return false
+	}
+	if len(hosts) > 0 {
+		if !matchesHostname(hosts, requestHostname(r)) {
+			return false
+		}
+	}
+	if len(methods) > 0 {
+		matched := false
+		for _, method := range methods {
+			if strings.EqualFold(method, r.Method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, value := range headers {
+		if !matchesValue(r.Header.Get(name), len(r.Header.Values(name)) > 0, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesValue reports whether a header or query parameter matches the
+// expected value, where "*" matches any value as long as it is present.
+func matchesValue(actual string, present bool, expected string) bool {
+	if expected == "*" {
+		return present
+	}
+	return actual == expected
+}
+
+func clientKey(key string, r *http.Request) string {
+	if name, ok := strings.CutPrefix(key, "header:"); ok {
+		if value := r.Header.Get(name); value != "" {
+			return key + "=" + value
+		}
+	}
+	return clientIP(r)
+}
+
+// rateLimits is a RateLimitConfig with the limiters of its clients, one
+// RateLimiter per rule. The last rule is the catch-all from the config's
+// own RateLimit.
+type rateLimits struct {
+	rules    []RateLimitRule
+	limiters []*ratelimiter.RateLimiter
+	costs    []RateLimitCost
+	headers  string
+	redis    *redisStore
+}
+
+func newRateLimits(config *RateLimitConfig, logger logging.Logger) *rateLimits {
+	if config == nil {
+		return nil
+	}
+	limits := &rateLimits{headers: config.Headers, costs: config.Costs}
+	idleTTL := time.Duration(config.IdleTTL)
+	if idleTTL == 0 {
+		idleTTL = defaultRateLimitIdleTTL
+	}
+	maxClients := config.MaxClients
+	if maxClients == 0 {
+		maxClients = defaultRateLimitMaxClients
+	}
+	var store ratelimiter.Store
+	if config.Redis != nil {
+		limits.redis = newRedisStore(config.Redis, logger)
+		store = limits.redis
+	}
+	rules := config.Rules
+	if config.Capacity > 0 {
+		rules = append(rules[:len(rules):len(rules)], RateLimitRule{Name: "default", RateLimit: config.RateLimit})
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		if rule.Algorithm == "" {
+			rule.Algorithm = config.Algorithm
+		}
+		if rule.Key == "" {
+			rule.Key = config.Key
+		}
+		rule := rule
+		limits.rules = append(limits.rules, rule)
+		newLimiter := func(clientID string) ratelimiter.Limiter {
+			return rule.newLimiter(store, rule.Name+":"+clientID)
+		}
+		limits.limiters = append(limits.limiters, ratelimiter.NewRateLimiterWith(newLimiter,
+			ratelimiter.WithIdleTTL(max(idleTTL, rule.recovery())),
+			ratelimiter.WithMaxClients(maxClients)))
+	}
+	return limits
+}
+
+// cost returns how many tokens r takes.
+func (l *rateLimits) cost(r *http.Request) int {
+	for i := range l.costs {
+		if l.costs[i].matches(r) {
+			return l.costs[i].Cost
+		}
+	}
+	return 1
+}
+
+func (l *rateLimits) close() {
+	if l == nil {
+		return
+	}
+	for _, limiter := range l.limiters {
+		limiter.Close()
+	}
+	if l.redis != nil {
+		l.redis.client.Close()
+	}
+}
+
+// setRateLimitHeaders tells the client about its quota in the headers
+// style asks for.
+func setRateLimitHeaders(header http.Header, style string, result ratelimiter.Result) {
+	prefix := "X-RateLimit-"
+	switch style {
+	case RateLimitHeadersNone:
+		return
+	case RateLimitHeadersDraft:
+		prefix = "RateLimit-"
+	}
+	header.Set(prefix+"Limit", strconv.Itoa(result.Limit))
+	header.Set(prefix+"Remaining", strconv.Itoa(result.Remaining))
+	header.Set(prefix+"Reset", seconds(result.Reset))
+}
+
+// seconds rounds d up to whole seconds, at least one.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(max(1, int64((d+time.Second-1)/time.Second)), 10)
+}
+
+// admitRateLimit turns away clients over their limit with a 429, and
+// holds back those a leaky bucket makes wait.
+func (lb *LoadBalancer) admitRateLimit(limits *rateLimits, w http.ResponseWriter, r *http.Request) bool {
+	if limits == nil {
+		return true
+	}
+	for i := range limits.rules {
+		rule := &limits.rules[i]
+		if !rule.matches(r) {
+			continue
+		}
+		result := limits.limiters[i].TakeN(clientKey(rule.Key, r), limits.cost(r))
+		setRateLimitHeaders(w.Header(), limits.headers, result)
+		if !result.Allowed {
+			lb.logger.Debugf("Rate limiting request %s from %s by %s", r.Header.Get(RequestIDHeader), clientIP(r), rule.Name)
+			lb.metrics.RecordRateLimited(lb.listener)
+			w.Header().Set("Retry-After", seconds(result.RetryAfter))
+			lb.httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+			return false
+		}
+		if result.Wait > 0 {
+			timer := time.NewTimer(result.Wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				lb.httpError(w, r, "Service unavailable", http.StatusServiceUnavailable)
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
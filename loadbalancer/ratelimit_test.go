@@ -0,0 +1,324 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:  []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{RateLimit: RateLimit{Capacity: 2, Rate: 1, Key: "header:X-API-Key"}},
+	})
+	defer lb.Close()
+
+	send := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := send("192.0.2.1:1234", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within the burst to pass, got %d", i+1, w.Code)
+		}
+		if limit, remaining := w.Header().Get("X-RateLimit-Limit"), w.Header().Get("X-RateLimit-Remaining"); limit != "2" || remaining != strconv.Itoa(1-i) {
+			t.Errorf("Expected request %d to leave %d of 2, got %s of %s", i+1, 1-i, remaining, limit)
+		}
+	}
+	w := send("192.0.2.1:1234", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || w.Header().Get("X-RateLimit-Reset") != "2" {
+		t.Errorf("Expected a 429 with Retry-After once the burst is used up, got %d %v", w.Code, w.Header())
+	}
+	if w := send("192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected other clients to have buckets of their own, got %d", w.Code)
+	}
+	if w := send("192.0.2.1:1234", "team-a"); w.Code != http.StatusOK {
+		t.Errorf("Expected requests with a key to be limited by the key, got %d", w.Code)
+	}
+
+	lb.Reload(Config{
+		Backends:  []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{RateLimit: RateLimit{Capacity: 2, Rate: 1, Key: "header:X-API-Key"}},
+	})
+	if w := send("192.0.2.1:1234", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected buckets to survive a reload that keeps the limit, got %d", w.Code)
+	}
+}
+
+func TestRateLimitRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{
+			RateLimit: RateLimit{Capacity: 2, Rate: 1},
+			Rules: []RateLimitRule{
+				{Name: "login", PathPrefix: "/login", Methods: []string{"POST"}, RateLimit: RateLimit{Capacity: 1, Rate: 1}},
+				{Name: "static", PathPrefix: "/static/", RateLimit: RateLimit{Capacity: 100, Rate: 100}},
+				{Name: "partners", Hosts: []string{"api.example.com"}, Headers: map[string]string{"X-Plan": "partner"}, RateLimit: RateLimit{Capacity: 5, Rate: 5}},
+				{Name: "search", PathPrefix: "/search", RateLimit: RateLimit{Algorithm: RateLimitSlidingWindow, Capacity: 3, Window: Duration(time.Minute)}},
+			},
+		},
+	})
+	defer lb.Close()
+
+	allowed := func(method, target, plan string, n int) int {
+		passed := 0
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(method, target, nil)
+			if plan != "" {
+				req.Header.Set("X-Plan", plan)
+			}
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, req)
+			if w.Code == http.StatusOK {
+				passed++
+			}
+		}
+		return passed
+	}
+
+	for _, test := range []struct {
+		name, method, target, plan string
+		expected                   int
+	}{
+		{"login", "POST", "/login", "", 1},
+		{"static", "GET", "/static/app.js", "", 10},
+		{"partner", "GET", "http://api.example.com/items", "partner", 5},
+		{"sliding window", "GET", "/search?q=shoes", "", 3},
+		{"default", "GET", "/login", "", 2},
+	} {
+		if passed := allowed(test.method, test.target, test.plan, 10); passed != test.expected {
+			t.Errorf("%s: expected %d of 10 requests to pass, got %d", test.name, test.expected, passed)
+		}
+	}
+}
+
+func TestRateLimitMaxClients(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:  []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{RateLimit: RateLimit{Capacity: 1, Rate: 1}, MaxClients: 1},
+	})
+	defer lb.Close()
+
+	codes := ""
+	for _, client := range []string{"192.0.2.1:1", "192.0.2.1:1", "192.0.2.2:1", "192.0.2.1:1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = client
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		codes += strconv.Itoa(w.Code) + " "
+	}
+	if codes != "200 429 200 200 " {
+		t.Errorf("Expected the first client to be forgotten for the second, got %s", codes)
+	}
+}
+
+func TestRateLimitSlowRates(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	for _, test := range []struct {
+		limit      RateLimit
+		retryAfter string
+	}{
+		{RateLimit{Capacity: 1, RatePerMinute: 30}, "2"},
+		{RateLimit{Capacity: 1, Rate: 0.25}, "4"},
+		{RateLimit{Capacity: 1, Rate: 6, Per: Duration(time.Hour)}, "600"},
+	} {
+		lb := NewLoadBalancer(Config{
+			Backends:  []BackendConfig{{URL: backend.URL}},
+			RateLimit: &RateLimitConfig{RateLimit: test.limit},
+		})
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("%+v: expected a 429 with Retry-After %s, got %d with %s", test.limit, test.retryAfter, w.Code, w.Header().Get("Retry-After"))
+		}
+		lb.Close()
+	}
+}
+
+func TestRateLimitDraftHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{
+			RateLimit: RateLimit{Algorithm: RateLimitSlidingWindow, Capacity: 10, Window: Duration(time.Minute)},
+			Headers:   RateLimitHeadersDraft,
+		},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("RateLimit-Limit") != "10" || w.Header().Get("RateLimit-Remaining") != "9" || w.Header().Get("RateLimit-Reset") == "" {
+		t.Errorf("Expected the draft headers, got %v", w.Header())
+	}
+	if w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Error("Expected no X-RateLimit-* headers with the draft ones")
+	}
+}
+
+func TestRateLimitLeakyBucket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends:  []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{RateLimit: RateLimit{Algorithm: RateLimitLeakyBucket, Capacity: 1, Rate: 20}},
+	})
+	defer lb.Close()
+
+	start := time.Now()
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			codes <- w.Code
+		}()
+	}
+	counts := map[int]int{}
+	for i := 0; i < 3; i++ {
+		counts[<-codes]++
+	}
+	if counts[http.StatusOK] != 2 || counts[http.StatusTooManyRequests] != 1 {
+		t.Errorf("Expected one request to go, one to wait and one to be refused, got %v", counts)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected the second request to wait for its turn, took %v", elapsed)
+	}
+}
+
+func TestRateLimitRedis(t *testing.T) {
+	// The fake Redis answers every command as if the bucket in it was
+	// empty.
+	redis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands atomic.Int64
+	go func() {
+		for {
+			conn, err := redis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					for i := 0; i < 2*n; i++ {
+						reader.ReadString('\n')
+					}
+					commands.Add(1)
+					conn.Write([]byte("*4\r\n:0\r\n:0\r\n:3000\r\n:1500\r\n"))
+				}
+			}()
+		}
+	}()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{
+			RateLimit: RateLimit{Capacity: 5, Rate: 1},
+			Redis:     &RedisConfig{Address: redis.Addr().String()},
+		},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests || commands.Load() != 1 {
+		t.Errorf("Expected the shared bucket in Redis to decide, got %d after %d commands", w.Code, commands.Load())
+	}
+	if w.Header().Get("Retry-After") != "2" || w.Header().Get("X-RateLimit-Reset") != "3" {
+		t.Errorf("Expected the times Redis reported, got %v", w.Header())
+	}
+
+	redis.Close()
+	lb.mutex.Lock()
+	lb.rateLimit.redis.client.Close()
+	lb.mutex.Unlock()
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a local bucket to stand in while Redis is down, got %d", w.Code)
+	}
+}
+
+func TestRateLimitCosts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		RateLimit: &RateLimitConfig{
+			RateLimit: RateLimit{Capacity: 12, Rate: 1},
+			Costs: []RateLimitCost{
+				{PathPrefix: "/search", Cost: 10},
+				{PathPrefix: "/ping", Cost: 0},
+			},
+		},
+	})
+	defer lb.Close()
+
+	send := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	if w := send("/search"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("Expected a search to take 10 of 12 tokens, got %d with %s left", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if w := send("/search"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "8" {
+		t.Errorf("Expected a second search to wait 8s for its tokens, got %d %v", w.Code, w.Header())
+	}
+	for i := 0; i < 5; i++ {
+		if w := send("/ping"); w.Code != http.StatusOK {
+			t.Errorf("Expected pings to cost nothing, got %d", w.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if w := send("/"); w.Code != http.StatusOK {
+			t.Errorf("Expected request %d costing 1 to pass, got %d", i+1, w.Code)
+		}
+	}
+	if w := send("/"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the quota to be used up, got %d", w.Code)
+	}
+}
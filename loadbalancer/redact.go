@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the config that is safe to show to operators:
+// passwords in URLs and of the status page, credential-looking headers (of
+// health checks and trace exports), registry tokens, JWT and OIDC secrets,
+// auth and Redis passwords, API keys and webhook paths (which usually embed a token)
+// are replaced.
+func (c Config) Redacted() Config {
+	c.Backends = redactBackends(c.Backends)
+	c.Split = c.Split.redacted()
+	c.HealthCheck = *c.HealthCheck.redacted()
+	c.JWT = c.JWT.redacted()
+	c.Auth = c.Auth.redacted()
+	c.OIDC = c.OIDC.redacted()
+	c.RateLimit = c.RateLimit.redacted()
+	c.AdminOIDC = c.AdminOIDC.redacted()
+
+	routes := c.Routes
+	c.Routes = nil
+	for _, route := range routes {
+		route.Backends = redactBackends(route.Backends)
+		route.Split = route.Split.redacted()
+		route.HealthCheck = route.HealthCheck.redacted()
+		route.JWT = route.JWT.redacted()
+		route.Auth = route.Auth.redacted()
+		route.OIDC = route.OIDC.redacted()
+		route.RateLimit = route.RateLimit.redacted()
+		c.Routes = append(c.Routes, route)
+	}
+
+	webhooks := c.HealthWebhooks
+	c.HealthWebhooks = nil
+	for _, webhook := range webhooks {
+		c.HealthWebhooks = append(c.HealthWebhooks, redactWebhook(webhook))
+	}
+
+	if c.Tracing != nil {
+		tracing := *c.Tracing
+		tracing.Headers = redactHeaders(tracing.Headers)
+		c.Tracing = &tracing
+	}
+
+	if c.StatusPage != nil {
+		c.StatusPage = &StatusPageConfig{Username: c.StatusPage.Username, Password: redacted}
+	}
+
+	if c.Defaults != nil {
+		defaults := *c.Defaults
+		defaults.HealthCheck = *defaults.HealthCheck.redacted()
+		defaults.RateLimit = defaults.RateLimit.redacted()
+		c.Defaults = &defaults
+	}
+
+	listeners := c.Listeners
+	c.Listeners = nil
+	for _, listener := range listeners {
+		c.Listeners = append(c.Listeners, listener.Redacted())
+	}
+	return c
+}
+
+func redactBackends(backends []BackendConfig) []BackendConfig {
+	backends = append([]BackendConfig(nil), backends...)
+	for i := range backends {
+		backends[i].URL = redactURL(backends[i].URL)
+		backends[i].HealthCheck = backends[i].HealthCheck.redacted()
+		backends[i].Discovery = redactDiscovery(backends[i].Discovery)
+	}
+	return backends
+}
+
+func (c *HealthCheckConfig) redacted() *HealthCheckConfig {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	out.Headers = redactHeaders(c.Headers)
+	return &out
+}
+
+func (c *JWTConfig) redacted() *JWTConfig {
+	if c == nil || c.Secret == "" {
+		return c
+	}
+	out := *c
+	out.Secret = redacted
+	return &out
+}
+
+func (c *RateLimitConfig) redacted() *RateLimitConfig {
+	if c == nil || c.Redis == nil {
+		return c
+	}
+	out := *c
+	out.Redis = c.Redis.redacted()
+	return &out
+}
+
+func (c *AuthConfig) redacted() *AuthConfig {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	if c.Users != nil {
+		out.Users = make(map[string]string, len(c.Users))
+		for user := range c.Users {
+			out.Users[user] = redacted
+		}
+	}
+	if c.APIKeys != nil {
+		out.APIKeys = make([]string, len(c.APIKeys))
+		for i := range c.APIKeys {
+			out.APIKeys[i] = redacted
+		}
+	}
+	return &out
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if isSecretName(name) {
+			value = redacted
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// redactDiscovery blanks the credential-looking fields of provider configs,
+// which the balancer only knows as raw JSON.
+func redactDiscovery(providers map[string]json.RawMessage) map[string]json.RawMessage {
+	if providers == nil {
+		return nil
+	}
+	out := make(map[string]json.RawMessage, len(providers))
+	for name, config := range providers {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(config, &fields) != nil {
+			out[name] = config
+			continue
+		}
+		for field := range fields {
+			if isSecretName(field) {
+				fields[field] = json.RawMessage(`"` + redacted + `"`)
+			}
+		}
+		out[name], _ = json.Marshal(fields)
+	}
+	return out
+}
+
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, marker := range []string{"auth", "token", "secret", "password", "key", "cookie"} {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsed.Redacted()
+}
+
+func redactWebhook(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return redacted
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/" + redacted
+}
@@ -0,0 +1,113 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// HTTPSRedirect answers every request with a permanent redirect to the same
+// host and path on the HTTPS listener at httpsPort.
+func HTTPSRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// RedirectConfig answers requests with a redirect to another URL instead of
+// proxying them. The target is the request's URL with Scheme and Host
+// replaced when set, and its path replaced by Path. With a Pattern, a Go
+// regular expression, only what it matches in the path is replaced, and Path
+// can refer to its groups as $1 or ${name}. The query string is kept. Status
+// defaults to 302.
+type RedirectConfig struct {
+	Status  int    `json:"status,omitempty"`
+	Scheme  string `json:"scheme,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+func (c *RedirectConfig) validate() error {
+	switch c.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return errors.New("status: must be 301, 302, 307 or 308")
+	}
+	if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+		return errors.New("scheme: must be http or https")
+	}
+	if strings.ContainsAny(c.Host, "/?# ") {
+		return fmt.Errorf("host: %q must be a host name, optionally with a port", c.Host)
+	}
+	if c.Pattern == "" && c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return errors.New("path: must start with /")
+	}
+	_, err := c.compile()
+	return err
+}
+
+type redirector struct {
+	config  RedirectConfig
+	pattern *regexp.Regexp
+}
+
+func (c *RedirectConfig) compile() (*redirector, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rd := &redirector{config: *c}
+	if c.Status == 0 {
+		rd.config.Status = http.StatusFound
+	}
+	if c.Pattern != "" {
+		var err error
+		if rd.pattern, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, fmt.Errorf("pattern: %v", err)
+		}
+	}
+	return rd, nil
+}
+
+// target returns the URL r is redirected to.
+func (rd *redirector) target(r *http.Request) string {
+	target := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	if r.TLS != nil {
+		target.Scheme = "https"
+	}
+	if rd.config.Scheme != "" {
+		target.Scheme = rd.config.Scheme
+	}
+	if rd.config.Host != "" {
+		target.Host = rd.config.Host
+	}
+	if rd.pattern != nil {
+		target.Path = rd.pattern.ReplaceAllString(target.Path, rd.config.Path)
+	} else if rd.config.Path != "" {
+		target.Path = rd.config.Path
+	}
+	return target.String()
+}
+
+func (lb *LoadBalancer) serveRedirect(w http.ResponseWriter, r *http.Request, rd *redirector) {
+	target := rd.target(r)
+	lb.logger.Debugf("Redirecting request %s to %s", r.Header.Get(RequestIDHeader), target)
+	http.Redirect(w, r, target, rd.config.Status)
+}
@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	for _, test := range []struct {
+		config   RedirectConfig
+		target   string
+		tls      bool
+		status   int
+		location string
+	}{
+		{RedirectConfig{Scheme: "https"}, "http://example.com/a?b=1", false, http.StatusFound, "https://example.com/a?b=1"},
+		{RedirectConfig{Status: 301, Host: "new.example.com"}, "http://example.com/a", true, http.StatusMovedPermanently, "https://new.example.com/a"},
+		{RedirectConfig{Status: 308, Pattern: `^/blog/(\d+)/(.*)$`, Path: "/posts/$2?"}, "http://example.com/blog/2019/hello", false, http.StatusPermanentRedirect, "http://example.com/posts/hello%3F"},
+		{RedirectConfig{Path: "/"}, "http://example.com/old/page", false, http.StatusFound, "http://example.com/"},
+	} {
+		lb := NewLoadBalancer(Config{Redirect: &test.config})
+		r := httptest.NewRequest("GET", test.target, nil)
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		lb.Close()
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("Expected %s redirected by %+v to be %d %s, got %d %s", test.target, test.config, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRouteRedirect(t *testing.T) {
+	web := namedBackend(t, "web")
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: web.URL}},
+		Routes:   []RouteConfig{{PathPrefix: "/docs/", Redirect: &RedirectConfig{Host: "docs.example.com", Pattern: "^/docs", Path: ""}}},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/docs/install", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://docs.example.com/install" {
+		t.Errorf("Expected the route to redirect, got %d %v", w.Code, w.Header())
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Body.String() != "web" {
+		t.Errorf("Expected other requests to be proxied, got %d %q", w.Code, w.Body.String())
+	}
+}
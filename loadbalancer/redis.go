@@ -0,0 +1,148 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/logging"
+	"loadbalancer/ratelimiter"
+	"loadbalancer/redis"
+)
+
+const defaultRedisKeyPrefix = "httpbalance:ratelimit:"
+
+// RedisConfig keeps rate limit buckets in Redis, shared by every balancer
+// using it. Keys start with KeyPrefix; routes sharing a Redis need
+// prefixes of their own when their rules have the same names.
+type RedisConfig struct {
+	Address   string   `json:"address"`
+	Password  string   `json:"password,omitempty"`
+	DB        int      `json:"db,omitempty"`
+	KeyPrefix string   `json:"key_prefix,omitempty"`
+	Timeout   Duration `json:"timeout,omitempty"`
+}
+
+func (c *RedisConfig) validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("address: is required")
+	}
+	if c.DB < 0 {
+		return fmt.Errorf("db: must not be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: must not be negative")
+	}
+	return nil
+}
+
+func (c *RedisConfig) redacted() *RedisConfig {
+	if c == nil || c.Password == "" {
+		return c
+	}
+	out := *c
+	out.Password = redacted
+	return &out
+}
+
+// takeTokenScript is a token bucket refilled continuously from the time
+// of its last take, from which a request takes cost tokens. The caller's
+// clock is used, so buckets stay consistent as long as the balancers'
+// clocks roughly agree. It returns whether the request is allowed, the
+// whole tokens left and the milliseconds until the bucket is full and
+// until there are enough tokens.
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(bucket[1])
+local at = tonumber(bucket[2])
+if tokens == nil then
+  tokens = capacity
+  at = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - at) * rate / 1000)
+local allowed = 0
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(math.max(now, at)))
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate * 1000) + 1000)
+return {allowed, math.floor(tokens), math.ceil((capacity - tokens) / rate * 1000), math.ceil(math.max(0, cost - tokens) / rate * 1000)}
+`)
+
+// redisStore is a ratelimiter.Store in Redis. It logs when Redis stops
+// and starts answering, rather than on every failed request.
+type redisStore struct {
+	client  *redis.Client
+	address string
+	prefix  string
+	logger  logging.Logger
+	failing atomic.Bool
+}
+
+func newRedisStore(config *RedisConfig, logger logging.Logger) *redisStore {
+	prefix := config.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &redisStore{
+		client: redis.New(redis.Config{
+			Address:  config.Address,
+			Password: config.Password,
+			DB:       config.DB,
+			Timeout:  time.Duration(config.Timeout),
+		}),
+		address: config.Address,
+		prefix:  prefix,
+		logger:  logger,
+	}
+}
+
+func (s *redisStore) Take(key string, capacity int, rate float64, n int) (ratelimiter.Result, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	reply, err := takeTokenScript.Run(context.Background(), s.client, []string{s.prefix + key}, strconv.Itoa(capacity), strconv.FormatFloat(rate, 'g', -1, 64), now, strconv.Itoa(n))
+	var numbers []int64
+	if err == nil {
+		numbers, err = integers(reply, 4)
+	}
+	if err != nil {
+		if !s.failing.Swap(true) {
+			s.logger.Warnf("Rate limiting locally, Redis at %s is unavailable: %v", s.address, err)
+		}
+		return ratelimiter.Result{}, err
+	}
+	if s.failing.Swap(false) {
+		s.logger.Infof("Redis at %s is available again, sharing rate limits", s.address)
+	}
+	result := ratelimiter.Result{
+		Allowed:   numbers[0] == 1,
+		Limit:     capacity,
+		Remaining: int(numbers[1]),
+		Reset:     time.Duration(numbers[2]) * time.Millisecond,
+	}
+	if !result.Allowed {
+		result.RetryAfter = time.Duration(numbers[3]) * time.Millisecond
+	}
+	return result, nil
+}
+
+// integers returns reply as n integers.
+func integers(reply interface{}, n int) ([]int64, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != n {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+	numbers := make([]int64, n)
+	for i, value := range values {
+		if numbers[i], ok = value.(int64); !ok {
+			return nil, fmt.Errorf("unexpected reply %v", reply)
+		}
+	}
+	return numbers, nil
+}
@@ -0,0 +1,366 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries          = 2
+	defaultRetryBackoff        = 25 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+	defaultRetryMaxBodyBytes   = 64 << 10
+	defaultRetryBudget         = 0.2
+	defaultMinRetriesPerSecond = 10
+
+	// retryBudgetWindow is how far back the retry budget looks.
+	retryBudgetWindow = 10
+)
+
+var (
+	defaultRetryOn      = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	defaultRetryMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE"}
+)
+
+// RetryConfig retries requests on another backend when one cannot be
+// reached or answers with a status in RetryOn (502 and 503 by default), up
+// to MaxRetries times (default 2). Only the idempotent Methods are retried
+// by default. Attempts are spaced by Backoff (default 25ms), doubling up
+// to MaxBackoff (default 1s) with jitter. Request bodies are buffered up
+// to MaxBodyBytes (default 64 KB) for replay; larger ones are not retried.
+// Retries may make up at most Budget (default 0.2) of the requests of the
+// last 10 seconds, though MinRetriesPerSecond (default 10) are always
+// allowed, so a failing pool does not face a retry storm on top.
+type RetryConfig struct {
+	MaxRetries          int      `json:"max_retries,omitempty"`
+	RetryOn             []int    `json:"retry_on,omitempty"`
+	Methods             []string `json:"methods,omitempty"`
+	Backoff             Duration `json:"backoff,omitempty"`
+	MaxBackoff          Duration `json:"max_backoff,omitempty"`
+	MaxBodyBytes        int64    `json:"max_body_bytes,omitempty"`
+	Budget              float64  `json:"budget,omitempty"`
+	MinRetriesPerSecond int      `json:"min_retries_per_second,omitempty"`
+}
+
+func (c *RetryConfig) validate() error {
+	if c.MaxRetries < 0 {
+		return errors.New("max_retries: must not be negative")
+	}
+	for _, status := range c.RetryOn {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("retry_on: %d is not an HTTP status", status)
+		}
+	}
+	if c.Backoff < 0 {
+		return errors.New("backoff: must not be negative")
+	}
+	if c.MaxBackoff < 0 {
+		return errors.New("max_backoff: must not be negative")
+	}
+	if c.MaxBodyBytes < 0 {
+		return errors.New("max_body_bytes: must not be negative")
+	}
+	if c.Budget < 0 || c.Budget > 1 {
+		return errors.New("budget: must be between 0 and 1")
+	}
+	if c.MinRetriesPerSecond < 0 {
+		return errors.New("min_retries_per_second: must not be negative")
+	}
+	return nil
+}
+
+// retryPolicy is a RetryConfig with its defaults applied and the budget
+// its retries draw on.
+type retryPolicy struct {
+	maxRetries   int
+	statuses     map[int]bool
+	grpcStatuses map[int]bool
+	methods      map[string]bool
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	maxBodyBytes int64
+	budget       *retryBudget
+}
+
+// newRetryPolicy returns the policy of config, which also retries on the
+// gRPC status codes of grpc.
+func newRetryPolicy(config *RetryConfig, grpc *GRPCConfig) *retryPolicy {
+	if config == nil {
+		return nil
+	}
+	p := &retryPolicy{
+		maxRetries:   config.MaxRetries,
+		statuses:     make(map[int]bool),
+		grpcStatuses: grpc.retryCodes(),
+		methods:      make(map[string]bool),
+		backoff:      time.Duration(config.Backoff),
+		maxBackoff:   time.Duration(config.MaxBackoff),
+		maxBodyBytes: config.MaxBodyBytes,
+	}
+	if p.maxRetries == 0 {
+		p.maxRetries = defaultMaxRetries
+	}
+	retryOn := config.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, status := range retryOn {
+		p.statuses[status] = true
+	}
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	for _, method := range methods {
+		p.methods[strings.ToUpper(method)] = true
+	}
+	if p.backoff == 0 {
+		p.backoff = defaultRetryBackoff
+	}
+	if p.maxBackoff == 0 {
+		p.maxBackoff = defaultRetryMaxBackoff
+	}
+	if p.maxBodyBytes == 0 {
+		p.maxBodyBytes = defaultRetryMaxBodyBytes
+	}
+	budget, minPerSecond := config.Budget, config.MinRetriesPerSecond
+	if budget == 0 {
+		budget = defaultRetryBudget
+	}
+	if minPerSecond == 0 {
+		minPerSecond = defaultMinRetriesPerSecond
+	}
+	p.budget = &retryBudget{ratio: budget, minPerSecond: minPerSecond}
+	return p
+}
+
+// eligible reports whether r may be retried at all. Upgrades are not, as
+// the connection is the client's once it switched protocols.
+func (p *retryPolicy) eligible(r *http.Request) bool {
+	return p.methods[r.Method] && r.Header.Get("Upgrade") == ""
+}
+
+// delay returns the backoff before retry number attempt, counting from 0:
+// the doubled backoff, of which a random half is jitter.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.maxBackoff
+	if attempt < 30 && p.backoff<<attempt < p.maxBackoff {
+		d = p.backoff << attempt
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryBudget counts requests and retries per second over the last
+// retryBudgetWindow seconds.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mutex    sync.Mutex
+	seconds  [retryBudgetWindow]int64
+	requests [retryBudgetWindow]int
+	retries  [retryBudgetWindow]int
+}
+
+// slot returns the index of the current second, clearing it if it last
+// held an older one. The caller holds b.mutex.
+func (b *retryBudget) slot(now time.Time) int {
+	second := now.Unix()
+	i := int(second % retryBudgetWindow)
+	if b.seconds[i] != second {
+		b.seconds[i], b.requests[i], b.retries[i] = second, 0, 0
+	}
+	return i
+}
+
+func (b *retryBudget) request() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.requests[b.slot(time.Now())]++
+}
+
+// withdraw reports whether another retry fits in the budget and counts it
+// if so.
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	current := b.slot(now)
+	requests, retries := 0, 0
+	for i := range b.seconds {
+		if now.Unix()-b.seconds[i] < retryBudgetWindow {
+			requests += b.requests[i]
+			retries += b.retries[i]
+		}
+	}
+	if float64(retries+1) > b.ratio*float64(requests) && retries+1 > b.minPerSecond*retryBudgetWindow {
+		return false
+	}
+	b.retries[current]++
+	return true
+}
+
+// retryWriter holds back a response the request is retried over, and
+// passes any other through to the client. Headers are collected apart
+// until then, so those of a discarded attempt do not leak.
+type retryWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	policy   *retryPolicy
+	canRetry bool
+	header   http.Header
+
+	wroteHeader bool
+	retrying    bool
+	reason      string
+}
+
+func newRetryWriter(w http.ResponseWriter, r *http.Request, policy *retryPolicy, canRetry bool) *retryWriter {
+	return &retryWriter{ResponseWriter: w, request: r, policy: policy, canRetry: canRetry, header: w.Header().Clone()}
+}
+
+// retry reports whether the request is to be retried after this attempt,
+// taking the retry from the budget.
+func (w *retryWriter) retry(reason string) bool {
+	if !w.canRetry || w.request.Context().Err() != nil || !w.policy.budget.withdraw() {
+		return false
+	}
+	w.wroteHeader, w.retrying, w.reason = true, true, reason
+	return true
+}
+
+// retryError is called when the backend could not be reached, and reports
+// whether the error response is to be left out for a retry.
+func (w *retryWriter) retryError(err error) bool {
+	return !w.wroteHeader && w.retry(err.Error())
+}
+
+func (w *retryWriter) Header() http.Header {
+	if w.wroteHeader && !w.retrying {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *retryWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if w.policy.statuses[status] && w.retry(fmt.Sprintf("status %d", status)) {
+		return
+	}
+	// A gRPC error without messages comes with its status in the headers.
+	if code := grpcStatus(w.header); status == http.StatusOK && w.policy.grpcStatuses[code] && w.retry("gRPC status "+grpcCodes[code]) {
+		return
+	}
+	w.wroteHeader = true
+	header := w.ResponseWriter.Header()
+	for name := range header {
+		delete(header, name)
+	}
+	for name, values := range w.header {
+		header[name] = values
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *retryWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.retrying {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *retryWriter) Flush() {
+	if w.wroteHeader && !w.retrying {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// bufferBody reads r's body for replaying it, and reports whether it could.
+// A body over limit, or one that fails to read, is put back in front of
+// the rest to be proxied once.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		rest := r.Body
+		if err != nil {
+			rest = io.NopCloser(errorReader{err})
+		}
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), rest), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// forward proxies r to backend, retrying on other backends as policy
+// allows, and returns the backend that answered. It gives back every
+// backend's slot.
+func (lb *LoadBalancer) forward(w http.ResponseWriter, r *http.Request, backend *Backend, policy *retryPolicy) *Backend {
+	if policy == nil {
+		defer lb.releaseBackend(backend)
+		backend.serve(w, r)
+		return backend
+	}
+	policy.budget.request()
+	if !policy.eligible(r) {
+		return lb.forward(w, r, backend, nil)
+	}
+	body, replayable := bufferBody(r, policy.maxBodyBytes)
+	if !replayable {
+		return lb.forward(w, r, backend, nil)
+	}
+
+	tried := []*Backend{backend}
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		rw := newRetryWriter(w, r, policy, attempt < policy.maxRetries)
+		backend.serve(rw, r)
+		lb.releaseBackend(backend)
+		if !rw.retrying {
+			return backend
+		}
+
+		lb.logger.Debugf("Retrying request %s after %s from %s", r.Header.Get(RequestIDHeader), rw.reason, backend.URL.String())
+		lb.metrics.requestRetried(lb.listener)
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+		next, _ := lb.acquireBackend(r.Context(), tried...)
+		if next == nil {
+			lb.recordError(r, nil, http.StatusServiceUnavailable, "no backend available for retry")
+			lb.httpError(w, r, "Service unavailable", http.StatusServiceUnavailable)
+			return backend
+		}
+		backend = next
+		tried = append(tried, backend)
+	}
+}
@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryOnAnotherBackend(t *testing.T) {
+	var failed atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		failed.Add(1)
+		w.Header().Set("X-Failing", "yes")
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	// The unreachable backend passes its health checks but drops every
+	// proxied request.
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		failed.Add(1)
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer unreachable.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer working.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: failing.URL}, {URL: unreachable.URL}, {URL: working.URL}},
+		Retry:    &RetryConfig{Backoff: Duration(1)},
+	})
+	defer lb.Close()
+
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("PUT", "/", strings.NewReader("payload")))
+		if w.Code != http.StatusOK || w.Body.String() != "payload" {
+			t.Errorf("Expected request %d to be retried until it reached the working backend, got %d %q", i+1, w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-Failing") != "" {
+			t.Errorf("Expected the headers of a discarded attempt to be left out, got %v", w.Header())
+		}
+	}
+	if failed.Load() == 0 {
+		t.Error("Expected some requests to have been tried on the failing backends first")
+	}
+
+	// POST is not idempotent, so it is answered by whichever backend it
+	// reaches first.
+	codes := make(map[int]bool)
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+		codes[w.Code] = true
+	}
+	if !codes[http.StatusServiceUnavailable] || !codes[http.StatusBadGateway] {
+		t.Errorf("Expected POST requests not to be retried, got statuses %v", codes)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		attempts.Add(1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Retry:    &RetryConfig{MaxRetries: 3, Backoff: Duration(1)},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "overloaded") {
+		t.Errorf("Expected the last attempt's response once retries ran out, got %d %q", w.Code, w.Body.String())
+	}
+	if attempts.Load() != 4 {
+		t.Errorf("Expected 1 attempt and 3 retries, got %d attempts", attempts.Load())
+	}
+
+	large := strings.Repeat("x", defaultRetryMaxBodyBytes+1)
+	attempts.Store(0)
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/", strings.NewReader(large)))
+	if attempts.Load() != 1 {
+		t.Errorf("Expected a body over max_body_bytes not to be retried, got %d attempts", attempts.Load())
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := &retryBudget{ratio: 0.5}
+	for i := 0; i < 10; i++ {
+		budget.request()
+	}
+	for i := 0; i < 5; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("Expected retry %d to fit in half of 10 requests", i+1)
+		}
+	}
+	if budget.withdraw() {
+		t.Error("Expected the budget to be used up")
+	}
+
+	budget.minPerSecond = 1
+	if !budget.withdraw() {
+		t.Error("Expected the minimum rate of retries to be allowed regardless")
+	}
+}
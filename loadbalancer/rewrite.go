@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RewriteConfig changes the path of requests before they are proxied:
+// StripPrefix is cut off the front, then each of Rules replaces the
+// matches of its Pattern, a Go regular expression, by Replacement, which can
+// refer to groups as $1 or ${name}, and finally AddPrefix is put in front.
+// Access logs, metrics and the checks before proxying see the original
+// path.
+type RewriteConfig struct {
+	StripPrefix string        `json:"strip_prefix,omitempty"`
+	AddPrefix   string        `json:"add_prefix,omitempty"`
+	Rules       []RewriteRule `json:"rules,omitempty"`
+}
+
+type RewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+func (c *RewriteConfig) validate() error {
+	if c.StripPrefix != "" && !strings.HasPrefix(c.StripPrefix, "/") {
+		return errors.New("strip_prefix: must start with /")
+	}
+	if c.AddPrefix != "" && !strings.HasPrefix(c.AddPrefix, "/") {
+		return errors.New("add_prefix: must start with /")
+	}
+	_, err := c.compile()
+	return err
+}
+
+type rewriter struct {
+	stripPrefix  string
+	addPrefix    string
+	patterns     []*regexp.Regexp
+	replacements []string
+}
+
+func (c *RewriteConfig) compile() (*rewriter, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rw := &rewriter{stripPrefix: c.StripPrefix, addPrefix: c.AddPrefix}
+	for i, rule := range c.Rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d].pattern: %v", i, err)
+		}
+		rw.patterns = append(rw.patterns, pattern)
+		rw.replacements = append(rw.replacements, rule.Replacement)
+	}
+	return rw, nil
+}
+
+// apply returns r with its path rewritten, leaving r itself alone.
+func (rw *rewriter) apply(r *http.Request) *http.Request {
+	if rw == nil {
+		return r
+	}
+	path := r.URL.Path
+	if rw.stripPrefix != "" {
+		if rest, ok := strings.CutPrefix(path, strings.TrimSuffix(rw.stripPrefix, "/")); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+			path = rest
+		}
+	}
+	for i, pattern := range rw.patterns {
+		path = pattern.ReplaceAllString(path, rw.replacements[i])
+	}
+	if rw.addPrefix != "" {
+		path = strings.TrimSuffix(rw.addPrefix, "/") + path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if path == r.URL.Path {
+		return r
+	}
+	rewritten := r.WithContext(r.Context())
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	rewritten.URL = &u
+	return rewritten
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	for _, test := range []struct {
+		config   RewriteConfig
+		path     string
+		expected string
+	}{
+		{RewriteConfig{StripPrefix: "/serviceA"}, "/serviceA/foo", "/foo"},
+		{RewriteConfig{StripPrefix: "/serviceA/"}, "/serviceA", "/"},
+		{RewriteConfig{StripPrefix: "/serviceA"}, "/serviceAB/foo", "/serviceAB/foo"},
+		{RewriteConfig{AddPrefix: "/v2/"}, "/users", "/v2/users"},
+		{RewriteConfig{StripPrefix: "/api", AddPrefix: "/internal"}, "/api/users", "/internal/users"},
+		{RewriteConfig{Rules: []RewriteRule{{Pattern: `^/users/(\d+)$`, Replacement: "/accounts/$1/profile"}}}, "/users/42", "/accounts/42/profile"},
+	} {
+		rw, err := test.config.compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", test.path+"?q=1", nil)
+		rewritten := rw.apply(r)
+		if rewritten.URL.Path != test.expected || rewritten.URL.RawQuery != "q=1" {
+			t.Errorf("Expected %s rewritten by %+v to be %s, got %s", test.path, test.config, test.expected, rewritten.URL)
+		}
+		if r.URL.Path != test.path {
+			t.Errorf("Expected the original request to keep its path, got %s", r.URL.Path)
+		}
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Routes: []RouteConfig{{
+			PathPrefix: "/serviceA/",
+			Backends:   []BackendConfig{{URL: backend.URL}},
+			Rewrite:    &RewriteConfig{StripPrefix: "/serviceA"},
+		}},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/serviceA/foo?bar=1", nil))
+	if w.Body.String() != "/foo?bar=1" {
+		t.Errorf("Expected the backend to see /foo?bar=1, got %q", w.Body.String())
+	}
+}
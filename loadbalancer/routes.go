@@ -0,0 +1,347 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// RouteConfig sends the requests it matches to a backend pool of its own.
+// ServerNames matches the TLS server name (SNI) the client asked for and
+// Hosts the Host header, exactly or with a leading wildcard such as
+// "*.example.com", PathPrefix and PathRegex the request path, and Methods,
+// Headers and Query the method, headers and query parameters, where a
+// value of "*" only needs the header or parameter to be present. A route
+// needs all it sets to match, and of the routes matching a request the one
+// with the longest PathPrefix wins, the first one on a tie. Settings the
+// route leaves out are taken from its listener.
+type RouteConfig struct {
+	Name             string                  `json:"name,omitempty"`
+	ServerNames      []string                `json:"server_names,omitempty"`
+	Hosts            []string                `json:"hosts,omitempty"`
+	PathPrefix       string                  `json:"path_prefix,omitempty"`
+	PathRegex        string                  `json:"path_regex,omitempty"`
+	Methods          []string                `json:"methods,omitempty"`
+	Headers          map[string]string       `json:"headers,omitempty"`
+	Query            map[string]string       `json:"query,omitempty"`
+	Backends         []BackendConfig         `json:"backends"`
+	BackendTLS       *ClientTLSConfig        `json:"backend_tls,omitempty"`
+	Strategy         string                  `json:"strategy,omitempty"`
+	HealthCheck      *HealthCheckConfig      `json:"health_check,omitempty"`
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+	SecurityHeaders  *SecurityHeadersConfig  `json:"security_headers,omitempty"`
+	AccessControl    *AccessControlConfig    `json:"access_control,omitempty"`
+	RequestLimits    *RequestLimitsConfig    `json:"request_limits,omitempty"`
+	Decompression    *DecompressionConfig    `json:"decompression,omitempty"`
+	Retry            *RetryConfig            `json:"retry,omitempty"`
+	CircuitBreaker   *CircuitBreakerConfig   `json:"circuit_breaker,omitempty"`
+	Timeouts         *TimeoutsConfig         `json:"timeouts,omitempty"`
+	Hedge            *HedgeConfig            `json:"hedge,omitempty"`
+	GRPC             *GRPCConfig             `json:"grpc,omitempty"`
+	BackendHTTP2     *BackendHTTP2Config     `json:"backend_http2,omitempty"`
+	WebSocket        *WebSocketConfig        `json:"websocket,omitempty"`
+	Streaming        *StreamingConfig        `json:"streaming,omitempty"`
+	Compression      *CompressionConfig      `json:"compression,omitempty"`
+	Fault            *FaultConfig            `json:"fault,omitempty"`
+	Mirror           *MirrorConfig           `json:"mirror,omitempty"`
+	Maintenance      *MaintenanceConfig      `json:"maintenance,omitempty"`
+	Fallback         *FallbackConfig         `json:"fallback,omitempty"`
+	Redirect         *RedirectConfig         `json:"redirect,omitempty"`
+	Static           *StaticConfig           `json:"static,omitempty"`
+	Split            *SplitConfig            `json:"split,omitempty"`
+	Experiment       *ExperimentConfig       `json:"experiment,omitempty"`
+	ErrorPages       *ErrorPagesConfig       `json:"error_pages,omitempty"`
+	Rewrite          *RewriteConfig          `json:"rewrite,omitempty"`
+	RequestHeaders   *HeaderRules            `json:"request_headers,omitempty"`
+	ResponseHeaders  *HeaderRules            `json:"response_headers,omitempty"`
+	RateLimit        *RateLimitConfig        `json:"rate_limit,omitempty"`
+	CORS             *CORSConfig             `json:"cors,omitempty"`
+	WAF              *WAFConfig              `json:"waf,omitempty"`
+	JWT              *JWTConfig              `json:"jwt,omitempty"`
+	Auth             *AuthConfig             `json:"auth,omitempty"`
+	OIDC             *OIDCConfig             `json:"oidc,omitempty"`
+}
+
+// route is a configured route with the load balancer serving its pool.
+type route struct {
+	name      string
+	config    RouteConfig
+	pathRegex *regexp.Regexp
+	lb        *LoadBalancer
+	// split is set on the pools of the listener's split, which are picked
+	// by weight rather than matched.
+	split  bool
+	weight atomic.Int64
+}
+
+func (r *route) matches(req *http.Request) bool {
+	if !r.config.matches(req) {
+		return false
+	}
+	// A path_regex that does not compile matches nothing.
+	return r.config.PathRegex == "" || r.pathRegex != nil && r.pathRegex.MatchString(req.URL.Path)
+}
+
+func (r RouteConfig) matches(req *http.Request) bool {
+	if !requestMatches(req, r.PathPrefix, r.Hosts, r.Methods, r.Headers) {
+		return false
+	}
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range r.Query {
+			if !matchesValue(query.Get(name), query.Has(name), value) {
+				return false
+			}
+		}
+	}
+	if len(r.ServerNames) > 0 {
+		if req.TLS == nil || !matchesHostname(r.ServerNames, req.TLS.ServerName) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHostname returns the Host header of r without its port.
+func requestHostname(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// matchesHostname reports whether host equals one of patterns, ignoring
+// case and a trailing dot. A pattern "*.example.com" matches any name
+// ending in ".example.com".
+func matchesHostname(patterns []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// routeConfig returns the config of the pool behind route: the listener's
+// settings with the route's own on top.
+func (c Config) routeConfig(route RouteConfig) Config {
+	c.Routes = nil
+	c.Backends = route.Backends
+	// The listener's access control has already let the request through
+	// by the time it reaches the route.
+	c.AccessControl = route.AccessControl
+	// The listener's concurrency limit covers its routes' requests too.
+	c.ConcurrencyLimit = nil
+	// Redirecting, serving files and splitting are what a route does
+	// instead of proxying to its backends, so they are not inherited.
+	c.Redirect = route.Redirect
+	c.Static = route.Static
+	c.Split = route.Split
+	if route.BackendTLS != nil {
+		c.BackendTLS = route.BackendTLS
+	}
+	if route.Strategy != "" {
+		c.Strategy = route.Strategy
+	}
+	c.HealthCheck = c.HealthCheck.merge(route.HealthCheck)
+	if route.OutlierDetection != nil {
+		c.OutlierDetection = route.OutlierDetection
+	}
+	if route.SecurityHeaders != nil {
+		c.SecurityHeaders = route.SecurityHeaders
+	}
+	if route.RequestLimits != nil {
+		c.RequestLimits = route.RequestLimits
+	}
+	if route.Decompression != nil {
+		c.Decompression = route.Decompression
+	}
+	if route.Retry != nil {
+		c.Retry = route.Retry
+	}
+	if route.CircuitBreaker != nil {
+		c.CircuitBreaker = route.CircuitBreaker
+	}
+	if route.Timeouts != nil {
+		c.Timeouts = route.Timeouts
+	}
+	if route.Hedge != nil {
+		c.Hedge = route.Hedge
+	}
+	if route.GRPC != nil {
+		c.GRPC = route.GRPC
+	}
+	if route.BackendHTTP2 != nil {
+		c.BackendHTTP2 = route.BackendHTTP2
+	}
+	if route.WebSocket != nil {
+		c.WebSocket = route.WebSocket
+	}
+	if route.Streaming != nil {
+		c.Streaming = route.Streaming
+	}
+	if route.Compression != nil {
+		c.Compression = route.Compression
+	}
+	if route.Fault != nil {
+		c.Fault = route.Fault
+	}
+	if route.Mirror != nil {
+		c.Mirror = route.Mirror
+	}
+	if route.Maintenance != nil {
+		c.Maintenance = route.Maintenance
+	}
+	if route.Fallback != nil {
+		c.Fallback = route.Fallback
+	}
+	if route.ErrorPages != nil {
+		c.ErrorPages = route.ErrorPages
+	}
+	if route.Rewrite != nil {
+		c.Rewrite = route.Rewrite
+	}
+	if route.Experiment != nil {
+		c.Experiment = route.Experiment
+	}
+	if route.RequestHeaders != nil {
+		c.RequestHeaders = route.RequestHeaders
+	}
+	if route.ResponseHeaders != nil {
+		c.ResponseHeaders = route.ResponseHeaders
+	}
+	if route.RateLimit != nil {
+		c.RateLimit = route.RateLimit
+	}
+	if route.CORS != nil {
+		c.CORS = route.CORS
+	}
+	if route.WAF != nil {
+		c.WAF = route.WAF
+	}
+	if route.JWT != nil {
+		c.JWT = route.JWT
+	}
+	if route.Auth != nil {
+		c.Auth = route.Auth
+	}
+	if route.OIDC != nil {
+		c.OIDC = route.OIDC
+	}
+	return c
+}
+
+func routeName(index int, config RouteConfig) string {
+	if config.Name != "" {
+		return config.Name
+	}
+	return fmt.Sprintf("routes[%d]", index)
+}
+
+// syncRoutes gives every route and split pool of config a load balancer,
+// reloading the ones that already exist at the same position and closing
+// those that are gone. The routes themselves are built anew, as requests
+// in flight may still be matching against the previous ones.
+func (lb *LoadBalancer) syncRoutes(config Config) {
+	lb.mutex.Lock()
+	previous := lb.routes
+	lb.mutex.Unlock()
+
+	routes := make([]*route, 0, len(config.Routes))
+	pool := func(poolConfig Config) *LoadBalancer {
+		if i := len(routes); i < len(previous) {
+			previous[i].lb.Reload(poolConfig)
+			return previous[i].lb
+		}
+		return NewLoadBalancer(poolConfig, append(lb.options, withParent(lb))...)
+	}
+	for i, routeConfig := range config.Routes {
+		r := &route{name: routeName(i, routeConfig), config: routeConfig, lb: pool(config.routeConfig(routeConfig))}
+		if routeConfig.PathRegex != "" {
+			var err error
+			if r.pathRegex, err = regexp.Compile(routeConfig.PathRegex); err != nil {
+				lb.logger.Errorf("Error in path_regex of route %s, matching no requests: %v", r.name, err)
+			}
+		}
+		routes = append(routes, r)
+	}
+	if config.Split != nil {
+		for _, splitPool := range config.Split.Pools {
+			split := &route{name: splitPool.Name, config: RouteConfig{Name: splitPool.Name}, lb: pool(config.splitPoolConfig(splitPool)), split: true}
+			split.weight.Store(int64(splitPool.Weight))
+			routes = append(routes, split)
+		}
+	}
+	for _, removed := range previous[min(len(previous), len(routes)):] {
+		removed.lb.Close()
+	}
+
+	lb.mutex.Lock()
+	lb.routes = routes
+	lb.mutex.Unlock()
+}
+
+// route returns the load balancer of the route r goes to, or nil when r
+// goes to the listener's own pool.
+func (lb *LoadBalancer) route(r *http.Request) *LoadBalancer {
+	lb.mutex.Lock()
+	routes := lb.routes
+	var splitKey string
+	if lb.config.Split != nil {
+		splitKey = lb.config.Split.Key
+	}
+	lb.mutex.Unlock()
+	var best *route
+	var splits []*route
+	for _, route := range routes {
+		if route.split {
+			splits = append(splits, route)
+		} else if route.matches(r) && (best == nil || len(route.config.PathPrefix) > len(best.config.PathPrefix)) {
+			best = route
+		}
+	}
+	if best == nil && len(splits) > 0 {
+		best = pickSplit(splitKey, splits, r)
+	}
+	if best == nil {
+		return nil
+	}
+	return best.lb
+}
+
+func (lb *LoadBalancer) routeSnapshot() []*route {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.routes
+}
+
+// withParent makes a route's load balancer report health events to the
+// callbacks registered on its listener's.
+func withParent(parent *LoadBalancer) Option {
+	return func(lb *LoadBalancer) {
+		lb.parent = parent
+	}
+}
+
+// mergeErrors returns the newest of the errors of all pools, newest first.
+func mergeErrors(lists ...[]RequestError) []RequestError {
+	var merged []RequestError
+	for _, list := range lists {
+		merged = append(merged, list...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Time.After(merged[j].Time) })
+	if len(merged) > recentErrorsKept {
+		merged = merged[:recentErrorsKept]
+	}
+	return merged
+}
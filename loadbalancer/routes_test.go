@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func namedBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRoutesByServerName(t *testing.T) {
+	web := namedBackend(t, "web")
+	api := namedBackend(t, "api")
+	tenants := namedBackend(t, "tenants")
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: web.URL}},
+		Routes: []RouteConfig{
+			{Name: "api", ServerNames: []string{"api.example.com"}, Backends: []BackendConfig{{URL: api.URL}}},
+			{ServerNames: []string{"*.tenants.example.com"}, Backends: []BackendConfig{{URL: tenants.URL}}},
+		},
+	})
+	defer lb.Close()
+
+	for serverName, expected := range map[string]string{
+		"":                         "web",
+		"API.example.com.":         "api",
+		"acme.tenants.example.com": "tenants",
+		"tenants.example.com":      "web",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if serverName != "" {
+			r.TLS = &tls.ConnectionState{ServerName: serverName}
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Body.String() != expected {
+			t.Errorf("Expected server name %q to reach %s, got %q", serverName, expected, w.Body.String())
+		}
+	}
+
+	if lb.AvailableBackends() != 3 {
+		t.Errorf("Expected the backends of routes to count as available, got %d", lb.AvailableBackends())
+	}
+	routes := map[string]string{}
+	for _, backend := range lb.Stats(MaxStatsWindow) {
+		routes[backend.URL] = backend.Route
+	}
+	if routes[web.URL] != "" || routes[api.URL] != "api" || routes[tenants.URL] != "routes[1]" {
+		t.Errorf("Expected stats to name each backend's route, got %v", routes)
+	}
+
+	lb.Reload(Config{Backends: []BackendConfig{{URL: web.URL}}})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "api.example.com"}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Body.String() != "web" {
+		t.Errorf("Expected removed routes to stop matching, got %q", w.Body.String())
+	}
+}
+
+func TestRoutesByHost(t *testing.T) {
+	web := namedBackend(t, "web")
+	api := namedBackend(t, "api")
+	tenants := namedBackend(t, "tenants")
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: web.URL}},
+		Routes: []RouteConfig{
+			{Hosts: []string{"api.example.com"}, Backends: []BackendConfig{{URL: api.URL}}},
+			{Hosts: []string{"*.api.example.com"}, ServerNames: []string{"*.api.example.com"}, Backends: []BackendConfig{{URL: tenants.URL}}},
+		},
+	})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		host, serverName, expected string
+	}{
+		{"example.com", "", "web"},
+		{"API.example.com:8080", "", "api"},
+		{"acme.api.example.com", "acme.api.example.com", "tenants"},
+		{"acme.api.example.com", "", "web"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		if test.serverName != "" {
+			r.TLS = &tls.ConnectionState{ServerName: test.serverName}
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Body.String() != test.expected {
+			t.Errorf("Expected host %q with server name %q to reach %s, got %q", test.host, test.serverName, test.expected, w.Body.String())
+		}
+	}
+}
+
+func TestRoutesByPath(t *testing.T) {
+	api := namedBackend(t, "api")
+	users := namedBackend(t, "users")
+	reports := namedBackend(t, "reports")
+
+	lb := NewLoadBalancer(Config{
+		Routes: []RouteConfig{
+			{PathPrefix: "/api/", Backends: []BackendConfig{{URL: api.URL}}},
+			{PathPrefix: "/api/users/", Backends: []BackendConfig{{URL: users.URL}}},
+			{PathRegex: `^/reports/\d+\.pdf$`, Backends: []BackendConfig{{URL: reports.URL}}},
+		},
+	})
+	defer lb.Close()
+
+	for path, expected := range map[string]string{
+		"/api/orders":       "api",
+		"/api/users/42":     "users",
+		"/reports/2024.pdf": "reports",
+		"/reports/all.pdf":  "",
+		"/":                 "",
+	} {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if expected == "" && w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to match no route without a default pool, got %d %q", path, w.Code, w.Body.String())
+		} else if expected != "" && w.Body.String() != expected {
+			t.Errorf("Expected %s to reach %s, got %q", path, expected, w.Body.String())
+		}
+	}
+}
+
+func TestReloadRoutesUnderTraffic(t *testing.T) {
+	api := namedBackend(t, "api")
+	reports := namedBackend(t, "reports")
+	configs := []Config{
+		{Routes: []RouteConfig{
+			{PathPrefix: "/api/", Backends: []BackendConfig{{URL: api.URL}}},
+			{PathRegex: `^/reports/`, Backends: []BackendConfig{{URL: reports.URL}}},
+		}},
+		{Routes: []RouteConfig{
+			{Name: "api", PathRegex: `^/api/`, Backends: []BackendConfig{{URL: api.URL}}},
+			{Name: "reports", PathPrefix: "/reports/", Backends: []BackendConfig{{URL: reports.URL}}},
+		}},
+	}
+	lb := NewLoadBalancer(configs[0])
+	defer lb.Close()
+	pool := lb.routeSnapshot()[0].lb
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				w := httptest.NewRecorder()
+				lb.ServeHTTP(w, httptest.NewRequest("GET", "/reports/1", nil))
+				if w.Body.String() != "reports" {
+					t.Errorf("Expected every request to keep reaching its route during reloads, got %d %q", w.Code, w.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		lb.Reload(configs[i%2])
+	}
+	wg.Wait()
+	if lb.routeSnapshot()[0].lb != pool {
+		t.Error("Expected a reload to keep the pool of a route at the same position")
+	}
+}
+
+func TestRoutesByPredicates(t *testing.T) {
+	stable := namedBackend(t, "stable")
+	canary := namedBackend(t, "canary")
+	writes := namedBackend(t, "writes")
+	beta := namedBackend(t, "beta")
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: stable.URL}},
+		Routes: []RouteConfig{
+			{Headers: map[string]string{"X-Canary": "true"}, Backends: []BackendConfig{{URL: canary.URL}}},
+			{Methods: []string{"POST", "put"}, Backends: []BackendConfig{{URL: writes.URL}}},
+			{Query: map[string]string{"beta": "*"}, Backends: []BackendConfig{{URL: beta.URL}}},
+		},
+	})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		method, target, canary, expected string
+	}{
+		{"GET", "/", "", "stable"},
+		{"GET", "/", "true", "canary"},
+		{"GET", "/", "false", "stable"},
+		{"PUT", "/", "", "writes"},
+		{"GET", "/?beta", "", "beta"},
+		{"GET", "/?alpha=1", "", "stable"},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.canary != "" {
+			r.Header.Set("X-Canary", test.canary)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Body.String() != test.expected {
+			t.Errorf("Expected %s %s with X-Canary %q to reach %s, got %q", test.method, test.target, test.canary, test.expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	FrameOptionsDeny       = "DENY"
+	FrameOptionsSameOrigin = "SAMEORIGIN"
+
+	defaultHSTSMaxAge = 365 * 24 * time.Hour
+)
+
+// SecurityHeadersConfig is the set of security headers added to every
+// proxied response, replacing any the backend sent. HSTS is only sent over
+// HTTPS, where browsers honor it.
+type SecurityHeadersConfig struct {
+	HSTS                  *HSTSConfig `json:"hsts,omitempty"`
+	ContentTypeOptions    bool        `json:"content_type_options,omitempty"`
+	FrameOptions          string      `json:"frame_options,omitempty"`
+	ContentSecurityPolicy string      `json:"content_security_policy,omitempty"`
+}
+
+// HSTSConfig builds the Strict-Transport-Security header. MaxAge defaults
+// to a year.
+type HSTSConfig struct {
+	MaxAge            Duration `json:"max_age,omitempty"`
+	IncludeSubdomains bool     `json:"include_subdomains,omitempty"`
+	Preload           bool     `json:"preload,omitempty"`
+}
+
+func (c *HSTSConfig) value() string {
+	maxAge := time.Duration(c.MaxAge)
+	if maxAge <= 0 {
+		maxAge = defaultHSTSMaxAge
+	}
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if c.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if c.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+func (c *SecurityHeadersConfig) validate() error {
+	switch strings.ToUpper(c.FrameOptions) {
+	case "", FrameOptionsDeny, FrameOptionsSameOrigin:
+	default:
+		return fmt.Errorf("frame_options must be %s or %s, got %q", FrameOptionsDeny, FrameOptionsSameOrigin, c.FrameOptions)
+	}
+	if c.HSTS != nil && c.HSTS.MaxAge < 0 {
+		return fmt.Errorf("hsts.max_age must not be negative")
+	}
+	return nil
+}
+
+// headers returns the headers c adds to responses, split into those
+// for every response and those only sent over HTTPS.
+func (c *SecurityHeadersConfig) headers() (always, secure http.Header) {
+	if c == nil {
+		return nil, nil
+	}
+	always = http.Header{}
+	if c.ContentTypeOptions {
+		always.Set("X-Content-Type-Options", "nosniff")
+	}
+	if c.FrameOptions != "" {
+		always.Set("X-Frame-Options", strings.ToUpper(c.FrameOptions))
+	}
+	if c.ContentSecurityPolicy != "" {
+		always.Set("Content-Security-Policy", c.ContentSecurityPolicy)
+	}
+	if c.HSTS != nil {
+		secure = http.Header{"Strict-Transport-Security": {c.HSTS.value()}}
+	}
+	return always, secure
+}
+
+// setSecurityHeaders adds the listener's security headers to resp.
+func (lb *LoadBalancer) setSecurityHeaders(resp *http.Response) {
+	lb.mutex.Lock()
+	always, secure := lb.securityHeaders, lb.secureHeaders
+	lb.mutex.Unlock()
+
+	for name, values := range always {
+		resp.Header[name] = append([]string(nil), values...)
+	}
+	if resp.Request != nil && resp.Request.TLS != nil {
+		for name, values := range secure {
+			resp.Header[name] = append([]string(nil), values...)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		SecurityHeaders: &SecurityHeadersConfig{
+			HSTS:                  &HSTSConfig{MaxAge: Duration(48 * time.Hour), IncludeSubdomains: true},
+			ContentTypeOptions:    true,
+			FrameOptions:          "deny",
+			ContentSecurityPolicy: "default-src 'self'",
+		},
+	})
+	defer lb.Close()
+
+	recorder := httptest.NewRecorder()
+	lb.ServeHTTP(recorder, httptest.NewRequest("GET", "http://example.com/", nil))
+	for name, expected := range map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Content-Security-Policy":   "default-src 'self'",
+		"Strict-Transport-Security": "",
+	} {
+		if got := recorder.Header().Get(name); got != expected {
+			t.Errorf("Expected %s to be %q, got %q", name, expected, got)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	lb.ServeHTTP(recorder, httptest.NewRequest("GET", "https://example.com/", nil))
+	if got := recorder.Header().Get("Strict-Transport-Security"); got != "max-age=172800; includeSubDomains" {
+		t.Errorf("Expected HSTS over HTTPS, got %q", got)
+	}
+}
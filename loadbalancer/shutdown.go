@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultShutdownGracePeriod = 25 * time.Second
+
+// ShutdownConfig sets how the process stops on SIGTERM or SIGINT. /readyz
+// fails right away, and the listeners keep serving for ReadinessDelay so
+// that health checkers take the process out of rotation first. Then new
+// requests are refused and those in flight get GracePeriod (default 25s)
+// to finish before the servers are shut down, which closes what is left
+// after another 5 seconds.
+type ShutdownConfig struct {
+	ReadinessDelay Duration `json:"readiness_delay,omitempty"`
+	GracePeriod    Duration `json:"grace_period,omitempty"`
+}
+
+func (c *ShutdownConfig) validate() error {
+	if c.ReadinessDelay < 0 {
+		return errors.New("readiness_delay: must not be negative")
+	}
+	if c.GracePeriod < 0 {
+		return errors.New("grace_period: must not be negative")
+	}
+	return nil
+}
+
+// ShutdownGracePeriod returns how long requests in flight get to finish on
+// shutdown.
+func (c Config) ShutdownGracePeriod() time.Duration {
+	if c.Shutdown == nil || c.Shutdown.GracePeriod == 0 {
+		return defaultShutdownGracePeriod
+	}
+	return time.Duration(c.Shutdown.GracePeriod)
+}
+
+// ShutdownReadinessDelay returns how long readiness fails before the
+// listeners stop taking requests.
+func (c Config) ShutdownReadinessDelay() time.Duration {
+	if c.Shutdown == nil {
+		return 0
+	}
+	return time.Duration(c.Shutdown.ReadinessDelay)
+}
+
+// requestTracker counts the requests a listener is serving, and refuses
+// new ones once closed.
+type requestTracker struct {
+	mutex   sync.Mutex
+	active  int
+	closed  bool
+	drained chan struct{}
+}
+
+// start counts a new request, unless the tracker is closed.
+func (t *requestTracker) start() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return false
+	}
+	t.active++
+	return true
+}
+
+func (t *requestTracker) finish() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active--
+	// No request starts once closed, so this happens at most once.
+	if t.closed && t.active == 0 {
+		close(t.drained)
+	}
+}
+
+// close refuses new requests and returns a channel that is closed once
+// those in flight finished.
+func (t *requestTracker) close() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.drained = make(chan struct{})
+		if t.active == 0 {
+			close(t.drained)
+		}
+	}
+	return t.drained
+}
+
+// Shutdown refuses new requests with 503 and waits for those in flight to
+// finish until ctx is done, when it returns how many are left.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) (int, error) {
+	select {
+	case <-lb.requests.close():
+		return 0, nil
+	case <-ctx.Done():
+		lb.requests.mutex.Lock()
+		defer lb.requests.mutex.Unlock()
+		return lb.requests.active, ctx.Err()
+	}
+}
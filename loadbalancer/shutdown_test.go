@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForRequestsInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	defer lb.Close()
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if left, err := lb.Shutdown(ctx); err == nil || left != 1 {
+		t.Errorf("Expected 1 request left in flight after the grace period, got %d (%v)", left, err)
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Connection") != "close" {
+		t.Errorf("Expected new requests to be refused with 503 and the connection closed, got %d %v", w.Code, w.Header())
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the request in flight to finish, got %d", code)
+	}
+	if left, err := lb.Shutdown(context.Background()); err != nil || left != 0 {
+		t.Errorf("Expected no requests left, got %d (%v)", left, err)
+	}
+}
@@ -0,0 +1,241 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// SplitConfig divides the requests of a listener or route among Pools of
+// backends in proportion to their weights, for instance 95 to a stable
+// pool and 5 to a canary. Key makes the choice stick to the client: "ip"
+// for its address, "header:<name>" or "cookie:<name>" for a header or
+// cookie value. Requests with the same key go to the same pool as long as
+// the weights stay the same, and growing the last pool's weight only moves
+// clients to it. Requests without a key are split at random. With Active,
+// the pool of that name gets all requests whatever the weights, and the
+// others are kept running to switch back to.
+type SplitConfig struct {
+	Key    string        `json:"key,omitempty"`
+	Pools  []SplitPool   `json:"pools"`
+	Active string        `json:"active,omitempty"`
+	Canary *CanaryConfig `json:"canary,omitempty"`
+}
+
+type SplitPool struct {
+	Name     string          `json:"name"`
+	Weight   int             `json:"weight"`
+	Backends []BackendConfig `json:"backends"`
+}
+
+func (c *SplitConfig) validate() error {
+	if c.Key != "" && !validSplitKey(c.Key) {
+		return errors.New(`key: must be "ip", "header:<name>" or "cookie:<name>"`)
+	}
+	if len(c.Pools) == 0 {
+		return errors.New("pools: at least one pool is required")
+	}
+	names := make(map[string]bool)
+	total := 0
+	for i, pool := range c.Pools {
+		if pool.Name == "" {
+			return fmt.Errorf("pools[%d].name: must be set", i)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("pools[%d].name: %q is used by another pool", i, pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.Weight < 0 {
+			return fmt.Errorf("pools[%d].weight: must not be negative", i)
+		}
+		total += pool.Weight
+	}
+	if c.Active != "" && !names[c.Active] {
+		return fmt.Errorf("active: no pool is named %q", c.Active)
+	}
+	if c.Active != "" && c.Canary != nil {
+		return errors.New("active: cannot be used with canary")
+	}
+	if total == 0 && c.Canary == nil && c.Active == "" {
+		return errors.New("pools: at least one pool needs a weight")
+	}
+	if c.Canary != nil {
+		if err := c.Canary.validate(c.Pools); err != nil {
+			return fmt.Errorf("canary.%v", err)
+		}
+	}
+	return nil
+}
+
+// splitPoolConfig returns the config of a pool of a split: the settings of
+// the listener or route that splits, with the pool's backends.
+func (c Config) splitPoolConfig(pool SplitPool) Config {
+	return c.routeConfig(RouteConfig{Backends: pool.Backends})
+}
+
+func validSplitKey(key string) bool {
+	return key == "ip" || strings.HasPrefix(key, "header:") || strings.HasPrefix(key, "cookie:")
+}
+
+// splitKey returns the value the pool of r is picked by, if r has one.
+func splitKey(key string, r *http.Request) (string, bool) {
+	switch {
+	case key == "ip":
+		return clientIP(r), true
+	case strings.HasPrefix(key, "header:"):
+		value := r.Header.Get(strings.TrimPrefix(key, "header:"))
+		return value, value != ""
+	case strings.HasPrefix(key, "cookie:"):
+		cookie, err := r.Cookie(strings.TrimPrefix(key, "cookie:"))
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// pickSplit returns the pool of splits r goes to.
+func pickSplit(key string, splits []*route, r *http.Request) *route {
+	weights := make([]int, len(splits))
+	for i, split := range splits {
+		weights[i] = int(split.weight.Load())
+	}
+	point := rand.Float64()
+	if value, ok := splitKey(key, r); ok {
+		point = hashPoint(value)
+	}
+	if i := pickWeighted(weights, point); i >= 0 {
+		return splits[i]
+	}
+	return nil
+}
+
+// hashPoint maps value to a fixed point in [0, 1).
+func hashPoint(value string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	return float64(hash.Sum64()%10000) / 10000
+}
+
+// pickWeighted returns the index of the weight point falls in when [0, 1)
+// is shared out in proportion to weights in order, or -1 if they are all
+// zero.
+func pickWeighted(weights []int, point float64) int {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return -1
+	}
+	threshold := 0
+	for i, weight := range weights {
+		threshold += weight
+		if point < float64(threshold)/float64(total) {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
+
+// syncActivePool gives all requests to the active pool of config's split,
+// the one the admin API switched to or else the configured one. A switch
+// lasts until a reload changes the configured one.
+func (lb *LoadBalancer) syncActivePool(config Config) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	configured := ""
+	if config.Split != nil {
+		configured = config.Split.Active
+	}
+	if configured != lb.activeConfigured {
+		lb.activeConfigured, lb.activeSwitched = configured, ""
+	}
+	if lb.activeSwitched != "" {
+		lb.setActivePool(lb.activeSwitched)
+	} else if configured != "" {
+		lb.setActivePool(configured)
+	}
+}
+
+// setActivePool gives all requests to the split pool with the given name
+// and reports whether there is one. lb.mutex must be held.
+func (lb *LoadBalancer) setActivePool(name string) bool {
+	found := false
+	for _, route := range lb.routes {
+		if route.split && route.name == name {
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	for _, route := range lb.routes {
+		if route.split && route.name == name {
+			route.weight.Store(100)
+		} else if route.split {
+			route.weight.Store(0)
+		}
+	}
+	return true
+}
+
+// SwitchPool gives all requests of the listener, or of the route with the
+// given name, to the pool of its split with the given name on behalf of
+// actor, for a blue/green deployment. The other pools keep running to
+// switch back to.
+func (lb *LoadBalancer) SwitchPool(routeName, poolName, actor string) error {
+	target := lb
+	if routeName != "" {
+		target = nil
+		for _, route := range lb.routeSnapshot() {
+			if !route.split && route.name == routeName {
+				target = route.lb
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("no route named %q", routeName)
+		}
+	}
+
+	target.mutex.Lock()
+	if target.config.Split == nil {
+		target.mutex.Unlock()
+		return errors.New("no split to switch")
+	}
+	if target.canary != nil {
+		target.mutex.Unlock()
+		return errors.New("the split is rolling out a canary")
+	}
+	if !target.setActivePool(poolName) {
+		target.mutex.Unlock()
+		return fmt.Errorf("no pool named %q", poolName)
+	}
+	target.activeSwitched = poolName
+	target.mutex.Unlock()
+
+	if routeName != "" {
+		lb.logger.Infof("Switched route %s on port %s to pool %s", routeName, lb.listener, poolName)
+	} else {
+		lb.logger.Infof("Switched port %s to pool %s", lb.listener, poolName)
+	}
+	lb.auditLog.Record(AuditEvent{Actor: actor, Action: AuditPoolSwitched, Listener: lb.listener, Target: strings.TrimPrefix(routeName+"/"+poolName, "/")})
+	return nil
+}
+
+func (c *SplitConfig) redacted() *SplitConfig {
+	if c == nil {
+		return nil
+	}
+	split := *c
+	split.Pools = nil
+	for _, pool := range c.Pools {
+		pool.Backends = redactBackends(pool.Backends)
+		split.Pools = append(split.Pools, pool)
+	}
+	return &split
+}
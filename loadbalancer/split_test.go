@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	stable := namedBackend(t, "stable")
+	canary := namedBackend(t, "canary")
+
+	lb := NewLoadBalancer(Config{
+		Routes: []RouteConfig{{
+			Name:       "api",
+			PathPrefix: "/api/",
+			Split: &SplitConfig{Key: "header:X-User", Pools: []SplitPool{
+				{Name: "stable", Weight: 80, Backends: []BackendConfig{{URL: stable.URL}}},
+				{Name: "canary", Weight: 20, Backends: []BackendConfig{{URL: canary.URL}}},
+			}},
+		}},
+	})
+	defer lb.Close()
+
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		r := httptest.NewRequest("GET", "/api/", nil)
+		r.Header.Set("X-User", fmt.Sprint(i))
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		counts[w.Body.String()]++
+
+		// The same user keeps reaching the same pool.
+		again := httptest.NewRecorder()
+		lb.ServeHTTP(again, r)
+		if again.Body.String() != w.Body.String() {
+			t.Fatalf("Expected user %d to stick to %s, got %s", i, w.Body.String(), again.Body.String())
+		}
+	}
+	if counts["canary"] < 50 || counts["canary"] > 150 || counts["stable"]+counts["canary"] != 500 {
+		t.Errorf("Expected about a fifth of users on the canary, got %v", counts)
+	}
+
+	routes := map[string]string{}
+	for _, backend := range lb.Stats(MaxStatsWindow) {
+		routes[backend.URL] = backend.Route
+	}
+	if routes[stable.URL] != "api/stable" || routes[canary.URL] != "api/canary" {
+		t.Errorf("Expected stats to name the split pools, got %v", routes)
+	}
+}
+
+func TestPickSplitOnlyMovesClientsToGrowingPool(t *testing.T) {
+	stable, canary := &route{name: "stable", split: true}, &route{name: "canary", split: true}
+	splits := []*route{stable, canary}
+	picks := func(canaryWeight int) map[string]string {
+		stable.weight.Store(int64(100 - canaryWeight))
+		canary.weight.Store(int64(canaryWeight))
+		picked := map[string]string{}
+		for i := 0; i < 200; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-User", fmt.Sprint(i))
+			picked[fmt.Sprint(i)] = pickSplit("header:X-User", splits, r).name
+		}
+		return picked
+	}
+
+	before, after := picks(10), picks(30)
+	for user, pool := range before {
+		if pool == "canary" && after[user] != "canary" {
+			t.Errorf("Expected user %s to stay on the canary as it grows", user)
+		}
+	}
+	for user, pool := range picks(0) {
+		if pool != "stable" {
+			t.Errorf("Expected user %s on the stable pool with a canary weight of 0", user)
+		}
+	}
+}
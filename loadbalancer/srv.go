@@ -0,0 +1,185 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SRV backends are written as srv://_service._tcp.example.com, or
+// srv+https:// to talk to the discovered targets over TLS.
+const (
+	schemeSRV      = "srv"
+	schemeSRVHTTPS = "srv+https"
+)
+
+func isSRV(rawURL string) bool {
+	return strings.HasPrefix(rawURL, schemeSRV+"://") || strings.HasPrefix(rawURL, schemeSRVHTTPS+"://")
+}
+
+// resolveSRV returns one copy of the backend per SRV record of the highest
+// priority (lowest value), taking port and weight from the record, together
+// with the shortest TTL of the answer.
+func (lb *LoadBalancer) resolveSRV(backend BackendConfig) ([]BackendConfig, time.Duration, error) {
+	parsed, err := url.Parse(backend.URL)
+	if err != nil {
+		return nil, 0, err
+	}
+	scheme := "http"
+	if parsed.Scheme == schemeSRVHTTPS {
+		scheme = "https"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	records, ttl, err := lb.lookupSRV(ctx, parsed.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Target+strconv.Itoa(int(records[i].Port)) < records[j].Target+strconv.Itoa(int(records[j].Port))
+	})
+
+	var resolved []BackendConfig
+	for _, record := range records {
+		if record.Priority != records[0].Priority {
+			break
+		}
+		address := url.URL{
+			Scheme:   scheme,
+			Host:     net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))),
+			Path:     parsed.Path,
+			RawQuery: parsed.RawQuery,
+		}
+		copied := backend
+		copied.URL = address.String()
+		copied.Weight = int(record.Weight)
+		resolved = append(resolved, copied)
+	}
+	return resolved, ttl, nil
+}
+
+// lookupSRV queries the nameservers from /etc/resolv.conf directly, because
+// the standard library resolver does not report record TTLs.
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	var errs []error
+	for _, server := range nameservers("/etc/resolv.conf") {
+		records, ttl, err := querySRV(ctx, server, name)
+		if err == nil {
+			return records, ttl, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+func nameservers(path string) []string {
+	var servers []string
+	if file, err := os.Open(path); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+func querySRV(ctx context.Context, server, name string) ([]*net.SRV, time.Duration, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	question, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  question,
+			Type:  dnsmessage.TypeSRV,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(packed); err != nil {
+		return nil, 0, err
+	}
+
+	buffer := make([]byte, 4096)
+	var response dnsmessage.Message
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := response.Unpack(buffer[:n]); err == nil && response.ID == query.ID {
+			break
+		}
+	}
+	if response.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("%s: %s", server, response.RCode)
+	}
+	if response.Truncated {
+		return nil, 0, fmt.Errorf("%s: response truncated", server)
+	}
+
+	var (
+		records []*net.SRV
+		ttl     time.Duration
+	)
+	for _, answer := range response.Answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		records = append(records, &net.SRV{
+			Target:   srv.Target.String(),
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+		recordTTL := time.Duration(answer.Header.TTL) * time.Second
+		if ttl == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("%s: no SRV records for %s", server, name)
+	}
+	return records, ttl, nil
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestQuerySRVReadsRecordsAndTTL(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buffer := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buffer[:n]); err != nil {
+			return
+		}
+		target := dnsmessage.MustNewName("web-1.example.com.")
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true},
+			Questions: query.Questions,
+		}
+		for _, ttl := range []uint32{60, 15} {
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.SRVResource{Priority: 10, Weight: 5, Port: 8080, Target: target},
+			})
+		}
+		packed, _ := response.Pack()
+		conn.WriteTo(packed, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	records, ttl, err := querySRV(ctx, conn.LocalAddr().String(), "_http._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Target != "web-1.example.com." || records[0].Port != 8080 || records[0].Weight != 5 {
+		t.Errorf("Unexpected records: %+v", records)
+	}
+	if ttl != 15*time.Second {
+		t.Errorf("Expected the shortest TTL of 15s, got %v", ttl)
+	}
+}
+
+func TestSRVBackendsTakePortAndWeightFromRecords(t *testing.T) {
+	lookup := func(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+		if name != "_http._tcp.example.com" {
+			t.Errorf("Unexpected SRV lookup of %q", name)
+		}
+		return []*net.SRV{
+			{Target: "web-2.example.com.", Port: 9000, Priority: 10, Weight: 1},
+			{Target: "web-1.example.com.", Port: 8080, Priority: 10, Weight: 3},
+			{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 1},
+		}, 10 * time.Second, nil
+	}
+
+	lb := NewLoadBalancer(Config{
+		Backends:    []BackendConfig{{URL: "srv://_http._tcp.example.com"}},
+		HealthCheck: HealthCheckConfig{Interval: -1, Timeout: Duration(10 * time.Millisecond)},
+	}, func(lb *LoadBalancer) { lb.lookupSRV = lookup })
+	defer lb.Close()
+
+	pool := lb.poolSnapshot()
+	if len(pool) != 2 {
+		t.Fatalf("Expected only the highest priority records, got %d backends", len(pool))
+	}
+	if pool[0].URL.String() != "http://web-1.example.com:8080" || pool[0].weight != 3 {
+		t.Errorf("Unexpected first backend %s with weight %d", pool[0].URL, pool[0].weight)
+	}
+	if pool[1].URL.String() != "http://web-2.example.com:9000" || pool[1].weight != 1 {
+		t.Errorf("Unexpected second backend %s with weight %d", pool[1].URL, pool[1].weight)
+	}
+
+	lb.poolMutex.Lock()
+	delay := lb.resolveDelay
+	lb.poolMutex.Unlock()
+	if delay != 10*time.Second {
+		t.Errorf("Expected the next lookup after the 10s TTL, got %v", delay)
+	}
+}
@@ -0,0 +1,142 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// StaticConfig answers requests with the files under the directory Root
+// instead of proxying them. A request for a directory gets the first of its
+// Index files that exists (default index.html), or a listing of the
+// directory with Listing. Files carry an ETag and Last-Modified, so
+// conditional and range requests are answered as usual.
+type StaticConfig struct {
+	Root    string   `json:"root"`
+	Index   []string `json:"index,omitempty"`
+	Listing bool     `json:"listing,omitempty"`
+}
+
+func (c *StaticConfig) validate() error {
+	if c.Root == "" {
+		return errors.New("root: required")
+	}
+	info, err := os.Stat(c.Root)
+	if err != nil {
+		return fmt.Errorf("root: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("root: %s is not a directory", c.Root)
+	}
+	for _, index := range c.Index {
+		if index == "" || strings.Contains(index, "/") {
+			return fmt.Errorf("index: %q must be a file name", index)
+		}
+	}
+	return nil
+}
+
+func (c *StaticConfig) indexFiles() []string {
+	if len(c.Index) == 0 {
+		return []string{"index.html"}
+	}
+	return c.Index
+}
+
+// serveFiles answers r from the files of config.
+func (lb *LoadBalancer) serveFiles(w http.ResponseWriter, r *http.Request, config *StaticConfig) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	root := http.Dir(config.Root)
+	name := path.Clean("/" + r.URL.Path)
+	file, err := root.Open(name)
+	if err != nil {
+		lb.fileError(w, r, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		lb.fileError(w, r, err)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// Relative, since r's path may have been rewritten.
+			target := url.URL{Path: path.Base(name) + "/", RawQuery: r.URL.RawQuery}
+			w.Header().Set("Location", target.String())
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		for _, index := range config.indexFiles() {
+			indexFile, err := root.Open(path.Join(name, index))
+			if err != nil {
+				continue
+			}
+			defer indexFile.Close()
+			if indexInfo, err := indexFile.Stat(); err == nil && !indexInfo.IsDir() {
+				file, info = indexFile, indexInfo
+				break
+			}
+		}
+	}
+	if info.IsDir() {
+		if !config.Listing {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		lb.logger.Debugf("Listing directory %s for request %s", name, r.Header.Get(RequestIDHeader))
+		listDirectory(w, r, file, name)
+		return
+	}
+
+	lb.logger.Debugf("Serving file %s for request %s", path.Join(config.Root, name), r.Header.Get(RequestIDHeader))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func (lb *LoadBalancer) fileError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		lb.logger.Errorf("Error serving file for request %s: %v", r.Header.Get(RequestIDHeader), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func listDirectory(w http.ResponseWriter, r *http.Request, dir http.File, name string) {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, "<!doctype html>\n<title>Index of %s</title>\n<h1>Index of %s</h1>\n<ul>\n", html.EscapeString(name), html.EscapeString(name))
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		link := url.URL{Path: entryName}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link.String()), html.EscapeString(entryName))
+	}
+	fmt.Fprint(w, "</ul>\n")
+}
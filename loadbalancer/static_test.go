@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticFiles(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>Home</h1>"), 0o644)
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("console.log(1)"), 0o644)
+	os.Mkdir(filepath.Join(root, "docs"), 0o755)
+	os.WriteFile(filepath.Join(root, "docs", "guide.txt"), []byte("guide"), 0o644)
+
+	config := Config{Port: "8080", Routes: []RouteConfig{{
+		Name:       "assets",
+		PathPrefix: "/assets",
+		Rewrite:    &RewriteConfig{StripPrefix: "/assets"},
+		Static:     &StaticConfig{Root: root},
+	}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a static route to need no backends, got %v", err)
+	}
+	lb := NewLoadBalancer(config)
+	defer lb.Close()
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w
+	}
+	w := get("/assets/app.js", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "console.log(1)" || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("Expected the file with an ETag and Last-Modified, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if w = get("/assets/app.js", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", w.Code)
+	}
+	if w = get("/assets/", nil); w.Code != http.StatusOK || w.Body.String() != "<h1>Home</h1>" {
+		t.Errorf("Expected the index file, got %d %q", w.Code, w.Body.String())
+	}
+	if w = get("/assets/docs", nil); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "docs/" {
+		t.Errorf("Expected a redirect to the directory with a trailing slash, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w = get("/assets/docs/", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a directory without an index and listing, got %d", w.Code)
+	}
+	if w = get("/assets/missing.css", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing file, got %d", w.Code)
+	}
+	if w = get("/assets/../../etc/passwd", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected paths not to leave the root, got %d", w.Code)
+	}
+	if w = get("/other", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected requests outside the route to get a 404, got %d", w.Code)
+	}
+
+	config.Routes[0].Static.Listing = true
+	lb.Reload(config)
+	if w = get("/assets/docs/", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<a href="guide.txt">guide.txt</a>`) {
+		t.Errorf("Expected a listing of the directory, got %d %q", w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest("POST", "/assets/app.js", nil)
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for a POST, got %d", w.Code)
+	}
+}
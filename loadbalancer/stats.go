@@ -0,0 +1,272 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsBuckets     = 15
+	statsBucketWidth = time.Minute
+
+	// MaxStatsWindow is how far back Stats can look.
+	MaxStatsWindow = statsBuckets * statsBucketWidth
+
+	// Latencies are counted in exponential buckets growing by a quarter
+	// from 100µs, which keeps percentiles within 25% up to about two
+	// minutes.
+	latencyBuckets = 64
+	latencyBase    = 100 * time.Microsecond
+	latencyGrowth  = 1.25
+
+	recentErrorsKept = 20
+)
+
+var latencyBounds = func() [latencyBuckets]time.Duration {
+	var bounds [latencyBuckets]time.Duration
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(latencyBase) * math.Pow(latencyGrowth, float64(i)))
+	}
+	return bounds
+}()
+
+type statsBucket struct {
+	start     time.Time
+	requests  int
+	errors    int
+	latencies [latencyBuckets]int
+}
+
+// requestStats keeps per-minute request counts and latency histograms of a
+// backend for the last MaxStatsWindow, in the same ring layout as
+// outcomeWindow.
+type requestStats struct {
+	total int64 // accessed atomically
+
+	mutex   sync.Mutex
+	buckets [statsBuckets]statsBucket
+}
+
+func (s *requestStats) record(now time.Time, latency time.Duration, failed bool) {
+	atomic.AddInt64(&s.total, 1)
+
+	start := now.Truncate(statsBucketWidth)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bucket := &s.buckets[(start.UnixNano()/int64(statsBucketWidth))%statsBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = statsBucket{start: start}
+	}
+	bucket.requests++
+	if failed {
+		bucket.errors++
+	}
+	bucket.latencies[latencyBucket(latency)]++
+}
+
+func latencyBucket(latency time.Duration) int {
+	for i, bound := range latencyBounds {
+		if latency <= bound {
+			return i
+		}
+	}
+	return latencyBuckets - 1
+}
+
+// BackendStats describes a backend's state and its traffic over the
+// requested window. Latencies are approximate: each percentile is the upper
+// bound of the histogram bucket it falls in.
+type BackendStats struct {
+	URL               string             `json:"url"`
+	Route             string             `json:"route,omitempty"`
+	Labels            map[string]string  `json:"labels,omitempty"`
+	State             string             `json:"state"`
+	Weight            int                `json:"weight"`
+	ActiveConnections int64              `json:"active_connections"`
+	MaxConcurrent     int                `json:"max_concurrent_requests,omitempty"`
+	Circuit           string             `json:"circuit,omitempty"`
+	RequestsTotal     int64              `json:"requests_total"`
+	Requests          int                `json:"requests"`
+	Errors            int                `json:"errors"`
+	ErrorRate         float64            `json:"error_rate"`
+	LatencyMs         LatencyPercentiles `json:"latency_ms"`
+}
+
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+const (
+	BackendUp       = "up"
+	BackendDown     = "down"
+	BackendEjected  = "ejected"
+	BackendDraining = "draining"
+)
+
+// Stats reports every backend in the pool, followed by those of routes,
+// with its traffic over the last window, rounded up to whole minutes and
+// capped at MaxStatsWindow.
+func (lb *LoadBalancer) Stats(window time.Duration) []BackendStats {
+	lb.mutex.Lock()
+	pool := lb.pool
+	weights := make([]int, len(pool))
+	limits := make([]int, len(pool))
+	for i, backend := range pool {
+		weights[i] = backend.weight
+		limits[i] = backend.maxActive
+	}
+	inGrace := time.Now().Before(lb.graceUntil)
+	lb.mutex.Unlock()
+
+	stats := make([]BackendStats, 0, len(pool))
+	for i, backend := range pool {
+		backendStats := backend.stats.summary(time.Now(), window)
+		backendStats.URL = backend.URL.String()
+		backendStats.Labels = backend.Labels
+		backendStats.State = backend.state(inGrace)
+		backendStats.Weight = weights[i]
+		backendStats.ActiveConnections = atomic.LoadInt64(&backend.active)
+		backendStats.MaxConcurrent = limits[i]
+		backendStats.Circuit = backend.circuit()
+		stats = append(stats, backendStats)
+	}
+	for _, route := range lb.routeSnapshot() {
+		for _, backendStats := range route.lb.Stats(window) {
+			if backendStats.Route != "" {
+				// A pool of the route's split.
+				backendStats.Route = route.name + "/" + backendStats.Route
+			} else {
+				backendStats.Route = route.name
+			}
+			stats = append(stats, backendStats)
+		}
+	}
+	return stats
+}
+
+func (b *Backend) state(inGrace bool) string {
+	b.mutex.Lock()
+	ejected := b.ejected
+	b.mutex.Unlock()
+	switch {
+	case b.draining():
+		return BackendDraining
+	case ejected:
+		return BackendEjected
+	case b.available(inGrace):
+		return BackendUp
+	default:
+		return BackendDown
+	}
+}
+
+func (s *requestStats) summary(now time.Time, window time.Duration) BackendStats {
+	return summarize(now, window, s)
+}
+
+// summarize adds up the traffic of several backends over window.
+func summarize(now time.Time, window time.Duration, all ...*requestStats) BackendStats {
+	minutes := int((window + statsBucketWidth - 1) / statsBucketWidth)
+	if minutes < 1 {
+		minutes = 1
+	}
+	if minutes > statsBuckets {
+		minutes = statsBuckets
+	}
+	oldest := now.Truncate(statsBucketWidth).Add(-statsBucketWidth * time.Duration(minutes-1))
+
+	var stats BackendStats
+	var latencies [latencyBuckets]int
+	for _, s := range all {
+		s.mutex.Lock()
+		for _, bucket := range s.buckets {
+			if bucket.start.Before(oldest) {
+				continue
+			}
+			stats.Requests += bucket.requests
+			stats.Errors += bucket.errors
+			for i, count := range bucket.latencies {
+				latencies[i] += count
+			}
+		}
+		s.mutex.Unlock()
+		stats.RequestsTotal += atomic.LoadInt64(&s.total)
+	}
+
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+		stats.LatencyMs = LatencyPercentiles{
+			P50: percentile(latencies, stats.Requests, 0.50),
+			P95: percentile(latencies, stats.Requests, 0.95),
+			P99: percentile(latencies, stats.Requests, 0.99),
+		}
+	}
+	return stats
+}
+
+func percentile(latencies [latencyBuckets]int, count int, q float64) float64 {
+	rank := int(math.Ceil(q * float64(count)))
+	seen := 0
+	for i, n := range latencies {
+		seen += n
+		if seen >= rank {
+			return float64(latencyBounds[i].Microseconds()) / 1000
+		}
+	}
+	return float64(latencyBounds[latencyBuckets-1].Microseconds()) / 1000
+}
+
+// RequestError is a request that failed with a 5xx, as listed by
+// RecentErrors.
+type RequestError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Backend   string    `json:"backend,omitempty"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error"`
+}
+
+// RecentErrors returns the last failed requests of the listener and its
+// routes, newest first.
+func (lb *LoadBalancer) RecentErrors() []RequestError {
+	lb.errorsMutex.Lock()
+	recent := make([]RequestError, len(lb.recentErrors))
+	for i, requestError := range lb.recentErrors {
+		recent[len(recent)-1-i] = requestError
+	}
+	lb.errorsMutex.Unlock()
+
+	routes := lb.routeSnapshot()
+	if len(routes) == 0 {
+		return recent
+	}
+	lists := [][]RequestError{recent}
+	for _, route := range routes {
+		lists = append(lists, route.lb.RecentErrors())
+	}
+	return mergeErrors(lists...)
+}
+
+func (lb *LoadBalancer) recordError(r *http.Request, backend *Backend, status int, message string) {
+	requestError := RequestError{
+		Time:      time.Now(),
+		RequestID: r.Header.Get(RequestIDHeader),
+		Status:    status,
+		Error:     message,
+	}
+	if backend != nil {
+		requestError.Backend = backend.URL.String()
+	}
+
+	lb.errorsMutex.Lock()
+	defer lb.errorsMutex.Unlock()
+	if len(lb.recentErrors) == recentErrorsKept {
+		lb.recentErrors = append(lb.recentErrors[:0], lb.recentErrors[1:]...)
+	}
+	lb.recentErrors = append(lb.recentErrors, requestError)
+}
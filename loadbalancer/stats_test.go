@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestStatsSummary(t *testing.T) {
+	var stats requestStats
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	stats.record(now.Add(-10*time.Minute), time.Second, true)
+	for i := 0; i < 98; i++ {
+		stats.record(now, 10*time.Millisecond, false)
+	}
+	stats.record(now, 200*time.Millisecond, true)
+	stats.record(now, 900*time.Millisecond, false)
+
+	summary := stats.summary(now, 5*time.Minute)
+	if summary.RequestsTotal != 101 || summary.Requests != 100 || summary.Errors != 1 || summary.ErrorRate != 0.01 {
+		t.Errorf("Expected the 10 minute old request to be outside the window, got %+v", summary)
+	}
+	if summary.LatencyMs.P50 < 10 || summary.LatencyMs.P50 > 12.5 {
+		t.Errorf("Expected p50 close to 10ms, got %v", summary.LatencyMs.P50)
+	}
+	if summary.LatencyMs.P99 < 200 || summary.LatencyMs.P99 > 250 {
+		t.Errorf("Expected p99 close to 200ms, got %v", summary.LatencyMs.P99)
+	}
+
+	if summary := stats.summary(now, MaxStatsWindow); summary.Requests != 101 {
+		t.Errorf("Expected the full window to include every request, got %d", summary.Requests)
+	}
+}
+
+func TestStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL, Weight: 3}}})
+	defer lb.Close()
+	for _, path := range []string{"/", "/", "/", "/fail"} {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	stats := lb.Stats(time.Minute)
+	if len(stats) != 1 {
+		t.Fatalf("Expected one backend, got %d", len(stats))
+	}
+	got := stats[0]
+	if got.URL != backend.URL || got.State != BackendUp || got.Weight != 3 || got.Requests != 4 || got.ErrorRate != 0.25 {
+		t.Errorf("Unexpected stats %+v", got)
+	}
+}
@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyRandom           = "random"
+)
+
+// nextBackend picks a backend from the rotation according to the
+// configured strategy. Weights are honored by every strategy. Callers must
+// hold lb.mutex.
+func (lb *LoadBalancer) nextBackend(backends []*Backend) *Backend {
+	switch lb.strategy {
+	case StrategyLeastConnections:
+		return leastConnections(backends)
+	case StrategyRandom:
+		return weightedRandom(backends)
+	default:
+		return smoothWeightedRoundRobin(backends)
+	}
+}
+
+// smoothWeightedRoundRobin grows every backend's current weight by its
+// weight, picks the largest one and makes it pay back the total. With equal
+// weights this is plain round-robin.
+func smoothWeightedRoundRobin(backends []*Backend) *Backend {
+	var (
+		best  *Backend
+		total int
+	)
+	for _, backend := range backends {
+		backend.currentWeight += backend.weight
+		total += backend.weight
+		if best == nil || backend.currentWeight > best.currentWeight {
+			best = backend
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// leastConnections picks the backend with the fewest in-flight requests
+// relative to its weight, breaking ties in rotation order.
+func leastConnections(backends []*Backend) *Backend {
+	var best *Backend
+	var bestActive int64
+	for _, backend := range backends {
+		active := atomic.LoadInt64(&backend.active)
+		if best == nil || active*int64(best.weight) < bestActive*int64(backend.weight) {
+			best = backend
+			bestActive = active
+		}
+	}
+	return best
+}
+
+func weightedRandom(backends []*Backend) *Backend {
+	total := 0
+	for _, backend := range backends {
+		total += backend.weight
+	}
+	pick := rand.Intn(total)
+	for _, backend := range backends {
+		if pick < backend.weight {
+			return backend
+		}
+		pick -= backend.weight
+	}
+	return backends[len(backends)-1]
+}
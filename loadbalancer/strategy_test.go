@@ -0,0 +1,29 @@
+package loadbalancer
+
+import "testing"
+
+func TestLeastConnectionsPrefersIdleBackend(t *testing.T) {
+	busy := &Backend{weight: 1, active: 3}
+	idle := &Backend{weight: 1, active: 1}
+	heavy := &Backend{weight: 4, active: 2}
+
+	if picked := leastConnections([]*Backend{busy, idle}); picked != idle {
+		t.Error("Expected the backend with fewer in-flight requests")
+	}
+	if picked := leastConnections([]*Backend{busy, idle, heavy}); picked != heavy {
+		t.Error("Expected in-flight requests to be weighed against backend weight")
+	}
+}
+
+func TestWeightedRandomHonorsWeights(t *testing.T) {
+	light := &Backend{weight: 1}
+	heavy := &Backend{weight: 9}
+
+	picks := map[*Backend]int{}
+	for i := 0; i < 1000; i++ {
+		picks[weightedRandom([]*Backend{light, heavy})]++
+	}
+	if picks[heavy] < 800 {
+		t.Errorf("Expected the heavy backend to get about 90%% of picks, got %d of 1000", picks[heavy])
+	}
+}
@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// StreamingConfig is for backends that stream their responses, such as
+// Server-Sent Events and long polling. Each write of the backend is
+// flushed to the client right away, or every FlushInterval, responses are
+// not compressed between the backend and the balancer, and requests are not
+// bound by timeouts.request but by MaxDuration, which is unlimited by
+// default. Responses of type text/event-stream and those without a length
+// are flushed right away even without streaming.
+type StreamingConfig struct {
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+	MaxDuration   Duration `json:"max_duration,omitempty"`
+}
+
+func (c *StreamingConfig) validate() error {
+	if c.FlushInterval < 0 {
+		return errors.New("flush_interval: must not be negative")
+	}
+	if c.MaxDuration < 0 {
+		return errors.New("max_duration: must not be negative")
+	}
+	return nil
+}
+
+// flushInterval returns the proxy's flush interval, negative to flush
+// after every write.
+func (c *StreamingConfig) flushInterval() time.Duration {
+	if c == nil {
+		return 0
+	}
+	if c.FlushInterval == 0 {
+		return -1
+	}
+	return time.Duration(c.FlushInterval)
+}
+
+// withMaxDuration bounds r by MaxDuration, if one is set. The caller calls
+// the returned cancel func once done with r.
+func (c *StreamingConfig) withMaxDuration(r *http.Request) (*http.Request, context.CancelFunc) {
+	if c.MaxDuration <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(c.MaxDuration))
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		// Only the stream is let go.
+		if r.URL.Path != "/events" {
+			<-r.Context().Done()
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("world"))
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Timeouts: &TimeoutsConfig{Request: Duration(50 * time.Millisecond)},
+		Routes: []RouteConfig{{
+			PathPrefix: "/events",
+			Backends:   []BackendConfig{{URL: backend.URL}},
+			Streaming:  &StreamingConfig{},
+		}},
+	})
+	defer lb.Close()
+	frontend := httptest.NewServer(lb)
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "hello" {
+		t.Fatalf("Expected the first write before the backend finished, got %q %v", first, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || string(rest) != "world" {
+		t.Errorf("Expected the stream to outlive timeouts.request, got %q %v", rest, err)
+	}
+
+	// Other requests are cut off by timeouts.request, before or while
+	// their body is sent.
+	if resp, err := http.Get(frontend.URL + "/"); err == nil {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("Expected timeouts.request to cut off other requests, got %q", body)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+const (
+	ModeHTTP = "http"
+	ModeTCP  = "tcp"
+
+	defaultTCPDialTimeout = 30 * time.Second
+	defaultTCPPeekTimeout = 10 * time.Second
+)
+
+// validateTCPURL checks a backend of a tcp listener, tcp://host:port.
+func validateTCPURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "tcp" {
+		return fmt.Errorf("%q must use tcp in tcp mode", rawURL)
+	}
+	if parsed.Hostname() == "" || parsed.Port() == "" {
+		return fmt.Errorf("%q needs a host and a port", rawURL)
+	}
+	return nil
+}
+
+// healthCheckDefaults returns the listener's health check settings, which
+// default to connecting in tcp mode.
+func (c Config) healthCheckDefaults() HealthCheckConfig {
+	health := c.HealthCheck
+	if c.Mode == ModeTCP && health.Type == "" {
+		health.Type = HealthCheckTCP
+	}
+	return health
+}
+
+// ServeTCP proxies the connections accepted by listener to the pool's
+// backends without looking into them, until listener is closed.
+func (lb *LoadBalancer) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go lb.serveConn(conn)
+	}
+}
+
+func (lb *LoadBalancer) serveConn(client net.Conn) {
+	defer client.Close()
+	if !lb.requests.start() {
+		return
+	}
+	defer lb.requests.finish()
+
+	lb.mutex.Lock()
+	accessList, timeouts, routes := lb.accessList, lb.config.Timeouts, lb.routes
+	lb.mutex.Unlock()
+	peer, _ := netip.ParseAddrPort(client.RemoteAddr().String())
+	if !accessList.allows(peer.Addr().Unmap()) {
+		lb.logger.Debugf("Refusing connection from %s", client.RemoteAddr())
+		return
+	}
+
+	if len(routes) > 0 {
+		peekTimeout := defaultTCPPeekTimeout
+		if timeouts != nil && timeouts.TLSHandshake > 0 {
+			peekTimeout = time.Duration(timeouts.TLSHandshake)
+		}
+		var serverName string
+		serverName, client = peekServerName(client, peekTimeout)
+		for _, route := range routes {
+			if matchesHostname(route.config.ServerNames, serverName) {
+				route.lb.proxyConn(client)
+				return
+			}
+		}
+	}
+	lb.proxyConn(client)
+}
+
+// proxyConn splices client to a backend of the pool.
+func (lb *LoadBalancer) proxyConn(client net.Conn) {
+	lb.mutex.Lock()
+	timeouts, proxyProtocol := lb.config.Timeouts, lb.config.ProxyProtocol
+	lb.mutex.Unlock()
+	dialTimeout := defaultTCPDialTimeout
+	if timeouts != nil && timeouts.Dial > 0 {
+		dialTimeout = time.Duration(timeouts.Dial)
+	}
+	backend, upstream := lb.dialBackend(dialTimeout)
+	if upstream == nil {
+		lb.metrics.tcpRefused(lb.listener)
+		return
+	}
+	defer lb.releaseBackend(backend)
+	defer upstream.Close()
+	if proxyProtocol != nil && proxyProtocol.Send != "" {
+		if err := writeProxyHeader(upstream, proxyProtocol.Send, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			lb.logger.Warnf("Error sending the PROXY header to backend %s: %v", backend.URL.Host, err)
+			return
+		}
+	}
+
+	lb.logger.Debugf("Proxying connection from %s to %s", client.RemoteAddr(), backend.URL.Host)
+	lb.metrics.tcpOpened(lb.listener, backend.URL.String())
+	defer lb.metrics.tcpClosed(lb.listener)
+
+	// A draining backend's connections are cut once its drain timeout
+	// passed, like its requests.
+	backend.mutex.Lock()
+	drained := backend.drained
+	backend.mutex.Unlock()
+	stop := context.AfterFunc(drained, func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer stop()
+	splice(client, upstream)
+}
+
+// dialBackend connects to a backend of the pool, trying others when one
+// cannot be reached. It returns nil if none could be.
+func (lb *LoadBalancer) dialBackend(timeout time.Duration) (*Backend, net.Conn) {
+	var tried []*Backend
+	for attempt := 0; attempt <= defaultMaxRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		backend, _ := lb.acquireBackend(ctx, tried...)
+		if backend == nil {
+			cancel()
+			lb.logger.Warnf("No backend available for a connection to port %s", lb.listener)
+			return nil, nil
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", backend.URL.Host)
+		cancel()
+		lb.recordOutcome(backend, err != nil)
+		if err == nil {
+			return backend, conn
+		}
+		lb.logger.Warnf("Error connecting to backend %s: %v", backend.URL.Host, err)
+		lb.releaseBackend(backend)
+		tried = append(tried, backend)
+	}
+	return nil, nil
+}
+
+var errPeeked = errors.New("client hello read")
+
+// peekServerName reads the TLS ClientHello client starts with and returns
+// the server name it asks for, "" if it is not TLS or has none, along with
+// a conn that hands the bytes read to whoever reads it next.
+func peekServerName(client net.Conn, timeout time.Duration) (string, net.Conn) {
+	var peeked bytes.Buffer
+	var serverName string
+	client.SetReadDeadline(time.Now().Add(timeout))
+	tls.Server(readOnlyConn{Conn: client, reader: io.TeeReader(client, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+	client.SetReadDeadline(time.Time{})
+	return serverName, &replayConn{Conn: client, reader: io.MultiReader(&peeked, client)}
+}
+
+// readOnlyConn lets the TLS handshake read from reader but keeps it from
+// answering the client.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// replayConn reads what was peeked from a conn before the rest of it.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+func (c *replayConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// splice copies between a and b both ways until both sides are done,
+// passing on when one side stops sending.
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyConn := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+			conn.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyConn(a, b)
+	go copyConn(b, a)
+	<-done
+	<-done
+}
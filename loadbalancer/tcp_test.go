@@ -0,0 +1,178 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"loadbalancer/metrics"
+)
+
+func newEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTCPMode(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+
+	registry := metrics.NewRegistry()
+	config := Config{
+		Port:     "5432",
+		Mode:     ModeTCP,
+		Backends: []BackendConfig{{URL: "tcp://" + backend.Addr().String()}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid tcp listener, got %v", err)
+	}
+	lb := NewLoadBalancer(config, WithMetrics(NewMetrics(registry)))
+	defer lb.Close()
+	if lb.AvailableBackends() != 1 {
+		t.Fatalf("Expected the backend to pass a TCP health check, got %d available", lb.AvailableBackends())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.ServeTCP(listener)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "SELECT 1;")
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(reply) != "SELECT 1;" {
+		t.Errorf("Expected the bytes to be echoed until the backend closed, got %q %v", reply, err)
+	}
+
+	var exposition strings.Builder
+	registry.WriteTo(&exposition)
+	expected := `httpbalance_tcp_connections_total{listener="5432",backend="tcp://` + backend.Addr().String() + `"} 1`
+	if !strings.Contains(exposition.String(), expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, exposition.String())
+	}
+
+	config.AccessControl = &AccessControlConfig{Deny: []string{"127.0.0.1"}}
+	lb.Reload(config)
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello")
+	if reply, _ := io.ReadAll(conn); len(reply) != 0 {
+		t.Errorf("Expected denied clients to be disconnected, got %q", reply)
+	}
+}
+
+func TestValidateTCPMode(t *testing.T) {
+	config := Config{
+		Port:     "5432",
+		Mode:     ModeTCP,
+		TLS:      &ServerTLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"},
+		Backends: []BackendConfig{{URL: "http://10.0.0.1:5432"}, {URL: "tcp://10.0.0.2"}},
+		Routes: []RouteConfig{
+			{ServerNames: []string{"db.example.com"}, PathPrefix: "/", Backends: []BackendConfig{{URL: "http://10.0.0.3:5432"}}},
+		},
+	}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid tcp listener")
+	}
+	for _, expected := range []string{"tls: not available in tcp mode", "backends[0]:", "backends[1]:",
+		"routes[0]: only server_names", "routes[0].backends[0]:"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in %v", expected, err)
+		}
+	}
+}
+
+func TestTCPModeRoutesByServerName(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.TLS.ServerName)
+		}))
+	}
+	api, web := newBackend("api"), newBackend("web")
+	defer api.Close()
+	defer web.Close()
+	plain := newEchoServer(t)
+	defer plain.Close()
+
+	config := Config{
+		Port:     "443",
+		Mode:     ModeTCP,
+		Backends: []BackendConfig{{URL: "tcp://" + plain.Addr().String()}},
+		Routes: []RouteConfig{
+			{ServerNames: []string{"api.example.com"}, Backends: []BackendConfig{{URL: "tcp://" + api.Listener.Addr().String()}}},
+			{ServerNames: []string{"*.example.com"}, Backends: []BackendConfig{{URL: "tcp://" + web.Listener.Addr().String()}}},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid tcp listener with routes, got %v", err)
+	}
+	lb := NewLoadBalancer(config)
+	defer lb.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.ServeTCP(listener)
+	defer listener.Close()
+
+	for serverName, expected := range map[string]string{
+		"api.example.com": "api api.example.com",
+		"www.example.com": "web www.example.com",
+	} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Expected the TLS handshake with the backend for %s to pass through, got %v", serverName, err)
+		}
+		io.WriteString(conn, "GET / HTTP/1.0\r\nHost: "+serverName+"\r\n\r\n")
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		if !strings.HasSuffix(string(reply), expected) {
+			t.Errorf("Expected %q for %s, got %q", expected, serverName, reply)
+		}
+	}
+
+	// Clients without a matching server name, TLS or not, go to the
+	// listener's backends with what they sent intact.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "PING")
+	conn.(*net.TCPConn).CloseWrite()
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(reply) != "PING" {
+		t.Errorf("Expected plain connections to reach the listener's backends, got %q", reply)
+	}
+}
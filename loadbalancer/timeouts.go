@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TimeoutsConfig bounds how long proxying to a backend may take: Dial for
+// connecting, TLSHandshake for the handshake with an https:// backend,
+// ResponseHeader for the backend to start answering once the request was
+// sent, and Request for the whole request, including waiting for a backend
+// and retries. Unset ones keep Go's defaults, 30s to dial, 10s for the
+// handshake and no limit on the others.
+type TimeoutsConfig struct {
+	Dial           Duration `json:"dial,omitempty"`
+	TLSHandshake   Duration `json:"tls_handshake,omitempty"`
+	ResponseHeader Duration `json:"response_header,omitempty"`
+	Request        Duration `json:"request,omitempty"`
+}
+
+func (c *TimeoutsConfig) validate() error {
+	if c.Dial < 0 {
+		return errors.New("dial: must not be negative")
+	}
+	if c.TLSHandshake < 0 {
+		return errors.New("tls_handshake: must not be negative")
+	}
+	if c.ResponseHeader < 0 {
+		return errors.New("response_header: must not be negative")
+	}
+	if c.Request < 0 {
+		return errors.New("request: must not be negative")
+	}
+	return nil
+}
+
+// apply sets the connection timeouts on a backend's transport.
+func (c *TimeoutsConfig) apply(transport *http.Transport) {
+	if c.Dial > 0 {
+		dialer := &net.Dialer{Timeout: time.Duration(c.Dial), KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if c.TLSHandshake > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(c.TLSHandshake)
+	}
+	if c.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(c.ResponseHeader)
+	}
+}
+
+// withRequestTimeout bounds r by the request timeout, if one is set. The
+// caller calls the returned cancel func once done with r.
+func withRequestTimeout(r *http.Request, timeouts *TimeoutsConfig) (*http.Request, context.CancelFunc) {
+	if timeouts == nil || timeouts.Request <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeouts.Request))
+	return r.WithContext(ctx), cancel
+}
+
+// isTimeout reports whether err is a timeout proxying to a backend. Dial,
+// handshake and response header timeouts are net.Errors, as is an expired
+// request context.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,71 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Timeouts: &TimeoutsConfig{ResponseHeader: Duration(20 * time.Millisecond)},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 when the backend is slow to answer, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 from a backend answering in time, got %d", w.Code)
+	}
+}
+
+func TestRequestTimeoutPerRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Timeouts: &TimeoutsConfig{Request: Duration(10 * time.Millisecond)},
+		Routes: []RouteConfig{{
+			ServerNames: []string{"slow.example.com"},
+			Backends:    []BackendConfig{{URL: backend.URL}},
+			Timeouts:    &TimeoutsConfig{Request: Duration(time.Second)},
+		}},
+	})
+	defer lb.Close()
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 once the request timeout passed, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "slow.example.com"}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the route's own request timeout to apply, got %d", w.Code)
+	}
+}
@@ -0,0 +1,277 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// ClientTLSConfig configures the TLS client side of connections the balancer
+// opens: an optional client certificate for mTLS and the CA bundle used to
+// verify the server.
+type ClientTLSConfig struct {
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	CAFile             string `json:"ca_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+func (c *ClientTLSConfig) load() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig makes a listener serve HTTPS with the certificate in
+// CertFile and KeyFile, the Certificates chosen by the server name (SNI)
+// clients ask for, or certificates for ACMEHosts obtained from the CA in the
+// top-level acme settings. CertFile is also used for names no certificate
+// covers. MinVersion is "1.0" to "1.3" (default "1.2") and
+// CipherSuites lists the suites allowed up to TLS 1.2 by their standard
+// names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"; TLS 1.3 suites are
+// not configurable. ClientAuth asks clients for certificates, which the
+// verifying modes check against the CAs in ClientCAFile.
+type ServerTLSConfig struct {
+	CertFile     string              `json:"cert_file,omitempty"`
+	KeyFile      string              `json:"key_file,omitempty"`
+	Certificates []CertificateConfig `json:"certificates,omitempty"`
+	ACMEHosts    []string            `json:"acme_hosts,omitempty"`
+	MinVersion   string              `json:"min_version,omitempty"`
+	CipherSuites []string            `json:"cipher_suites,omitempty"`
+	ClientAuth   string              `json:"client_auth,omitempty"`
+	ClientCAFile string              `json:"client_ca_file,omitempty"`
+
+	// RedirectHTTPPort, when set, is a plain HTTP port redirecting every
+	// request to this listener.
+	RedirectHTTPPort string `json:"redirect_http_port,omitempty"`
+}
+
+const (
+	ClientAuthNone             = "none"
+	ClientAuthRequest          = "request"
+	ClientAuthRequire          = "require"
+	ClientAuthVerifyIfGiven    = "verify_if_given"
+	ClientAuthRequireAndVerify = "require_and_verify"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                         tls.NoClientCert,
+	ClientAuthNone:             tls.NoClientCert,
+	ClientAuthRequest:          tls.RequestClientCert,
+	ClientAuthRequire:          tls.RequireAnyClientCert,
+	ClientAuthVerifyIfGiven:    tls.VerifyClientCertIfGiven,
+	ClientAuthRequireAndVerify: tls.RequireAndVerifyClientCert,
+}
+
+func parseClientAuth(name string) (tls.ClientAuthType, error) {
+	clientAuth, ok := clientAuthTypes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown mode %q, expected %s, %s, %s, %s or %s", name,
+			ClientAuthNone, ClientAuthRequest, ClientAuthRequire, ClientAuthVerifyIfGiven, ClientAuthRequireAndVerify)
+	}
+	return clientAuth, nil
+}
+
+// verifiesClients reports whether client certificates are checked against
+// the client CAs.
+func (c *ServerTLSConfig) verifiesClients() bool {
+	return c != nil && (c.ClientAuth == ClientAuthVerifyIfGiven || c.ClientAuth == ClientAuthRequireAndVerify)
+}
+
+// CertificateConfig is a certificate chain and its key.
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// CertificateStore holds the certificates of a listener and swaps them for
+// new ones from disk on Reload, without dropping connections.
+type CertificateStore struct {
+	config       ServerTLSConfig
+	version      uint16
+	suites       []uint16
+	clientAuth   tls.ClientAuthType
+	certificates atomic.Pointer[[]tls.Certificate]
+	clientCAs    atomic.Pointer[x509.CertPool]
+}
+
+// NewCertificateStore reads the certificates of config. ACME certificates
+// are left to the caller.
+func NewCertificateStore(config ServerTLSConfig) (*CertificateStore, error) {
+	version, err := parseTLSVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(config.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := parseClientAuth(config.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	s := &CertificateStore{config: config, version: version, suites: suites, clientAuth: clientAuth}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the certificates and client CAs again. On error the current
+// ones are kept.
+func (s *CertificateStore) Reload() error {
+	var clientCAs *x509.CertPool
+	if s.config.ClientCAFile != "" {
+		var err error
+		if clientCAs, err = loadCertPool(s.config.ClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	var certificates []tls.Certificate
+	for _, pair := range s.pairs() {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate %s: %w", pair.CertFile, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parsing certificate %s: %w", pair.CertFile, err)
+		}
+		certificates = append(certificates, cert)
+	}
+	s.certificates.Store(&certificates)
+	s.clientCAs.Store(clientCAs)
+	return nil
+}
+
+// Files returns the certificate and key files the store reads.
+func (s *CertificateStore) Files() []string {
+	var files []string
+	for _, pair := range s.pairs() {
+		files = append(files, pair.CertFile, pair.KeyFile)
+	}
+	if s.config.ClientCAFile != "" {
+		files = append(files, s.config.ClientCAFile)
+	}
+	return files
+}
+
+func (s *CertificateStore) pairs() []CertificateConfig {
+	var pairs []CertificateConfig
+	if s.config.CertFile != "" {
+		pairs = append(pairs, CertificateConfig{CertFile: s.config.CertFile, KeyFile: s.config.KeyFile})
+	}
+	return append(pairs, s.config.Certificates...)
+}
+
+// GetCertificate returns the first certificate valid for the server name
+// the client asked for, or the first one, which is CertFile, when none is.
+// Without certificates it returns nil.
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := *s.certificates.Load()
+	if len(certificates) == 0 {
+		return nil, nil
+	}
+	for i := range certificates {
+		if hello.SupportsCertificate(&certificates[i]) == nil {
+			return &certificates[i], nil
+		}
+	}
+	return &certificates[0], nil
+}
+
+// TLSConfig returns the server side TLS config serving the store's
+// certificates and verifying clients against its current client CAs.
+func (s *CertificateStore) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     s.version,
+		CipherSuites:   s.suites,
+		GetCertificate: s.GetCertificate,
+		ClientAuth:     s.clientAuth,
+		// Set here rather than left to http.Server, which only adds them
+		// to its own copy and not to the per-handshake configs below.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if s.config.ClientCAFile != "" {
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			handshake := config.Clone()
+			handshake.GetConfigForClient = nil
+			handshake.ClientCAs = s.clientCAs.Load()
+			return handshake, nil
+		}
+	}
+	return config
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// parseCipherSuites looks up suites by name. Only the suites Go considers
+// secure are accepted; nil leaves the choice to Go.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
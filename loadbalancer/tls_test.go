@@ -0,0 +1,321 @@
+package loadbalancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate creates a self-signed certificate valid for
+// 127.0.0.1 and writes it and its key as PEM files into dir.
+func writeTestCertificate(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{name},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestHealthCheckWithClientCertificateAndHeaders(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey, _ := writeTestCertificate(t, dir, "server")
+	clientCert, clientKey, clientX509 := writeTestCertificate(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	keyPair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer probe-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	probeTLS := &ClientTLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: serverCert}
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, HealthCheck: &HealthCheckConfig{TLS: probeTLS}},
+		},
+		HealthCheck: HealthCheckConfig{Headers: map[string]string{"Authorization": "Bearer probe-token"}},
+	})
+	defer lb.Close()
+
+	if lb.AvailableBackends() != 1 {
+		t.Errorf("Expected only the backend probed with a client certificate to pass, got %d", lb.AvailableBackends())
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t, t.TempDir(), "server")
+
+	config := ServerTLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}
+	store, err := NewCertificateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = store.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	// httptest adds a certificate of its own, which Go prefers to
+	// GetCertificate for clients that send no server name.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "server", MaxVersion: tls.VersionTLS12}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.TLS.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Expected the configured cipher suite, got %s", tls.CipherSuiteName(resp.TLS.CipherSuite))
+	}
+
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "server", MaxVersion: tls.VersionTLS11}}}
+	if _, err := old.Get(server.URL); err == nil {
+		t.Error("Expected a TLS 1.1 client to be refused")
+	}
+}
+
+func TestServerTLSCertificatesBySNI(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert, defaultKey, _ := writeTestCertificate(t, dir, "www.example.com")
+	apiCert, apiKey, _ := writeTestCertificate(t, dir, "api.example.com")
+
+	config := ServerTLSConfig{
+		CertFile:     defaultCert,
+		KeyFile:      defaultKey,
+		Certificates: []CertificateConfig{{CertFile: apiCert, KeyFile: apiKey}},
+	}
+	store, err := NewCertificateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = store.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	for serverName, expected := range map[string]string{"api.example.com": "api.example.com", "other.example.com": "www.example.com"} {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		presented := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if presented != expected {
+			t.Errorf("Expected %s to get the certificate of %s, got %s", serverName, expected, presented)
+		}
+	}
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first := writeTestCertificate(t, dir, "server")
+	store, err := NewCertificateStore(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, second := writeTestCertificate(t, dir, "server")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "server"})
+	if cert.Leaf.SerialNumber.Cmp(second.SerialNumber) != 0 || cert.Leaf.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("Expected the rewritten certificate after a reload, got serial %v", cert.Leaf.SerialNumber)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Error("Expected reloading a broken key to fail")
+	}
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{}); cert == nil || cert.Leaf.SerialNumber.Cmp(second.SerialNumber) != 0 {
+		t.Error("Expected the current certificate to be kept when a reload fails")
+	}
+}
+
+func TestClientCertificateHeaders(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey, serverX509 := writeTestCertificate(t, dir, "server")
+	clientCert, clientKey, _ := writeTestCertificate(t, dir, "client")
+
+	var subject, sans string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = r.Header.Get(ClientCertSubjectHeader)
+		sans = r.Header.Get(ClientCertSANHeader)
+	}))
+	defer backend.Close()
+
+	tlsConfig := &ServerTLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientAuth: ClientAuthVerifyIfGiven, ClientCAFile: clientCert}
+	lb := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: backend.URL}}, TLS: tlsConfig})
+	defer lb.Close()
+	store, err := NewCertificateStore(*tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(lb)
+	server.TLS = store.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverX509)
+	keyPair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(certificates []tls.Certificate) {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "server", Certificates: certificates}}}
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set(ClientCertSubjectHeader, "CN=admin")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get([]tls.Certificate{keyPair})
+	if subject != "CN=client" || sans != "DNS:client, IP:127.0.0.1" {
+		t.Errorf("Expected the verified certificate's details, got subject %q and SANs %q", subject, sans)
+	}
+	get(nil)
+	if subject != "" || sans != "" {
+		t.Errorf("Expected headers sent by the client to be dropped, got subject %q and SANs %q", subject, sans)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey, _ := writeTestCertificate(t, dir, "server")
+	clientCert, clientKey, clientX509 := writeTestCertificate(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	keyPair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	for _, test := range []struct {
+		name       string
+		backendTLS *ClientTLSConfig
+		expected   int
+	}{
+		{"verified", &ClientTLSConfig{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey}, http.StatusOK},
+		{"unknown CA", &ClientTLSConfig{CertFile: clientCert, KeyFile: clientKey}, http.StatusBadGateway},
+		{"no client certificate", &ClientTLSConfig{InsecureSkipVerify: true}, http.StatusBadGateway},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// A TCP health check keeps the backend in rotation, so that the
+			// proxied request is what fails.
+			lb := NewLoadBalancer(Config{
+				Backends:    []BackendConfig{{URL: backend.URL}},
+				BackendTLS:  test.backendTLS,
+				HealthCheck: HealthCheckConfig{Type: HealthCheckTCP},
+			})
+			defer lb.Close()
+			recorder := httptest.NewRecorder()
+			lb.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+			if recorder.Code != test.expected {
+				t.Errorf("Expected status %d, got %d", test.expected, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, test := range []struct {
+		port, target, expected string
+	}{
+		{"443", "http://example.com/path?q=1", "https://example.com/path?q=1"},
+		{"443", "http://example.com:80/", "https://example.com/"},
+		{"8443", "http://example.com/a", "https://example.com:8443/a"},
+		{"443", "http://[::1]:80/", "https://[::1]/"},
+	} {
+		recorder := httptest.NewRecorder()
+		HTTPSRedirect(test.port).ServeHTTP(recorder, httptest.NewRequest("POST", test.target, nil))
+		if recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != test.expected {
+			t.Errorf("Expected %s to be redirected to %s, got %d %s", test.target, test.expected, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,829 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"loadbalancer/acme"
+	"loadbalancer/discovery"
+	"loadbalancer/logging"
+	"loadbalancer/statsd"
+)
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+// Validate checks the configuration for mistakes that would otherwise only
+// show up at runtime and returns all of them joined into one error.
+func (c Config) Validate() error {
+	v := &validator{}
+
+	if c.Port != "" || len(c.Backends) > 0 || len(c.Listeners) == 0 {
+		v.validateListener("", c.resolve())
+	}
+
+	ports := map[string]string{}
+	claim := func(name, port string) {
+		if port == "" {
+			return
+		}
+		if other, ok := ports[port]; ok {
+			v.add("%s: port %s is already used by %s", name, port, other)
+			return
+		}
+		ports[port] = name
+	}
+	claim("port", c.Port)
+	for i, listener := range c.Listeners {
+		claim(fmt.Sprintf("listeners[%d].port", i), listener.Port)
+	}
+	if c.TLS != nil {
+		claim("tls.redirect_http_port", c.TLS.RedirectHTTPPort)
+	}
+	for i, listener := range c.Listeners {
+		if listener.TLS != nil {
+			claim(fmt.Sprintf("listeners[%d].tls.redirect_http_port", i), listener.TLS.RedirectHTTPPort)
+		}
+	}
+
+	if c.AdminPort != "" {
+		if err := validatePort(c.AdminPort); err != nil {
+			v.add("admin_port: %v", err)
+		} else if other, ok := ports[c.AdminPort]; ok {
+			v.add("admin_port: port %s is already used by %s", c.AdminPort, other)
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		v.add("log_level: %v", err)
+	}
+	if accessLog := c.AccessLog; accessLog != nil {
+		if accessLog.Sample < 0 {
+			v.add("access_log.sample: must not be negative")
+		}
+		if accessLog.SlowRequestThreshold < 0 {
+			v.add("access_log.slow_request_threshold: must not be negative")
+		}
+	}
+	if c.AuditLog != nil && c.AuditLog.Path == "" {
+		v.add("audit_log.path: is required")
+	}
+	if c.AccessLog != nil {
+		v.validateRotation("access_log.rotate", c.AccessLog.Rotate)
+	}
+	if c.AuditLog != nil {
+		v.validateRotation("audit_log.rotate", c.AuditLog.Rotate)
+	}
+	if output := c.LogOutput; output != nil {
+		if (output.File == "") == (output.Syslog == nil) {
+			v.add("log_output: exactly one of file and syslog must be set")
+		}
+		if output.Rotate != nil && output.File == "" {
+			v.add("log_output.rotate: only applies to file")
+		}
+		v.validateRotation("log_output.rotate", output.Rotate)
+		if syslog := output.Syslog; syslog != nil {
+			if (syslog.Network == "") != (syslog.Address == "") {
+				v.add("log_output.syslog: network and address must be set together")
+			}
+			if _, err := logging.ParseFacility(syslog.Facility); err != nil {
+				v.add("log_output.syslog.facility: %v", err)
+			}
+		}
+	}
+	if tracing := c.Tracing; tracing != nil {
+		if tracing.OTLPEndpoint != "" {
+			if err := validateURL(tracing.OTLPEndpoint); err != nil {
+				v.add("tracing.otlp_endpoint: %v", err)
+			}
+		}
+		if ratio := tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+			v.add("tracing.sample_ratio: must be between 0 and 1")
+		}
+	}
+	if page := c.StatusPage; page != nil {
+		if page.Username == "" || page.Password == "" {
+			v.add("status_page: username and password are required")
+		}
+		if c.AdminPort == "" {
+			v.add("status_page: requires admin_port")
+		}
+	}
+	if sink := c.StatsD; sink != nil {
+		if _, _, err := net.SplitHostPort(sink.Address); err != nil {
+			v.add("statsd.address: %v", err)
+		}
+		switch sink.Flavor {
+		case "", statsd.FlavorDogStatsD, statsd.FlavorStatsD:
+		default:
+			v.add("statsd.flavor: unknown flavor %q", sink.Flavor)
+		}
+	}
+	if c.DebugEndpoints && c.AdminPort == "" {
+		v.add("debug_endpoints: requires admin_port")
+	}
+	if c.AdminOIDC != nil {
+		if err := c.AdminOIDC.validate(); err != nil {
+			v.add("admin_oidc.%v", err)
+		}
+		if c.AdminPort == "" {
+			v.add("admin_oidc: requires admin_port")
+		}
+	}
+	if c.Shutdown != nil {
+		if err := c.Shutdown.validate(); err != nil {
+			v.add("shutdown.%v", err)
+		}
+	}
+	v.validateACME(c)
+
+	for i, listener := range c.Listeners {
+		prefix := fmt.Sprintf("listeners[%d].", i)
+		if listener.Defaults == nil {
+			listener.Defaults = c.Defaults
+		}
+		v.validateListener(prefix, listener.resolve())
+		if listener.AdminPort != "" {
+			v.add("%sadmin_port: only allowed at the top level", prefix)
+		}
+		if listener.AuditLog != nil {
+			v.add("%saudit_log: only allowed at the top level", prefix)
+		}
+		if listener.LogOutput != nil {
+			v.add("%slog_output: only allowed at the top level", prefix)
+		}
+		if listener.LogLevel != "" {
+			v.add("%slog_level: only allowed at the top level", prefix)
+		}
+		if listener.Tracing != nil {
+			v.add("%stracing: only allowed at the top level", prefix)
+		}
+		if listener.StatusPage != nil {
+			v.add("%sstatus_page: only allowed at the top level", prefix)
+		}
+		if listener.DebugEndpoints {
+			v.add("%sdebug_endpoints: only allowed at the top level", prefix)
+		}
+		if listener.StatsD != nil {
+			v.add("%sstatsd: only allowed at the top level", prefix)
+		}
+		if listener.ACME != nil {
+			v.add("%sacme: only allowed at the top level", prefix)
+		}
+		if listener.AdminOIDC != nil {
+			v.add("%sadmin_oidc: only allowed at the top level", prefix)
+		}
+		if listener.Shutdown != nil {
+			v.add("%sshutdown: only allowed at the top level", prefix)
+		}
+		if len(listener.Listeners) > 0 {
+			v.add("%slisteners: listeners cannot be nested", prefix)
+		}
+	}
+
+	return errors.Join(v.errs...)
+}
+
+func (v *validator) validateACME(c Config) {
+	hosts := c.ACMEHosts()
+	config := c.ACME
+	if config == nil {
+		if len(hosts) > 0 {
+			v.add("tls.acme_hosts: requires the top-level acme settings")
+		}
+		return
+	}
+
+	if config.CacheDir == "" {
+		v.add("acme.cache_dir: is required")
+	}
+	if !config.AcceptTOS {
+		v.add("acme.accept_tos: must be true to agree to the CA's terms of service")
+	}
+	if config.DirectoryURL != "" {
+		if err := validateURL(config.DirectoryURL); err != nil {
+			v.add("acme.directory_url: %v", err)
+		}
+	}
+	switch config.Challenge {
+	case "", acme.ChallengeTLSALPN01:
+	case acme.ChallengeHTTP01:
+		plainPort80 := false
+		for _, listener := range c.ListenerConfigs() {
+			if listener.Port == "80" && listener.TLS == nil {
+				plainPort80 = true
+			}
+			if listener.TLS != nil && listener.TLS.RedirectHTTPPort == "80" {
+				plainPort80 = true
+			}
+		}
+		if !plainPort80 {
+			v.add("acme.challenge: http-01 needs a plain HTTP listener on port 80 or a tls.redirect_http_port of 80")
+		}
+	default:
+		v.add("acme.challenge: unknown challenge %q", config.Challenge)
+	}
+	if len(hosts) == 0 {
+		v.add("acme: no listener sets tls.acme_hosts")
+	}
+}
+
+func (v *validator) validateRotation(name string, rotate *RotationConfig) {
+	if rotate == nil {
+		return
+	}
+	if rotate.MaxSizeMB < 0 || rotate.Every < 0 || rotate.MaxBackups < 0 {
+		v.add("%s: values must not be negative", name)
+	}
+}
+
+func (v *validator) validateListener(prefix string, c Config) {
+	if err := validatePort(c.Port); err != nil {
+		v.add("%sport: %v", prefix, err)
+	}
+	switch c.Mode {
+	case "", ModeHTTP:
+	case ModeTCP:
+		// Without HTTP there is nothing to terminate TLS for, and routes
+		// can only go by the server name in the ClientHello.
+		if c.TLS != nil {
+			v.add("%stls: not available in tcp mode", prefix)
+		}
+		for i, route := range c.Routes {
+			if len(route.ServerNames) == 0 || len(route.Hosts) > 0 || route.PathPrefix != "" || route.PathRegex != "" ||
+				len(route.Methods) > 0 || len(route.Headers) > 0 || len(route.Query) > 0 {
+				v.add("%sroutes[%d]: only server_names can be matched in tcp mode", prefix, i)
+			}
+			if route.Redirect != nil || route.Static != nil || route.Split != nil || route.Fallback != nil {
+				v.add("%sroutes[%d]: redirect, static, split and fallback are not available in tcp mode", prefix, i)
+			}
+		}
+	default:
+		v.add("%smode: must be http or tcp", prefix)
+	}
+	if c.ProxyProtocol != nil {
+		if err := c.ProxyProtocol.validate(); err != nil {
+			v.add("%sproxy_protocol.%v", prefix, err)
+		} else if c.ProxyProtocol.Send != "" && c.Mode != ModeTCP {
+			// Connections to HTTP backends are shared by many clients.
+			v.add("%sproxy_protocol.send: only available in tcp mode", prefix)
+		}
+	}
+	if c.HTTP3 != nil {
+		if err := c.HTTP3.validate(); err != nil {
+			v.add("%shttp3.%v", prefix, err)
+		} else if c.TLS == nil {
+			// QUIC always runs over TLS.
+			v.add("%shttp3: needs tls on the listener", prefix)
+		}
+	}
+	if tls := c.TLS; tls != nil {
+		if (tls.CertFile == "") != (tls.KeyFile == "") {
+			v.add("%stls: cert_file and key_file must be set together", prefix)
+		}
+		if tls.CertFile == "" && len(tls.Certificates) == 0 && len(tls.ACMEHosts) == 0 {
+			v.add("%stls: one of cert_file, certificates and acme_hosts must be set", prefix)
+		}
+		for i, pair := range tls.Certificates {
+			if pair.CertFile == "" || pair.KeyFile == "" {
+				v.add("%stls.certificates[%d]: cert_file and key_file are required", prefix, i)
+			}
+		}
+		if _, err := parseTLSVersion(tls.MinVersion); err != nil {
+			v.add("%stls.min_version: %v", prefix, err)
+		}
+		if _, err := parseCipherSuites(tls.CipherSuites); err != nil {
+			v.add("%stls.cipher_suites: %v", prefix, err)
+		}
+		if _, err := parseClientAuth(tls.ClientAuth); err != nil {
+			v.add("%stls.client_auth: %v", prefix, err)
+		}
+		if tls.verifiesClients() && tls.ClientCAFile == "" {
+			v.add("%stls.client_ca_file: is required to verify client certificates", prefix)
+		}
+		if tls.RedirectHTTPPort != "" {
+			if err := validatePort(tls.RedirectHTTPPort); err != nil {
+				v.add("%stls.redirect_http_port: %v", prefix, err)
+			}
+		}
+	}
+
+	// A listener with routes only needs backends of its own for the
+	// requests no route matches, and one that redirects, serves files or
+	// splits them none at all.
+	v.validatePool(prefix, c, len(c.Routes) == 0 && c.Redirect == nil && c.Static == nil && c.Split == nil && c.Fallback == nil)
+	if err := c.HealthCheck.validate(); err != nil {
+		v.add("%shealth_check: %v", prefix, err)
+	}
+	if c.HealthCheck.Concurrency < 0 {
+		v.add("%shealth_check.concurrency: must not be negative", prefix)
+	}
+
+	if c.SecurityHeaders != nil {
+		if err := c.SecurityHeaders.validate(); err != nil {
+			v.add("%ssecurity_headers: %v", prefix, err)
+		}
+	}
+	if _, err := c.AccessControl.compile(); err != nil {
+		v.add("%saccess_control.%v", prefix, err)
+	}
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		v.add("%strusted_proxies: %v", prefix, err)
+	}
+	if c.RequestLimits != nil {
+		if err := c.RequestLimits.validate(); err != nil {
+			v.add("%srequest_limits.%v", prefix, err)
+		}
+	}
+	if c.Decompression != nil {
+		if err := c.Decompression.validate(); err != nil {
+			v.add("%sdecompression.%v", prefix, err)
+		}
+	}
+	if c.Retry != nil {
+		if err := c.Retry.validate(); err != nil {
+			v.add("%sretry.%v", prefix, err)
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.validate(); err != nil {
+			v.add("%scircuit_breaker.%v", prefix, err)
+		}
+	}
+	if c.Timeouts != nil {
+		if err := c.Timeouts.validate(); err != nil {
+			v.add("%stimeouts.%v", prefix, err)
+		}
+	}
+	if c.Hedge != nil {
+		if err := c.Hedge.validate(); err != nil {
+			v.add("%shedge.%v", prefix, err)
+		}
+	}
+	if c.GRPC != nil {
+		if err := c.GRPC.validate(); err != nil {
+			v.add("%sgrpc.%v", prefix, err)
+		}
+	}
+	if c.BackendHTTP2 != nil {
+		if err := c.BackendHTTP2.validate(); err != nil {
+			v.add("%sbackend_http2.%v", prefix, err)
+		}
+	}
+	if c.WebSocket != nil {
+		if err := c.WebSocket.validate(); err != nil {
+			v.add("%swebsocket.%v", prefix, err)
+		}
+	}
+	if c.Streaming != nil {
+		if err := c.Streaming.validate(); err != nil {
+			v.add("%sstreaming.%v", prefix, err)
+		}
+	}
+	if c.Compression != nil {
+		if err := c.Compression.validate(); err != nil {
+			v.add("%scompression.%v", prefix, err)
+		}
+	}
+	if c.Fault != nil {
+		if err := c.Fault.validate(); err != nil {
+			v.add("%sfault.%v", prefix, err)
+		}
+	}
+	if c.Mirror != nil {
+		if err := c.Mirror.validate(); err != nil {
+			v.add("%smirror.%v", prefix, err)
+		}
+		v.validatePool(prefix+"mirror.", Config{Backends: c.Mirror.Backends, HealthCheck: c.HealthCheck}, true)
+	}
+	if c.Maintenance != nil {
+		if err := c.Maintenance.validate(); err != nil {
+			v.add("%smaintenance.%v", prefix, err)
+		}
+	}
+	if c.Fallback != nil {
+		if err := c.Fallback.validate(); err != nil {
+			v.add("%sfallback.%v", prefix, err)
+		}
+		v.validatePool(prefix+"fallback.", Config{Backends: c.Fallback.Backends}, false)
+	}
+	if c.Redirect != nil {
+		if err := c.Redirect.validate(); err != nil {
+			v.add("%sredirect.%v", prefix, err)
+		}
+	}
+	if c.Static != nil {
+		if err := c.Static.validate(); err != nil {
+			v.add("%sstatic.%v", prefix, err)
+		}
+	}
+	if c.Split != nil {
+		if err := c.Split.validate(); err != nil {
+			v.add("%ssplit.%v", prefix, err)
+		}
+		for i, pool := range c.Split.Pools {
+			v.validatePool(fmt.Sprintf("%ssplit.pools[%d].", prefix, i), Config{Backends: pool.Backends}, true)
+		}
+	}
+	if c.ErrorPages != nil {
+		if err := c.ErrorPages.validate(); err != nil {
+			v.add("%serror_pages.%v", prefix, err)
+		}
+	}
+	if c.Rewrite != nil {
+		if err := c.Rewrite.validate(); err != nil {
+			v.add("%srewrite.%v", prefix, err)
+		}
+	}
+	if c.Experiment != nil {
+		if err := c.Experiment.validate(); err != nil {
+			v.add("%sexperiment.%v", prefix, err)
+		}
+	}
+	if c.RequestHeaders != nil {
+		if err := c.RequestHeaders.validate(); err != nil {
+			v.add("%srequest_headers.%v", prefix, err)
+		}
+	}
+	if c.ResponseHeaders != nil {
+		if err := c.ResponseHeaders.validate(); err != nil {
+			v.add("%sresponse_headers.%v", prefix, err)
+		}
+	}
+	if c.ConcurrencyLimit != nil {
+		if err := c.ConcurrencyLimit.validate(); err != nil {
+			v.add("%sconcurrency_limit.%v", prefix, err)
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.validate(); err != nil {
+			v.add("%srate_limit.%v", prefix, err)
+		}
+	}
+	if c.CORS != nil {
+		if err := c.CORS.validate(); err != nil {
+			v.add("%scors.%v", prefix, err)
+		}
+	}
+	if c.WAF != nil {
+		if err := c.WAF.validate(); err != nil {
+			v.add("%swaf.%v", prefix, err)
+		}
+	}
+	if c.JWT != nil {
+		if err := c.JWT.validate(); err != nil {
+			v.add("%sjwt: %v", prefix, err)
+		}
+	}
+	if c.Auth != nil {
+		if err := c.Auth.validate(); err != nil {
+			v.add("%sauth: %v", prefix, err)
+		}
+	}
+	if c.OIDC != nil {
+		if err := c.OIDC.validate(); err != nil {
+			v.add("%soidc.%v", prefix, err)
+		}
+	}
+
+	for i, route := range c.Routes {
+		routePrefix := fmt.Sprintf("%sroutes[%d].", prefix, i)
+		if route.SecurityHeaders != nil {
+			if err := route.SecurityHeaders.validate(); err != nil {
+				v.add("%ssecurity_headers: %v", routePrefix, err)
+			}
+		}
+		if _, err := route.AccessControl.compile(); err != nil {
+			v.add("%saccess_control.%v", routePrefix, err)
+		}
+		if route.JWT != nil {
+			if err := route.JWT.validate(); err != nil {
+				v.add("%sjwt: %v", routePrefix, err)
+			}
+		}
+		if route.RequestLimits != nil {
+			if err := route.RequestLimits.validate(); err != nil {
+				v.add("%srequest_limits.%v", routePrefix, err)
+			}
+		}
+		if route.Decompression != nil {
+			if err := route.Decompression.validate(); err != nil {
+				v.add("%sdecompression.%v", routePrefix, err)
+			}
+		}
+		if route.RateLimit != nil {
+			if err := route.RateLimit.validate(); err != nil {
+				v.add("%srate_limit.%v", routePrefix, err)
+			}
+		}
+		if route.Retry != nil {
+			if err := route.Retry.validate(); err != nil {
+				v.add("%sretry.%v", routePrefix, err)
+			}
+		}
+		if route.CircuitBreaker != nil {
+			if err := route.CircuitBreaker.validate(); err != nil {
+				v.add("%scircuit_breaker.%v", routePrefix, err)
+			}
+		}
+		if route.Timeouts != nil {
+			if err := route.Timeouts.validate(); err != nil {
+				v.add("%stimeouts.%v", routePrefix, err)
+			}
+		}
+		if route.Hedge != nil {
+			if err := route.Hedge.validate(); err != nil {
+				v.add("%shedge.%v", routePrefix, err)
+			}
+		}
+		if route.GRPC != nil {
+			if err := route.GRPC.validate(); err != nil {
+				v.add("%sgrpc.%v", routePrefix, err)
+			}
+		}
+		if route.BackendHTTP2 != nil {
+			if err := route.BackendHTTP2.validate(); err != nil {
+				v.add("%sbackend_http2.%v", routePrefix, err)
+			}
+		}
+		if route.WebSocket != nil {
+			if err := route.WebSocket.validate(); err != nil {
+				v.add("%swebsocket.%v", routePrefix, err)
+			}
+		}
+		if route.Streaming != nil {
+			if err := route.Streaming.validate(); err != nil {
+				v.add("%sstreaming.%v", routePrefix, err)
+			}
+		}
+		if route.Compression != nil {
+			if err := route.Compression.validate(); err != nil {
+				v.add("%scompression.%v", routePrefix, err)
+			}
+		}
+		if route.Fault != nil {
+			if err := route.Fault.validate(); err != nil {
+				v.add("%sfault.%v", routePrefix, err)
+			}
+		}
+		if route.Mirror != nil {
+			if err := route.Mirror.validate(); err != nil {
+				v.add("%smirror.%v", routePrefix, err)
+			}
+			v.validatePool(routePrefix+"mirror.", Config{Backends: route.Mirror.Backends}, true)
+		}
+		if route.Maintenance != nil {
+			if err := route.Maintenance.validate(); err != nil {
+				v.add("%smaintenance.%v", routePrefix, err)
+			}
+		}
+		if route.Fallback != nil {
+			if err := route.Fallback.validate(); err != nil {
+				v.add("%sfallback.%v", routePrefix, err)
+			}
+			v.validatePool(routePrefix+"fallback.", Config{Backends: route.Fallback.Backends}, false)
+		}
+		if route.Redirect != nil {
+			if err := route.Redirect.validate(); err != nil {
+				v.add("%sredirect.%v", routePrefix, err)
+			}
+		}
+		if route.Static != nil {
+			if err := route.Static.validate(); err != nil {
+				v.add("%sstatic.%v", routePrefix, err)
+			}
+		}
+		if route.Split != nil {
+			if err := route.Split.validate(); err != nil {
+				v.add("%ssplit.%v", routePrefix, err)
+			}
+			for i, pool := range route.Split.Pools {
+				v.validatePool(fmt.Sprintf("%ssplit.pools[%d].", routePrefix, i), Config{Backends: pool.Backends}, true)
+			}
+		}
+		if route.ErrorPages != nil {
+			if err := route.ErrorPages.validate(); err != nil {
+				v.add("%serror_pages.%v", routePrefix, err)
+			}
+		}
+		if route.Rewrite != nil {
+			if err := route.Rewrite.validate(); err != nil {
+				v.add("%srewrite.%v", routePrefix, err)
+			}
+		}
+		if route.Experiment != nil {
+			if err := route.Experiment.validate(); err != nil {
+				v.add("%sexperiment.%v", routePrefix, err)
+			}
+		}
+		if route.RequestHeaders != nil {
+			if err := route.RequestHeaders.validate(); err != nil {
+				v.add("%srequest_headers.%v", routePrefix, err)
+			}
+		}
+		if route.ResponseHeaders != nil {
+			if err := route.ResponseHeaders.validate(); err != nil {
+				v.add("%sresponse_headers.%v", routePrefix, err)
+			}
+		}
+		if route.CORS != nil {
+			if err := route.CORS.validate(); err != nil {
+				v.add("%scors.%v", routePrefix, err)
+			}
+		}
+		if route.WAF != nil {
+			if err := route.WAF.validate(); err != nil {
+				v.add("%swaf.%v", routePrefix, err)
+			}
+		}
+		if route.Auth != nil {
+			if err := route.Auth.validate(); err != nil {
+				v.add("%sauth: %v", routePrefix, err)
+			}
+		}
+		if route.OIDC != nil {
+			if err := route.OIDC.validate(); err != nil {
+				v.add("%soidc.%v", routePrefix, err)
+			}
+		}
+		if len(route.ServerNames) == 0 && len(route.Hosts) == 0 && route.PathPrefix == "" && route.PathRegex == "" &&
+			len(route.Methods) == 0 && len(route.Headers) == 0 && len(route.Query) == 0 {
+			v.add("%sroutes[%d]: needs server_names, hosts, path_prefix, path_regex, methods, headers or query to match requests", prefix, i)
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			v.add("%spath_prefix: must start with /", routePrefix)
+		}
+		if route.PathRegex != "" {
+			if _, err := regexp.Compile(route.PathRegex); err != nil {
+				v.add("%spath_regex: %v", routePrefix, err)
+			}
+		}
+		for j, host := range route.Hosts {
+			if err := validateHostPattern(host); err != nil {
+				v.add("%shosts[%d]: %v", routePrefix, j, err)
+			}
+		}
+		if len(route.ServerNames) > 0 && c.TLS == nil && c.Mode != ModeTCP {
+			v.add("%sserver_names: needs tls on the listener", routePrefix)
+		}
+		pool := Config{Mode: c.Mode, Backends: route.Backends, BackendTLS: route.BackendTLS, Strategy: route.Strategy, OutlierDetection: route.OutlierDetection}
+		if route.HealthCheck != nil {
+			pool.HealthCheck = *route.HealthCheck
+			if err := pool.HealthCheck.validate(); err != nil {
+				v.add("%shealth_check: %v", routePrefix, err)
+			}
+		}
+		v.validatePool(routePrefix, pool, route.Redirect == nil && route.Static == nil && route.Split == nil && route.Fallback == nil)
+	}
+
+	for i, webhook := range c.HealthWebhooks {
+		if err := validateURL(webhook); err != nil {
+			v.add("%shealth_webhooks[%d]: %v", prefix, i, err)
+		}
+	}
+}
+
+// validatePool checks the settings that make up a backend pool, which
+// listeners and routes share.
+func (v *validator) validatePool(prefix string, c Config, backendsRequired bool) {
+	switch c.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConnections, StrategyRandom:
+	default:
+		v.add("%sstrategy: unknown strategy %q", prefix, c.Strategy)
+	}
+
+	if tls := c.BackendTLS; tls != nil && (tls.CertFile == "") != (tls.KeyFile == "") {
+		v.add("%sbackend_tls: cert_file and key_file must be set together", prefix)
+	}
+
+	if len(c.Backends) == 0 && backendsRequired {
+		v.add("%sbackends: at least one backend is required", prefix)
+	}
+	for i, backend := range c.Backends {
+		v.validateBackendSource(fmt.Sprintf("%sbackends[%d]", prefix, i), backend, c.Mode == ModeTCP)
+		if backend.Weight < 0 {
+			v.add("%sbackends[%d].weight: must be positive", prefix, i)
+		}
+		if backend.MaxConnections < 0 {
+			v.add("%sbackends[%d].max_connections: must not be negative", prefix, i)
+		}
+		if backend.MaxConcurrentRequests < 0 {
+			v.add("%sbackends[%d].max_concurrent_requests: must not be negative", prefix, i)
+		}
+		if backend.ResolveInterval < 0 {
+			v.add("%sbackends[%d].resolve_interval: must not be negative", prefix, i)
+		}
+		if err := c.HealthCheck.merge(backend.HealthCheck).validate(); err != nil {
+			v.add("%sbackends[%d].health_check: %v", prefix, i, err)
+		}
+	}
+
+	if outlier := c.OutlierDetection; outlier != nil {
+		if outlier.ErrorThreshold < 0 || outlier.ErrorThreshold > 1 {
+			v.add("%soutlier_detection.error_threshold: must be between 0 and 1", prefix)
+		}
+		if outlier.MinRequests < 0 {
+			v.add("%soutlier_detection.min_requests: must not be negative", prefix)
+		}
+	}
+	if c.BackendQueueTimeout < 0 {
+		v.add("%sbackend_queue_timeout: must not be negative", prefix)
+	}
+	if c.DrainTimeout < 0 {
+		v.add("%sdrain_timeout: must not be negative", prefix)
+	}
+}
+
+// validateBackendSource checks that a backend has exactly one of a URL or
+// a service registry to discover its instances from.
+func (v *validator) validateBackendSource(name string, backend BackendConfig, tcp bool) {
+	if len(backend.Discovery) == 0 {
+		validate := validateBackendURL
+		if tcp {
+			validate = validateTCPURL
+		}
+		if err := validate(backend.URL); err != nil {
+			v.add("%s: %v", name, err)
+		}
+		return
+	}
+	if backend.URL != "" || len(backend.Discovery) > 1 {
+		v.add("%s: only one of url and a discovery provider (%s) may be set", name, strings.Join(discovery.Names(), ", "))
+	}
+	for provider, config := range backend.Discovery {
+		if _, err := discovery.New(provider, config); err != nil {
+			v.add("%s.%s: %v", name, provider, err)
+		}
+	}
+}
+
+func (c HealthCheckConfig) validate() error {
+	switch c.Type {
+	case "", HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC:
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", port)
+	}
+	if number < 1 || number > 65535 {
+		return fmt.Errorf("%d is out of range", number)
+	}
+	return nil
+}
+
+func validateBackendURL(rawURL string) error {
+	if !isSRV(rawURL) {
+		return validateURL(rawURL)
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%q has no SRV name", rawURL)
+	}
+	return nil
+}
+
+func validateURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%q must use http or https", rawURL)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%q has no host", rawURL)
+	}
+	return nil
+}
+
+// validateHostPattern checks a host name a route matches, which may start
+// with a "*." wildcard.
+func validateHostPattern(pattern string) error {
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") {
+		return fmt.Errorf("%q must be a host name, optionally starting with *.", pattern)
+	}
+	return nil
+}
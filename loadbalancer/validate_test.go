@@ -0,0 +1,168 @@
+package loadbalancer
+
+import (
+	"strings"
+	"testing"
+
+	"loadbalancer/acme"
+)
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	config := Config{
+		Port:             "http",
+		AdminPort:        "70000",
+		Backends:         []BackendConfig{{URL: "backend1:80"}, {URL: "http://backend2:80", HealthCheck: &HealthCheckConfig{Type: "icmp"}}},
+		BackendTLS:       &ClientTLSConfig{CertFile: "client.crt"},
+		SecurityHeaders:  &SecurityHeadersConfig{FrameOptions: "ALLOWALL"},
+		AccessControl:    &AccessControlConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/33"}},
+		TrustedProxies:   []string{"proxy"},
+		RequestLimits:    &RequestLimitsConfig{MaxBodyBytes: -1},
+		ConcurrencyLimit: &ConcurrencyLimitConfig{MaxInFlight: 0},
+		Retry:            &RetryConfig{Budget: 2},
+		CircuitBreaker:   &CircuitBreakerConfig{ErrorThreshold: 1.5},
+		Timeouts:         &TimeoutsConfig{Dial: -1},
+		Hedge:            &HedgeConfig{Delay: -1},
+		Fault:            &FaultConfig{AbortStatus: 42},
+		Mirror:           &MirrorConfig{Percent: 200},
+		Maintenance:      &MaintenanceConfig{Status: 42},
+		Fallback:         &FallbackConfig{Status: 42},
+		Redirect:         &RedirectConfig{Status: 200},
+		Static:           &StaticConfig{},
+		GRPC:             &GRPCConfig{RetryOn: []string{"nope"}},
+		WebSocket:        &WebSocketConfig{IdleTimeout: -1},
+		Streaming:        &StreamingConfig{MaxDuration: -1},
+		BackendHTTP2:     &BackendHTTP2Config{PingTimeout: -1},
+		ProxyProtocol:    &ProxyProtocolConfig{Send: "v3"},
+		Compression:      &CompressionConfig{Level: 10},
+		HTTP3:            &HTTP3Config{MaxAge: -1},
+		Decompression:    &DecompressionConfig{MaxBodyBytes: -1},
+		Split:            &SplitConfig{Key: "random"},
+		ErrorPages:       &ErrorPagesConfig{HTML: map[string]string{"404": "404.html"}},
+		Rewrite:          &RewriteConfig{StripPrefix: "api"},
+		Experiment:       &ExperimentConfig{Name: "checkout", Key: "session"},
+		ResponseHeaders:  &HeaderRules{Remove: []string{"Bad Header"}},
+		DrainTimeout:     -1,
+		Shutdown:         &ShutdownConfig{GracePeriod: -1},
+		RateLimit:        &RateLimitConfig{RateLimit: RateLimit{Capacity: 10, Rate: 1}, Rules: []RateLimitRule{{RateLimit: RateLimit{Capacity: 1}}}},
+		CORS:             &CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		JWT:              &JWTConfig{JWKSURL: "https://issuer/jwks", Secret: "secret"},
+		Auth:             &AuthConfig{Users: map[string]string{"alice": "sha256:abc"}},
+		OIDC:             &OIDCConfig{Issuer: "https://issuer", ClientID: "lb", RedirectURL: "https://lb/callback", CookieSecret: "short"},
+		HealthCheck:      HealthCheckConfig{Concurrency: -1},
+		LogLevel:         "verbose",
+		LogOutput:        &LogOutputConfig{Syslog: &SyslogConfig{Facility: "kern0"}},
+		TLS:              &ServerTLSConfig{CertFile: "server.crt", KeyFile: "server.key", MinVersion: "1.4", ClientAuth: "always"},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, expected := range []string{"port:", "admin_port:", "backends[0]:", "backends[1].health_check:", "health_check.concurrency:", "log_level:", "log_output.syslog.facility:", "tls.min_version:", "tls.client_auth:", "backend_tls:", "security_headers:", "access_control.deny:", "trusted_proxies:", "request_limits.max_body_bytes:", "concurrency_limit.max_in_flight:", "retry.budget:", "circuit_breaker.error_threshold:", "timeouts.dial:", "hedge.delay:", "grpc.retry_on:", "websocket.idle_timeout:", "streaming.max_duration:", "backend_http2.ping_timeout:", "proxy_protocol.send:", "compression.level:", "http3.max_age:", "decompression.max_body_bytes:", "fault.abort_status:", "mirror.percent:", "mirror.backends:", "maintenance.status:", "redirect.status:", "static.root:", "split.key:", "error_pages.html.404:", "rewrite.strip_prefix:", "experiment.key:", "response_headers.remove:", "drain_timeout:", "shutdown.grace_period:", "rate_limit.rules[0].rate:", "cors.allowed_origins:", "jwt:", "auth: users.alice:", "oidc.cookie_secret:"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error mentioning %q, got:\n%v", expected, err)
+		}
+	}
+
+	valid := Config{Port: "8080", Backends: []BackendConfig{{URL: "http://backend1:80"}, {URL: "srv://_http._tcp.backend2"}}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	config := Config{
+		AdminPort: "9000",
+		Listeners: []Config{
+			{Port: "8080", Backends: []BackendConfig{{URL: "http://a:80"}}},
+			{Port: "8080", Backends: []BackendConfig{{URL: "http://b:80"}}, Strategy: "fastest"},
+			{Port: "9000", Backends: []BackendConfig{{URL: "http://c:80"}}},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, expected := range []string{"listeners[1].port: port 8080 is already used", "listeners[1].strategy:", "admin_port: port 9000 is already used"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error mentioning %q, got:\n%v", expected, err)
+		}
+	}
+
+	if listeners := config.ListenerConfigs(); len(listeners) != 3 {
+		t.Errorf("Expected 3 listeners without a top-level port, got %d", len(listeners))
+	}
+}
+
+func TestValidateACME(t *testing.T) {
+	config := Config{
+		ACME: &acme.Config{Challenge: acme.ChallengeHTTP01},
+		Listeners: []Config{
+			{Port: "443", Backends: []BackendConfig{{URL: "http://a:80"}}, TLS: &ServerTLSConfig{ACMEHosts: []string{"example.com"}, Certificates: []CertificateConfig{{CertFile: "api.crt"}}}},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, expected := range []string{"acme.cache_dir:", "acme.accept_tos:", "acme.challenge: http-01 needs a plain HTTP listener on port 80", "listeners[0].tls.certificates[0]: cert_file and key_file are required"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error mentioning %q, got:\n%v", expected, err)
+		}
+	}
+
+	config.ACME = &acme.Config{CacheDir: "/var/lib/httpbalance/acme", AcceptTOS: true, Challenge: acme.ChallengeHTTP01}
+	config.Listeners[0].TLS = &ServerTLSConfig{ACMEHosts: []string{"example.com"}}
+	config.Listeners = append(config.Listeners, Config{Port: "80", Backends: []BackendConfig{{URL: "http://a:80"}}})
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+
+	// The redirect port answers http-01 challenges too, but cannot share
+	// a port with a listener.
+	config.Listeners[0].TLS.RedirectHTTPPort = "80"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "listeners[0].tls.redirect_http_port: port 80 is already used by listeners[1].port") {
+		t.Errorf("Expected the redirect port to clash with the plain listener, got %v", err)
+	}
+	config.Listeners = config.Listeners[:1]
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	config := Config{
+		Port: "8080",
+		Routes: []RouteConfig{
+			{Backends: []BackendConfig{{URL: "http://a:80"}}},
+			{Hosts: []string{"api.example.com:8080"}, Backends: []BackendConfig{{URL: "http://b:80"}}},
+			{ServerNames: []string{"api.example.com"}, Backends: []BackendConfig{{URL: "http://c:80"}}},
+			{PathPrefix: "api", Backends: []BackendConfig{{URL: "http://d:80"}}},
+			{PathRegex: "^/(api", Backends: []BackendConfig{{URL: "http://e:80"}}},
+			{PathPrefix: "/f/", Split: &SplitConfig{
+				Pools:  []SplitPool{{Name: "stable", Backends: []BackendConfig{{URL: "http://f1:80"}}}, {Name: "canary", Backends: []BackendConfig{{URL: "http://f2:80"}}}},
+				Canary: &CanaryConfig{Steps: []int{50, 10}},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, expected := range []string{"routes[0]: needs server_names, hosts,", "routes[1].hosts[0]:", "routes[2].server_names: needs tls", "routes[3].path_prefix:", "routes[4].path_regex:", "routes[5].split.canary.steps:"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error mentioning %q, got:\n%v", expected, err)
+		}
+	}
+
+	valid := Config{Port: "8080", Routes: []RouteConfig{
+		{Hosts: []string{"*.example.com"}, Backends: []BackendConfig{{URL: "http://a:80"}}},
+		{PathPrefix: "/old/", Redirect: &RedirectConfig{Path: "/new/"}},
+	}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+}
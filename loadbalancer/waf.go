@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	WAFActionBlock = "block"
+	WAFActionLog   = "log"
+
+	defaultWAFBodyBytes = 64 * 1024
+)
+
+// WAFConfig filters requests by rules before they are proxied.
+// DefaultRules adds defaultWAFRules in front of Rules. At most
+// InspectBodyBytes of a body are matched against (default 64 KB).
+type WAFConfig struct {
+	DefaultRules     bool      `json:"default_rules,omitempty"`
+	Rules            []WAFRule `json:"rules,omitempty"`
+	InspectBodyBytes int64     `json:"inspect_body_bytes,omitempty"`
+}
+
+// WAFRule matches Target against Regex or Contains (case-insensitive).
+// Target is "path", "query", "headers" (any header), "header:<name>" or
+// "body". Action is block (the default), answered with a 403, or log.
+type WAFRule struct {
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	Regex    string `json:"regex,omitempty"`
+	Contains string `json:"contains,omitempty"`
+	Action   string `json:"action,omitempty"`
+}
+
+// defaultWAFRules catch the most obvious attacks. They are deliberately
+// narrow; anything cleverer needs a real WAF.
+var defaultWAFRules = []WAFRule{
+	{Name: "path-traversal", Target: "path", Regex: `(^|[/\\])\.\.([/\\]|$)`},
+	{Name: "path-traversal-query", Target: "query", Regex: `(^|[/\\=])\.\.[/\\]`},
+	{Name: "sql-injection", Target: "query", Regex: `(?i)(\bunion\b[\s(]+(all\s+)?select\b|'\s*or\s+'?\d+'?\s*=\s*'?\d+|;\s*(drop|truncate)\s+table\b|\bsleep\s*\(\s*\d+\s*\)|--\s*$)`},
+	{Name: "xss", Target: "query", Regex: `(?i)(<\s*script\b|javascript:|\bon(error|load)\s*=)`},
+	{Name: "command-injection", Target: "query", Regex: `(;|\||&&|\$\(|` + "`" + `)\s*(cat|wget|curl|sh|bash|nc)\b`},
+	{Name: "sensitive-files", Target: "path", Regex: `(?i)/(\.git|\.env|\.htpasswd|etc/passwd)(/|$)`},
+}
+
+func (c *WAFConfig) rules() []WAFRule {
+	if !c.DefaultRules {
+		return c.Rules
+	}
+	return append(append([]WAFRule(nil), defaultWAFRules...), c.Rules...)
+}
+
+func (c *WAFConfig) validate() error {
+	if c.InspectBodyBytes < 0 {
+		return fmt.Errorf("inspect_body_bytes: must not be negative")
+	}
+	_, err := c.compile()
+	return err
+}
+
+type wafRule struct {
+	WAFRule
+	header  string
+	pattern *regexp.Regexp
+}
+
+// waf is a compiled WAFConfig. One that failed to compile rejects every
+// request.
+type waf struct {
+	rules     []wafRule
+	bodyBytes int64
+	inspects  bool // whether any rule looks at the body
+	rejectAll bool
+}
+
+func (c *WAFConfig) compile() (*waf, error) {
+	if c == nil {
+		return nil, nil
+	}
+	w := &waf{bodyBytes: c.InspectBodyBytes}
+	if w.bodyBytes == 0 {
+		w.bodyBytes = defaultWAFBodyBytes
+	}
+	for i, rule := range c.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rules[%d].name: is required", i)
+		}
+	}
+	for _, rule := range c.rules() {
+		compiled := wafRule{WAFRule: rule}
+		switch {
+		case rule.Target == "path", rule.Target == "query", rule.Target == "headers":
+		case rule.Target == "body":
+			w.inspects = true
+		case strings.HasPrefix(rule.Target, "header:") && len(rule.Target) > len("header:"):
+			compiled.header = http.CanonicalHeaderKey(strings.TrimPrefix(rule.Target, "header:"))
+		default:
+			return nil, fmt.Errorf("rules.%s.target: must be path, query, headers, header:<name> or body, got %q", rule.Name, rule.Target)
+		}
+		switch rule.Action {
+		case "", WAFActionBlock, WAFActionLog:
+		default:
+			return nil, fmt.Errorf("rules.%s.action: must be %s or %s, got %q", rule.Name, WAFActionBlock, WAFActionLog, rule.Action)
+		}
+		switch {
+		case rule.Regex != "" && rule.Contains != "":
+			return nil, fmt.Errorf("rules.%s: regex and contains are mutually exclusive", rule.Name)
+		case rule.Regex != "":
+			pattern, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rules.%s.regex: %v", rule.Name, err)
+			}
+			compiled.pattern = pattern
+		case rule.Contains != "":
+			compiled.pattern = regexp.MustCompile("(?i)" + regexp.QuoteMeta(rule.Contains))
+		default:
+			return nil, fmt.Errorf("rules.%s: needs regex or contains", rule.Name)
+		}
+		w.rules = append(w.rules, compiled)
+	}
+	return w, nil
+}
+
+// values returns what rule matches against in r. Path and query are
+// matched both as sent and percent-decoded, so encoding cannot hide an
+// attack.
+func (rule *wafRule) values(r *http.Request, body []byte) []string {
+	switch rule.Target {
+	case "path":
+		return []string{r.URL.EscapedPath(), r.URL.Path}
+	case "query":
+		values := []string{r.URL.RawQuery}
+		if decoded, err := url.QueryUnescape(r.URL.RawQuery); err == nil && decoded != r.URL.RawQuery {
+			values = append(values, decoded)
+		}
+		return values
+	case "headers":
+		var values []string
+		for _, header := range r.Header {
+			values = append(values, header...)
+		}
+		return values
+	case "body":
+		return []string{string(body)}
+	}
+	return r.Header.Values(rule.header)
+}
+
+// match returns the first rule r matches, after logging every log rule it
+// matches on the way.
+func (w *waf) match(lb *LoadBalancer, r *http.Request, body []byte) *wafRule {
+	for i := range w.rules {
+		rule := &w.rules[i]
+		matched := false
+		for _, value := range rule.values(r, body) {
+			if rule.pattern.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if rule.Action == WAFActionLog {
+			lb.logger.Warnf("WAF rule %s flagged request %s from %s: %s %s", rule.Name, r.Header.Get(RequestIDHeader), clientIP(r), r.Method, r.URL.RequestURI())
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// admitWAF turns away requests matching a blocking rule with a 403. The
+// part of the body the rules look at is read up front and put back in
+// front of the rest.
+func (lb *LoadBalancer) admitWAF(w *waf, rw http.ResponseWriter, r *http.Request) bool {
+	if w == nil {
+		return true
+	}
+	if w.rejectAll {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	var body []byte
+	if w.inspects && r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, w.bodyBytes))
+		if isBodyTooLarge(err) {
+			http.Error(rw, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		if err != nil {
+			http.Error(rw, "Bad request", http.StatusBadRequest)
+			return false
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	if rule := w.match(lb, r, body); rule != nil {
+		lb.logger.Warnf("WAF rule %s blocked request %s from %s: %s %s", rule.Name, r.Header.Get(RequestIDHeader), clientIP(r), r.Method, r.URL.RequestURI())
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWAF(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		WAF: &WAFConfig{
+			DefaultRules:     true,
+			InspectBodyBytes: 16,
+			Rules: []WAFRule{
+				{Name: "no-scanners", Target: "header:User-Agent", Contains: "sqlmap"},
+				{Name: "no-admin-payloads", Target: "body", Regex: `"role":\s*"admin"`},
+				{Name: "legacy-api", Target: "path", Regex: `^/v1/`, Action: WAFActionLog},
+			},
+		},
+	})
+	defer lb.Close()
+
+	for _, test := range []struct {
+		name, target, userAgent, body string
+		expected                      int
+	}{
+		{"clean", "/search?q=shoes", "", "", http.StatusOK},
+		{"path traversal", "/static/../../etc/passwd", "", "", http.StatusForbidden},
+		{"encoded path traversal", "/static/%2e%2e/%2e%2e/etc/shadow", "", "", http.StatusForbidden},
+		{"sql injection", "/search?q=1%27%20UNION%20SELECT%20password%20FROM%20users", "", "", http.StatusForbidden},
+		{"xss", "/search?q=%3Cscript%3Ealert(1)%3C/script%3E", "", "", http.StatusForbidden},
+		{"dotfile", "/.git/config", "", "", http.StatusForbidden},
+		{"header rule", "/", "SQLMap/1.7", "", http.StatusForbidden},
+		{"body rule", "/users", "", `{"role": "admin"}`, http.StatusForbidden},
+		{"body rule past the inspected bytes", "/users", "", `{"name": "alice", "role": "admin"}`, http.StatusOK},
+		{"log rule", "/v1/items", "", "", http.StatusOK},
+	} {
+		received = ""
+		req := httptest.NewRequest("POST", test.target, strings.NewReader(test.body))
+		if test.userAgent != "" {
+			req.Header.Set("User-Agent", test.userAgent)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, w.Code)
+		}
+		if test.expected == http.StatusOK && received != test.body {
+			t.Errorf("%s: expected the backend to get the whole body %q, got %q", test.name, test.body, received)
+		}
+	}
+}
+
+func TestWAFValidate(t *testing.T) {
+	for _, config := range []WAFConfig{
+		{Rules: []WAFRule{{Target: "path", Contains: "x"}}},
+		{Rules: []WAFRule{{Name: "a", Target: "cookie", Contains: "x"}}},
+		{Rules: []WAFRule{{Name: "a", Target: "path", Regex: "("}}},
+		{Rules: []WAFRule{{Name: "a", Target: "path"}}},
+		{Rules: []WAFRule{{Name: "a", Target: "path", Contains: "x", Action: "drop"}}},
+	} {
+		if err := config.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", config.Rules)
+		}
+	}
+	if err := (&WAFConfig{DefaultRules: true}).validate(); err != nil {
+		t.Errorf("Expected the default rules to compile: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// WebSocketConfig bounds proxied WebSocket connections: IdleTimeout closes
+// one once no data went either way for that long, and MaxLifetime closes it
+// after that long regardless. Neither is set by default. WebSocket
+// connections are not bound by timeouts.request, which would cut them off.
+type WebSocketConfig struct {
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	MaxLifetime Duration `json:"max_lifetime,omitempty"`
+}
+
+func (c *WebSocketConfig) validate() error {
+	if c.IdleTimeout < 0 {
+		return errors.New("idle_timeout: must not be negative")
+	}
+	if c.MaxLifetime < 0 {
+		return errors.New("max_lifetime: must not be negative")
+	}
+	return nil
+}
+
+// isWebSocket reports whether r asks to switch to the WebSocket protocol.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// withLifetime bounds the WebSocket request r by MaxLifetime, if one is
+// set. The caller calls the returned cancel func once done with r.
+func (c *WebSocketConfig) withLifetime(r *http.Request) (*http.Request, context.CancelFunc) {
+	if c == nil || c.MaxLifetime <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(c.MaxLifetime))
+	return r.WithContext(ctx), cancel
+}
+
+// websocketWriter hands the client's connection to the proxy once the
+// backend switched protocols, counting it as a WebSocket connection and
+// closing it when idle.
+type websocketWriter struct {
+	*responseRecorder
+	lb   *LoadBalancer
+	idle time.Duration
+}
+
+func (lb *LoadBalancer) newWebSocketWriter(recorder *responseRecorder, config *WebSocketConfig) *websocketWriter {
+	w := &websocketWriter{responseRecorder: recorder, lb: lb}
+	if config != nil {
+		w.idle = time.Duration(config.IdleTimeout)
+	}
+	return w
+}
+
+func (w *websocketWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The proxy writes the backend's 101 straight to the connection.
+	w.status = http.StatusSwitchingProtocols
+	w.lb.metrics.websocketOpened(w.lb.listener)
+	tracked := &websocketConn{Conn: conn, idle: w.idle, closed: func() { w.lb.metrics.websocketClosed(w.lb.listener) }}
+	tracked.extend()
+	return tracked, rw, nil
+}
+
+// websocketConn is a client's WebSocket connection, which times out after
+// idle without reads or writes.
+type websocketConn struct {
+	net.Conn
+	idle      time.Duration
+	closeOnce sync.Once
+	closed    func()
+}
+
+func (c *websocketConn) extend() {
+	if c.idle > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.idle))
+	}
+}
+
+func (c *websocketConn) Read(data []byte) (int, error) {
+	c.extend()
+	return c.Conn.Read(data)
+}
+
+func (c *websocketConn) Write(data []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(data)
+}
+
+func (c *websocketConn) Close() error {
+	c.closeOnce.Do(c.closed)
+	return c.Conn.Close()
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"loadbalancer/metrics"
+)
+
+func TestWebSocketProxying(t *testing.T) {
+	echo := websocket.Handler(func(conn *websocket.Conn) {
+		var message string
+		for websocket.Message.Receive(conn, &message) == nil {
+			websocket.Message.Send(conn, "echo "+message)
+		}
+	})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		echo.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	registry := metrics.NewRegistry()
+	lb := NewLoadBalancer(Config{
+		Port:      "8080",
+		Backends:  []BackendConfig{{URL: backend.URL}},
+		Timeouts:  &TimeoutsConfig{Request: Duration(50 * time.Millisecond)},
+		WebSocket: &WebSocketConfig{IdleTimeout: Duration(200 * time.Millisecond)},
+	}, WithMetrics(NewMetrics(registry)))
+	defer lb.Close()
+	frontend := httptest.NewServer(lb)
+	defer frontend.Close()
+
+	conn, err := websocket.Dial(strings.Replace(frontend.URL, "http", "ws", 1)+"/socket", "", frontend.URL)
+	if err != nil {
+		t.Fatalf("Expected the WebSocket handshake to go through, got %v", err)
+	}
+	defer conn.Close()
+	// Outliving timeouts.request, as long as the connection is in use.
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		var reply string
+		if err := websocket.Message.Send(conn, "hi"); err != nil {
+			t.Fatalf("Expected to send over the connection, got %v", err)
+		}
+		if err := websocket.Message.Receive(conn, &reply); err != nil || reply != "echo hi" {
+			t.Fatalf("Expected the echo, got %q %v", reply, err)
+		}
+	}
+
+	var exposition strings.Builder
+	registry.WriteTo(&exposition)
+	for _, expected := range []string{`httpbalance_websocket_connections{listener="8080"} 1`, `httpbalance_websocket_connections_total{listener="8080"} 1`} {
+		if !strings.Contains(exposition.String(), expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, exposition.String())
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var reply string
+	if err := websocket.Message.Receive(conn, &reply); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected the balancer to close the idle connection, got %q %v", reply, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	exposition.Reset()
+	registry.WriteTo(&exposition)
+	if expected := `httpbalance_websocket_connections{listener="8080"} 0`; !strings.Contains(exposition.String(), expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, exposition.String())
+	}
+	if expected := `httpbalance_requests_total{listener="8080",code="1xx"} 1`; !strings.Contains(exposition.String(), expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, exposition.String())
+	}
+}
+
+func TestIsWebSocket(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "WebSocket")
+	if !isWebSocket(r) {
+		t.Error("Expected a WebSocket upgrade")
+	}
+	r.Header.Set("Upgrade", "h2c")
+	if isWebSocket(r) {
+		t.Error("Expected other upgrades not to be WebSocket ones")
+	}
+}
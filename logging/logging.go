@@ -0,0 +1,144 @@
+// Package logging is the leveled logger used throughout the balancer.
+// Anything with Debugf, Infof, Warnf and Errorf methods can be injected,
+// e.g. a *zap.SugaredLogger as is, or a *slog.Logger through Slog.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads a log_level setting. The empty string means info.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return LevelInfo, nil
+	case "warning":
+		return LevelWarn, nil
+	}
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// StdLogger writes through a standard library *log.Logger, prefixing each
+// line with its level. Its level can be changed while it is in use.
+type StdLogger struct {
+	out   *log.Logger
+	level atomic.Int32
+}
+
+func NewStdLogger(out *log.Logger, level Level) *StdLogger {
+	logger := &StdLogger{out: out}
+	logger.SetLevel(level)
+	return logger
+}
+
+func (l *StdLogger) SetLevel(level Level) {
+	l.level.Store(int32(level))
+}
+
+func (l *StdLogger) Level() Level {
+	return Level(l.level.Load())
+}
+
+func (l *StdLogger) logf(level Level, format string, args ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+	l.out.Printf(strings.ToUpper(level.String())+" "+format, args...)
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+func (l *StdLogger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *StdLogger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *StdLogger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// Slog adapts a *slog.Logger. Messages are formatted before they reach
+// slog, so its handler decides the level threshold and output format.
+func Slog(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+func (l slogLogger) logf(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	l.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) Debugf(format string, args ...interface{}) {
+	l.logf(slog.LevelDebug, format, args...)
+}
+
+func (l slogLogger) Infof(format string, args ...interface{}) {
+	l.logf(slog.LevelInfo, format, args...)
+}
+
+func (l slogLogger) Warnf(format string, args ...interface{}) {
+	l.logf(slog.LevelWarn, format, args...)
+}
+
+func (l slogLogger) Errorf(format string, args ...interface{}) {
+	l.logf(slog.LevelError, format, args...)
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	SetDefault(NewStdLogger(log.Default(), LevelInfo))
+}
+
+// Default returns the logger used by code that was not handed one
+// explicitly.
+func Default() Logger {
+	return defaultLogger.Load().(*holder).logger
+}
+
+// SetDefault replaces the logger returned by Default.
+func SetDefault(logger Logger) {
+	defaultLogger.Store(&holder{logger: logger})
+}
+
+// holder keeps atomic.Value happy when loggers of different concrete types
+// are stored.
+type holder struct {
+	logger Logger
+}
@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestStdLoggerLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewStdLogger(log.New(&out, "", 0), LevelInfo)
+
+	logger.Debugf("Forwarding request to %s", "http://backend1")
+	logger.Infof("Backend %s removed from pool", "http://backend2")
+	logger.SetLevel(LevelError)
+	logger.Warnf("Error proxying to %s", "http://backend3")
+	logger.Errorf("All backends are unavailable")
+
+	expected := "INFO Backend http://backend2 removed from pool\nERROR All backends are unavailable\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]Level{"": LevelInfo, "debug": LevelDebug, "WARN": LevelWarn, "warning": LevelWarn, "error": LevelError} {
+		level, err := ParseLevel(name)
+		if err != nil || level != expected {
+			t.Errorf("Expected %q to parse as %v, got %v, %v", name, expected, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+}
+
+func TestSlog(t *testing.T) {
+	var out bytes.Buffer
+	logger := Slog(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	logger.Infof("Backend %s passed re-probe, re-admitting", "http://backend1")
+	logger.Warnf("Backend %s is unavailable: %v", "http://backend2", "connection refused")
+
+	if strings.Contains(out.String(), "re-admitting") {
+		t.Errorf("Expected info to be filtered by the handler, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), `level=WARN msg="Backend http://backend2 is unavailable: connection refused"`) {
+		t.Errorf("Expected a formatted warning, got %q", out.String())
+	}
+}
@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rotation says when a log file is rotated: once writing would take it past
+// MaxSize bytes or once it has been open for Every. MaxBackups limits how
+// many rotated files are kept; 0 keeps all. The zero value never rotates.
+type Rotation struct {
+	MaxSize    int64
+	Every      time.Duration
+	MaxBackups int
+}
+
+// File is an append-only log file that rotates itself. Rotated files are
+// renamed to the path followed by the time of rotation.
+type File struct {
+	path     string
+	perm     os.FileMode
+	rotation Rotation
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenFile opens path for appending, creating it with perm if needed.
+func OpenFile(path string, perm os.FileMode, rotation Rotation) (*File, error) {
+	f := &File{path: path, perm: perm, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *File) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.due(len(data)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) due(pending int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.rotation.MaxSize > 0 && f.size+int64(pending) > f.rotation.MaxSize {
+		return true
+	}
+	return f.rotation.Every > 0 && time.Since(f.opened) >= f.rotation.Every
+}
+
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	stamp := time.Now().UTC().Format("20060102T150405")
+	rotated := f.path + "." + stamp
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, stamp, i)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups. The timestamps
+// in their names sort chronologically. Failures are not logged, as the log
+// may well be this file.
+func (f *File) prune() {
+	if f.rotation.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil || len(backups) <= f.rotation.MaxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-f.rotation.MaxBackups] {
+		os.Remove(backup)
+	}
+}
+
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenFile(path, 0644, Rotation{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "fourth\n" {
+		t.Errorf("Expected only the last line in the current file, got %q", current)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 rotated files to be kept, got %v", backups)
+	}
+	newest, _ := os.ReadFile(backups[1])
+	if string(newest) != "third\n" {
+		t.Errorf("Expected the newest rotated file to hold %q, got %q", "third\n", newest)
+	}
+}
+
+func TestFileWithoutRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("existing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, 0600, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("appended\n"))
+	f.Close()
+
+	content, _ := os.ReadFile(path)
+	if string(content) != "existing\nappended\n" {
+		t.Errorf("Expected the file to be appended to, got %q", content)
+	}
+	if _, err := f.Write([]byte("late\n")); err == nil {
+		t.Error("Expected writing to a closed file to fail")
+	}
+}
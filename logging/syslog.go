@@ -0,0 +1,87 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+	"sync/atomic"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// SyslogLogger sends each line to syslog with the severity matching its
+// level.
+type SyslogLogger struct {
+	writer *syslog.Writer
+	level  atomic.Int32
+}
+
+// NewSyslogLogger connects to the syslog daemon at address over network
+// ("udp", "tcp" or "unix"), or to the local daemon when both are empty.
+// facility is a name such as "daemon" or "local0"; empty means "daemon".
+func NewSyslogLogger(network, address, tag, facility string, level Level) (*SyslogLogger, error) {
+	priority, err := ParseFacility(facility)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := syslog.Dial(network, address, priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	logger := &SyslogLogger{writer: writer}
+	logger.SetLevel(level)
+	return logger, nil
+}
+
+// ParseFacility reads a syslog facility name.
+func ParseFacility(name string) (syslog.Priority, error) {
+	if name == "" {
+		return syslog.LOG_DAEMON, nil
+	}
+	facility, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return facility, nil
+}
+
+func (l *SyslogLogger) SetLevel(level Level) {
+	l.level.Store(int32(level))
+}
+
+func (l *SyslogLogger) Close() error {
+	return l.writer.Close()
+}
+
+func (l *SyslogLogger) logf(level Level, send func(string) error, format string, args ...interface{}) {
+	if level < Level(l.level.Load()) {
+		return
+	}
+	send(fmt.Sprintf(format, args...))
+}
+
+func (l *SyslogLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, l.writer.Debug, format, args...)
+}
+
+func (l *SyslogLogger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, l.writer.Info, format, args...)
+}
+
+func (l *SyslogLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, l.writer.Warning, format, args...)
+}
+
+func (l *SyslogLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, l.writer.Err, format, args...)
+}
@@ -0,0 +1,22 @@
+//go:build windows || plan9
+
+package logging
+
+import "errors"
+
+// SyslogLogger is unavailable on this platform.
+type SyslogLogger struct {
+	StdLogger
+}
+
+func NewSyslogLogger(network, address, tag, facility string, level Level) (*SyslogLogger, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func ParseFacility(name string) (int, error) {
+	return 0, errors.New("syslog is not supported on this platform")
+}
+
+func (l *SyslogLogger) Close() error {
+	return nil
+}
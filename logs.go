@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"loadbalancer/loadbalancer"
+	"loadbalancer/logging"
+)
+
+const defaultSyslogTag = "httpbalance"
+
+// setUpLogging points the default logger at the configured output and
+// level. The returned closer releases the output.
+func setUpLogging(config loadbalancer.Config) (io.Closer, error) {
+	// The level was checked by loadConfig.
+	level, _ := logging.ParseLevel(config.LogLevel)
+	output := config.LogOutput
+
+	switch {
+	case output != nil && output.Syslog != nil:
+		tag := output.Syslog.Tag
+		if tag == "" {
+			tag = defaultSyslogTag
+		}
+		logger, err := logging.NewSyslogLogger(output.Syslog.Network, output.Syslog.Address, tag, output.Syslog.Facility, level)
+		if err != nil {
+			return nil, err
+		}
+		logging.SetDefault(logger)
+		return logger, nil
+
+	case output != nil && output.File != "":
+		file, err := logging.OpenFile(output.File, 0644, output.Rotate.Rotation())
+		if err != nil {
+			return nil, err
+		}
+		log.SetOutput(file)
+		logging.SetDefault(logging.NewStdLogger(log.Default(), level))
+		return file, nil
+	}
+
+	logging.SetDefault(logging.NewStdLogger(log.Default(), level))
+	return io.NopCloser(nil), nil
+}
@@ -1,150 +1,204 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"context"
-	"io/ioutil"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
-)
 
-type Config struct {
-	Port     string   `json:"port"`
-	Backends []string `json:"backends"`
-}
+	"loadbalancer/acme"
+	"loadbalancer/loadbalancer"
+	"loadbalancer/logging"
+	"loadbalancer/metrics"
+	"loadbalancer/statsd"
+	"loadbalancer/tracing"
+)
 
-type LoadBalancer struct {
-	config         Config
-	backends       []*url.URL
-	proxy          *httputil.ReverseProxy
-	currentBackend int
-	mutex          sync.Mutex
-	client        *http.Client
-}
+const configSettleDelay = 2 * time.Second
 
-func NewLoadBalancer(config Config) *LoadBalancer {
-	lb := &LoadBalancer{
-		config:   config,
-		client:   &http.Client{Timeout: 5 * time.Second},
+func main() {
+	configFile := flag.String("config", "config.json", "Path to config file, or consul://host:port/key or etcd://host:port/key")
+	configFormatFlag := flag.String("config-format", "", "Config file format: json or yaml (default: detected from the file extension)")
+	watch := flag.Bool("watch-config", true, "Reload the config file automatically when it changes")
+	validateOnly := flag.Bool("validate", false, "Validate the config file and exit")
+
+	// "loadbalancer check -config file" is an alias for -validate.
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "check" {
+		args = args[1:]
+		*validateOnly = true
 	}
+	flag.CommandLine.Parse(args)
 
-	for _, backend := range config.Backends {
-		backendURL, err := url.Parse(backend)
+	config, err := loadConfig(*configFile, *configFormatFlag)
+	if *validateOnly {
 		if err != nil {
-			log.Printf("Error parsing backend URL %s: %v", backend, err)
-			continue
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		lb.backends = append(lb.backends, backendURL)
+		fmt.Printf("%s is valid\n", *configFile)
+		return
 	}
-
-	lb.healthCheck()
-
-	return lb
-}
-
-func (lb *LoadBalancer) healthCheck() {
-	var healthyBackends []*url.URL
-
-	for _, backend := range lb.backends {
-		resp, err := lb.client.Get(backend.String() + "/health")
-		if err != nil || resp.StatusCode != http.StatusOK {
-			log.Printf("Backend %s is unavailable", backend.String())
-			continue
-		}
-		healthyBackends = append(healthyBackends, backend)
-		resp.Body.Close()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	lb.mutex.Lock()
-	lb.backends = healthyBackends
-	if len(lb.backends) == 0 {
-		log.Fatal("All backends are unavailable")
-	}
-	if lb.currentBackend >= len(lb.backends) {
-		lb.currentBackend = 0
+	logOutput, err := setUpLogging(config)
+	if err != nil {
+		log.Fatalf("Error opening log output: %v", err)
 	}
-	lb.mutex.Unlock()
-}
-
-func (lb *LoadBalancer) getNextBackend() *url.URL {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
+	defer logOutput.Close()
 
-	if len(lb.backends) == 0 {
-		return nil
+	accessLog, err := loadbalancer.OpenAccessLog(config.AccessLog)
+	if err != nil {
+		log.Fatalf("Error opening access log: %v", err)
 	}
+	defer accessLog.Close()
 
-	backend := lb.backends[lb.currentBackend]
-	lb.currentBackend = (lb.currentBackend + 1) % len(lb.backends)
-	return backend
-}
-
-func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backend := lb.getNextBackend()
-	if backend == nil {
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-		return
+	auditLog, err := loadbalancer.OpenAuditLog(config.AuditLog)
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
 	}
+	defer auditLog.Close()
 
-	log.Printf("Forwarding request to %s", backend.String())
-
-	proxy := httputil.NewSingleHostReverseProxy(backend)
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Error proxying to %s: %v", backend.String(), err)
-		lb.healthCheck()
-		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	var tracer *tracing.Tracer
+	if config.Tracing != nil {
+		tracer = tracing.NewTracer(*config.Tracing)
+		defer tracer.Close()
 	}
 
-	proxy.ServeHTTP(w, r)
-}
-
-func main() {
-	configFile := flag.String("config", "config.json", "Path to config file")
-	flag.Parse()
-
-	configData, err := ioutil.ReadFile(*configFile)
-	if err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+	registry := metrics.NewRegistry()
+	if config.StatsD != nil {
+		client, err := statsd.New(*config.StatsD)
+		if err != nil {
+			log.Fatalf("Error configuring StatsD: %v", err)
+		}
+		defer client.Close()
+		registry.AddSink(client)
 	}
-
-	var config Config
-	if err := json.Unmarshal(configData, &config); err != nil {
-		log.Fatalf("Error parsing config file: %v", err)
+	listeners := newListeners(config,
+		loadbalancer.WithMetrics(loadbalancer.NewMetrics(registry)),
+		loadbalancer.WithAccessLog(accessLog),
+		loadbalancer.WithAuditLog(auditLog),
+		loadbalancer.WithTracer(tracer))
+	for _, l := range listeners {
+		defer l.lb.Close()
+		if config.FailFastOnStart && l.lb.AvailableBackends() == 0 {
+			log.Fatalf("All backends for port %s are unavailable", l.port)
+		}
 	}
 
-	lb := NewLoadBalancer(config)
-
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	server := &http.Server{
-		Addr:    ":" + config.Port,
-		Handler: lb,
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	// SIGHUP and the config watchers can fire at the same time; reloads
+	// run one after the other so that no listener ends up with parts of
+	// two configs.
+	var reloadMutex sync.Mutex
+	reloadFromFile := func(actor string) {
+		reloadMutex.Lock()
+		defer reloadMutex.Unlock()
+		if err := reloadConfig(listeners, config, *configFile, *configFormatFlag, actor, auditLog); err != nil {
+			logging.Default().Errorf("Error reloading config, keeping the current one: %v", err)
+		}
 	}
-
 	go func() {
-		log.Printf("Load balancer started on port %s", config.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error starting server: %v", err)
+		for range reload {
+			reloadFromFile("signal SIGHUP")
+			reloadCertificates(listeners)
 		}
 	}()
 
+	if source := newRemoteSource(*configFile); source != nil && *watch {
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		go watchRemoteConfig(source, func() { reloadFromFile("remote config watch") }, stopWatching)
+	} else if *watch {
+		stopWatching, err := watchConfig(*configFile, configSettleDelay, func() { reloadFromFile("config file watch") })
+		if err != nil {
+			logging.Default().Warnf("Error watching config file, automatic reload is disabled: %v", err)
+		} else {
+			defer stopWatching()
+		}
+	}
+
+	var certificates *acme.Manager
+	if config.ACME != nil {
+		certificates, err = acme.NewManager(*config.ACME, config.ACMEHosts())
+		if err != nil {
+			log.Fatalf("Error setting up ACME: %v", err)
+		}
+		defer certificates.Close()
+	}
+	for _, l := range listeners {
+		l.start(certificates)
+	}
+	if files := certificateFiles(listeners); len(files) > 0 {
+		stopWatching, err := watchFiles(files, configSettleDelay, func() { reloadCertificates(listeners) })
+		if err != nil {
+			logging.Default().Warnf("Error watching TLS certificates, they are only reloaded on SIGHUP: %v", err)
+		} else {
+			defer stopWatching()
+		}
+	}
+
+	var adminServer *http.Server
+	if config.AdminPort != "" {
+		adminServer = &http.Server{
+			Addr:    ":" + config.AdminPort,
+			Handler: newAdminHandler(config, listeners, registry),
+		}
+		go func() {
+			logging.Default().Infof("Admin endpoints listening on port %s", config.AdminPort)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Error starting admin server: %v", err)
+			}
+		}()
+	}
+
 	<-stop
-	log.Println("Shutting down server...")
+	logging.Default().Infof("Shutting down server...")
+
+	for _, l := range listeners {
+		l.stopping.Store(true)
+	}
+	if delay := config.ShutdownReadinessDelay(); delay > 0 {
+		logging.Default().Infof("Failing readiness for %v before refusing requests", delay)
+		time.Sleep(delay)
+	}
+	grace, cancelGrace := context.WithTimeout(context.Background(), config.ShutdownGracePeriod())
+	defer cancelGrace()
+	var draining sync.WaitGroup
+	for _, l := range listeners {
+		l := l
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			l.drain(grace)
+		}()
+	}
+	draining.Wait()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Error shutting down server: %v", err)
+	for _, l := range listeners {
+		if err := l.shutdown(ctx); err != nil {
+			logging.Default().Errorf("Error shutting down server on port %s: %v", l.port, err)
+		}
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logging.Default().Errorf("Error shutting down admin server: %v", err)
+		}
 	}
 
-	log.Println("Server stopped")
-}
\ No newline at end of file
+	logging.Default().Infof("Server stopped")
+}
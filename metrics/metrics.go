@@ -0,0 +1,260 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds metric families in registration order.
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+	sinks    atomic.Pointer[[]Sink]
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type family struct {
+	registry *Registry
+	name     string
+	help     string
+	kind     string
+	labels   []string
+	buckets  []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	mutex   sync.Mutex
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		registry: r,
+		name:     name,
+		help:     help,
+		kind:     kind,
+		labels:   labels,
+		buckets:  buckets,
+		series:   make(map[string]*series),
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// delete drops every series whose labels have all the values in match.
+func (f *family) delete(match map[string]string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for key, s := range f.series {
+		matches := true
+		for i, name := range f.labels {
+			if value, ok := match[name]; ok && s.labelValues[i] != value {
+				matches = false
+			}
+		}
+		if matches {
+			delete(f.series, key)
+		}
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ family *family }
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, "counter", nil, labels)}
+}
+
+// Add increases the counter for the label values by delta.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	s := c.family.with(values)
+	s.mutex.Lock()
+	s.value += delta
+	s.mutex.Unlock()
+	c.family.notify(values, func(sink Sink, labels []Label) { sink.Count(c.family.name, labels, delta) })
+}
+
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+// Delete drops the series whose labels have all the values in match.
+func (c *CounterVec) Delete(match map[string]string) { c.family.delete(match) }
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct{ family *family }
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, "gauge", nil, labels)}
+}
+
+func (g *GaugeVec) Set(value float64, values ...string) {
+	s := g.family.with(values)
+	s.mutex.Lock()
+	s.value = value
+	s.mutex.Unlock()
+	g.family.notify(values, func(sink Sink, labels []Label) { sink.Gauge(g.family.name, labels, value) })
+}
+
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	s := g.family.with(values)
+	s.mutex.Lock()
+	s.value += delta
+	value := s.value
+	s.mutex.Unlock()
+	g.family.notify(values, func(sink Sink, labels []Label) { sink.Gauge(g.family.name, labels, value) })
+}
+
+func (g *GaugeVec) Delete(match map[string]string) { g.family.delete(match) }
+
+// HistogramVec counts observations into cumulative buckets, partitioned by
+// labels.
+type HistogramVec struct{ family *family }
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	s := h.family.with(values)
+	s.mutex.Lock()
+	for i, bound := range h.family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.samples++
+	s.mutex.Unlock()
+	h.family.notify(values, func(sink Sink, labels []Label) { sink.Observe(h.family.name, labels, value) })
+}
+
+func (h *HistogramVec) Delete(match map[string]string) { h.family.delete(match) }
+
+// ServeHTTP writes every metric in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mutex.Unlock()
+
+	var out strings.Builder
+	for _, f := range families {
+		f.write(&out)
+	}
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+func (f *family) write(out *strings.Builder) {
+	f.mutex.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	all := make([]*series, len(keys))
+	for i, key := range keys {
+		all[i] = f.series[key]
+	}
+	f.mutex.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+	for _, s := range all {
+		s.mutex.Lock()
+		labels := f.formatLabels(s.labelValues, "", "")
+		if f.kind != "histogram" {
+			fmt.Fprintf(out, "%s%s %s\n", f.name, labels, formatValue(s.value))
+			s.mutex.Unlock()
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, f.formatLabels(s.labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, f.formatLabels(s.labelValues, "le", "+Inf"), s.samples)
+		fmt.Fprintf(out, "%s_sum%s %s\n", f.name, labels, formatValue(s.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", f.name, labels, s.samples)
+		s.mutex.Unlock()
+	}
+}
+
+func (f *family) formatLabels(values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(value string) string { return labelEscaper.Replace(value) }
+func escapeHelp(value string) string  { return helpEscaper.Replace(value) }
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("requests_total", "Requests served.", "code")
+	inFlight := registry.Gauge("in_flight", "Requests in flight.")
+	latency := registry.Histogram("duration_seconds", "Request latency.", []float64{0.5, 0.1}, "backend")
+
+	requests.Inc("2xx")
+	requests.Add(2, "5xx")
+	inFlight.Set(3)
+	latency.Observe(0.05, `http://a"b`)
+	latency.Observe(0.3, `http://a"b`)
+	latency.Observe(2, `http://a"b`)
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="2xx"} 1
+requests_total{code="5xx"} 2
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 3
+# HELP duration_seconds Request latency.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{backend="http://a\"b",le="0.1"} 1
+duration_seconds_bucket{backend="http://a\"b",le="0.5"} 2
+duration_seconds_bucket{backend="http://a\"b",le="+Inf"} 3
+duration_seconds_sum{backend="http://a\"b"} 2.35
+duration_seconds_count{backend="http://a\"b"} 3
+`
+	if w.Body.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nwant:\n%s", w.Body.String(), expected)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+
+	latency.Observe(1, "other")
+	latency.Delete(map[string]string{"backend": `http://a"b`})
+	w = httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), `a\"b`) || !strings.Contains(w.Body.String(), `duration_seconds_count{backend="other"} 1`) {
+		t.Errorf("Expected only the deleted series to be gone:\n%s", w.Body.String())
+	}
+}
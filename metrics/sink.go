@@ -0,0 +1,43 @@
+package metrics
+
+// Sink receives every update as it happens, for push-based systems such as
+// StatsD. Gauges are reported with their new value.
+type Sink interface {
+	Count(name string, labels []Label, delta float64)
+	Gauge(name string, labels []Label, value float64)
+	Observe(name string, labels []Label, value float64)
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// AddSink makes the registry forward all later updates to sink.
+func (r *Registry) AddSink(sink Sink) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sinks := append(append([]Sink(nil), r.loadSinks()...), sink)
+	r.sinks.Store(&sinks)
+}
+
+func (r *Registry) loadSinks() []Sink {
+	if sinks := r.sinks.Load(); sinks != nil {
+		return *sinks
+	}
+	return nil
+}
+
+func (f *family) notify(values []string, send func(sink Sink, labels []Label)) {
+	sinks := f.registry.loadSinks()
+	if len(sinks) == 0 {
+		return
+	}
+	labels := make([]Label, len(values))
+	for i, value := range values {
+		labels[i] = Label{Name: f.labels[i], Value: value}
+	}
+	for _, sink := range sinks {
+		send(sink, labels)
+	}
+}
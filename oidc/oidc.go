@@ -0,0 +1,389 @@
+// Package oidc logs users in with an OpenID Connect provider using the
+// authorization code flow and keeps them logged in with signed cookies.
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/jwt"
+	"loadbalancer/logging"
+)
+
+const (
+	defaultCookieName = "httpbalance_session"
+	defaultSessionTTL = 8 * time.Hour
+
+	// loginTTL is how long a user has to finish logging in at the
+	// provider.
+	loginTTL = 10 * time.Minute
+
+	maxResponseSize = 1 << 20
+)
+
+var defaultScopes = []string{"openid", "profile", "email"}
+
+// Config describes the client registered with the provider at Issuer.
+// RedirectURL is the registered callback; requests to its path finish the
+// login. CookieSecret signs the session cookies, which last SessionTTL
+// (8 hours by default) and keep the subject plus the Claims listed.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	CookieSecret string
+	CookieName   string
+	SessionTTL   time.Duration
+	Claims       []string
+}
+
+// Session is what a session cookie holds about the logged-in user.
+type Session struct {
+	Claims  map[string]interface{} `json:"claims"`
+	Expires int64                  `json:"exp"`
+}
+
+// Authenticator sends users without a session to the provider and turns
+// the code it sends them back with into a session.
+type Authenticator struct {
+	config     Config
+	redirect   *url.URL
+	cookieName string
+	sessionTTL time.Duration
+	key        []byte
+	client     *http.Client
+
+	mutex    sync.Mutex
+	provider *provider
+	verifier *jwt.Verifier
+}
+
+// provider is the part of the provider's discovery document we use.
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// login is kept in a short-lived cookie while the user is at the provider.
+type login struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+func New(config Config) (*Authenticator, error) {
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil || redirect.Scheme == "" || redirect.Host == "" {
+		return nil, fmt.Errorf("invalid redirect URL %q", config.RedirectURL)
+	}
+	if config.CookieSecret == "" {
+		return nil, errors.New("a cookie secret is required")
+	}
+	key := sha256.Sum256([]byte(config.CookieSecret))
+	a := &Authenticator{
+		config:     config,
+		redirect:   redirect,
+		cookieName: config.CookieName,
+		sessionTTL: config.SessionTTL,
+		key:        key[:],
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if a.cookieName == "" {
+		a.cookieName = defaultCookieName
+	}
+	if a.sessionTTL <= 0 {
+		a.sessionTTL = defaultSessionTTL
+	}
+	if len(a.config.Scopes) == 0 {
+		a.config.Scopes = defaultScopes
+	}
+	return a, nil
+}
+
+// Authenticate returns the session of r. Without one it answers the
+// request itself: the callback finishes a login, page loads are sent to
+// the provider and anything else gets a 401.
+func (a *Authenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	if r.URL.Path == a.redirect.Path {
+		a.callback(w, r)
+		return nil, false
+	}
+	if session, ok := a.session(r); ok {
+		return session, true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	a.login(w, r)
+	return nil, false
+}
+
+// Handler only lets requests with a session through to next.
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.Authenticate(w, r); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// StripCookies removes the authenticator's cookies from r, so they are not
+// passed on to backends.
+func (a *Authenticator) StripCookies(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != a.cookieName && cookie.Name != a.loginCookieName() {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func (a *Authenticator) loginCookieName() string {
+	return a.cookieName + "_login"
+}
+
+func (a *Authenticator) session(r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(a.cookieName)
+	if err != nil {
+		return nil, false
+	}
+	var session Session
+	if !a.decode(a.cookieName, cookie.Value, &session) || time.Now().Unix() >= session.Expires {
+		return nil, false
+	}
+	if sub, _ := session.Claims["sub"].(string); sub == "" {
+		return nil, false
+	}
+	return &session, true
+}
+
+func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) {
+	p, _, err := a.discover(r.Context())
+	if err != nil {
+		logging.Default().Errorf("Error discovering OpenID provider %s: %v", a.config.Issuer, err)
+		http.Error(w, "Login unavailable", http.StatusBadGateway)
+		return
+	}
+
+	l := login{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+		Return:   r.URL.RequestURI(),
+		Expires:  time.Now().Add(loginTTL).Unix(),
+	}
+	a.setCookie(w, a.loginCookieName(), a.encode(a.loginCookieName(), l), int(loginTTL/time.Second))
+
+	challenge := sha256.Sum256([]byte(l.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.config.ClientID},
+		"redirect_uri":          {a.config.RedirectURL},
+		"scope":                 {strings.Join(a.config.Scopes, " ")},
+		"state":                 {l.State},
+		"nonce":                 {l.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target := p.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (a *Authenticator) callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(a.loginCookieName())
+	var l login
+	if err != nil || !a.decode(a.loginCookieName(), cookie.Value, &l) || time.Now().Unix() >= l.Expires {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(l.State)) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		logging.Default().Warnf("OpenID provider %s refused a login: %s %s", a.config.Issuer, reason, query.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := a.exchange(r.Context(), query.Get("code"), l)
+	if err != nil {
+		logging.Default().Warnf("Error finishing login with %s: %v", a.config.Issuer, err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	session := Session{Claims: map[string]interface{}{"sub": claims["sub"]}, Expires: time.Now().Add(a.sessionTTL).Unix()}
+	for _, name := range a.config.Claims {
+		if value, ok := claims[name]; ok {
+			session.Claims[name] = value
+		}
+	}
+	a.setCookie(w, a.cookieName, a.encode(a.cookieName, session), int(a.sessionTTL/time.Second))
+	a.setCookie(w, a.loginCookieName(), "", -1)
+	http.Redirect(w, r, l.Return, http.StatusFound)
+}
+
+// exchange trades code for tokens and returns the claims of the verified
+// ID token.
+func (a *Authenticator) exchange(ctx context.Context, code string, l login) (jwt.Claims, error) {
+	p, verifier, err := a.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.config.RedirectURL},
+		"code_verifier": {l.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.config.ClientID), url.QueryEscape(a.config.ClientSecret))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint answered %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+
+	claims, err := verifier.Verify(tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verifying ID token: %w", err)
+	}
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(l.Nonce)) != 1 {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// discover fetches the provider's configuration on first use; failures are
+// retried on the next login.
+func (a *Authenticator) discover(ctx context.Context) (*provider, *jwt.Verifier, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.provider != nil {
+		return a.provider, a.verifier, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(a.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s answered %d", discoveryURL, resp.StatusCode)
+	}
+	var p provider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&p); err != nil {
+		return nil, nil, fmt.Errorf("decoding %s: %w", discoveryURL, err)
+	}
+	if p.Issuer != a.config.Issuer {
+		return nil, nil, fmt.Errorf("provider claims to be %q", p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("%s lacks endpoints", discoveryURL)
+	}
+	verifier, err := jwt.NewVerifier(jwt.Config{JWKSURL: p.JWKSURI, Issuer: p.Issuer, Audience: []string{a.config.ClientID}, Leeway: time.Minute})
+	if err != nil {
+		return nil, nil, err
+	}
+	a.provider, a.verifier = &p, verifier
+	return a.provider, a.verifier, nil
+}
+
+// setCookie sets a cookie for maxAge seconds; a negative maxAge deletes it.
+func (a *Authenticator) setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   a.redirect.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// encode serializes value and signs it with the cookie key for the cookie
+// called name, so that one cookie can't be passed off as another.
+func (a *Authenticator) encode(name string, value interface{}) string {
+	data, _ := json.Marshal(value)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.sign(name, payload))
+}
+
+func (a *Authenticator) decode(name, cookie string, out interface{}) bool {
+	payload, signature, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return false
+	}
+	expected, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, a.sign(name, payload)) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, out) == nil
+}
+
+func (a *Authenticator) sign(name, payload string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	// Signed as it is sent, name=value; a cookie name has no "=".
+	mac.Write([]byte(name + "=" + payload))
+	return mac.Sum(nil)
+}
+
+func randomString() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,203 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider issues ID tokens for whatever code it handed out last,
+// checking the PKCE verifier and client credentials.
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mutex     sync.Mutex
+	challenge string
+	nonce     string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	p := &fakeProvider{t: t}
+	p.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(provider{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC", "kid": "1", "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(p.key.X.FillBytes(make([]byte, 32))),
+			"y": base64.RawURLEncoding.EncodeToString(p.key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		// Client credentials are form-encoded before basic auth (RFC 6749).
+		user, password, _ := r.BasicAuth()
+		user, _ = url.QueryUnescape(user)
+		password, _ = url.QueryUnescape(password)
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if user != "balancer" || password != "client secret" || r.Form.Get("code") != "the-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken(map[string]interface{}{
+			"iss": p.server.URL, "aud": "balancer", "sub": "alice", "email": "alice@example.com",
+			"nonce": p.nonce, "exp": time.Now().Add(time.Hour).Unix(),
+		})})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeProvider) idToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize plays the user logging in at the provider and returns the
+// callback the browser is sent back to.
+func (p *fakeProvider) authorize(t *testing.T, location string) url.Values {
+	t.Helper()
+	target, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, p.server.URL+"/authorize?") {
+		t.Fatalf("Expected a redirect to the provider, got %q", location)
+	}
+	query := target.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("redirect_uri") != "https://app.example.com/oauth2/callback" {
+		t.Errorf("Unexpected authorization request %v", query)
+	}
+	p.mutex.Lock()
+	p.challenge, p.nonce = query.Get("code_challenge"), query.Get("nonce")
+	p.mutex.Unlock()
+	return url.Values{"code": {"the-code"}, "state": {query.Get("state")}}
+}
+
+func withCookies(req *http.Request, recorder *httptest.ResponseRecorder) *http.Request {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.MaxAge >= 0 {
+			req.AddCookie(cookie)
+		}
+	}
+	return req
+}
+
+func TestLoginFlow(t *testing.T) {
+	p := newFakeProvider(t)
+	authenticator, err := New(Config{
+		Issuer:       p.server.URL,
+		ClientID:     "balancer",
+		ClientSecret: "client secret",
+		RedirectURL:  "https://app.example.com/oauth2/callback",
+		CookieSecret: "cookie secret",
+		Claims:       []string{"email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := httptest.NewRecorder()
+	if _, ok := authenticator.Authenticate(start, httptest.NewRequest("GET", "https://app.example.com/reports?year=2024", nil)); ok {
+		t.Fatal("Expected a request without a session to be sent to the provider")
+	}
+	callback := p.authorize(t, start.Header().Get("Location"))
+
+	forged := httptest.NewRecorder()
+	forgedCallback := url.Values{"code": {"the-code"}, "state": {"guess"}}
+	authenticator.Authenticate(forged, withCookies(httptest.NewRequest("GET", "https://app.example.com/oauth2/callback?"+forgedCallback.Encode(), nil), start))
+	if forged.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback with the wrong state to fail, got %d", forged.Code)
+	}
+
+	finish := httptest.NewRecorder()
+	authenticator.Authenticate(finish, withCookies(httptest.NewRequest("GET", "https://app.example.com/oauth2/callback?"+callback.Encode(), nil), start))
+	if finish.Code != http.StatusFound || finish.Header().Get("Location") != "/reports?year=2024" {
+		t.Fatalf("Expected to be sent back to the page, got %d %q: %s", finish.Code, finish.Header().Get("Location"), finish.Body.String())
+	}
+
+	req := withCookies(httptest.NewRequest("POST", "https://app.example.com/reports", nil), finish)
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	session, ok := authenticator.Authenticate(httptest.NewRecorder(), req)
+	if !ok || session.Claims["sub"] != "alice" || session.Claims["email"] != "alice@example.com" {
+		t.Fatalf("Expected a session for alice, got %+v", session)
+	}
+	authenticator.StripCookies(req)
+	if cookies := req.Cookies(); len(cookies) != 1 || cookies[0].Name != "theme" {
+		t.Errorf("Expected only the application's cookies to be left, got %v", cookies)
+	}
+
+	tampered := httptest.NewRequest("POST", "https://app.example.com/reports", nil)
+	cookie := finish.Result().Cookies()[0]
+	cookie.Value = strings.Replace(cookie.Value, ".", "x.", 1)
+	tampered.AddCookie(cookie)
+	rejected := httptest.NewRecorder()
+	if _, ok := authenticator.Authenticate(rejected, tampered); ok || rejected.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered session to be rejected with 401, got %d", rejected.Code)
+	}
+}
+
+func TestLoginCookieIsNoSession(t *testing.T) {
+	p := newFakeProvider(t)
+	authenticator, err := New(Config{
+		Issuer:       p.server.URL,
+		ClientID:     "balancer",
+		ClientSecret: "client secret",
+		RedirectURL:  "https://app.example.com/oauth2/callback",
+		CookieSecret: "cookie secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := httptest.NewRecorder()
+	authenticator.Authenticate(start, httptest.NewRequest("GET", "https://app.example.com/", nil))
+	var login *http.Cookie
+	for _, cookie := range start.Result().Cookies() {
+		if cookie.Name == "httpbalance_session_login" {
+			login = cookie
+		}
+	}
+	if login == nil {
+		t.Fatal("Expected a login cookie")
+	}
+	replayed := httptest.NewRequest("POST", "https://app.example.com/reports", nil)
+	replayed.AddCookie(&http.Cookie{Name: "httpbalance_session", Value: login.Value})
+	rejected := httptest.NewRecorder()
+	if session, ok := authenticator.Authenticate(rejected, replayed); ok || rejected.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the login cookie to be refused as a session, got %+v", session)
+	}
+
+	anonymous := httptest.NewRequest("POST", "https://app.example.com/reports", nil)
+	anonymous.AddCookie(&http.Cookie{Name: "httpbalance_session", Value: authenticator.encode("httpbalance_session", Session{Expires: time.Now().Add(time.Hour).Unix()})})
+	if session, ok := authenticator.Authenticate(httptest.NewRecorder(), anonymous); ok {
+		t.Errorf("Expected a session without a subject to be refused, got %+v", session)
+	}
+}
@@ -1,77 +1,425 @@
 package ratelimiter
 
 import (
+	"container/list"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Limiter decides whether one more request fits. TakeN weighs the request
+// as n; zero lets it through without using any of the quota.
+type Limiter interface {
+	TakeN(n int) Result
+}
+
+// Result is a Limiter's decision on a request and the state it left the
+// limiter in, for telling clients about their quota.
+type Result struct {
+	Allowed bool
+	// Wait is how long an allowed request has to wait before it may go
+	// ahead.
+	Wait time.Duration
+	// Limit and Remaining are the requests the client gets in all and
+	// still has.
+	Limit     int
+	Remaining int
+	// Reset is when the client has its full quota again, RetryAfter when
+	// a refused request would be allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// TokenBucket holds up to capacity tokens and refills continuously at
+// rate tokens per second, which may be fractional. Each request takes a
+// token, or n with TakeN.
 type TokenBucket struct {
-	capacity     int
-	rate         int
-	tokens       int
-	lastRefill   time.Time
-	mutex        sync.Mutex
+	capacity   int
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+	mutex      sync.Mutex
 }
 
-func NewTokenBucket(capacity, rate int) *TokenBucket {
+func NewTokenBucket(capacity int, rate float64) *TokenBucket {
 	return &TokenBucket{
 		capacity:   capacity,
 		rate:       rate,
-		tokens:     capacity,
+		tokens:     float64(capacity),
 		lastRefill: time.Now(),
 	}
 }
 
 func (tb *TokenBucket) refill() {
 	now := time.Now()
-	elapsed := now.Sub(tb.lastRefill)
-	tokensToAdd := int(elapsed.Seconds()) * tb.rate
-
-	if tokensToAdd > 0 {
-		if tb.tokens+tokensToAdd > tb.capacity {
-			tb.tokens = tb.capacity
-		} else {
-			tb.tokens += tokensToAdd
-		}
-		tb.lastRefill = now
-	}
+	tb.tokens = math.Min(float64(tb.capacity), tb.tokens+now.Sub(tb.lastRefill).Seconds()*tb.rate)
+	tb.lastRefill = now
 }
 
 func (tb *TokenBucket) Allow() bool {
+	return tb.Take().Allowed
+}
+
+func (tb *TokenBucket) Take() Result {
+	return tb.TakeN(1)
+}
+
+func (tb *TokenBucket) TakeN(n int) Result {
 	tb.mutex.Lock()
 	defer tb.mutex.Unlock()
 
 	tb.refill()
 
-	if tb.tokens > 0 {
-		tb.tokens--
-		return true
+	result := Result{Limit: tb.capacity}
+	if tb.tokens >= float64(n) {
+		tb.tokens -= float64(n)
+		result.Allowed = true
+	}
+	result.Remaining = int(tb.tokens)
+	result.Reset = tb.until(float64(tb.capacity))
+	if !result.Allowed {
+		result.RetryAfter = tb.until(float64(n))
+	}
+	return result
+}
+
+// until returns how long the bucket takes to refill to tokens.
+func (tb *TokenBucket) until(tokens float64) time.Duration {
+	if tb.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// SlidingWindow allows limit requests in any window. It keeps counts for
+// the current and the previous fixed window and weighs the previous one by
+// how much of it still overlaps the sliding window, which smooths the
+// bursts at window edges a fixed window allows.
+type SlidingWindow struct {
+	limit    int
+	window   time.Duration
+	start    time.Time
+	current  int
+	previous int
+	mutex    sync.Mutex
+}
+
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{limit: limit, window: window, start: time.Now()}
+}
+
+func (sw *SlidingWindow) Take() Result {
+	return sw.TakeN(1)
+}
+
+func (sw *SlidingWindow) TakeN(n int) Result {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(sw.start); elapsed >= sw.window {
+		if elapsed < 2*sw.window {
+			sw.previous = sw.current
+		} else {
+			sw.previous = 0
+		}
+		sw.current = 0
+		sw.start = sw.start.Add(elapsed / sw.window * sw.window)
+	}
+
+	result := Result{Limit: sw.limit}
+	overlap := 1 - float64(now.Sub(sw.start))/float64(sw.window)
+	count := float64(sw.previous)*overlap + float64(sw.current)
+	room := sw.limit - max(n-1, 0)
+	if n == 0 || count < float64(room) {
+		sw.current += n
+		count += float64(n)
+		result.Allowed = true
+	}
+	if remaining := float64(sw.limit) - count; remaining > 0 {
+		result.Remaining = int(remaining)
+	}
+	// The current window's requests count in full until it ends, and for
+	// a while into the next.
+	untilEnd := sw.start.Add(sw.window).Sub(now)
+	if sw.current > 0 {
+		result.Reset = untilEnd + sw.window
+	} else if sw.previous > 0 {
+		result.Reset = untilEnd
+	}
+	if !result.Allowed {
+		result.RetryAfter = sw.retryAfter(room, overlap, untilEnd)
+	}
+	return result
+}
+
+// retryAfter returns when the weighed count drops below room again.
+func (sw *SlidingWindow) retryAfter(room int, overlap float64, untilEnd time.Duration) time.Duration {
+	if sw.current < room && sw.previous > 0 {
+		// previous * (overlap - t/window) + current < room
+		t := (overlap - float64(room-sw.current)/float64(sw.previous)) * float64(sw.window)
+		if t >= 0 && time.Duration(t) < untilEnd {
+			return time.Duration(t) + time.Millisecond
+		}
+	}
+	if sw.current == 0 {
+		return untilEnd + time.Millisecond
+	}
+	// In the next window, the current one is weighed down over time.
+	t := (1 - float64(room)/float64(sw.current)) * float64(sw.window)
+	return untilEnd + time.Duration(max(t, 0)) + time.Millisecond
+}
+
+// LeakyBucket lets requests through at an even rate per second, making
+// those that arrive faster wait their turn. At most capacity requests wait
+// at a time; more are turned away. With TakeN a request counts as n, and
+// the ones after it wait for as long.
+type LeakyBucket struct {
+	capacity int
+	interval time.Duration
+	next     time.Time
+	mutex    sync.Mutex
+}
+
+func NewLeakyBucket(capacity int, rate float64) *LeakyBucket {
+	return &LeakyBucket{capacity: capacity, interval: time.Duration(float64(time.Second) / rate)}
+}
+
+func (lb *LeakyBucket) Take() Result {
+	return lb.TakeN(1)
+}
+
+func (lb *LeakyBucket) TakeN(n int) Result {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	now := time.Now()
+	if lb.next.Before(now) {
+		lb.next = now
+	}
+	result := Result{Limit: lb.capacity + 1, Wait: lb.next.Sub(now)}
+	full := time.Duration(lb.capacity-max(n-1, 0)) * lb.interval
+	if n == 0 {
+		result.Wait = 0
+		result.Allowed = true
+	} else if result.Wait <= full {
+		lb.next = lb.next.Add(time.Duration(n) * lb.interval)
+		result.Allowed = true
+	} else {
+		result.Wait = 0
+		result.RetryAfter = lb.next.Sub(now) - full
+	}
+	result.Reset = lb.next.Sub(now)
+	if queued := int((result.Reset + lb.interval - 1) / lb.interval); queued <= lb.capacity {
+		result.Remaining = lb.capacity + 1 - queued
+	}
+	return result
+}
+
+// Store keeps token buckets shared by several balancers, such as in Redis.
+// Take takes n tokens from the bucket at key.
+type Store interface {
+	Take(key string, capacity int, rate float64, n int) (Result, error)
+}
+
+// SharedTokenBucket is a token bucket kept in a Store, so that every
+// balancer using the store draws from the same bucket. While the store
+// fails, a local bucket stands in for it.
+type SharedTokenBucket struct {
+	store    Store
+	key      string
+	capacity int
+	rate     float64
+	local    *TokenBucket
+}
+
+func NewSharedTokenBucket(store Store, key string, capacity int, rate float64) *SharedTokenBucket {
+	return &SharedTokenBucket{store: store, key: key, capacity: capacity, rate: rate, local: NewTokenBucket(capacity, rate)}
+}
+
+func (sb *SharedTokenBucket) Take() Result {
+	return sb.TakeN(1)
+}
+
+func (sb *SharedTokenBucket) TakeN(n int) Result {
+	result, err := sb.store.Take(sb.key, sb.capacity, sb.rate, n)
+	if err != nil {
+		return sb.local.TakeN(n)
 	}
-	return false
+	return result
 }
 
+// RateLimiter keeps a limiter per client. Clients idle for longer than
+// the idle TTL are forgotten by a janitor, and past the maximum number of
+// clients one not seen recently is, so memory stays bounded however many
+// clients come and go. A forgotten client starts over with a fresh
+// limiter.
+//
+// Known clients are looked up without locking. Only adding and forgetting
+// clients takes the mutex, so each client gets exactly one limiter however
+// many of its requests arrive at once.
 type RateLimiter struct {
-	buckets map[string]*TokenBucket
-	mutex   sync.RWMutex
+	buckets    sync.Map   // client ID to *entry
+	clients    *list.List // of *entry, guarded by mutex
+	newLimiter func(clientID string) Limiter
+	idleTTL    time.Duration
+	maxClients int
+	mutex      sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-func NewRateLimiter() *RateLimiter {
-	return &RateLimiter{
-		buckets: make(map[string]*TokenBucket),
+// entry is a client's limiter. Clients are evicted by the second-chance
+// algorithm: seen is set by every request and cleared when the client is
+// passed over for eviction, which approximates least recently used
+// without reordering clients on every request.
+type entry struct {
+	clientID   string
+	limiter    Limiter
+	lastAccess atomic.Int64 // Unix nanoseconds
+	seen       atomic.Bool
+	element    *list.Element
+}
+
+func (e *entry) touch(now time.Time) {
+	e.lastAccess.Store(now.UnixNano())
+	e.seen.Store(true)
+}
+
+// Option configures a RateLimiter.
+type Option func(*RateLimiter)
+
+// WithIdleTTL forgets clients after ttl without requests.
+func WithIdleTTL(ttl time.Duration) Option {
+	return func(rl *RateLimiter) {
+		rl.idleTTL = ttl
 	}
 }
 
-func (rl *RateLimiter) Allow(clientID string, capacity, rate int) bool {
-	rl.mutex.RLock()
-	bucket, exists := rl.buckets[clientID]
-	rl.mutex.RUnlock()
+// WithMaxClients keeps at most n clients.
+func WithMaxClients(n int) Option {
+	return func(rl *RateLimiter) {
+		rl.maxClients = n
+	}
+}
 
-	if !exists {
-		rl.mutex.Lock()
-		bucket = NewTokenBucket(capacity, rate)
-		rl.buckets[clientID] = bucket
-		rl.mutex.Unlock()
+// NewRateLimiter returns a RateLimiter giving clients token buckets, see
+// Allow.
+func NewRateLimiter(options ...Option) *RateLimiter {
+	return NewRateLimiterWith(nil, options...)
+}
+
+// NewRateLimiterWith returns a RateLimiter giving each client a limiter
+// from newLimiter, see Take.
+func NewRateLimiterWith(newLimiter func(clientID string) Limiter, options ...Option) *RateLimiter {
+	rl := &RateLimiter{
+		clients:    list.New(),
+		newLimiter: newLimiter,
+		stop:       make(chan struct{}),
+	}
+	for _, option := range options {
+		option(rl)
 	}
+	if rl.idleTTL > 0 {
+		go rl.janitor()
+	}
+	return rl
+}
+
+// Close stops the janitor.
+func (rl *RateLimiter) Close() {
+	rl.stopOnce.Do(func() { close(rl.stop) })
+}
 
-	return bucket.Allow()
-}
\ No newline at end of file
+func (rl *RateLimiter) janitor() {
+	ticker := time.NewTicker(max(rl.idleTTL/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case now := <-ticker.C:
+			rl.evictIdle(now)
+		}
+	}
+}
+
+func (rl *RateLimiter) evictIdle(now time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	for element := rl.clients.Front(); element != nil; {
+		e := element.Value.(*entry)
+		element = element.Next()
+		if now.Sub(time.Unix(0, e.lastAccess.Load())) >= rl.idleTTL {
+			rl.remove(e)
+		}
+	}
+}
+
+// evictOne forgets a client other than added, giving those seen since
+// they were last passed over a second chance. The caller holds rl.mutex.
+func (rl *RateLimiter) evictOne(added *entry) {
+	for {
+		e := rl.clients.Back().Value.(*entry)
+		if e == added || e.seen.Swap(false) {
+			rl.clients.MoveToFront(e.element)
+			continue
+		}
+		rl.remove(e)
+		return
+	}
+}
+
+func (rl *RateLimiter) remove(e *entry) {
+	rl.clients.Remove(e.element)
+	rl.buckets.Delete(e.clientID)
+}
+
+// Len returns the number of clients kept.
+func (rl *RateLimiter) Len() int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.clients.Len()
+}
+
+func (rl *RateLimiter) limiter(clientID string, newLimiter func(clientID string) Limiter) Limiter {
+	now := time.Now()
+	if value, ok := rl.buckets.Load(clientID); ok {
+		e := value.(*entry)
+		e.touch(now)
+		return e.limiter
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	// Another request of the client may have added it in the meantime.
+	if value, ok := rl.buckets.Load(clientID); ok {
+		e := value.(*entry)
+		e.touch(now)
+		return e.limiter
+	}
+	e := &entry{clientID: clientID, limiter: newLimiter(clientID)}
+	e.lastAccess.Store(now.UnixNano())
+	e.element = rl.clients.PushFront(e)
+	rl.buckets.Store(clientID, e)
+	if rl.maxClients > 0 && rl.clients.Len() > rl.maxClients {
+		rl.evictOne(e)
+	}
+	return e.limiter
+}
+
+func (rl *RateLimiter) Allow(clientID string, capacity int, rate float64) bool {
+	return rl.limiter(clientID, func(string) Limiter { return NewTokenBucket(capacity, rate) }).TakeN(1).Allowed
+}
+
+// Take takes from clientID's limiter, see Limiter.
+func (rl *RateLimiter) Take(clientID string) Result {
+	return rl.TakeN(clientID, 1)
+}
+
+// TakeN takes n from clientID's limiter, see Limiter.
+func (rl *RateLimiter) TakeN(clientID string, n int) Result {
+	return rl.limiter(clientID, rl.newLimiter).TakeN(n)
+}
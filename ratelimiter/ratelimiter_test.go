@@ -1,28 +1,191 @@
 package ratelimiter
 
 import (
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConcurrentRateLimiter(t *testing.T) {
 	rl := NewRateLimiter()
 	clientID := "test-client"
 	var wg sync.WaitGroup
-	allowed := 0
+	var allowed atomic.Int32
 
 	for i := 0; i < 100; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			if rl.Allow(clientID, 10, 1) {
-				allowed++
+				allowed.Add(1)
 			}
 		}()
 	}
 
 	wg.Wait()
-	if allowed != 10 {
-		t.Errorf("Expected exactly 10 allowed requests, got %d", allowed)
+	if allowed.Load() != 10 {
+		t.Errorf("Expected exactly 10 allowed requests, got %d", allowed.Load())
 	}
-}
\ No newline at end of file
+}
+
+func TestConcurrentFirstRequestsShareALimiter(t *testing.T) {
+	var created atomic.Int32
+	rl := NewRateLimiterWith(func(string) Limiter {
+		created.Add(1)
+		return NewTokenBucket(10, 1)
+	})
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if rl.Take("client").Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if created.Load() != 1 {
+		t.Errorf("Expected one limiter for the client, %d were created", created.Load())
+	}
+	if allowed.Load() != 10 {
+		t.Errorf("Expected exactly 10 allowed requests, got %d", allowed.Load())
+	}
+}
+
+func TestConcurrentEviction(t *testing.T) {
+	rl := NewRateLimiter(WithIdleTTL(time.Minute), WithMaxClients(10))
+	defer rl.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				rl.Allow(strconv.Itoa((i*500+j)%50), 5, 1)
+				if j%100 == 0 {
+					rl.evictIdle(time.Now())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rl.Len() > 10 {
+		t.Errorf("Expected at most 10 clients, got %d", rl.Len())
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	sw := NewSlidingWindow(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if !sw.Take().Allowed {
+			t.Fatalf("Expected request %d within the limit to pass", i+1)
+		}
+	}
+	if sw.Take().Allowed {
+		t.Error("Expected the request over the limit to be refused")
+	}
+
+	// Halfway into the next window, half of the previous one still counts.
+	sw.start = sw.start.Add(-time.Hour - 30*time.Minute)
+	passed := 0
+	for i := 0; i < 3; i++ {
+		if sw.Take().Allowed {
+			passed++
+		}
+	}
+	if passed != 2 {
+		t.Errorf("Expected 2 requests to pass with 1.5 of 3 still counted, got %d", passed)
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	lb := NewLeakyBucket(2, 10)
+	var waits []time.Duration
+	for i := 0; i < 4; i++ {
+		result := lb.Take()
+		if !result.Allowed {
+			break
+		}
+		waits = append(waits, result.Wait)
+	}
+	if len(waits) != 3 {
+		t.Fatalf("Expected one request to go and two to wait, got %v", waits)
+	}
+	if waits[0] != 0 || waits[1] < 90*time.Millisecond || waits[2] < 190*time.Millisecond {
+		t.Errorf("Expected requests to be spaced 100ms apart, got %v", waits)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	rl := NewRateLimiter(WithIdleTTL(time.Minute), WithMaxClients(2))
+	defer rl.Close()
+
+	rl.Allow("a", 1, 1)
+	rl.Allow("b", 1, 1)
+	rl.Allow("a", 1, 1)
+	rl.Allow("c", 1, 1)
+	if rl.Len() != 2 {
+		t.Fatalf("Expected at most 2 clients, got %d", rl.Len())
+	}
+	if rl.Allow("a", 1, 1) {
+		t.Error("Expected a recently seen client to keep its bucket")
+	}
+	if !rl.Allow("b", 1, 1) {
+		t.Error("Expected the least recently seen client to start over")
+	}
+
+	rl.evictIdle(time.Now().Add(time.Minute))
+	if rl.Len() != 0 {
+		t.Errorf("Expected idle clients to be forgotten, %d left", rl.Len())
+	}
+}
+
+func TestTokenBucketFractionalRate(t *testing.T) {
+	tb := NewTokenBucket(1, 0.5)
+	if !tb.Take().Allowed {
+		t.Fatal("Expected the first request to take the only token")
+	}
+	result := tb.Take()
+	if result.Allowed || result.RetryAfter < 1900*time.Millisecond || result.RetryAfter > 2*time.Second {
+		t.Errorf("Expected to wait about 2s for half a token a second, got %+v", result)
+	}
+
+	tb.lastRefill = tb.lastRefill.Add(-1500 * time.Millisecond)
+	if tb.Take().Allowed {
+		t.Error("Expected 0.75 tokens not to be enough")
+	}
+	tb.lastRefill = tb.lastRefill.Add(-500 * time.Millisecond)
+	if !tb.Take().Allowed {
+		t.Error("Expected a token after 2s")
+	}
+}
+
+func TestTakeN(t *testing.T) {
+	for name, limiter := range map[string]Limiter{
+		"token_bucket":   NewTokenBucket(4, 1),
+		"sliding_window": NewSlidingWindow(4, time.Minute),
+		"leaky_bucket":   NewLeakyBucket(3, 1000),
+	} {
+		if !limiter.TakeN(3).Allowed {
+			t.Errorf("%s: Expected a request costing 3 of 4 to pass", name)
+		}
+		if limiter.TakeN(2).Allowed {
+			t.Errorf("%s: Expected a request costing 2 not to fit in the 1 left", name)
+		}
+		if !limiter.TakeN(0).Allowed {
+			t.Errorf("%s: Expected a request costing nothing to pass", name)
+		}
+		if !limiter.TakeN(1).Allowed {
+			t.Errorf("%s: Expected a request costing 1 to take the last of the quota", name)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package redis is a minimal Redis client: enough of RESP to run commands
+// and Lua scripts over a small pool of connections.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = 100 * time.Millisecond
+	maxIdle        = 8
+)
+
+// Config selects the server. Timeout bounds connecting and every command
+// (default 100ms), so a slow Redis cannot hold up requests for long.
+type Config struct {
+	Address  string
+	Password string
+	DB       int
+	Timeout  time.Duration
+}
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Client runs commands, reusing up to maxIdle connections.
+type Client struct {
+	config Config
+	idle   chan *conn
+}
+
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func New(config Config) *Client {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Client{config: config, idle: make(chan *conn, maxIdle)}
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, "tcp", c.config.Address)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, reader: bufio.NewReader(nc)}
+	if c.config.Password != "" {
+		if _, err := cn.do(c.config.Timeout, "AUTH", c.config.Password); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	if c.config.DB != 0 {
+		if _, err := cn.do(c.config.Timeout, "SELECT", strconv.Itoa(c.config.DB)); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("SELECT: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+// Do runs a command and returns its reply: a string, an int64, nil or a
+// []interface{} of those. Error replies are returned as Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	var cn *conn
+	select {
+	case cn = <-c.idle:
+	default:
+		var err error
+		if cn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := cn.do(c.config.Timeout, args...)
+	var serverError Error
+	if err != nil && !errors.As(err, &serverError) {
+		// The connection may be halfway through a reply.
+		cn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+	return reply, err
+}
+
+func (cn *conn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	cn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(cn, b.String()); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+func (cn *conn) read() (interface{}, error) {
+	line, err := cn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			// Error replies inside arrays are values, not failures.
+			value, err := cn.read()
+			var serverError Error
+			if errors.As(err, &serverError) {
+				value, err = serverError, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// Script is a Lua script run by its SHA1, so it is only sent to the
+// server when the server does not have it cached yet.
+type Script struct {
+	source string
+	sha1   string
+}
+
+func NewScript(source string) *Script {
+	sum := sha1.Sum([]byte(source))
+	return &Script{source: source, sha1: hex.EncodeToString(sum[:])}
+}
+
+// Run runs the script with keys and args.
+func (s *Script) Run(ctx context.Context, c *Client, keys []string, args ...string) (interface{}, error) {
+	command := append([]string{"EVALSHA", s.sha1, strconv.Itoa(len(keys))}, keys...)
+	reply, err := c.Do(ctx, append(command, args...)...)
+	if serverError := (Error("")); errors.As(err, &serverError) && strings.HasPrefix(string(serverError), "NOSCRIPT") {
+		command[0], command[1] = "EVAL", s.source
+		reply, err = c.Do(ctx, append(command, args...)...)
+	}
+	return reply, err
+}
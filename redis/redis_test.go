@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer answers a handful of commands the way Redis does.
+type fakeServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	commands [][]string
+	scripts  map[string]bool
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: listener, scripts: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			reader.ReadString('\n')
+			arg, _ := reader.ReadString('\n')
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, args)
+		s.mutex.Unlock()
+
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[1] != "secret" {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case "EVALSHA":
+			if !s.scripts[args[1]] {
+				fmt.Fprint(conn, "-NOSCRIPT No matching script\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "*2\r\n:1\r\n$5\r\nhello\r\n")
+		case "EVAL":
+			s.scripts[NewScript(args[1]).sha1] = true
+			fmt.Fprint(conn, "*2\r\n:1\r\n$5\r\nhello\r\n")
+		case "GET":
+			fmt.Fprint(conn, "$-1\r\n")
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := newFakeServer(t)
+	client := New(Config{Address: server.listener.Addr().String(), Password: "secret"})
+	defer client.Close()
+
+	if reply, err := client.Do(context.Background(), "GET", "missing"); err != nil || reply != nil {
+		t.Errorf("Expected a nil reply, got %v, %v", reply, err)
+	}
+	if _, err := client.Do(context.Background(), "FLUSHALL"); err == nil || !strings.HasPrefix(err.Error(), "ERR") {
+		t.Errorf("Expected the error reply, got %v", err)
+	}
+
+	script := NewScript("return {1, 'hello'}")
+	for i := 0; i < 2; i++ {
+		reply, err := script.Run(context.Background(), client, []string{"key"}, "arg")
+		values, ok := reply.([]interface{})
+		if err != nil || !ok || len(values) != 2 || values[0] != int64(1) || values[1] != "hello" {
+			t.Fatalf("Unexpected script reply %#v, %v", reply, err)
+		}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	var names []string
+	for _, command := range server.commands {
+		names = append(names, command[0])
+	}
+	// One connection is reused throughout, so AUTH is sent once, and the
+	// script is only sent the first time.
+	if got := strings.Join(names, " "); got != "AUTH GET FLUSHALL EVALSHA EVAL EVALSHA" {
+		t.Errorf("Unexpected commands %s", got)
+	}
+}
+
+func TestClientWrongPassword(t *testing.T) {
+	server := newFakeServer(t)
+	client := New(Config{Address: server.listener.Addr().String(), Password: "wrong"})
+	defer client.Close()
+
+	if _, err := client.Do(context.Background(), "GET", "key"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected AUTH to fail, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+
+	"loadbalancer/loadbalancer"
+	"loadbalancer/logging"
+)
+
+// reloadConfig re-reads the config file and applies it to the running
+// listeners, matched by port. Ports are bound at startup, so adding or
+// removing listeners and moving the admin port still require a restart, as
+// do the other process-wide settings of started. The reload and every
+// listener it changes are recorded in audit on behalf of actor.
+func reloadConfig(listeners []*listener, started loadbalancer.Config, path, format, actor string, audit *loadbalancer.AuditLog) error {
+	config, err := loadConfig(path, format)
+	if err != nil {
+		return err
+	}
+	audit.Record(loadbalancer.AuditEvent{Actor: actor, Action: loadbalancer.AuditConfigReloaded, Target: path})
+
+	if config.AdminPort != started.AdminPort {
+		logging.Default().Warnf("Admin port change in %s is ignored until restart", path)
+	}
+	if config.LogLevel != started.LogLevel {
+		logging.Default().Warnf("Log level change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.LogOutput, started.LogOutput) {
+		logging.Default().Warnf("Log output change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.AccessLog, started.AccessLog) {
+		logging.Default().Warnf("Access log change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.AuditLog, started.AuditLog) {
+		logging.Default().Warnf("Audit log change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.Tracing, started.Tracing) {
+		logging.Default().Warnf("Tracing change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.StatusPage, started.StatusPage) {
+		logging.Default().Warnf("Status page change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.StatsD, started.StatsD) {
+		logging.Default().Warnf("StatsD change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.ACME, started.ACME) {
+		logging.Default().Warnf("ACME change in %s is ignored until restart", path)
+	}
+	if !reflect.DeepEqual(config.AdminOIDC, started.AdminOIDC) {
+		logging.Default().Warnf("Admin OIDC change in %s is ignored until restart", path)
+	}
+	if config.DebugEndpoints != started.DebugEndpoints {
+		logging.Default().Warnf("Debug endpoints change in %s is ignored until restart", path)
+	}
+
+	running := make(map[string]*listener, len(listeners))
+	for _, l := range listeners {
+		running[l.port] = l
+	}
+
+	for _, listenerConfig := range config.ListenerConfigs() {
+		l, ok := running[listenerConfig.Port]
+		if !ok {
+			logging.Default().Warnf("New listener on port %s is ignored until restart", listenerConfig.Port)
+			continue
+		}
+		delete(running, listenerConfig.Port)
+		if l.mode != listenerConfig.Mode {
+			logging.Default().Warnf("Mode change for port %s in %s is ignored until restart", l.port, path)
+		}
+		if !reflect.DeepEqual(l.tls, listenerConfig.TLS) {
+			logging.Default().Warnf("TLS change for port %s in %s is ignored until restart", l.port, path)
+		}
+		if !reflect.DeepEqual(l.http3, listenerConfig.HTTP3) {
+			logging.Default().Warnf("HTTP/3 change for port %s in %s is ignored until restart", l.port, path)
+		}
+		if maxConcurrentStreams(l.http2) != maxConcurrentStreams(listenerConfig.HTTP2) {
+			logging.Default().Warnf("HTTP/2 max_concurrent_streams change for port %s in %s is ignored until restart", l.port, path)
+		}
+		if before := l.lb.Config(); !reflect.DeepEqual(before, listenerConfig) {
+			audit.Record(loadbalancer.AuditEvent{
+				Actor:    actor,
+				Action:   loadbalancer.AuditListenerReloaded,
+				Listener: l.port,
+				Before:   before.Redacted(),
+				After:    listenerConfig.Redacted(),
+			})
+		}
+		l.lb.Reload(listenerConfig)
+	}
+	for port := range running {
+		logging.Default().Warnf("Listener on port %s was removed from %s but keeps running until restart", port, path)
+	}
+
+	logging.Default().Infof("Configuration reloaded from %s", path)
+	return nil
+}
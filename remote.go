@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadbalancer/logging"
+)
+
+const (
+	remoteWaitTime     = 5 * time.Minute
+	remotePollInterval = 10 * time.Second
+	remoteRetryDelay   = 5 * time.Second
+)
+
+// remoteSource is a config stored in a KV store instead of a local file.
+// fetch returns the value together with the store's change index; when
+// waitIndex is non-zero it waits until the value changes past that index
+// (or until the store's wait time elapses), giving up once ctx is done.
+type remoteSource interface {
+	fetch(ctx context.Context, waitIndex uint64) ([]byte, uint64, error)
+}
+
+// newRemoteSource returns the KV source for consul://host:port/key and
+// etcd://host:port/key config locations, or nil for local files.
+func newRemoteSource(location string) remoteSource {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil
+	}
+	switch parsed.Scheme {
+	case "consul":
+		return &consulSource{
+			client: &http.Client{Timeout: remoteWaitTime + 30*time.Second},
+			host:   parsed.Host,
+			key:    strings.TrimPrefix(parsed.Path, "/"),
+			token:  os.Getenv("CONSUL_HTTP_TOKEN"),
+		}
+	case "etcd":
+		return &etcdSource{
+			client:       &http.Client{Timeout: 30 * time.Second},
+			host:         parsed.Host,
+			key:          parsed.Path,
+			pollInterval: remotePollInterval,
+		}
+	default:
+		return nil
+	}
+}
+
+// watchRemoteConfig calls reload every time the remote value changes until
+// stop is closed.
+func watchRemoteConfig(source remoteSource, reload func(), stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var index uint64
+	for {
+		started := time.Now()
+		_, changed, err := source.fetch(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.Default().Warnf("Error watching remote config: %v", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(remoteRetryDelay):
+			}
+			continue
+		}
+		// Blocking queries don't wait on an index of 0, which a store that
+		// was just reset may answer with.
+		changed = max(changed, 1)
+		switch {
+		case changed < index:
+			// An index that goes backwards means the store's state was
+			// reset, e.g. after a Consul leader change; the value may have
+			// changed with it, and blocking queries have to start over
+			// from 0.
+			reload()
+			index = 0
+			continue
+		case changed == index:
+			// A query that comes back unchanged well before the store's
+			// wait time did not block, and is not repeated right away.
+			select {
+			case <-stop:
+				return
+			case <-time.After(remoteRetryDelay - time.Since(started)):
+			}
+		case index != 0:
+			reload()
+		}
+		index = changed
+	}
+}
+
+// consulSource reads a key from the Consul KV HTTP API and waits for
+// changes with blocking queries.
+type consulSource struct {
+	client *http.Client
+	host   string
+	key    string
+	token  string
+}
+
+func (s *consulSource) fetch(ctx context.Context, waitIndex uint64) ([]byte, uint64, error) {
+	query := url.Values{"raw": {""}}
+	if waitIndex > 0 {
+		query.Set("index", strconv.FormatUint(waitIndex, 10))
+		query.Set("wait", remoteWaitTime.String())
+	}
+	endpoint := fmt.Sprintf("http://%s/v1/kv/%s?%s", s.host, s.key, query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned status %d for key %s", resp.StatusCode, s.key)
+	}
+
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul response has no valid X-Consul-Index: %w", err)
+	}
+	return data, index, nil
+}
+
+// etcdSource reads a key through the etcd v3 JSON gateway. The gateway has
+// no long-polling range call, so changes are detected by polling the key's
+// mod_revision.
+type etcdSource struct {
+	client       *http.Client
+	host         string
+	key          string
+	pollInterval time.Duration
+}
+
+type etcdRangeResponse struct {
+	KVs []struct {
+		Value       string `json:"value"`
+		ModRevision string `json:"mod_revision"`
+	} `json:"kvs"`
+}
+
+func (s *etcdSource) fetch(ctx context.Context, waitIndex uint64) ([]byte, uint64, error) {
+	for {
+		data, revision, err := s.get(ctx)
+		if err != nil || waitIndex == 0 || revision != waitIndex {
+			return data, revision, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+func (s *etcdSource) get(ctx context.Context) ([]byte, uint64, error) {
+	body, err := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/v3/kv/range", s.host), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd returned status %d for key %s", resp.StatusCode, s.key)
+	}
+
+	var decoded etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, 0, err
+	}
+	if len(decoded.KVs) == 0 {
+		return nil, 0, fmt.Errorf("etcd key %s not found", s.key)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(decoded.KVs[0].Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, err := strconv.ParseUint(decoded.KVs[0].ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, revision, nil
+}
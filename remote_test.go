@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves a single KV key and honors blocking queries.
+type fakeConsul struct {
+	mutex   sync.Mutex
+	value   string
+	index   uint64
+	changed chan struct{}
+}
+
+func (c *fakeConsul) set(value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.value = value
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	index, changed := c.index, c.changed
+	c.mutex.Unlock()
+
+	if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait != 0 && wait == index {
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	w.Write([]byte(c.value))
+}
+
+func TestConsulConfigSource(t *testing.T) {
+	consul := &fakeConsul{changed: make(chan struct{})}
+	consul.set(`{"port": "8080", "backends": ["http://a:80"]}`)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	location := "consul://" + strings.TrimPrefix(server.URL, "http://") + "/httpbalance/config"
+	config, err := loadConfig(location, "")
+	if err != nil {
+		t.Fatalf("Error loading config from consul: %v", err)
+	}
+	if config.Port != "8080" {
+		t.Errorf("Expected port from consul, got %q", config.Port)
+	}
+
+	reloads := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchRemoteConfig(newRemoteSource(location), func() { reloads <- struct{}{} }, stop)
+
+	time.Sleep(50 * time.Millisecond)
+	consul.set(`{"port": "8080", "backends": ["http://b:80"]}`)
+
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a reload after the consul key changed")
+	}
+}
+
+func TestEtcdConfigSource(t *testing.T) {
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Key string `json:"key"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		key, _ := base64.StdEncoding.DecodeString(request.Key)
+		if r.URL.Path != "/v3/kv/range" || string(key) != "/httpbalance/config.yaml" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		value := base64.StdEncoding.EncodeToString([]byte("port: \"9090\"\nbackends: [\"http://a:80\"]\n"))
+		w.Write([]byte(`{"kvs": [{"value": "` + value + `", "mod_revision": "7"}]}`))
+	}))
+	defer etcd.Close()
+
+	config, err := loadConfig("etcd://"+strings.TrimPrefix(etcd.URL, "http://")+"/httpbalance/config.yaml", "")
+	if err != nil {
+		t.Fatalf("Error loading config from etcd: %v", err)
+	}
+	if config.Port != "9090" {
+		t.Errorf("Expected port from etcd, got %q", config.Port)
+	}
+}
+
+func TestConsulIndexGoingBackwards(t *testing.T) {
+	consul := &fakeConsul{changed: make(chan struct{})}
+	for i := 0; i < 5; i++ {
+		consul.set(`{"port": "8080", "backends": ["http://a:80"]}`)
+	}
+	var (
+		mutex   sync.Mutex
+		indexes []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		indexes = append(indexes, r.URL.Query().Get("index"))
+		mutex.Unlock()
+		consul.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	reloads := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchRemoteConfig(newRemoteSource("consul://"+strings.TrimPrefix(server.URL, "http://")+"/httpbalance/config"), func() { reloads <- struct{}{} }, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	// A new leader that is behind answers with a lower index.
+	consul.mutex.Lock()
+	consul.index = 2
+	close(consul.changed)
+	consul.changed = make(chan struct{})
+	consul.mutex.Unlock()
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a reload once the consul index went backwards")
+	}
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(indexes) < 3 || strings.Join(indexes[:3], ",") != ",5," {
+		t.Errorf("Expected the blocking queries to start over from index 0, got %q", indexes)
+	}
+}
+
+func TestConsulIndexZeroDoesNotSpin(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		indexes []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		indexes = append(indexes, r.URL.Query().Get("index"))
+		mutex.Unlock()
+		// A store that was just reset answers right away with index 0.
+		w.Header().Set("X-Consul-Index", "0")
+		w.Write([]byte(`{"port": "8080", "backends": ["http://a:80"]}`))
+	}))
+	defer server.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchRemoteConfig(newRemoteSource("consul://"+strings.TrimPrefix(server.URL, "http://")+"/httpbalance/config"), func() {
+		t.Error("Expected no reload while the index stays the same")
+	}, stop)
+	time.Sleep(200 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(indexes, ",") != ",1" {
+		t.Errorf("Expected one blocking query at index 1 and then a pause, got %q", indexes)
+	}
+}
+
+func TestEtcdWatchStopsDuringPoll(t *testing.T) {
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := base64.StdEncoding.EncodeToString([]byte(`port: "9090"`))
+		w.Write([]byte(`{"kvs": [{"value": "` + value + `", "mod_revision": "7"}]}`))
+	}))
+	defer etcd.Close()
+
+	source := newRemoteSource("etcd://" + strings.TrimPrefix(etcd.URL, "http://") + "/httpbalance/config.yaml").(*etcdSource)
+	source.pollInterval = time.Hour
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchRemoteConfig(source, func() {}, stop)
+		close(stopped)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the watch to stop without waiting out the poll interval")
+	}
+}
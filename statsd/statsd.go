@@ -0,0 +1,205 @@
+// Package statsd pushes metrics to a StatsD or DogStatsD agent over UDP. It
+// implements metrics.Sink, so every update of the registry is forwarded as
+// it happens.
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/logging"
+	"loadbalancer/metrics"
+)
+
+const (
+	FlavorDogStatsD = "dogstatsd"
+	FlavorStatsD    = "statsd"
+
+	flushInterval = time.Second
+	// maxPacketSize keeps packets below the usual Ethernet MTU.
+	maxPacketSize = 1432
+)
+
+// Config selects the agent. Prefix is put in front of every metric name and
+// Tags (e.g. "env:prod") are added to every metric. The DogStatsD flavor
+// (default) sends labels as tags; plain StatsD has no tags, so label values
+// are appended to the metric name instead.
+type Config struct {
+	Address string   `json:"address"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Flavor  string   `json:"flavor,omitempty"`
+}
+
+// Client buffers metric lines and sends them in packets every second or
+// whenever a packet is full.
+type Client struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+	plain  bool
+
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(config Config) (*Client, error) {
+	switch config.Flavor {
+	case "", FlavorDogStatsD, FlavorStatsD:
+	default:
+		return nil, fmt.Errorf("unknown flavor %q, expected %s or %s", config.Flavor, FlavorDogStatsD, FlavorStatsD)
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:   conn,
+		prefix: config.Prefix,
+		tags:   config.Tags,
+		plain:  config.Flavor == FlavorStatsD,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Close sends what is buffered and closes the connection.
+func (c *Client) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return c.conn.Close()
+}
+
+func (c *Client) Count(name string, labels []metrics.Label, delta float64) {
+	c.send(name, labels, delta, "c")
+}
+
+func (c *Client) Gauge(name string, labels []metrics.Label, value float64) {
+	c.send(name, labels, value, "g")
+}
+
+// Observe sends a histogram sample, as a DogStatsD histogram or a StatsD
+// timer.
+func (c *Client) Observe(name string, labels []metrics.Label, value float64) {
+	if c.plain {
+		c.send(name, labels, value, "ms")
+		return
+	}
+	c.send(name, labels, value, "h")
+}
+
+func (c *Client) send(name string, labels []metrics.Label, value float64, kind string) {
+	line := c.format(name, labels, value, kind)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.buffer.Len() > 0 && c.buffer.Len()+1+len(line) > maxPacketSize {
+		c.flushLocked()
+	}
+	if c.buffer.Len() > 0 {
+		c.buffer.WriteByte('\n')
+	}
+	c.buffer.WriteString(line)
+}
+
+func (c *Client) format(name string, labels []metrics.Label, value float64, kind string) string {
+	var line strings.Builder
+	line.WriteString(c.prefix)
+	line.WriteString(name)
+	if c.plain {
+		for _, label := range labels {
+			line.WriteByte('.')
+			line.WriteString(sanitize(label.Value))
+		}
+	}
+	line.WriteByte(':')
+	line.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	line.WriteByte('|')
+	line.WriteString(kind)
+
+	if !c.plain && (len(labels) > 0 || len(c.tags) > 0) {
+		line.WriteString("|#")
+		first := true
+		for _, tag := range c.tags {
+			if !first {
+				line.WriteByte(',')
+			}
+			line.WriteString(tag)
+			first = false
+		}
+		for _, label := range labels {
+			if !first {
+				line.WriteByte(',')
+			}
+			line.WriteString(label.Name)
+			line.WriteByte(':')
+			line.WriteString(sanitizeTag(label.Value))
+			first = false
+		}
+	}
+	return line.String()
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			c.flush()
+			return
+		}
+		c.flush()
+	}
+}
+
+func (c *Client) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flushLocked()
+}
+
+func (c *Client) flushLocked() {
+	if c.buffer.Len() == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buffer.Bytes()); err != nil {
+		logging.Default().Warnf("Error sending StatsD metrics: %v", err)
+	}
+	c.buffer.Reset()
+}
+
+// sanitize turns a label value into a single StatsD name segment.
+func sanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// sanitizeTag drops the characters that delimit DogStatsD tags and fields.
+func sanitizeTag(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
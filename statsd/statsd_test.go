@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"loadbalancer/metrics"
+)
+
+func receive(t *testing.T, config Config, record func(registry *metrics.Registry)) string {
+	t.Helper()
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	config.Address = agent.LocalAddr().String()
+	client, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	registry.AddSink(client)
+	record(registry)
+	client.Close()
+
+	packet := make([]byte, maxPacketSize)
+	n, _, err := agent.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(packet[:n])
+}
+
+func record(registry *metrics.Registry) {
+	registry.Counter("httpbalance_requests_total", "", "listener", "code").Inc("8080", "2xx")
+	inFlight := registry.Gauge("httpbalance_in_flight_requests", "", "listener")
+	inFlight.Add(1, "8080")
+	inFlight.Add(1, "8080")
+	registry.Histogram("httpbalance_request_duration_seconds", "", metrics.DefaultBuckets, "listener", "backend").
+		Observe(0.25, "8080", "http://10.0.0.1:80")
+}
+
+func TestDogStatsD(t *testing.T) {
+	packet := receive(t, Config{Prefix: "edge.", Tags: []string{"env:prod"}}, record)
+
+	expected := strings.Join([]string{
+		"edge.httpbalance_requests_total:1|c|#env:prod,listener:8080,code:2xx",
+		"edge.httpbalance_in_flight_requests:1|g|#env:prod,listener:8080",
+		"edge.httpbalance_in_flight_requests:2|g|#env:prod,listener:8080",
+		"edge.httpbalance_request_duration_seconds:0.25|h|#env:prod,listener:8080,backend:http://10.0.0.1:80",
+	}, "\n")
+	if packet != expected {
+		t.Errorf("Expected packet\n%s\ngot\n%s", expected, packet)
+	}
+}
+
+func TestPlainStatsD(t *testing.T) {
+	packet := receive(t, Config{Flavor: FlavorStatsD, Tags: []string{"ignored"}}, record)
+
+	lines := strings.Split(packet, "\n")
+	if lines[0] != "httpbalance_requests_total.8080.2xx:1|c" {
+		t.Errorf("Expected label values in the name, got %q", lines[0])
+	}
+	if lines[3] != "httpbalance_request_duration_seconds.8080.http___10_0_0_1_80:0.25|ms" {
+		t.Errorf("Expected a timer with a sanitized name, got %q", lines[3])
+	}
+}
+
+func TestUnknownFlavor(t *testing.T) {
+	if _, err := New(Config{Address: "127.0.0.1:8125", Flavor: "graphite"}); err == nil {
+		t.Error("Expected an unknown flavor to be rejected")
+	}
+}
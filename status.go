@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"time"
+
+	"loadbalancer/loadbalancer"
+	"loadbalancer/logging"
+)
+
+const (
+	statusRefreshSeconds = 5
+	statusWindow         = 5 * time.Minute
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>HTTPBalanceGo status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child, td.text { text-align: left; }
+.up { background: #dff0d8; } .down { background: #f2dede; } .ejected { background: #fcf8e3; }
+.bar { display: inline-block; height: 10px; background: #5b8def; }
+</style>
+</head>
+<body>
+<h1>HTTPBalanceGo status</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}, traffic over the last {{.Window}}, refreshes every {{.Refresh}}s.</p>
+{{range .Listeners}}
+<h2>Port {{.Port}}</h2>
+<table>
+<tr><th>Backend</th><th>State</th><th>Weight</th><th>Active</th><th>Requests</th><th>Share</th><th>Errors</th><th>p50 ms</th><th>p95 ms</th><th>p99 ms</th><th>Total</th></tr>
+{{range .Backends}}
+<tr class="{{.State}}"><td>{{.URL}}{{with .Route}} ({{.}}){{end}}</td><td class="text">{{.State}}</td><td>{{.Weight}}</td><td>{{.ActiveConnections}}</td><td>{{.Requests}}</td>
+<td class="text"><span class="bar" style="width: {{.SharePercent}}px"></span> {{printf "%.1f" .SharePercent}}%</td>
+<td>{{.Errors}} ({{printf "%.1f" .ErrorPercent}}%)</td><td>{{.LatencyMs.P50}}</td><td>{{.LatencyMs.P95}}</td><td>{{.LatencyMs.P99}}</td><td>{{.RequestsTotal}}</td></tr>
+{{else}}
+<tr><td colspan="11">No backends</td></tr>
+{{end}}
+</table>
+{{if .Errors}}
+<h3>Recent errors</h3>
+<table>
+<tr><th>Time</th><th>Status</th><th>Backend</th><th>Request ID</th><th>Error</th></tr>
+{{range .Errors}}
+<tr><td class="text">{{.Time.Format "15:04:05"}}</td><td>{{.Status}}</td><td class="text">{{.Backend}}</td><td class="text">{{.RequestID}}</td><td class="text">{{.Error}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+type statusPageData struct {
+	Generated time.Time
+	Window    time.Duration
+	Refresh   int
+	Listeners []statusPageListener
+}
+
+type statusPageListener struct {
+	Port     string
+	Backends []statusPageBackend
+	Errors   []loadbalancer.RequestError
+}
+
+type statusPageBackend struct {
+	loadbalancer.BackendStats
+	SharePercent float64
+	ErrorPercent float64
+}
+
+// statusPage renders an auto-refreshing overview of every listener, in the
+// spirit of HAProxy's stats page.
+func statusPage(listeners []*listener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := statusPageData{
+			Generated: time.Now(),
+			Window:    statusWindow,
+			Refresh:   statusRefreshSeconds,
+		}
+		for _, l := range listeners {
+			stats := l.lb.Stats(statusWindow)
+			requests := 0
+			for _, backend := range stats {
+				requests += backend.Requests
+			}
+
+			page := statusPageListener{Port: l.port, Errors: l.lb.RecentErrors()}
+			for _, backend := range stats {
+				row := statusPageBackend{BackendStats: backend, ErrorPercent: backend.ErrorRate * 100}
+				if requests > 0 {
+					row.SharePercent = float64(backend.Requests) * 100 / float64(requests)
+				}
+				page.Backends = append(page.Backends, row)
+			}
+			data.Listeners = append(data.Listeners, page)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, data); err != nil {
+			logging.Default().Errorf("Error rendering status page: %v", err)
+		}
+	})
+}
+
+func basicAuth(credentials loadbalancer.StatusPageConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		validUsername := subtle.ConstantTimeCompare([]byte(username), []byte(credentials.Username)) == 1
+		validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(credentials.Password)) == 1
+		if !ok || !validUsername || !validPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="httpbalance", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,229 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/logging"
+)
+
+const (
+	exportInterval  = 5 * time.Second
+	exportBatchSize = 512
+	exportQueueSize = 4096
+	exportTimeout   = 10 * time.Second
+
+	spanKindServer  = 2
+	statusCodeError = 2
+)
+
+// exporter batches finished spans and posts them to an OTLP/HTTP endpoint.
+// Spans are dropped rather than slowing down requests when the collector
+// cannot keep up.
+type exporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+
+	spans    chan otlpSpan
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newExporter(endpoint string, headers map[string]string, serviceName string) *exporter {
+	e := &exporter{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		spans:       make(chan otlpSpan, exportQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) add(span otlpSpan) {
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+func (e *exporter) close() {
+	e.stopOnce.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					e.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) export(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	payload, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", e.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: defaultServiceName},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		logging.Default().Errorf("Error encoding spans: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		logging.Default().Errorf("Error exporting spans to %s: %v", e.endpoint, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		logging.Default().Warnf("Error exporting %d spans to %s: %v", len(spans), e.endpoint, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logging.Default().Warnf("Trace collector %s answered with status %d", e.endpoint, resp.StatusCode)
+	}
+}
+
+// The types below follow the JSON encoding of the OTLP trace service
+// request: IDs are hex strings and 64-bit integers are decimal strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func (s *Span) finish(end time.Time, failed bool) otlpSpan {
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		TraceState:        s.tracestate,
+		Name:              s.name,
+		Kind:              spanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if failed {
+		span.Status.Code = statusCodeError
+	}
+
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attribute := otlpAttribute{Key: key}
+		switch value := s.attributes[key].(type) {
+		case int:
+			formatted := strconv.Itoa(value)
+			attribute.Value.IntValue = &formatted
+		case bool:
+			attribute.Value.BoolValue = &value
+		default:
+			formatted := fmt.Sprint(value)
+			attribute.Value.StringValue = &formatted
+		}
+		span.Attributes = append(span.Attributes, attribute)
+	}
+	return span
+}
@@ -0,0 +1,177 @@
+// Package tracing creates a span for every proxied request, propagates it
+// to backends with W3C trace context headers and, when an endpoint is
+// configured, exports finished spans to an OpenTelemetry collector over
+// OTLP/HTTP with JSON encoding.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+
+	defaultServiceName = "httpbalance"
+)
+
+// Config enables tracing. Without OTLPEndpoint spans are only propagated.
+// SampleRatio is the share of new traces that are recorded (default 1);
+// requests that arrive with a traceparent follow the caller's decision.
+// Headers are sent with every export, e.g. an API key of a hosted backend.
+type Config struct {
+	OTLPEndpoint string            `json:"otlp_endpoint,omitempty"`
+	ServiceName  string            `json:"service_name,omitempty"`
+	SampleRatio  *float64          `json:"sample_ratio,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+}
+
+// Tracer starts spans. A nil *Tracer is valid and starts nil spans, which
+// do nothing.
+type Tracer struct {
+	serviceName string
+	sampleRatio float64
+	exporter    *exporter
+}
+
+func NewTracer(config Config) *Tracer {
+	t := &Tracer{
+		serviceName: config.ServiceName,
+		sampleRatio: 1,
+	}
+	if t.serviceName == "" {
+		t.serviceName = defaultServiceName
+	}
+	if config.SampleRatio != nil {
+		t.sampleRatio = *config.SampleRatio
+	}
+	if config.OTLPEndpoint != "" {
+		t.exporter = newExporter(config.OTLPEndpoint, config.Headers, t.serviceName)
+	}
+	return t
+}
+
+// Close exports the spans that are still buffered.
+func (t *Tracer) Close() {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	t.exporter.close()
+}
+
+// Span is one request passing through the balancer.
+type Span struct {
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	tracestate string
+	name       string
+	start      time.Time
+	attributes map[string]interface{}
+}
+
+// Start begins a server span for r, continuing the trace of its
+// traceparent header when it has a valid one.
+func (t *Tracer) Start(r *http.Request) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		tracer:     t,
+		name:       r.Method,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		span.traceID = traceID
+		span.parentID = parentID
+		span.sampled = flags&1 == 1
+		span.tracestate = r.Header.Get(TracestateHeader)
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = mathrand.Float64() < t.sampleRatio
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// Inject replaces the trace context headers of an outgoing request with
+// this span's.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set(TraceparentHeader, s.Traceparent())
+	if s.tracestate != "" {
+		header.Set(TracestateHeader, s.tracestate)
+	}
+}
+
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// TraceID returns the span's trace ID in hex, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttribute records a string, int or bool attribute on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// End finishes the span with the HTTP status of the response, marking it
+// as failed for 5xx, and hands it to the exporter if it is sampled.
+func (s *Span) End(status int) {
+	if s == nil {
+		return
+	}
+	s.SetAttribute("http.response.status_code", status)
+	if s.sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.add(s.finish(time.Now(), status >= 500))
+	}
+}
+
+// parseTraceparent reads a version 00 traceparent header. Later versions
+// are read the same way, as the specification asks.
+func parseTraceparent(value string) (traceID [16]byte, spanID [8]byte, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, spanID, 0, false
+	}
+	var flagBytes [1]byte
+	if !decodeHex(traceID[:], parts[1]) || !decodeHex(spanID[:], parts[2]) || !decodeHex(flagBytes[:], parts[3]) {
+		return traceID, spanID, 0, false
+	}
+	if traceID == [16]byte{} || spanID == [8]byte{} {
+		return traceID, spanID, 0, false
+	}
+	return traceID, spanID, flagBytes[0], true
+}
+
+func decodeHex(dst []byte, value string) bool {
+	if len(value) != 2*len(dst) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err == nil
+}
@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz": false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":     false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":     false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":        false,
+		"": false,
+	} {
+		if _, _, _, ok := parseTraceparent(value); ok != valid {
+			t.Errorf("Expected %q valid=%v, got %v", value, valid, ok)
+		}
+	}
+}
+
+func TestSpanContinuesIncomingTrace(t *testing.T) {
+	tracer := NewTracer(Config{})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	r.Header.Set(TracestateHeader, "vendor=value")
+	span := tracer.Start(r)
+
+	outgoing := http.Header{}
+	span.Inject(outgoing)
+	traceparent := outgoing.Get(TraceparentHeader)
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceparent, "-00") {
+		t.Errorf("Expected the trace and sampling decision to be kept, got %q", traceparent)
+	}
+	if strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("Expected a new span ID, got %q", traceparent)
+	}
+	if outgoing.Get(TracestateHeader) != "vendor=value" {
+		t.Errorf("Expected tracestate to be passed on, got %q", outgoing.Get(TracestateHeader))
+	}
+
+	var nilTracer *Tracer
+	nilTracer.Start(r).End(http.StatusOK)
+}
+
+func TestExportOTLP(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("Unexpected export to %s with headers %v", r.URL.Path, r.Header)
+		}
+		var request otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	ratio := 1.0
+	tracer := NewTracer(Config{
+		OTLPEndpoint: collector.URL,
+		ServiceName:  "edge",
+		SampleRatio:  &ratio,
+		Headers:      map[string]string{"X-Api-Key": "secret"},
+	})
+	span := tracer.Start(httptest.NewRequest("POST", "/items", nil))
+	span.SetAttribute("url.path", "/items")
+	span.End(http.StatusBadGateway)
+	tracer.Close()
+
+	request := <-requests
+	resource := request.ResourceSpans[0]
+	if value := resource.Resource.Attributes[0].Value.StringValue; value == nil || *value != "edge" {
+		t.Errorf("Expected service.name edge, got %+v", resource.Resource.Attributes)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("Expected one span, got %d", len(spans))
+	}
+	exported := spans[0]
+	if exported.TraceID != span.TraceID() || exported.Name != "POST" || exported.Kind != spanKindServer || exported.Status.Code != statusCodeError {
+		t.Errorf("Unexpected span %+v", exported)
+	}
+	var status string
+	for _, attribute := range exported.Attributes {
+		if attribute.Key == "http.response.status_code" && attribute.Value.IntValue != nil {
+			status = *attribute.Value.IntValue
+		}
+	}
+	if status != "502" {
+		t.Errorf("Expected status code attribute 502, got %+v", exported.Attributes)
+	}
+}
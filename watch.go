@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"loadbalancer/logging"
+)
+
+// watchConfig calls reload once the config file at path has stopped changing
+// for delay.
+func watchConfig(path string, delay time.Duration, reload func()) (func(), error) {
+	return watchFiles([]string{path}, delay, reload)
+}
+
+// watchFiles calls reload once the files at paths have stopped changing for
+// delay. The parent directories are watched rather than the files
+// themselves because editors and cert-manager replace files by renaming.
+// Kubernetes ConfigMaps and Secrets leave the files alone and swap the
+// ..data symlink they point through instead, so a path leading somewhere
+// else than before counts as a change too.
+func watchFiles(paths []string, delay time.Duration, reload func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]string)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		resolved[path] = resolve(watcher, path)
+	}
+
+	go func() {
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				name := filepath.Clean(event.Name)
+				for path, target := range resolved {
+					resolved[path] = resolve(watcher, path)
+					if name == path || name == target || resolved[path] != target {
+						settle = time.After(delay)
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logging.Default().Warnf("Error watching %s: %v", strings.Join(paths, ", "), err)
+			case <-settle:
+				settle = nil
+				reload()
+			}
+		}
+	}()
+
+	return func() { watcher.Close() }, nil
+}
+
+// resolve returns the file path leads to through symlinks, empty if there
+// is none, and watches the directory it is in for changes made in place.
+func resolve(watcher *fsnotify.Watcher, path string) string {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+	if dir := filepath.Dir(target); dir != filepath.Dir(path) {
+		watcher.Add(dir)
+	}
+	return target
+}
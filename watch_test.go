@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigDebouncesChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan struct{}, 10)
+	stop, err := watchConfig(path, 100*time.Millisecond, func() { reloads <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(path, []byte(`{"port": "8080"}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a reload after the config file changed")
+	}
+	select {
+	case <-reloads:
+		t.Error("Expected burst of writes to trigger a single reload")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// TestWatchConfigFollowsConfigMapUpdates updates the config the way the
+// kubelet updates a mounted ConfigMap: the file is a symlink through
+// ..data, which is swapped to a new directory.
+func TestWatchConfigFollowsConfigMapUpdates(t *testing.T) {
+	dir := t.TempDir()
+	writeVersion := func(version, config string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, version), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "config.json"), []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..2024_01", `{}`)
+	if err := os.Symlink("..2024_01", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := os.Symlink(filepath.Join("..data", "config.json"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan struct{}, 10)
+	stop, err := watchConfig(path, 50*time.Millisecond, func() { reloads <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	writeVersion("..2024_02", `{"port": "8080"}`)
+	if err := os.Symlink("..2024_02", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "..2024_01")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a reload after the ..data symlink was swapped")
+	}
+
+	// The file the symlinks lead to changing in place counts as well.
+	if err := os.WriteFile(filepath.Join(dir, "..2024_02", "config.json"), []byte(`{"port": "9090"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a reload after the file behind the symlinks changed")
+	}
+}